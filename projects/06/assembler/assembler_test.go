@@ -0,0 +1,96 @@
+package assembler
+
+import (
+    "testing"
+    "fmt"
+    "strings"
+)
+
+func parseLines(lines ...string) (ParsedProgram, error) {
+    var raw RawProgram
+    for i, line := range lines {
+        raw.AddLine(line, uint64(i + 1))
+    }
+    return Parse(raw)
+}
+
+/* the c instructions for ! and - on each register */
+func TestUnaryEncoding(test *testing.T){
+    expected := map[string]string{
+        "D=!D": "1110001101010000",
+        "M=!M": "1111110001001000",
+        "A=!A": "1110110001100000",
+        "D=-D": "1110001111010000",
+        "MD=-A": "1110110011011000",
+    }
+
+    for text, binary := range expected {
+        assignment, err := parseAssignment(RawCode{Text: text})
+        if err != nil {
+            test.Errorf("could not parse '%v': %v", text, err)
+            continue
+        }
+        if assignment.ToBinaryString() != binary {
+            test.Errorf("'%v' is %v instead of %v", text, assignment.ToBinaryString(), binary)
+        }
+    }
+}
+
+/* labels are resolved to the instruction after them, variables are given
+ * slots from 16 up
+ */
+func TestParse(test *testing.T){
+    program, err := parseLines("// a loop", "(loop)", "@counter", "M=M+1", "@loop", "0; JMP")
+    if err != nil {
+        test.Fatalf("could not parse: %v", err)
+    }
+
+    expected := "0000000000010000\n1111110111001000\n0000000000000000\n1110101010000111\n"
+    if program.ToBinaryString() != expected {
+        test.Errorf("got\n%v\ninstead of\n%v", program.ToBinaryString(), expected)
+    }
+}
+
+func TestDuplicateLabel(test *testing.T){
+    _, err := parseLines("(twice)", "@twice", "0; JMP", "(twice)")
+    if err == nil {
+        test.Fatalf("a label defined twice was accepted")
+    }
+    if !strings.Contains(err.Error(), "line 4") {
+        test.Errorf("the error does not give the line of the second label: %v", err)
+    }
+}
+
+/* RAM[16..16383] holds the variables, one more would be in the screen */
+func TestVariableOverflow(test *testing.T){
+    var lines []string
+    for i := 16; i < 0x4000; i++ {
+        lines = append(lines, fmt.Sprintf("@variable%v", i))
+    }
+    _, err := parseLines(lines...)
+    if err != nil {
+        test.Fatalf("%v variables did not fit: %v", len(lines), err)
+    }
+
+    lines = append(lines, "@onemore")
+    _, err = parseLines(lines...)
+    if err == nil {
+        test.Errorf("%v variables were accepted", len(lines))
+    }
+}
+
+/* only R0 to R15 are registers, R16 is a label like any other */
+func TestRegisterNames(test *testing.T){
+    program, err := parseLines("@R15", "@R16", "(R16)", "@R01", "0; JMP")
+    if err != nil {
+        test.Fatalf("could not parse: %v", err)
+    }
+
+    expected := []int32{15, 2, 16}
+    for i, constant := range expected {
+        memory := program.Code[i].(*ParsedMemoryReference)
+        if memory.Constant != constant {
+            test.Errorf("instruction %v refers to %v instead of %v", i, memory.Constant, constant)
+        }
+    }
+}
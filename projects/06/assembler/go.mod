@@ -1,3 +1,3 @@
-module github.com/kazzmir/nand2tetris
+module github.com/kazzmir/nand2tetris/assembler
 
 go 1.14
@@ -0,0 +1,444 @@
+package bytecode
+
+/* A binary encoding of vm programs.
+ *
+ * A bytecode file holds any number of classes, which lets a whole library
+ * such as the OS be distributed as one file. All numbers are varints as
+ * written by encoding/binary.
+ *
+ *   "HVMB" version
+ *   constant pool: count, then each string as length followed by its bytes
+ *   class table: count, then the name of each class (pool index)
+ *   then for each class, in the order of the class table:
+ *     static table: count, then each static index used by the class
+ *     instruction count, then the instructions
+ *
+ * The class table is part of the header so the classes a file defines can be
+ * found without decoding the code, see ReadClassNames.
+ *
+ * An instruction is an opcode byte followed by its operands:
+ *
+ *   push/pop    opcode is OpPush or OpPop plus the segment, then the index.
+ *               static indexes refer to the static table of the class
+ *   label, goto, if-goto       the name (pool index)
+ *   function, call             the name (pool index) and the locals/arguments
+ *   everything else            no operands
+ *
+ * Instructions are made from the commands parsed by the vm translator, see
+ * vm.BytecodeClass, and String turns them back into text for the same parser,
+ * so there is only one grammar for vm text.
+ */
+
+import (
+    "io"
+    "fmt"
+    "bytes"
+    "io/ioutil"
+    "encoding/binary"
+)
+
+const Magic = "HVMB"
+const Version = 2
+
+type Opcode byte
+
+const (
+    OpAdd Opcode = iota + 1
+    OpSub
+    OpNeg
+    OpEq
+    OpGt
+    OpLt
+    OpAnd
+    OpOr
+    OpNot
+    OpMul
+    OpDiv
+    OpMod
+    OpShl
+    OpShr
+    OpXor
+    OpLabel
+    OpGoto
+    OpIfGoto
+    OpFunction
+    OpCall
+    OpReturn
+)
+
+/* push and pop take 8 opcodes each, one per segment */
+const OpPush Opcode = 0x40
+const OpPop Opcode = 0x50
+
+var segments = []string{"constant", "local", "argument", "this", "that", "temp", "pointer", "static"}
+
+const staticSegment = 7
+
+/* commands that take no operands */
+var simpleNames = map[Opcode]string{
+    OpAdd: "add",
+    OpSub: "sub",
+    OpNeg: "neg",
+    OpEq: "eq",
+    OpGt: "gt",
+    OpLt: "lt",
+    OpAnd: "and",
+    OpOr: "or",
+    OpNot: "not",
+    OpMul: "mul",
+    OpDiv: "div",
+    OpMod: "mod",
+    OpShl: "shl",
+    OpShr: "shr",
+    OpXor: "xor",
+    OpReturn: "return",
+}
+
+/* commands that take a name */
+var namedNames = map[Opcode]string{
+    OpLabel: "label",
+    OpGoto: "goto",
+    OpIfGoto: "if-goto",
+    OpFunction: "function",
+    OpCall: "call",
+}
+
+type Instruction struct {
+    Op Opcode
+    /* for push and pop */
+    Segment string
+    Index int
+    /* for label, goto, if-goto, function and call */
+    Name string
+    /* locals of a function or arguments of a call */
+    Count int
+}
+
+/* the vm text for the instruction */
+func (instruction Instruction) String() string {
+    switch instruction.Op {
+        case OpPush:
+            return fmt.Sprintf("push %v %v", instruction.Segment, instruction.Index)
+        case OpPop:
+            return fmt.Sprintf("pop %v %v", instruction.Segment, instruction.Index)
+        case OpFunction, OpCall:
+            return fmt.Sprintf("%v %v %v", namedNames[instruction.Op], instruction.Name, instruction.Count)
+        case OpLabel, OpGoto, OpIfGoto:
+            return fmt.Sprintf("%v %v", namedNames[instruction.Op], instruction.Name)
+    }
+
+    return simpleNames[instruction.Op]
+}
+
+func segmentNumber(segment string) (int, bool) {
+    for i, name := range segments {
+        if name == segment {
+            return i, true
+        }
+    }
+    return 0, false
+}
+
+type Class struct {
+    Name string
+    Instructions []Instruction
+}
+
+/* true if the data starts like a bytecode file */
+func IsBytecode(data []byte) bool {
+    return bytes.HasPrefix(data, []byte(Magic))
+}
+
+type encoder struct {
+    buffer bytes.Buffer
+}
+
+func (encoder *encoder) number(value int) {
+    var scratch [binary.MaxVarintLen64]byte
+    size := binary.PutVarint(scratch[:], int64(value))
+    encoder.buffer.Write(scratch[:size])
+}
+
+func Encode(output io.Writer, classes []Class) error {
+    pool := make(map[string]int)
+    var names []string
+    intern := func (name string) int {
+        index, ok := pool[name]
+        if !ok {
+            index = len(names)
+            pool[name] = index
+            names = append(names, name)
+        }
+        return index
+    }
+
+    var table encoder
+    table.number(len(classes))
+    for _, class := range classes {
+        table.number(intern(class.Name))
+    }
+
+    var body encoder
+    for _, class := range classes {
+        /* statics in the order they are first used */
+        slots := make(map[int]int)
+        var statics []int
+        for _, instruction := range class.Instructions {
+            if (instruction.Op == OpPush || instruction.Op == OpPop) && instruction.Segment == segments[staticSegment] {
+                if _, ok := slots[instruction.Index]; !ok {
+                    slots[instruction.Index] = len(statics)
+                    statics = append(statics, instruction.Index)
+                }
+            }
+        }
+
+        body.number(len(statics))
+        for _, index := range statics {
+            body.number(index)
+        }
+
+        body.number(len(class.Instructions))
+        for _, instruction := range class.Instructions {
+            switch instruction.Op {
+                case OpPush, OpPop:
+                    segment, ok := segmentNumber(instruction.Segment)
+                    if !ok {
+                        return fmt.Errorf("%v: unknown segment '%v'", class.Name, instruction.Segment)
+                    }
+                    body.buffer.WriteByte(byte(instruction.Op) + byte(segment))
+                    if segment == staticSegment {
+                        body.number(slots[instruction.Index])
+                    } else {
+                        body.number(instruction.Index)
+                    }
+                case OpFunction, OpCall:
+                    body.buffer.WriteByte(byte(instruction.Op))
+                    body.number(intern(instruction.Name))
+                    body.number(instruction.Count)
+                case OpLabel, OpGoto, OpIfGoto:
+                    body.buffer.WriteByte(byte(instruction.Op))
+                    body.number(intern(instruction.Name))
+                default:
+                    if _, ok := simpleNames[instruction.Op]; !ok {
+                        return fmt.Errorf("%v: unknown opcode %v", class.Name, instruction.Op)
+                    }
+                    body.buffer.WriteByte(byte(instruction.Op))
+            }
+        }
+    }
+
+    var header encoder
+    header.buffer.WriteString(Magic)
+    header.number(Version)
+    header.number(len(names))
+    for _, name := range names {
+        header.number(len(name))
+        header.buffer.WriteString(name)
+    }
+
+    for _, part := range []*encoder{&header, &table, &body} {
+        _, err := part.buffer.WriteTo(output)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+type decoder struct {
+    input *bytes.Reader
+    pool []string
+    /* the names from the class table */
+    classes []string
+}
+
+func (decoder *decoder) number() (int, error) {
+    value, err := binary.ReadVarint(decoder.input)
+    if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    return int(value), err
+}
+
+/* Reads a count, making sure it is not negative. Everything counted takes at
+ * least a byte, so a count larger than what is left of the input can only come
+ * from a corrupt file and is refused before anything is allocated for it.
+ */
+func (decoder *decoder) count(what string) (int, error) {
+    value, err := decoder.number()
+    if err != nil {
+        return 0, err
+    }
+    if value < 0 {
+        return 0, fmt.Errorf("negative %v count %v", what, value)
+    }
+    if value > decoder.input.Len() {
+        return 0, fmt.Errorf("%v count %v is larger than the rest of the file", what, value)
+    }
+    return value, nil
+}
+
+/* reads the magic, version, constant pool and class table */
+func (decoder *decoder) header() error {
+    magic := make([]byte, len(Magic))
+    if _, err := io.ReadFull(decoder.input, magic); err != nil || string(magic) != Magic {
+        return fmt.Errorf("not a vm bytecode file")
+    }
+
+    version, err := decoder.number()
+    if err != nil {
+        return err
+    }
+    if version != Version {
+        return fmt.Errorf("unsupported bytecode version %v", version)
+    }
+
+    poolSize, err := decoder.count("constant pool")
+    if err != nil {
+        return err
+    }
+    for i := 0; i < poolSize; i++ {
+        length, err := decoder.count("string length")
+        if err != nil {
+            return err
+        }
+        data := make([]byte, length)
+        if _, err := io.ReadFull(decoder.input, data); err != nil {
+            return io.ErrUnexpectedEOF
+        }
+        decoder.pool = append(decoder.pool, string(data))
+    }
+
+    classCount, err := decoder.count("class")
+    if err != nil {
+        return err
+    }
+    for i := 0; i < classCount; i++ {
+        name, err := decoder.name()
+        if err != nil {
+            return err
+        }
+        decoder.classes = append(decoder.classes, name)
+    }
+
+    return nil
+}
+
+/* reads a pool index and gives the string it refers to */
+func (decoder *decoder) name() (string, error) {
+    index, err := decoder.number()
+    if err != nil {
+        return "", err
+    }
+    if index < 0 || index >= len(decoder.pool) {
+        return "", fmt.Errorf("constant pool index %v out of range", index)
+    }
+    return decoder.pool[index], nil
+}
+
+/* the names of the classes in a bytecode file, read from its header alone */
+func ReadClassNames(input io.Reader) ([]string, error) {
+    data, err := ioutil.ReadAll(input)
+    if err != nil {
+        return nil, err
+    }
+
+    decoder := decoder{input: bytes.NewReader(data)}
+    err = decoder.header()
+    if err != nil {
+        return nil, err
+    }
+
+    return decoder.classes, nil
+}
+
+func Decode(input io.Reader) ([]Class, error) {
+    data, err := ioutil.ReadAll(input)
+    if err != nil {
+        return nil, err
+    }
+
+    decoder := decoder{input: bytes.NewReader(data)}
+    err = decoder.header()
+    if err != nil {
+        return nil, err
+    }
+
+    var classes []Class
+    for _, name := range decoder.classes {
+        class := Class{Name: name}
+
+        staticCount, err := decoder.count("static")
+        if err != nil {
+            return nil, err
+        }
+        statics := make([]int, staticCount)
+        for slot := range statics {
+            statics[slot], err = decoder.number()
+            if err != nil {
+                return nil, err
+            }
+        }
+
+        instructionCount, err := decoder.count("instruction")
+        if err != nil {
+            return nil, err
+        }
+        for j := 0; j < instructionCount; j++ {
+            opcode, err := decoder.input.ReadByte()
+            if err != nil {
+                return nil, io.ErrUnexpectedEOF
+            }
+
+            op := Opcode(opcode)
+            var instruction Instruction
+            switch {
+                case op >= OpPush && op < OpPush + Opcode(len(segments)),
+                     op >= OpPop && op < OpPop + Opcode(len(segments)):
+                    base := OpPush
+                    if op >= OpPop {
+                        base = OpPop
+                    }
+                    segment := int(op - base)
+                    index, err := decoder.number()
+                    if err != nil {
+                        return nil, err
+                    }
+                    if segment == staticSegment {
+                        if index < 0 || index >= len(statics) {
+                            return nil, fmt.Errorf("%v: static slot %v out of range", class.Name, index)
+                        }
+                        index = statics[index]
+                    }
+                    instruction = Instruction{Op: base, Segment: segments[segment], Index: index}
+                case op == OpFunction || op == OpCall:
+                    instruction.Op = op
+                    instruction.Name, err = decoder.name()
+                    if err != nil {
+                        return nil, err
+                    }
+                    instruction.Count, err = decoder.number()
+                    if err != nil {
+                        return nil, err
+                    }
+                case op == OpLabel || op == OpGoto || op == OpIfGoto:
+                    instruction.Op = op
+                    instruction.Name, err = decoder.name()
+                    if err != nil {
+                        return nil, err
+                    }
+                default:
+                    if _, ok := simpleNames[op]; !ok {
+                        return nil, fmt.Errorf("%v: unknown opcode 0x%02x", class.Name, opcode)
+                    }
+                    instruction.Op = op
+            }
+
+            class.Instructions = append(class.Instructions, instruction)
+        }
+
+        classes = append(classes, class)
+    }
+
+    return classes, nil
+}
@@ -0,0 +1,126 @@
+package bytecode
+
+import (
+    "testing"
+    "bytes"
+    "encoding/binary"
+)
+
+func TestRoundTrip(test *testing.T){
+    classes := []Class{
+        Class{
+            Name: "Main",
+            Instructions: []Instruction{
+                Instruction{Op: OpFunction, Name: "Main.main", Count: 1},
+                Instruction{Op: OpPush, Segment: "static", Index: 3},
+                Instruction{Op: OpPop, Segment: "local", Index: 0},
+                Instruction{Op: OpCall, Name: "Main.main", Count: 0},
+                Instruction{Op: OpXor},
+                Instruction{Op: OpReturn},
+            },
+        },
+    }
+
+    var data bytes.Buffer
+    err := Encode(&data, classes)
+    if err != nil {
+        test.Fatalf("could not encode: %v", err)
+    }
+
+    decoded, err := Decode(&data)
+    if err != nil {
+        test.Fatalf("could not decode: %v", err)
+    }
+
+    if len(decoded) != 1 || len(decoded[0].Instructions) != len(classes[0].Instructions) {
+        test.Fatalf("decoded %+v", decoded)
+    }
+
+    for i, instruction := range decoded[0].Instructions {
+        if instruction != classes[0].Instructions[i] {
+            test.Errorf("instruction %v is %+v but should be %+v", i, instruction, classes[0].Instructions[i])
+        }
+    }
+}
+
+/* the classes a file defines can be read without decoding their code */
+func TestReadClassNames(test *testing.T){
+    classes := []Class{
+        Class{Name: "Memory", Instructions: []Instruction{Instruction{Op: OpFunction, Name: "Memory.init", Count: 0}, Instruction{Op: OpReturn}}},
+        Class{Name: "Math", Instructions: []Instruction{Instruction{Op: OpFunction, Name: "Math.init", Count: 0}, Instruction{Op: OpReturn}}},
+        Class{Name: "Sys"},
+    }
+
+    var data bytes.Buffer
+    err := Encode(&data, classes)
+    if err != nil {
+        test.Fatalf("could not encode: %v", err)
+    }
+
+    /* only the header is read, so code cut short does not matter */
+    truncated := data.Bytes()[:data.Len() - 3]
+    names, err := ReadClassNames(bytes.NewReader(truncated))
+    if err != nil {
+        test.Fatalf("could not read the class names: %v", err)
+    }
+    if len(names) != 3 || names[0] != "Memory" || names[1] != "Math" || names[2] != "Sys" {
+        test.Errorf("the classes are %v", names)
+    }
+    if _, err := Decode(bytes.NewReader(truncated)); err == nil {
+        test.Errorf("the truncated code decoded without an error")
+    }
+
+    decoded, err := Decode(&data)
+    if err != nil {
+        test.Fatalf("could not decode: %v", err)
+    }
+    for i, class := range decoded {
+        if class.Name != names[i] || len(class.Instructions) != len(classes[i].Instructions) {
+            test.Errorf("class %v decoded as %+v", i, class)
+        }
+    }
+}
+
+/* the magic and version followed by varints for the int64 parts and the
+ * bytes of the string parts
+ */
+func corrupt(parts ...interface{}) []byte {
+    var data bytes.Buffer
+    data.WriteString(Magic)
+    var scratch [binary.MaxVarintLen64]byte
+    for _, part := range append([]interface{}{int64(Version)}, parts...) {
+        switch part := part.(type) {
+            case int64:
+                size := binary.PutVarint(scratch[:], part)
+                data.Write(scratch[:size])
+            case string:
+                data.WriteString(part)
+        }
+    }
+    return data.Bytes()
+}
+
+/* huge counts must be refused before anything is allocated for them */
+func TestCorrupt(test *testing.T){
+    inputs := [][]byte{
+        /* constant pool size */
+        corrupt(int64(1 << 62)),
+        /* string length */
+        corrupt(int64(1), int64(1 << 40)),
+        /* class count */
+        corrupt(int64(0), int64(1 << 50)),
+        /* static count of class A */
+        corrupt(int64(1), int64(1), "A", int64(1), int64(0), int64(1 << 45)),
+        /* instruction count of class A */
+        corrupt(int64(1), int64(1), "A", int64(1), int64(0), int64(0), int64(1 << 30)),
+        /* truncated */
+        []byte(Magic),
+    }
+
+    for i, input := range inputs {
+        _, err := Decode(bytes.NewReader(input))
+        if err == nil {
+            test.Errorf("input %v decoded without an error", i)
+        }
+    }
+}
@@ -0,0 +1,131 @@
+package main
+
+/* Encodes .vm files as vm bytecode. All the classes given on the command line
+ * go into one bytecode file.
+ */
+
+import (
+    "os"
+    "fmt"
+    "flag"
+    "bufio"
+    "sort"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+
+    "github.com/kazzmir/nand2tetris/bytecode"
+    "github.com/kazzmir/nand2tetris/vm"
+)
+
+/* parses the file with the translator's parser, so only vm code the
+ * translator accepts gets encoded
+ */
+func readClass(path string, options vm.ParseOptions) (bytecode.Class, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return bytecode.Class{}, err
+    }
+    defer file.Close()
+
+    parsed, err := vm.ParseVMFile(file, path, options)
+    if err != nil {
+        return bytecode.Class{}, err
+    }
+
+    return vm.BytecodeClass(parsed)
+}
+
+/* the .vm files directly inside a directory, or the file itself */
+func vmFiles(path string) ([]string, error) {
+    info, err := os.Stat(path)
+    if err != nil {
+        return nil, err
+    }
+
+    if !info.IsDir() {
+        return []string{path}, nil
+    }
+
+    entries, err := ioutil.ReadDir(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var out []string
+    for _, entry := range entries {
+        if entry.Mode().IsRegular() && filepath.Ext(entry.Name()) == ".vm" {
+            out = append(out, filepath.Join(path, entry.Name()))
+        }
+    }
+    sort.Strings(out)
+
+    return out, nil
+}
+
+func help() {
+    fmt.Printf(`Help:
+ $ vmasm [options] file.vm|directory ...
+
+Options:
+`)
+    flag.PrintDefaults()
+}
+
+func main(){
+    outputPath := flag.String("o", "", "the bytecode file to write (default: the first input with a .vmb extension)")
+    var options vm.ParseOptions
+    flag.BoolVar(&options.Extensions, "extensions", false, "accept the extended commands mul, div, mod, shl, shr and xor")
+    flag.Parse()
+
+    if flag.NArg() < 1 {
+        fmt.Printf("Give .vm files or directories with .vm files in them\n\n")
+        help()
+        return
+    }
+
+    var classes []bytecode.Class
+    for _, path := range flag.Args() {
+        files, err := vmFiles(path)
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            os.Exit(1)
+        }
+
+        for _, file := range files {
+            class, err := readClass(file, options)
+            if err != nil {
+                fmt.Printf("Error: %v\n", err)
+                os.Exit(1)
+            }
+            classes = append(classes, class)
+        }
+    }
+
+    if *outputPath == "" {
+        first := filepath.Clean(flag.Arg(0))
+        *outputPath = strings.TrimSuffix(first, filepath.Ext(first)) + ".vmb"
+        if info, err := os.Stat(first); err == nil && info.IsDir() {
+            *outputPath = first + ".vmb"
+        }
+    }
+
+    output, err := os.Create(*outputPath)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        os.Exit(1)
+    }
+    defer output.Close()
+
+    writer := bufio.NewWriter(output)
+    err = bytecode.Encode(writer, classes)
+    if err == nil {
+        err = writer.Flush()
+    }
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        os.Exit(1)
+    }
+
+    fmt.Printf("Encoded %v classes to %v\n", len(classes), *outputPath)
+}
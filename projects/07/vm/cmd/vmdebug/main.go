@@ -0,0 +1,593 @@
+package main
+
+/* An interactive debugger for vm programs. The program runs in the vm
+ * interpreter, so RAM looks the same as it would on the hack platform, and
+ * the call stack is worked out from the saved frames on the stack.
+ */
+
+import (
+    "os"
+    "os/signal"
+    "fmt"
+    "flag"
+    "bufio"
+    "sort"
+    "strings"
+    "strconv"
+
+    "github.com/kazzmir/nand2tetris/vm"
+)
+
+type Breakpoint struct {
+    ID int
+    PC int
+    Description string
+}
+
+type Debugger struct {
+    machine *vm.Machine
+    breakpoints []Breakpoint
+    nextBreakpoint int
+    /* watched addresses and the value they had when last looked at */
+    watches map[int]int16
+    /* the frame the segment commands look at, 0 is the innermost */
+    frame int
+    interrupt chan os.Signal
+}
+
+/* why running stopped, or empty if it should continue */
+type stopCheck func () string
+
+func (debugger *Debugger) describe(pc int) string {
+    if pc < 0 || pc >= len(debugger.machine.Code) {
+        return "<end of program>"
+    }
+    instruction := &debugger.machine.Code[pc]
+    function := instruction.Function
+    if function == vm.TopLevelFunction {
+        function = "<top level>"
+    }
+    return fmt.Sprintf("%v %v  %v", instruction.Position(), function, strings.TrimSpace(instruction.Text))
+}
+
+func (debugger *Debugger) showLocation() {
+    if debugger.machine.Halted {
+        fmt.Printf("Program halted after %v steps\n", debugger.machine.Steps)
+        return
+    }
+    fmt.Printf("%v\n", debugger.describe(debugger.machine.PC))
+}
+
+func (debugger *Debugger) breakpointAt(pc int) *Breakpoint {
+    for i := range debugger.breakpoints {
+        if debugger.breakpoints[i].PC == pc {
+            return &debugger.breakpoints[i]
+        }
+    }
+    return nil
+}
+
+/* Steps until the machine halts, fails, hits a breakpoint or watchpoint, is
+ * interrupted, or until says to stop. The breakpoint at the starting point is
+ * ignored so that continuing from a breakpoint makes progress.
+ */
+func (debugger *Debugger) run(until stopCheck) {
+    machine := debugger.machine
+    debugger.frame = 0
+
+    /* forget an interrupt that arrived while waiting at the prompt */
+    select {
+        case <-debugger.interrupt:
+        default:
+    }
+
+    for first := true; !machine.Halted; first = false {
+        if !first {
+            if breakpoint := debugger.breakpointAt(machine.PC); breakpoint != nil {
+                fmt.Printf("Breakpoint %v, %v\n", breakpoint.ID, breakpoint.Description)
+                break
+            }
+        }
+
+        err := machine.Step()
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            return
+        }
+
+        if watched := debugger.checkWatches(); watched {
+            break
+        }
+
+        if until != nil {
+            if reason := until(); reason != "" {
+                break
+            }
+        }
+
+        if machine.Steps % 4096 == 0 {
+            select {
+                case <-debugger.interrupt:
+                    fmt.Printf("Interrupted\n")
+                    debugger.showLocation()
+                    return
+                default:
+            }
+        }
+    }
+
+    debugger.showLocation()
+}
+
+/* true if the last step wrote to a watched address */
+func (debugger *Debugger) checkWatches() bool {
+    hit := false
+    for _, address := range debugger.machine.Writes {
+        old, ok := debugger.watches[address]
+        if !ok {
+            continue
+        }
+        value := debugger.machine.RAM[address]
+        fmt.Printf("Watchpoint RAM[%v]: %v -> %v\n", address, old, value)
+        debugger.watches[address] = value
+        hit = true
+    }
+    return hit
+}
+
+func (debugger *Debugger) step(count int) {
+    steps := 0
+    debugger.run(func () string {
+        steps += 1
+        if steps >= count {
+            return "step"
+        }
+        return ""
+    })
+}
+
+/* runs until the command after the current one in the same frame, so calls
+ * run to completion
+ */
+func (debugger *Debugger) next() {
+    machine := debugger.machine
+    target := machine.PC + 1
+    lcl := machine.RAM[1]
+    if _, ok := machine.Current().Command.(*vm.Call); !ok {
+        debugger.step(1)
+        return
+    }
+
+    debugger.run(func () string {
+        if machine.PC == target && machine.RAM[1] == lcl {
+            return "next"
+        }
+        return ""
+    })
+}
+
+/* runs until the current function returns to its caller */
+func (debugger *Debugger) finish() {
+    machine := debugger.machine
+    frames := machine.Frames(2)
+    if len(frames) < 2 {
+        fmt.Printf("The outermost frame has no caller to return to, continuing\n")
+        debugger.run(nil)
+        return
+    }
+
+    caller := frames[1]
+    debugger.run(func () string {
+        if machine.PC == caller.PC && int(machine.RAM[1]) == caller.LCL {
+            return "finish"
+        }
+        return ""
+    })
+}
+
+func (debugger *Debugger) addBreakpoint(where string) error {
+    machine := debugger.machine
+    var pc int
+    if colon := strings.LastIndex(where, ":"); colon != -1 {
+        line, err := strconv.Atoi(where[colon+1:])
+        if err != nil {
+            return fmt.Errorf("invalid line number in '%v'", where)
+        }
+        found, ok := machine.FindLine(where[:colon], uint64(line))
+        if !ok {
+            return fmt.Errorf("no vm command at %v", where)
+        }
+        pc = found
+    } else {
+        found, ok := machine.FunctionEntry(where)
+        if !ok {
+            return fmt.Errorf("no function named '%v'", where)
+        }
+        pc = found
+    }
+
+    debugger.nextBreakpoint += 1
+    breakpoint := Breakpoint{ID: debugger.nextBreakpoint, PC: pc, Description: debugger.describe(pc)}
+    debugger.breakpoints = append(debugger.breakpoints, breakpoint)
+    fmt.Printf("Breakpoint %v at %v\n", breakpoint.ID, breakpoint.Description)
+    return nil
+}
+
+func (debugger *Debugger) deleteBreakpoint(id int) error {
+    for i, breakpoint := range debugger.breakpoints {
+        if breakpoint.ID == id {
+            debugger.breakpoints = append(debugger.breakpoints[:i], debugger.breakpoints[i+1:]...)
+            return nil
+        }
+    }
+    return fmt.Errorf("no breakpoint %v", id)
+}
+
+/* accepts RAM[n] or n */
+func parseAddress(text string) (int, error) {
+    if strings.HasPrefix(text, "RAM[") && strings.HasSuffix(text, "]") {
+        text = text[4:len(text)-1]
+    }
+    address, err := strconv.Atoi(text)
+    if err != nil || address < 0 || address >= vm.RAMSize {
+        return 0, fmt.Errorf("invalid address '%v'", text)
+    }
+    return address, nil
+}
+
+func (debugger *Debugger) backtrace(limit int) {
+    for i, frame := range debugger.machine.Frames(limit) {
+        marker := " "
+        if i == debugger.frame {
+            marker = "*"
+        }
+        /* callers are shown at their call */
+        pc := frame.PC
+        if i > 0 {
+            pc -= 1
+        }
+        fmt.Printf("%v#%-3v %v  LCL=%v ARG=%v\n", marker, i, debugger.describe(pc), frame.LCL, frame.ARG)
+    }
+}
+
+func (debugger *Debugger) selectedFrame() (vm.Frame, bool) {
+    frames := debugger.machine.Frames(debugger.frame + 1)
+    if debugger.frame >= len(frames) {
+        return vm.Frame{}, false
+    }
+    return frames[debugger.frame], true
+}
+
+/* this and that of the selected frame. Older frames find theirs saved in the
+ * frame of the function they called
+ */
+func (debugger *Debugger) pointers() (int16, int16) {
+    machine := debugger.machine
+    if debugger.frame == 0 {
+        return machine.RAM[3], machine.RAM[4]
+    }
+    callee := machine.Frames(debugger.frame)[debugger.frame - 1]
+    return machine.Read(callee.LCL - 2), machine.Read(callee.LCL - 1)
+}
+
+func (debugger *Debugger) printWords(name string, base int, count int) {
+    for i := 0; i < count; i++ {
+        address := (base + i) & (vm.RAMSize - 1)
+        fmt.Printf("  %v %-3v RAM[%v] = %v\n", name, i, address, debugger.machine.RAM[address])
+    }
+}
+
+func (debugger *Debugger) showSegment(segment string, count int) {
+    frame, ok := debugger.selectedFrame()
+    if !ok {
+        fmt.Printf("No frame %v\n", debugger.frame)
+        return
+    }
+
+    machine := debugger.machine
+    switch segment {
+        case "local":
+            debugger.printWords("local", frame.LCL, frame.Locals)
+        case "argument":
+            if frame.Arguments < 0 {
+                fmt.Printf("  the number of arguments of %v is not known\n", frame.Function)
+                return
+            }
+            debugger.printWords("argument", frame.ARG, frame.Arguments)
+        case "this":
+            this, _ := debugger.pointers()
+            debugger.printWords("this", int(this), count)
+        case "that":
+            _, that := debugger.pointers()
+            debugger.printWords("that", int(that), count)
+        case "temp":
+            debugger.printWords("temp", vm.TempStart, vm.TempSize)
+        case "static":
+            class := machine.Code[frame.PC].File.Class
+            for _, slot := range machine.Statics(class) {
+                fmt.Printf("  static %-3v RAM[%v] = %v\n", slot.Index, slot.Address, machine.RAM[slot.Address])
+            }
+    }
+}
+
+func (debugger *Debugger) list() {
+    machine := debugger.machine
+    for pc := machine.PC - 5; pc <= machine.PC + 5; pc++ {
+        if pc < 0 || pc >= len(machine.Code) {
+            continue
+        }
+        marker := "  "
+        if pc == machine.PC {
+            marker = "=>"
+        }
+        if debugger.breakpointAt(pc) != nil {
+            marker = "b" + marker[1:]
+        }
+        instruction := &machine.Code[pc]
+        fmt.Printf("%v %5v  %v\n", marker, instruction.Line, strings.TrimSpace(instruction.Text))
+    }
+}
+
+const commandHelp = `Commands:
+  break FUNCTION | FILE:LINE   stop when the command is about to run (b)
+  delete [N]                   remove breakpoint N, or all of them
+  info                         list breakpoints and watchpoints
+  watch RAM[N]                 stop after any write to RAM[N]
+  unwatch RAM[N]               stop watching RAM[N]
+  run, continue                run until something stops the program (c)
+  step [N]                     run N commands, entering calls (s)
+  next                         run one command, running calls to completion (n)
+  finish                       run until the current function returns
+  backtrace [N]                show the call stack (bt)
+  frame N                      look at the segments of frame N of the backtrace
+  local, argument, static, temp
+  this [N], that [N]           show a segment of the selected frame, N words of this and that
+  segments                     show all of the segments
+  print RAM[N] [COUNT]         show RAM (p)
+  list                         show the commands around the current one (l)
+  quit                         leave the debugger (q)
+An empty line repeats step or next.
+`
+
+/* runs one command line, returns false to quit */
+func (debugger *Debugger) execute(words []string) bool {
+    machine := debugger.machine
+
+    /* an optional count after the command */
+    count := func (fallback int) (int, error) {
+        if len(words) < 2 {
+            return fallback, nil
+        }
+        value, err := strconv.Atoi(words[1])
+        if err != nil || value < 1 {
+            return 0, fmt.Errorf("invalid count '%v'", words[1])
+        }
+        return value, nil
+    }
+
+    running := func () bool {
+        if machine.Halted {
+            fmt.Printf("The program has halted\n")
+            return false
+        }
+        return true
+    }
+
+    var err error
+    switch words[0] {
+        case "help", "h", "?":
+            fmt.Print(commandHelp)
+        case "quit", "q", "exit":
+            return false
+        case "break", "b":
+            if len(words) != 2 {
+                err = fmt.Errorf("break needs a function name or file:line")
+                break
+            }
+            err = debugger.addBreakpoint(words[1])
+        case "delete", "d":
+            if len(words) == 1 {
+                debugger.breakpoints = nil
+                break
+            }
+            var id int
+            id, err = strconv.Atoi(words[1])
+            if err == nil {
+                err = debugger.deleteBreakpoint(id)
+            }
+        case "info", "breakpoints":
+            for _, breakpoint := range debugger.breakpoints {
+                fmt.Printf("Breakpoint %v at %v\n", breakpoint.ID, breakpoint.Description)
+            }
+            var addresses []int
+            for address := range debugger.watches {
+                addresses = append(addresses, address)
+            }
+            sort.Ints(addresses)
+            for _, address := range addresses {
+                fmt.Printf("Watchpoint RAM[%v] = %v\n", address, machine.RAM[address])
+            }
+        case "watch", "unwatch":
+            if len(words) != 2 {
+                err = fmt.Errorf("%v needs an address such as RAM[256]", words[0])
+                break
+            }
+            var address int
+            address, err = parseAddress(words[1])
+            if err != nil {
+                break
+            }
+            if words[0] == "watch" {
+                debugger.watches[address] = machine.RAM[address]
+                fmt.Printf("Watching RAM[%v] = %v\n", address, machine.RAM[address])
+            } else {
+                delete(debugger.watches, address)
+            }
+        case "run", "r", "continue", "c":
+            if running() {
+                debugger.run(nil)
+            }
+        case "step", "s":
+            var steps int
+            steps, err = count(1)
+            if err == nil && running() {
+                debugger.step(steps)
+            }
+        case "next", "n":
+            if running() {
+                debugger.next()
+            }
+        case "finish", "fin":
+            if running() {
+                debugger.finish()
+            }
+        case "backtrace", "bt", "where":
+            var limit int
+            limit, err = count(100)
+            if err == nil {
+                debugger.backtrace(limit)
+            }
+        case "frame", "f":
+            var frame int
+            frame, err = strconv.Atoi(strings.Join(words[1:], ""))
+            if err != nil || frame < 0 || frame >= len(machine.Frames(frame + 1)) {
+                err = fmt.Errorf("no such frame")
+                break
+            }
+            debugger.frame = frame
+            debugger.backtrace(frame + 1)
+        case "local", "locals", "argument", "args", "static", "temp", "this", "that":
+            segment := map[string]string{"locals": "local", "args": "argument"}[words[0]]
+            if segment == "" {
+                segment = words[0]
+            }
+            var amount int
+            amount, err = count(8)
+            if err == nil {
+                debugger.showSegment(segment, amount)
+            }
+        case "segments":
+            for _, segment := range []string{"local", "argument", "this", "that", "static", "temp"} {
+                fmt.Printf("%v:\n", segment)
+                debugger.showSegment(segment, 8)
+            }
+        case "print", "p", "x":
+            if len(words) < 2 {
+                err = fmt.Errorf("print needs an address such as RAM[256]")
+                break
+            }
+            var address int
+            address, err = parseAddress(words[1])
+            if err != nil {
+                break
+            }
+            amount := 1
+            if len(words) > 2 {
+                amount, err = strconv.Atoi(words[2])
+                if err != nil || amount < 1 {
+                    err = fmt.Errorf("invalid count '%v'", words[2])
+                    break
+                }
+            }
+            for i := 0; i < amount; i++ {
+                at := (address + i) & (vm.RAMSize - 1)
+                fmt.Printf("RAM[%v] = %v\n", at, machine.RAM[at])
+            }
+        case "list", "l":
+            debugger.list()
+        default:
+            err = fmt.Errorf("unknown command '%v', try help", words[0])
+    }
+
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+    }
+
+    return true
+}
+
+func (debugger *Debugger) loop() {
+    input := bufio.NewScanner(os.Stdin)
+    var last []string
+    for {
+        fmt.Printf("(vmdebug) ")
+        if !input.Scan() {
+            fmt.Printf("\n")
+            return
+        }
+
+        words := strings.Fields(input.Text())
+        if len(words) == 0 {
+            if len(last) == 0 {
+                continue
+            }
+            words = last
+        }
+
+        last = nil
+        switch words[0] {
+            case "step", "s", "next", "n":
+                last = words
+        }
+
+        if !debugger.execute(words) {
+            return
+        }
+    }
+}
+
+func help() {
+    fmt.Printf(`Help:
+ $ vmdebug [options] file.vm|directory
+
+Runs a vm program in an interpreter under an interactive debugger. Type help
+at the prompt for the commands.
+
+Options:
+`)
+    flag.PrintDefaults()
+}
+
+func main(){
+    bootstrap := vm.DefaultBootstrapOptions()
+    var parse vm.ParseOptions
+
+    noBootstrap := flag.Bool("no-bootstrap", false, "start at the first command instead of calling the entry point")
+    flag.StringVar(&bootstrap.EntryPoint, "entry", bootstrap.EntryPoint, "function called by the bootstrap code")
+    flag.BoolVar(&parse.Extensions, "extensions", false, "accept the extended commands mul, div, mod, shl, shr and xor")
+    flag.Parse()
+
+    if flag.NArg() != 1 {
+        help()
+        os.Exit(1)
+    }
+
+    bootstrap.Enabled = !*noBootstrap
+    flag.Visit(func (set *flag.Flag){
+        if set.Name == "entry" {
+            bootstrap.ExplicitEntry = true
+        }
+    })
+
+    program, err := vm.LoadProgram(flag.Arg(0), parse, vm.InputOptions{})
+    if err == nil {
+        var machine *vm.Machine
+        machine, err = vm.NewMachine(program, bootstrap)
+        if err == nil {
+            debugger := Debugger{
+                machine: machine,
+                watches: make(map[int]int16),
+                interrupt: make(chan os.Signal, 1),
+            }
+            signal.Notify(debugger.interrupt, os.Interrupt)
+
+            fmt.Printf("Loaded %v commands, type help for the commands\n", len(machine.Code))
+            debugger.showLocation()
+            debugger.loop()
+            return
+        }
+    }
+
+    fmt.Printf("Error: %v\n", err)
+    os.Exit(1)
+}
@@ -0,0 +1,169 @@
+package main
+
+/* Runs vm programs both in the vm interpreter and as translated hack machine
+ * code on a hack CPU, and reports the first place they disagree. Either a
+ * program is given on the command line or random straight-line programs are
+ * made up, in which case a program that fails is saved so it can be run again.
+ */
+
+import (
+    "os"
+    "fmt"
+    "flag"
+    "time"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+
+    "github.com/kazzmir/nand2tetris/vm"
+)
+
+func report(result *vm.DiffResult) bool {
+    if result.Divergence != nil {
+        fmt.Printf("Difference after %v commands and %v instructions:\n", result.Commands, result.Instructions)
+        fmt.Print(result.Divergence.String())
+        return false
+    }
+
+    if !result.Halted {
+        fmt.Printf("No differences in %v commands, %v instructions and %v returns, but the program did not halt\n", result.Commands, result.Instructions, result.Returns)
+        return true
+    }
+
+    fmt.Printf("No differences in %v commands, %v instructions and %v returns\n", result.Commands, result.Instructions, result.Returns)
+    return true
+}
+
+/* writes a random program to directory/Random.vm, so the directory can be
+ * given to vmdiff to run it again
+ */
+func saveProgram(directory string, source string) (string, error) {
+    err := os.MkdirAll(directory, 0755)
+    if err != nil {
+        return "", err
+    }
+
+    path := filepath.Join(directory, "Random.vm")
+    return directory, ioutil.WriteFile(path, []byte(source), 0644)
+}
+
+func runRandom(count int, seed int64, functions int, length int, save string, options vm.DiffOptions) bool {
+    for i := 0; i < count; i++ {
+        programSeed := seed + int64(i)
+        source := vm.RandomProgram(programSeed, functions, length)
+
+        file, err := vm.ParseVMFile(strings.NewReader(source), "Random.vm", vm.ParseOptions{})
+        if err != nil {
+            fmt.Printf("Error: seed %v made a program that does not parse: %v\n", programSeed, err)
+            return false
+        }
+        program := &vm.VMProgram{Files: []*vm.VMFile{file}}
+
+        result, err := vm.DiffProgram(program, options)
+        if err != nil {
+            fmt.Printf("Error: seed %v: %v\n", programSeed, err)
+            return false
+        }
+
+        if result.Divergence != nil || !result.Halted {
+            fmt.Printf("Random program with seed %v:\n", programSeed)
+            report(result)
+            directory, err := saveProgram(filepath.Join(save, fmt.Sprintf("random-%v", programSeed)), source)
+            if err != nil {
+                fmt.Printf("Error: could not save the program: %v\n", err)
+            } else {
+                fmt.Printf("The program is saved in %v\n", directory)
+            }
+            return false
+        }
+    }
+
+    fmt.Printf("No differences in %v random programs starting at seed %v\n", count, seed)
+    return true
+}
+
+func help(){
+    fmt.Printf(`Help:
+ $ vmdiff [options] file.vm|directory
+ $ vmdiff [options] -random count
+
+Runs a vm program in the vm interpreter and as hack machine code on a hack
+CPU at the same time, comparing RAM as it goes, and reports the first vm
+command after which they differ. With -inline, -tail-calls or -cache-top the
+code no longer follows the commands one at a time, so only the RAM the two
+halt with is compared.
+
+Options:
+`)
+    flag.PrintDefaults()
+}
+
+func main(){
+    options := vm.DefaultDiffOptions()
+    var parse vm.ParseOptions
+
+    noBootstrap := flag.Bool("no-bootstrap", false, "start at the first command instead of calling the entry point")
+    flag.StringVar(&options.Translate.Bootstrap.EntryPoint, "entry", options.Translate.Bootstrap.EntryPoint, "function called by the bootstrap code")
+    flag.IntVar(&options.Translate.Bootstrap.SP, "sp", -1, "initial value of SP (default 256 if the entry point is called)")
+    flag.IntVar(&options.Translate.Bootstrap.LCL, "lcl", -1, "initial value of LCL")
+    flag.IntVar(&options.Translate.Bootstrap.ARG, "arg", -1, "initial value of ARG")
+    flag.IntVar(&options.Translate.Bootstrap.THIS, "this", -1, "initial value of THIS")
+    flag.IntVar(&options.Translate.Bootstrap.THAT, "that", -1, "initial value of THAT")
+    flag.BoolVar(&parse.Extensions, "extensions", false, "accept the extended commands mul, div, mod, shl, shr and xor")
+    flag.IntVar(&options.Translate.Inline, "inline", 0, "inline calls to leaf functions of at most this many commands, 0 disables inlining")
+    flag.BoolVar(&options.Translate.TailCalls, "tail-calls", false, "reuse the current frame for a call that is directly followed by a return")
+    flag.BoolVar(&options.Translate.CacheTop, "cache-top", false, "keep the top of the stack in the D register between commands")
+    flag.BoolVar(&options.Translate.CheckStack, "check-stack", false, "halt with an error code if the stack reaches the stack limit")
+    flag.IntVar(&options.Translate.StackLimit, "stack-limit", options.Translate.StackLimit, "first address above the stack, used by -check-stack and -profile")
+    flag.BoolVar(&options.Translate.Profile, "profile", false, "count function entries and calls in RAM below the stack limit")
+    flag.Uint64Var(&options.MaxCommands, "steps", options.MaxCommands, "stop after this many vm commands, 0 for no limit")
+    random := flag.Int("random", 0, "test this many random straight-line programs instead of a given one")
+    seed := flag.Int64("seed", 0, "seed of the first random program (default based on the time)")
+    functions := flag.Int("functions", 5, "functions in each random program besides Sys.init")
+    length := flag.Int("length", 40, "commands in each function of a random program")
+    save := flag.String("save", ".", "directory to save a failing random program in")
+    flag.Parse()
+
+    options.Translate.Bootstrap.Enabled = !*noBootstrap
+    flag.Visit(func (set *flag.Flag){
+        if set.Name == "entry" {
+            options.Translate.Bootstrap.ExplicitEntry = true
+        }
+    })
+
+    if *random > 0 {
+        if flag.NArg() != 0 {
+            help()
+            os.Exit(1)
+        }
+
+        if *seed == 0 {
+            *seed = time.Now().UnixNano() % 1000000
+        }
+
+        if !runRandom(*random, *seed, *functions, *length, *save, options) {
+            os.Exit(1)
+        }
+        return
+    }
+
+    if flag.NArg() != 1 {
+        help()
+        os.Exit(1)
+    }
+
+    program, err := vm.LoadProgram(flag.Arg(0), parse, vm.InputOptions{})
+    if err == nil {
+        var result *vm.DiffResult
+        result, err = vm.DiffProgram(program, options)
+        if err == nil {
+            if !report(result) {
+                os.Exit(1)
+            }
+            return
+        }
+    }
+
+    fmt.Printf("Error: %v\n", err)
+    os.Exit(1)
+}
@@ -0,0 +1,79 @@
+package main
+
+/* Decodes a vm bytecode file back into vm text, either on stdout or as one .vm
+ * file per class.
+ */
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "flag"
+    "bufio"
+    "path/filepath"
+
+    "github.com/kazzmir/nand2tetris/bytecode"
+)
+
+func writeClass(output io.Writer, class bytecode.Class) {
+    for _, instruction := range class.Instructions {
+        fmt.Fprintf(output, "%v\n", instruction)
+    }
+}
+
+func help() {
+    fmt.Printf(`Help:
+ $ vmdis [options] file.vmb
+
+Options:
+`)
+    flag.PrintDefaults()
+}
+
+func main(){
+    directory := flag.String("d", "", "write each class to <directory>/<class>.vm instead of printing it")
+    flag.Parse()
+
+    if flag.NArg() < 1 {
+        fmt.Printf("Give a .vmb file\n\n")
+        help()
+        return
+    }
+
+    input, err := os.Open(flag.Arg(0))
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        os.Exit(1)
+    }
+    defer input.Close()
+
+    classes, err := bytecode.Decode(input)
+    if err != nil {
+        fmt.Printf("Could not decode %v: %v\n", flag.Arg(0), err)
+        os.Exit(1)
+    }
+
+    for _, class := range classes {
+        if *directory == "" {
+            fmt.Printf("// %v.vm\n", class.Name)
+            writeClass(os.Stdout, class)
+            continue
+        }
+
+        path := filepath.Join(*directory, class.Name + ".vm")
+        output, err := os.Create(path)
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            os.Exit(1)
+        }
+
+        writer := bufio.NewWriter(output)
+        writeClass(writer, class)
+        err = writer.Flush()
+        output.Close()
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            os.Exit(1)
+        }
+    }
+}
@@ -0,0 +1,209 @@
+package main
+
+/* Reads the counter map written by 'vm -profile' and a RAM dump taken after
+ * running the program, and prints how often each function was entered and
+ * how often each function called each other function.
+ */
+
+import (
+    "os"
+    "io"
+    "io/ioutil"
+    "fmt"
+    "flag"
+    "bufio"
+    "sort"
+    "strings"
+    "strconv"
+    "encoding/binary"
+)
+
+type Counter struct {
+    Address int
+    Function string
+    /* empty for function entry counters */
+    Callee string
+    Position string
+}
+
+func readProfileMap(path string) ([]Counter, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    var counters []Counter
+    scanner := bufio.NewScanner(file)
+    lineNumber := 0
+    for scanner.Scan() {
+        lineNumber += 1
+        fields := strings.Fields(scanner.Text())
+        if len(fields) == 0 {
+            continue
+        }
+
+        address, err := strconv.Atoi(fields[0])
+        if err != nil {
+            return nil, fmt.Errorf("%v:%v: invalid address '%v'", path, lineNumber, fields[0])
+        }
+
+        switch {
+            case len(fields) == 3 && fields[1] == "function":
+                counters = append(counters, Counter{Address: address, Function: fields[2]})
+            case len(fields) == 5 && fields[1] == "call":
+                counters = append(counters, Counter{Address: address, Function: fields[2], Callee: fields[3], Position: fields[4]})
+            default:
+                return nil, fmt.Errorf("%v:%v: cannot parse '%v'", path, lineNumber, scanner.Text())
+        }
+    }
+
+    return counters, scanner.Err()
+}
+
+/* A binary dump is the RAM as little endian 16-bit words starting at address 0.
+ * A text dump has one value per line, either 'value' for consecutive addresses
+ * starting at 0 or 'address value'. Anything after the numbers is ignored.
+ */
+func readRAM(path string, isBinary bool) (map[int]int, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    ram := make(map[int]int)
+
+    if isBinary {
+        for i := 0; i + 1 < len(data); i += 2 {
+            ram[i / 2] = int(int16(binary.LittleEndian.Uint16(data[i:])))
+        }
+        return ram, nil
+    }
+
+    next := 0
+    for lineNumber, line := range strings.Split(string(data), "\n") {
+        fields := strings.FieldsFunc(line, func (r rune) bool {
+            return r == ' ' || r == '\t' || r == ':' || r == '\r'
+        })
+
+        var numbers []int
+        for _, field := range fields {
+            value, err := strconv.Atoi(field)
+            if err != nil {
+                break
+            }
+            numbers = append(numbers, value)
+        }
+
+        switch len(numbers) {
+            case 0:
+                if len(fields) > 0 {
+                    return nil, fmt.Errorf("%v:%v: cannot parse '%v'", path, lineNumber + 1, line)
+                }
+            case 1:
+                ram[next] = numbers[0]
+                next += 1
+            default:
+                ram[numbers[0]] = numbers[1]
+                next = numbers[0] + 1
+        }
+    }
+
+    return ram, nil
+}
+
+/* counters are 16-bit, so treat the value as unsigned */
+func count(ram map[int]int, address int) int {
+    return ram[address] & 0xffff
+}
+
+type callPair struct {
+    Caller string
+    Callee string
+}
+
+func report(output io.Writer, counters []Counter, ram map[int]int, top int) {
+    var functions []Counter
+    pairs := make(map[callPair]int)
+    for _, counter := range counters {
+        if counter.Callee == "" {
+            functions = append(functions, counter)
+        } else {
+            pairs[callPair{Caller: counter.Function, Callee: counter.Callee}] += count(ram, counter.Address)
+        }
+    }
+
+    sort.SliceStable(functions, func (a, b int) bool {
+        return count(ram, functions[a].Address) > count(ram, functions[b].Address)
+    })
+
+    if top > 0 && len(functions) > top {
+        functions = functions[:top]
+    }
+
+    fmt.Fprintf(output, "Calls per function\n")
+    for _, function := range functions {
+        fmt.Fprintf(output, "  %-40v %8v\n", function.Function, count(ram, function.Address))
+    }
+
+    var calls []callPair
+    for pair, total := range pairs {
+        if total > 0 {
+            calls = append(calls, pair)
+        }
+    }
+
+    sort.Slice(calls, func (a, b int) bool {
+        if pairs[calls[a]] != pairs[calls[b]] {
+            return pairs[calls[a]] > pairs[calls[b]]
+        }
+        if calls[a].Caller != calls[b].Caller {
+            return calls[a].Caller < calls[b].Caller
+        }
+        return calls[a].Callee < calls[b].Callee
+    })
+
+    if top > 0 && len(calls) > top {
+        calls = calls[:top]
+    }
+
+    fmt.Fprintf(output, "\nCaller -> callee\n")
+    for _, pair := range calls {
+        fmt.Fprintf(output, "  %-30v -> %-30v %8v\n", pair.Caller, pair.Callee, pairs[pair])
+    }
+}
+
+func help() {
+    fmt.Printf(`Help:
+ $ vmprof [options] program.profile ram-dump
+
+Options:
+`)
+    flag.PrintDefaults()
+}
+
+func main(){
+    isBinary := flag.Bool("binary", false, "the ram dump is little endian 16-bit words instead of text")
+    top := flag.Int("top", 0, "only show this many functions and caller/callee pairs (0 for all)")
+    flag.Parse()
+
+    if flag.NArg() < 2 {
+        fmt.Printf("Give a profile map and a ram dump\n\n")
+        help()
+        return
+    }
+
+    counters, err := readProfileMap(flag.Arg(0))
+    if err != nil {
+        fmt.Printf("Could not read profile map: %v\n", err)
+        os.Exit(1)
+    }
+
+    ram, err := readRAM(flag.Arg(1), *isBinary)
+    if err != nil {
+        fmt.Printf("Could not read ram dump: %v\n", err)
+        os.Exit(1)
+    }
+
+    report(os.Stdout, counters, ram, *top)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+    "testing"
+    "os"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+)
+
+func writeFile(test *testing.T, directory string, name string, contents string) string {
+    path := filepath.Join(directory, name)
+    err := ioutil.WriteFile(path, []byte(contents), 0644)
+    if err != nil {
+        test.Fatalf("could not write %v: %v", path, err)
+    }
+    return path
+}
+
+func TestReport(test *testing.T){
+    directory, err := ioutil.TempDir("", "vmprof")
+    if err != nil {
+        test.Fatalf("could not make a directory: %v", err)
+    }
+    defer os.RemoveAll(directory)
+
+    profile := writeFile(test, directory, "Test.profile", `
+100 function Sys.init
+101 function Test.f
+102 call Sys.init Test.f Sys.vm:6
+103 call Test.f Test.g Test.vm:3
+104 call Test.f Test.g Test.vm:4
+`)
+    counters, err := readProfileMap(profile)
+    if err != nil {
+        test.Fatalf("could not read the profile map: %v", err)
+    }
+    if len(counters) != 5 || counters[2].Callee != "Test.f" || counters[2].Position != "Sys.vm:6" {
+        test.Fatalf("read the wrong counters: %#v", counters)
+    }
+
+    /* a later 'address value' line replaces an earlier value */
+    dump := writeFile(test, directory, "ram.txt", "100 1\n3\n-1\n102: 3\n2\n5\n")
+    ram, err := readRAM(dump, false)
+    if err != nil {
+        test.Fatalf("could not read the ram dump: %v", err)
+    }
+
+    var output strings.Builder
+    report(&output, counters, ram, 0)
+    lines := strings.Fields(output.String())
+    text := strings.Join(lines, " ")
+
+    for _, expected := range []string{
+        "Calls per function Test.f 3 Sys.init 1",
+        "Test.f -> Test.g 7 Sys.init -> Test.f 3",
+    } {
+        if !strings.Contains(text, expected) {
+            test.Errorf("the report does not contain '%v':\n%v", expected, output.String())
+        }
+    }
+
+    /* -1 as a signed word is 65535 calls */
+    if count(map[int]int{0: -1}, 0) != 65535 {
+        test.Errorf("a counter of -1 should be 65535")
+    }
+}
+
+func TestBadProfileMap(test *testing.T){
+    directory, err := ioutil.TempDir("", "vmprof")
+    if err != nil {
+        test.Fatalf("could not make a directory: %v", err)
+    }
+    defer os.RemoveAll(directory)
+
+    profile := writeFile(test, directory, "Test.profile", "100 function Sys.init\n101 call Sys.init\n")
+    _, err = readProfileMap(profile)
+    if err == nil || !strings.Contains(err.Error(), ":2:") {
+        test.Errorf("expected an error on line 2 but got %v", err)
+    }
+}
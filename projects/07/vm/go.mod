@@ -1,3 +1,7 @@
 module github.com/kazzmir/nand2tetris
 
 go 1.13
+
+require github.com/kazzmir/nand2tetris/assembler v0.0.0
+
+replace github.com/kazzmir/nand2tetris/assembler => ../../06/assembler
@@ -0,0 +1,150 @@
+package vm
+
+import (
+    "io"
+    "fmt"
+    "sort"
+)
+
+/* Generates code for a whole program. Every backend has its own translation
+ * of the commands it supports and keeps its own state while it translates, so
+ * a backend can be added without touching the commands or the others. A
+ * command the backend has no translation for is an error.
+ */
+type Backend interface {
+    /* the extension of the file the backend writes, without the dot */
+    Extension() string
+    /* writes the program to output, returning the files that go next to it or
+     * nil if there are none
+     */
+    Translate(output io.Writer, program *VMProgram, options TranslateOptions) (Sidecars, error)
+}
+
+/* Files such as source maps and reports that a backend writes next to its
+ * output. They are only written once the output itself has been.
+ */
+type Sidecars interface {
+    /* path is the input that was translated, log is where to say what was
+     * written
+     */
+    WriteSidecars(log io.Writer, path string, options TranslateOptions) error
+}
+
+/* the backends by the name used for TranslateOptions.Target */
+var Backends = map[string]Backend{
+    "asm": HackBackend{},
+    "hack": HackBinaryBackend{},
+    "c": CBackend{},
+    "wasm": WasmBackend{},
+    "x86-64": X86Backend{},
+}
+
+/* the error for a command that a backend has no translation for */
+func unsupportedCommand(file *VMFile, line VMLine, backend string) error {
+    return &ValidationError{
+        File: file.Path,
+        Line: line.Line,
+        Message: fmt.Sprintf("'%v' is not supported by the %v backend", normalizeWhitespace(line.Text), backend),
+    }
+}
+
+/* Hack assembly, the only backend that supports the code generation options
+ * for caching, checking, profiling, source maps and statistics, see
+ * hackbackend.go
+ */
+type HackBackend struct {
+}
+
+func (backend HackBackend) Extension() string {
+    return "asm"
+}
+
+func (backend HackBackend) Translate(output io.Writer, program *VMProgram, options TranslateOptions) (Sidecars, error) {
+    var translator asmTranslator
+    err := translator.translateProgram(output, program, options)
+    if err != nil {
+        return nil, err
+    }
+    return &translator, nil
+}
+
+/* hack machine code, assembled in memory from the output of the hack backend,
+ * see hack.go
+ */
+type HackBinaryBackend struct {
+}
+
+func (backend HackBinaryBackend) Extension() string {
+    return "hack"
+}
+
+func (backend HackBinaryBackend) Translate(output io.Writer, program *VMProgram, options TranslateOptions) (Sidecars, error) {
+    translator, err := translateToHack(output, program, options)
+    if err != nil {
+        return nil, err
+    }
+    return translator, nil
+}
+
+/* portable C with a main function, see cbackend.go */
+type CBackend struct {
+}
+
+func (backend CBackend) Extension() string {
+    return "c"
+}
+
+func (backend CBackend) Translate(output io.Writer, program *VMProgram, options TranslateOptions) (Sidecars, error) {
+    return nil, translateToC(output, program, options.Bootstrap)
+}
+
+/* a WebAssembly text module, see wasmbackend.go */
+type WasmBackend struct {
+}
+
+func (backend WasmBackend) Extension() string {
+    return "wat"
+}
+
+func (backend WasmBackend) Translate(output io.Writer, program *VMProgram, options TranslateOptions) (Sidecars, error) {
+    return nil, translateToWasm(output, program, options.Bootstrap)
+}
+
+/* x86-64 assembly for GNU as on Linux with a small runtime, see x86backend.go */
+type X86Backend struct {
+}
+
+func (backend X86Backend) Extension() string {
+    return "s"
+}
+
+func (backend X86Backend) Translate(output io.Writer, program *VMProgram, options TranslateOptions) (Sidecars, error) {
+    return nil, translateToX86(output, program, options.Bootstrap)
+}
+
+/* Parses vm text into commands, without the extended commands. Errors carry
+ * the line number they happened on.
+ */
+func ParseVM(input io.Reader) ([]Command, error) {
+    file, err := ParseVMFile(input, "", ParseOptions{})
+    if err != nil {
+        return nil, err
+    }
+
+    var commands []Command
+    for _, line := range file.Lines {
+        commands = append(commands, line.Command)
+    }
+
+    return commands, nil
+}
+
+/* the names of the backends, sorted */
+func BackendNames() []string {
+    var names []string
+    for name := range Backends {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
@@ -0,0 +1,80 @@
+package vm
+
+import (
+    "testing"
+    "strings"
+)
+
+/* a program made of one file that defines the given functions */
+func functionsProgram(names ...string) *VMProgram {
+    file := &VMFile{Path: "Test.vm", Class: "Test"}
+    for _, name := range names {
+        file.Lines = append(file.Lines, VMLine{Command: &Function{Name: name}, Text: "function " + name + " 0"})
+    }
+    return &VMProgram{Files: []*VMFile{file}}
+}
+
+func bootstrapAssembly(test *testing.T, program *VMProgram, options BootstrapOptions) string {
+    var output strings.Builder
+    var translator asmTranslator
+    err := writeBootstrapCode(&output, program, options, &translator)
+    if err != nil {
+        test.Fatalf("could not write the bootstrap code: %v", err)
+    }
+    return output.String()
+}
+
+func TestBootstrapDefault(test *testing.T){
+    assembly := bootstrapAssembly(test, functionsProgram("Sys.init"), DefaultBootstrapOptions())
+    if !strings.HasPrefix(assembly, "@256\nD=A\n@SP\nM=D\n") {
+        test.Errorf("SP is not set to 256 first:\n%v", assembly)
+    }
+    if !strings.Contains(assembly, "@Sys.init\n") {
+        test.Errorf("Sys.init is not called:\n%v", assembly)
+    }
+}
+
+func TestBootstrapEntryPoint(test *testing.T){
+    options := DefaultBootstrapOptions()
+    options.EntryPoint = "Main.main"
+    options.ExplicitEntry = true
+    options.SP = 300
+    options.THIS = 3000
+
+    assembly := bootstrapAssembly(test, functionsProgram("Main.main"), options)
+    if !strings.Contains(assembly, "@300\nD=A\n@SP\nM=D\n") || !strings.Contains(assembly, "@3000\nD=A\n@THIS\nM=D\n") {
+        test.Errorf("the pointers are not set:\n%v", assembly)
+    }
+    if !strings.Contains(assembly, "@Main.main\n") || strings.Contains(assembly, "Sys.init") {
+        test.Errorf("Main.main is not the function called:\n%v", assembly)
+    }
+}
+
+/* without an entry point execution falls into the first file, and SP is only
+ * set when asked for
+ */
+func TestBootstrapNoEntryPoint(test *testing.T){
+    options := DefaultBootstrapOptions()
+    options.LCL = 300
+    assembly := bootstrapAssembly(test, functionsProgram("Test.f"), options)
+    if assembly != "@300\nD=A\n@LCL\nM=D\n" {
+        test.Errorf("unexpected bootstrap code:\n%v", assembly)
+    }
+
+    options.ExplicitEntry = true
+    var output strings.Builder
+    err := writeBootstrapCode(&output, functionsProgram("Test.f"), options, &asmTranslator{})
+    if err == nil {
+        test.Errorf("a missing entry point that was asked for is not an error")
+    }
+}
+
+func TestBootstrapDisabled(test *testing.T){
+    options := DefaultBootstrapOptions()
+    options.Enabled = false
+    options.SP = 300
+    assembly := bootstrapAssembly(test, functionsProgram("Sys.init"), options)
+    if assembly != "" {
+        test.Errorf("disabled bootstrap code wrote:\n%v", assembly)
+    }
+}
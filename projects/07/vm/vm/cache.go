@@ -0,0 +1,287 @@
+package vm
+
+import (
+    "fmt"
+)
+
+/* Top of stack caching. In this mode the value on top of the stack may live in
+ * the D register instead of in RAM[SP-1], which lets a push followed by a
+ * command that consumes the value skip the round trip through memory. While the
+ * top is cached, SP does not count it.
+ *
+ * Commands that know about the cache implement CachedCommand. Any other
+ * command, and every point that can be jumped to, first spills D back onto the
+ * stack, so the cache is always empty at labels, function entries, calls and
+ * returns.
+ */
+type CachedCommand interface {
+    TranslateCached(*asmTranslator) []string
+}
+
+/* pushes D onto the real stack if it holds the top of the stack */
+func spillCache(translator *asmTranslator) []string {
+    if !translator.topInD {
+        return nil
+    }
+
+    translator.topInD = false
+    return []string{
+        "@SP",
+        "A=M",
+        "M=D",
+        "@SP",
+        "M=M+1",
+    }
+}
+
+/* makes D hold the top of the stack and removes it from the stack */
+func popToD(translator *asmTranslator) []string {
+    if translator.topInD {
+        translator.topInD = false
+        return nil
+    }
+
+    return []string{
+        "@SP",
+        "AM=M-1",
+        "D=M",
+    }
+}
+
+/* translates a command in caching mode */
+func translateCached(command asmCommand, translator *asmTranslator) []string {
+    cached, ok := command.(CachedCommand)
+    if ok {
+        return cached.TranslateCached(translator)
+    }
+
+    return append(spillCache(translator), command.TranslateToAssembly(translator)...)
+}
+
+/* the push is delayed by leaving the value in D */
+func cachedLoad(translator *asmTranslator, load []string) []string {
+    out := spillCache(translator)
+    out = append(out, load...)
+    translator.topInD = true
+    return out
+}
+
+func (constant *PushConstant) TranslateCached(translator *asmTranslator) []string {
+    return cachedLoad(translator, []string{
+        fmt.Sprintf("@%v", constant.Constant),
+        "D=A",
+    })
+}
+
+func cachedPushSegment(translator *asmTranslator, segment string, index int) []string {
+    return cachedLoad(translator, []string{
+        fmt.Sprintf("@%v", segment),
+        "D=M",
+        fmt.Sprintf("@%v", index),
+        "A=D+A",
+        "D=M",
+    })
+}
+
+func cachedPushAddress(translator *asmTranslator, address string) []string {
+    return cachedLoad(translator, []string{
+        fmt.Sprintf("@%v", address),
+        "D=M",
+    })
+}
+
+func (local *PushLocal) TranslateCached(translator *asmTranslator) []string {
+    return cachedPushSegment(translator, "LCL", local.Index)
+}
+
+func (argument *PushArgument) TranslateCached(translator *asmTranslator) []string {
+    return cachedPushSegment(translator, "ARG", argument.Index)
+}
+
+func (this *PushThis) TranslateCached(translator *asmTranslator) []string {
+    return cachedPushSegment(translator, "THIS", this.Index)
+}
+
+func (that *PushThat) TranslateCached(translator *asmTranslator) []string {
+    return cachedPushSegment(translator, "THAT", that.Index)
+}
+
+func (temp *PushTemp) TranslateCached(translator *asmTranslator) []string {
+    return cachedPushAddress(translator, fmt.Sprintf("%v", TempStart + temp.Index))
+}
+
+func (pointer *PushPointer) TranslateCached(translator *asmTranslator) []string {
+    return cachedPushAddress(translator, fmt.Sprintf("%v", PointerStart + pointer.Index))
+}
+
+func (static *PushStatic) TranslateCached(translator *asmTranslator) []string {
+    return cachedPushAddress(translator, fmt.Sprintf("static.%v.%v", translator.CurrentFile, static.Index))
+}
+
+/* the largest segment index that is reached by incrementing A rather than
+ * computing the address through R13
+ */
+const cachedSmallIndex = 3
+
+func cachedPopSegment(translator *asmTranslator, segment string, index int) []string {
+    out := popToD(translator)
+
+    if index <= cachedSmallIndex {
+        /* a = segment+index without touching d */
+        out = append(out, fmt.Sprintf("@%v", segment), "A=M")
+        for i := 0; i < index; i++ {
+            out = append(out, "A=A+1")
+        }
+        return append(out, "M=D")
+    }
+
+    return append(out,
+        "@R13",
+        "M=D", // r13 = value
+        fmt.Sprintf("@%v", segment),
+        "D=M",
+        fmt.Sprintf("@%v", index),
+        "D=D+A",
+        "@R14",
+        "M=D", // r14 = segment+index
+        "@R13",
+        "D=M",
+        "@R14",
+        "A=M",
+        "M=D")
+}
+
+func cachedPopAddress(translator *asmTranslator, address string) []string {
+    out := popToD(translator)
+    return append(out,
+        fmt.Sprintf("@%v", address),
+        "M=D")
+}
+
+func (local *PopLocal) TranslateCached(translator *asmTranslator) []string {
+    return cachedPopSegment(translator, "LCL", local.Index)
+}
+
+func (argument *PopArgument) TranslateCached(translator *asmTranslator) []string {
+    return cachedPopSegment(translator, "ARG", argument.Index)
+}
+
+func (this *PopThis) TranslateCached(translator *asmTranslator) []string {
+    return cachedPopSegment(translator, "THIS", this.Index)
+}
+
+func (that *PopThat) TranslateCached(translator *asmTranslator) []string {
+    return cachedPopSegment(translator, "THAT", that.Index)
+}
+
+func (temp *PopTemp) TranslateCached(translator *asmTranslator) []string {
+    return cachedPopAddress(translator, fmt.Sprintf("%v", TempStart + temp.Index))
+}
+
+func (pointer *PopPointer) TranslateCached(translator *asmTranslator) []string {
+    return cachedPopAddress(translator, fmt.Sprintf("%v", PointerStart + pointer.Index))
+}
+
+func (static *PopStatic) TranslateCached(translator *asmTranslator) []string {
+    return cachedPopAddress(translator, fmt.Sprintf("static.%v.%v", translator.CurrentFile, static.Index))
+}
+
+/* y is brought into d, x is popped from memory and x op y is left in d */
+func cachedBinary(translator *asmTranslator, operation string) []string {
+    out := popToD(translator)
+    out = append(out,
+        "@SP",
+        "AM=M-1",
+        operation)
+    translator.topInD = true
+    return out
+}
+
+func (add *Add) TranslateCached(translator *asmTranslator) []string {
+    return cachedBinary(translator, "D=D+M")
+}
+
+func (sub *Sub) TranslateCached(translator *asmTranslator) []string {
+    return cachedBinary(translator, "D=M-D")
+}
+
+func (and *And) TranslateCached(translator *asmTranslator) []string {
+    return cachedBinary(translator, "D=D&M")
+}
+
+func (or *Or) TranslateCached(translator *asmTranslator) []string {
+    return cachedBinary(translator, "D=D|M")
+}
+
+func (neg *Neg) TranslateCached(translator *asmTranslator) []string {
+    var out []string
+    if translator.topInD {
+        out = []string{"D=-D"}
+    } else {
+        out = []string{
+            "@SP",
+            "AM=M-1",
+            "D=-M",
+        }
+    }
+    translator.topInD = true
+    return out
+}
+
+func (not *Not) TranslateCached(translator *asmTranslator) []string {
+    var out []string
+    if translator.topInD {
+        out = []string{"D=!D"}
+    } else {
+        out = []string{
+            "@SP",
+            "AM=M-1",
+            "D=!M",
+        }
+    }
+    translator.topInD = true
+    return out
+}
+
+/* x-y is worked out into d as for the uncached comparisons, and is then
+ * replaced by -1 or 0
+ */
+func cachedComparison(translator *asmTranslator, difference func(*asmTranslator) []string, jumpTrue string) []string {
+    isTrue := translator.Gensym("cmp_true")
+    done := translator.Gensym("cmp_done")
+
+    out := popToD(translator)
+    out = append(out,
+        "@SP",
+        "AM=M-1")
+    out = append(out, difference(translator)...)
+    translator.topInD = true
+    return append(out,
+        fmt.Sprintf("@%v", isTrue),
+        fmt.Sprintf("D; %v", jumpTrue),
+        "D=0",
+        fmt.Sprintf("@%v", done),
+        "0; JMP",
+        fmt.Sprintf("(%v)", isTrue),
+        "D=-1",
+        fmt.Sprintf("(%v)", done))
+}
+
+func (lt *Lt) TranslateCached(translator *asmTranslator) []string {
+    return cachedComparison(translator, signedDifference, "JLT")
+}
+
+func (eq *Eq) TranslateCached(translator *asmTranslator) []string {
+    return cachedComparison(translator, plainDifference, "JEQ")
+}
+
+func (gt *Gt) TranslateCached(translator *asmTranslator) []string {
+    return cachedComparison(translator, signedDifference, "JGT")
+}
+
+func (ifgoto *IfGoto) TranslateCached(translator *asmTranslator) []string {
+    out := popToD(translator)
+    return append(out,
+        fmt.Sprintf("@%v", asmLabel(translator, ifgoto.Name)),
+        "D; JNE")
+}
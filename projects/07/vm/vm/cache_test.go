@@ -0,0 +1,139 @@
+package vm
+
+import (
+    "testing"
+)
+
+/* uses every kind of command, leaving its results in temp and static */
+const everyCommandSource = `
+function Sys.init 0
+push constant 9
+push constant 4
+call Test.mix 2
+pop temp 0
+call Test.pointers 0
+pop static 1
+label END
+goto END
+
+function Test.mix 2
+push argument 0
+push argument 1
+sub
+pop local 0
+push argument 0
+push argument 1
+lt
+push argument 1
+push argument 0
+gt
+and
+push local 0
+push constant 5
+eq
+or
+pop local 1
+push local 1
+if-goto YES
+push constant 100
+return
+label YES
+push local 0
+neg
+not
+push argument 1
+mul
+push constant 7
+xor
+push constant 2
+shl
+push constant 3
+div
+push constant 12
+add
+push constant 5
+mod
+push local 1
+push argument 0
+shr
+add
+return
+
+function Test.pointers 0
+push constant 3000
+pop pointer 0
+push constant 4000
+pop pointer 1
+push constant 11
+pop this 2
+push constant 13
+pop that 3
+push this 2
+push that 3
+add
+push pointer 1
+push pointer 0
+sub
+add
+pop static 0
+push static 0
+push constant 1
+add
+return
+`
+
+func TestCachedTop(test *testing.T){
+    plainAssembly := translateSource(test, everyCommandSource, hackOptions())
+    plain := runHack(test, plainAssembly)
+
+    options := hackOptions()
+    options.CacheTop = true
+    cachedAssembly := translateSource(test, everyCommandSource, options)
+    cached := runHack(test, cachedAssembly)
+
+    for _, address := range []int{TempStart, 3002, 4003} {
+        if plain.RAM[address] != cached.RAM[address] {
+            test.Errorf("RAM[%v] is %v with the top of the stack cached but %v without", address, cached.RAM[address], plain.RAM[address])
+        }
+    }
+    for _, static := range []string{"static.Test.0", "static.Test.1"} {
+        if plain.static(static) != cached.static(static) {
+            test.Errorf("%v is %v with the top of the stack cached but %v without", static, cached.static(static), plain.static(static))
+        }
+    }
+
+    /* 9-4 == 5 is true, so mix computes
+     * ((((!-5 * 4) ^ 7) << 2) / 3 + 12) % 5 + (-1 >> 9)
+     */
+    if plain.RAM[TempStart] != 1 {
+        test.Errorf("mix returned %v instead of 1", plain.RAM[TempStart])
+    }
+    if plain.static("static.Test.0") != 1024 || plain.static("static.Test.1") != 1025 {
+        test.Errorf("pointers left %v and %v instead of 1024 and 1025", plain.static("static.Test.0"), plain.static("static.Test.1"))
+    }
+
+    if len(newHackMachine(cachedAssembly).code) >= len(newHackMachine(plainAssembly).code) {
+        test.Errorf("caching the top of the stack did not make the program smaller")
+    }
+}
+
+func TestCachedNot(test *testing.T){
+    source := `
+function Sys.init 0
+push constant 5
+not
+pop temp 0
+push constant 12
+push constant 10
+xor
+pop temp 1
+label END
+goto END
+`
+    options := hackOptions()
+    options.CacheTop = true
+    machine := runHack(test, translateSource(test, source, options))
+    if machine.RAM[TempStart] != -6 || machine.RAM[TempStart + 1] != 6 {
+        test.Errorf("got %v and %v instead of -6 and 6", machine.RAM[TempStart], machine.RAM[TempStart + 1])
+    }
+}
@@ -0,0 +1,151 @@
+package vm
+
+import (
+    "io"
+    "fmt"
+    "sort"
+    "strings"
+)
+
+/* the name of the function that code appearing before any 'function' command
+ * in a file belongs to. such code is only reachable by falling into it, so it
+ * is always kept.
+ */
+const TopLevelFunction = ""
+
+/* calls made by each function, keyed by the function name */
+type CallGraph map[string][]string
+
+func (program *VMProgram) CallGraph() CallGraph {
+    graph := make(CallGraph)
+
+    for _, file := range program.Files {
+        current := TopLevelFunction
+        for _, line := range file.Lines {
+            switch command := line.Command.(type) {
+                case *Function:
+                    current = command.Name
+                    if _, ok := graph[current]; !ok {
+                        graph[current] = nil
+                    }
+                case *Call:
+                    graph[current] = append(graph[current], command.Name)
+                case *TailCall:
+                    graph[current] = append(graph[current], command.Name)
+            }
+        }
+    }
+
+    return graph
+}
+
+/* returns the set of functions that can be reached by following calls from
+ * the given roots
+ */
+func (graph CallGraph) Reachable(roots []string) map[string]bool {
+    reached := make(map[string]bool)
+
+    work := append([]string(nil), roots...)
+    for len(work) > 0 {
+        name := work[len(work)-1]
+        work = work[:len(work)-1]
+
+        if reached[name] {
+            continue
+        }
+        reached[name] = true
+
+        for _, callee := range graph[name] {
+            if !reached[callee] {
+                work = append(work, callee)
+            }
+        }
+    }
+
+    return reached
+}
+
+/* a function left out of the output */
+type RemovedFunction struct {
+    Name string
+    File string
+    /* number of hack instructions the function would have produced */
+    Instructions int
+}
+
+/* counts real instructions, ignoring label declarations and comments */
+func instructionCount(assembly []string) int {
+    count := 0
+    for _, line := range assembly {
+        if strings.HasPrefix(line, "(") || strings.HasPrefix(line, "//") {
+            continue
+        }
+        count += 1
+    }
+    return count
+}
+
+/* Removes every function that cannot be reached from the roots. Code before
+ * the first function of a file is always kept, and calls made from it are
+ * treated as additional roots.
+ */
+func (program *VMProgram) EliminateDeadFunctions(roots []string) []RemovedFunction {
+    graph := program.CallGraph()
+    reached := graph.Reachable(append([]string{TopLevelFunction}, roots...))
+
+    /* scratch translator used only to measure the size of removed code */
+    var scratch asmTranslator
+
+    var removed []RemovedFunction
+    for _, file := range program.Files {
+        scratch.CurrentFile = file.Class
+
+        var kept []VMLine
+        current := TopLevelFunction
+        var dead *RemovedFunction
+
+        for _, line := range file.Lines {
+            if function, ok := line.Command.(*Function); ok {
+                current = function.Name
+                if dead != nil {
+                    removed = append(removed, *dead)
+                    dead = nil
+                }
+                if !reached[current] {
+                    dead = &RemovedFunction{Name: current, File: file.Path}
+                }
+            }
+
+            if reached[current] {
+                kept = append(kept, line)
+            } else if command, ok := line.Command.(asmCommand); ok {
+                dead.Instructions += instructionCount(command.TranslateToAssembly(&scratch))
+            }
+        }
+
+        if dead != nil {
+            removed = append(removed, *dead)
+        }
+
+        file.Lines = kept
+    }
+
+    return removed
+}
+
+func writeDeadFunctionReport(output io.Writer, removed []RemovedFunction) {
+    sorted := append([]RemovedFunction(nil), removed...)
+    sort.SliceStable(sorted, func (a, b int) bool {
+        return sorted[a].Instructions > sorted[b].Instructions
+    })
+
+    total := 0
+    for _, function := range sorted {
+        total += function.Instructions
+    }
+
+    fmt.Fprintf(output, "Removed %v unreachable functions, saving %v instructions of ROM\n", len(sorted), total)
+    for _, function := range sorted {
+        fmt.Fprintf(output, "  %-40v %6v  %v\n", function.Name, function.Instructions, function.File)
+    }
+}
@@ -0,0 +1,88 @@
+package vm
+
+import (
+    "testing"
+)
+
+/* a file made of the given commands */
+func commandsFile(path string, class string, commands ...Command) *VMFile {
+    file := &VMFile{Path: path, Class: class}
+    for i, command := range commands {
+        file.Lines = append(file.Lines, VMLine{Command: command, Line: uint64(i + 1)})
+    }
+    return file
+}
+
+/* the names of the functions left in a program */
+func programFunctions(program *VMProgram) []string {
+    var names []string
+    for _, file := range program.Files {
+        for _, line := range file.Lines {
+            if function, ok := line.Command.(*Function); ok {
+                names = append(names, function.Name)
+            }
+        }
+    }
+    return names
+}
+
+func TestEliminateDeadFunctions(test *testing.T){
+    program := &VMProgram{Files: []*VMFile{
+        commandsFile("Sys.vm", "Sys",
+            &Function{Name: "Sys.init"},
+            &Call{Name: "Main.main", Arguments: 0},
+            &Return{},
+        ),
+        commandsFile("Main.vm", "Main",
+            &Function{Name: "Main.main"},
+            &Call{Name: "Main.main", Arguments: 0},
+            &Return{},
+            &Function{Name: "Main.unused"},
+            &Call{Name: "Main.alsoUnused", Arguments: 0},
+            &Return{},
+            &Function{Name: "Main.alsoUnused"},
+            &PushConstant{Constant: 1},
+            &Return{},
+        ),
+    }}
+
+    removed := program.EliminateDeadFunctions(entryRoots(program, DefaultBootstrapOptions()))
+    if len(removed) != 2 || removed[0].Name != "Main.unused" || removed[1].Name != "Main.alsoUnused" {
+        test.Fatalf("unexpected functions removed: %+v", removed)
+    }
+    for _, function := range removed {
+        if function.File != "Main.vm" || function.Instructions == 0 {
+            test.Errorf("wrong report for %v: %+v", function.Name, function)
+        }
+    }
+
+    kept := programFunctions(program)
+    if len(kept) != 2 || kept[0] != "Sys.init" || kept[1] != "Main.main" {
+        test.Errorf("unexpected functions kept: %v", kept)
+    }
+}
+
+/* code before the first function is kept along with everything it calls, and
+ * without an entry point the first function is the root
+ */
+func TestEliminateDeadFunctionsTopLevel(test *testing.T){
+    program := &VMProgram{Files: []*VMFile{
+        commandsFile("Test.vm", "Test",
+            &Call{Name: "Test.called", Arguments: 0},
+            &Function{Name: "Test.first"},
+            &Return{},
+            &Function{Name: "Test.called"},
+            &Return{},
+            &Function{Name: "Test.unused"},
+            &Return{},
+        ),
+    }}
+
+    removed := program.EliminateDeadFunctions(entryRoots(program, DefaultBootstrapOptions()))
+    if len(removed) != 1 || removed[0].Name != "Test.unused" {
+        test.Fatalf("unexpected functions removed: %+v", removed)
+    }
+    if len(program.Files[0].Lines) != 5 {
+        test.Errorf("the top level call was not kept")
+    }
+}
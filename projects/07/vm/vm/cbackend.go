@@ -0,0 +1,444 @@
+package vm
+
+import (
+    "io"
+    "fmt"
+    "strings"
+)
+
+/* Translation of vm commands to portable C. The whole program becomes one big
+ * function where each vm function is a label. RAM is modelled exactly as on the
+ * hack platform, a 32K array of 16-bit words, so the stack, the segment pointers
+ * and the heap all live in the same places they would on the real hardware.
+ *
+ * A call pushes a small integer identifying its return point instead of a ROM
+ * address, and return jumps back through a switch on that integer.
+ */
+
+/* the commands the c backend can translate */
+type cCommand interface {
+    TranslateToC(*cTranslator) []string
+}
+
+/* the state of the c backend: where the statics live, the number of return
+ * points created so far and whether any return needs the dispatch switch
+ */
+type cTranslator struct {
+    Translator
+    statics staticTable
+    returns int
+    dispatch bool
+}
+
+/* makes a vm name safe to use as part of a C identifier. every character that
+ * is not a letter or digit is escaped so that distinct names stay distinct.
+ */
+func mangleC(name string) string {
+    var out strings.Builder
+    for _, c := range []byte(name) {
+        if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+            out.WriteByte(c)
+        } else {
+            fmt.Fprintf(&out, "_%02x", c)
+        }
+    }
+    return out.String()
+}
+
+func cFunctionLabel(name string) string {
+    return fmt.Sprintf("F_%v", mangleC(name))
+}
+
+/* vm labels are local to the function they appear in */
+func cLabel(translator *cTranslator, name string) string {
+    return fmt.Sprintf("L_%v_%v", mangleC(translator.CurrentFunction), mangleC(name))
+}
+
+func cPushSegment(segment string, index int) []string {
+    return []string{fmt.Sprintf("PUSH(M(%v + %v));", segment, index)}
+}
+
+func cPopSegment(segment string, index int) []string {
+    /* compute the address first, the same way the assembly does */
+    return []string{fmt.Sprintf("{ int16_t address = W(%v + %v); M(address) = POP(); }", segment, index)}
+}
+
+func cBinary(operation string) []string {
+    return []string{fmt.Sprintf("{ int16_t y = POP(); int16_t x = POP(); PUSH(%v); }", operation)}
+}
+
+func (constant *PushConstant) TranslateToC(translator *cTranslator) []string {
+    return []string{fmt.Sprintf("PUSH(%v);", constant.Constant)}
+}
+
+func (add *Add) TranslateToC(translator *cTranslator) []string {
+    return cBinary("x + y")
+}
+
+func (sub *Sub) TranslateToC(translator *cTranslator) []string {
+    return cBinary("x - y")
+}
+
+func (lt *Lt) TranslateToC(translator *cTranslator) []string {
+    return cBinary("x < y ? -1 : 0")
+}
+
+func (eq *Eq) TranslateToC(translator *cTranslator) []string {
+    return cBinary("x == y ? -1 : 0")
+}
+
+func (gt *Gt) TranslateToC(translator *cTranslator) []string {
+    return cBinary("x > y ? -1 : 0")
+}
+
+func (and *And) TranslateToC(translator *cTranslator) []string {
+    return cBinary("x & y")
+}
+
+func (or *Or) TranslateToC(translator *cTranslator) []string {
+    return cBinary("x | y")
+}
+
+func (neg *Neg) TranslateToC(translator *cTranslator) []string {
+    return []string{"{ int16_t x = POP(); PUSH(-x); }"}
+}
+
+func (not *Not) TranslateToC(translator *cTranslator) []string {
+    return []string{"{ int16_t x = POP(); PUSH(~x); }"}
+}
+
+func (local *PopLocal) TranslateToC(translator *cTranslator) []string {
+    return cPopSegment("LCL", local.Index)
+}
+
+func (argument *PopArgument) TranslateToC(translator *cTranslator) []string {
+    return cPopSegment("ARG", argument.Index)
+}
+
+func (this *PopThis) TranslateToC(translator *cTranslator) []string {
+    return cPopSegment("THIS", this.Index)
+}
+
+func (that *PopThat) TranslateToC(translator *cTranslator) []string {
+    return cPopSegment("THAT", that.Index)
+}
+
+func (temp *PopTemp) TranslateToC(translator *cTranslator) []string {
+    return []string{fmt.Sprintf("M(%v) = POP();", TempStart + temp.Index)}
+}
+
+func (pointer *PopPointer) TranslateToC(translator *cTranslator) []string {
+    return []string{fmt.Sprintf("M(%v) = POP();", PointerStart + pointer.Index)}
+}
+
+func (static *PopStatic) TranslateToC(translator *cTranslator) []string {
+    return []string{fmt.Sprintf("M(%v) = POP();", translator.statics.address(translator.CurrentFile, static.Index))}
+}
+
+func (local *PushLocal) TranslateToC(translator *cTranslator) []string {
+    return cPushSegment("LCL", local.Index)
+}
+
+func (argument *PushArgument) TranslateToC(translator *cTranslator) []string {
+    return cPushSegment("ARG", argument.Index)
+}
+
+func (this *PushThis) TranslateToC(translator *cTranslator) []string {
+    return cPushSegment("THIS", this.Index)
+}
+
+func (that *PushThat) TranslateToC(translator *cTranslator) []string {
+    return cPushSegment("THAT", that.Index)
+}
+
+func (temp *PushTemp) TranslateToC(translator *cTranslator) []string {
+    return []string{fmt.Sprintf("PUSH(M(%v));", TempStart + temp.Index)}
+}
+
+func (pointer *PushPointer) TranslateToC(translator *cTranslator) []string {
+    return []string{fmt.Sprintf("PUSH(M(%v));", PointerStart + pointer.Index)}
+}
+
+func (static *PushStatic) TranslateToC(translator *cTranslator) []string {
+    return []string{fmt.Sprintf("PUSH(M(%v));", translator.statics.address(translator.CurrentFile, static.Index))}
+}
+
+func (label *Label) TranslateToC(translator *cTranslator) []string {
+    return []string{fmt.Sprintf("%v:;", cLabel(translator, label.Name))}
+}
+
+func (ifgoto *IfGoto) TranslateToC(translator *cTranslator) []string {
+    return []string{
+        "STEP();",
+        fmt.Sprintf("if (POP() != 0) goto %v;", cLabel(translator, ifgoto.Name)),
+    }
+}
+
+func (this *Goto) TranslateToC(translator *cTranslator) []string {
+    return []string{
+        "STEP();",
+        fmt.Sprintf("goto %v;", cLabel(translator, this.Name)),
+    }
+}
+
+func (function *Function) TranslateToC(translator *cTranslator) []string {
+    translator.CurrentFunction = function.Name
+
+    out := []string{fmt.Sprintf("%v:;", cFunctionLabel(function.Name))}
+
+    /* the os never returns from Sys.halt, so treat entering it as the end of
+     * the program
+     */
+    if function.Name == "Sys.halt" {
+        out = append(out, "return 0;")
+    }
+
+    for i := 0; i < function.Locals; i++ {
+        out = append(out, "PUSH(0);")
+    }
+
+    return out
+}
+
+func (ret *Return) TranslateToC(translator *cTranslator) []string {
+    translator.dispatch = true
+    return []string{
+        "{",
+        "    int16_t frame = LCL;",
+        "    pc = (uint16_t) M(frame - 5);",
+        "    M(ARG) = POP();",
+        "    SP = W(ARG + 1);",
+        "    THAT = M(frame - 1);",
+        "    THIS = M(frame - 2);",
+        "    ARG = M(frame - 3);",
+        "    LCL = M(frame - 4);",
+        "    goto dispatch;",
+        "}",
+    }
+}
+
+func (call *Call) TranslateToC(translator *cTranslator) []string {
+    id := translator.returns
+    translator.returns += 1
+
+    return []string{
+        "STEP();",
+        fmt.Sprintf("PUSH(%v);", id),
+        "PUSH(LCL);",
+        "PUSH(ARG);",
+        "PUSH(THIS);",
+        "PUSH(THAT);",
+        fmt.Sprintf("ARG = W(SP - %v - 5);", call.Arguments),
+        "LCL = SP;",
+        fmt.Sprintf("goto %v;", cFunctionLabel(call.Name)),
+        fmt.Sprintf("R_%v:;", id),
+    }
+}
+
+const cPrelude = `/* generated by the nand2tetris vm translator */
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+static int16_t ram[32768];
+static long long steps;
+static long long limit;
+
+#define M(address) ram[(uint16_t) (address) & 0x7fff]
+#define W(value) ((int16_t) (uint16_t) (value))
+#define SP ram[0]
+#define LCL ram[1]
+#define ARG ram[2]
+#define THIS ram[3]
+#define THAT ram[4]
+#define PUSH(value) do { int16_t pushed = W(value); M(SP) = pushed; SP = W(SP + 1); } while (0)
+#define POP() (SP = W(SP - 1), M(SP))
+/* gives up once the step limit is reached, so that programs which never halt
+ * can still be run headless
+ */
+#define STEP() do { steps += 1; if (limit > 0 && steps > limit) return 2; } while (0)
+
+#define SCREEN 16384
+#define SCREEN_WIDTH 512
+#define SCREEN_HEIGHT 256
+
+`
+
+const cMain = `
+/* writes the screen memory map as a binary PBM image */
+static int dump_screen(const char * path){
+    FILE * out = fopen(path, "wb");
+    int y, x;
+    if (out == NULL){
+        perror(path);
+        return 1;
+    }
+
+    fprintf(out, "P4\n%d %d\n", SCREEN_WIDTH, SCREEN_HEIGHT);
+    for (y = 0; y < SCREEN_HEIGHT; y++){
+        for (x = 0; x < SCREEN_WIDTH; x += 8){
+            unsigned char byte = 0;
+            int bit;
+            for (bit = 0; bit < 8; bit++){
+                int pixel = x + bit;
+                uint16_t word = (uint16_t) ram[SCREEN + y * 32 + pixel / 16];
+                if (word & (1 << (pixel % 16))){
+                    byte |= 0x80 >> bit;
+                }
+            }
+            fputc(byte, out);
+        }
+    }
+
+    fclose(out);
+    return 0;
+}
+
+/* writes every non-zero RAM location as 'address value' */
+static int dump_ram(const char * path){
+    FILE * out = fopen(path, "w");
+    int i;
+    if (out == NULL){
+        perror(path);
+        return 1;
+    }
+
+    for (i = 0; i < 32768; i++){
+        if (ram[i] != 0){
+            fprintf(out, "%d %d\n", i, ram[i]);
+        }
+    }
+
+    fclose(out);
+    return 0;
+}
+
+int main(int argc, char ** argv){
+    const char * screen = NULL;
+    const char * dump = NULL;
+    int i, result;
+
+    for (i = 1; i < argc; i++){
+        if (strcmp(argv[i], "-steps") == 0 && i + 1 < argc){
+            limit = atoll(argv[++i]);
+        } else if (strcmp(argv[i], "-screen") == 0 && i + 1 < argc){
+            screen = argv[++i];
+        } else if (strcmp(argv[i], "-ram") == 0 && i + 1 < argc){
+            dump = argv[++i];
+        } else {
+            fprintf(stderr, "usage: %s [-steps n] [-screen out.pbm] [-ram out.txt]\n", argv[0]);
+            return 1;
+        }
+    }
+
+    result = run();
+    if (result == 1){
+        fprintf(stderr, "bad return address\n");
+    } else if (result == 2){
+        fprintf(stderr, "step limit reached after %lld steps\n", steps);
+    }
+
+    if (screen != NULL && dump_screen(screen) != 0){
+        return 1;
+    }
+
+    if (dump != NULL && dump_ram(dump) != 0){
+        return 1;
+    }
+
+    return result;
+}
+`
+
+func writeCLines(output io.Writer, lines []string) {
+    for _, line := range lines {
+        io.WriteString(output, "    ")
+        io.WriteString(output, line)
+        output.Write([]byte{'\n'})
+    }
+}
+
+/* the C version of the bootstrap code, see writeBootstrapCode */
+func writeCBootstrap(output io.Writer, program *VMProgram, options BootstrapOptions, translator *cTranslator) error {
+    if !options.Enabled {
+        return nil
+    }
+
+    pointers, callEntry, err := planBootstrap(program, options)
+    if err != nil {
+        return err
+    }
+
+    for _, pointer := range pointers {
+        writeCLines(output, []string{fmt.Sprintf("%v = %v;", pointer.Name, pointer.Value)})
+    }
+
+    if callEntry {
+        translator.CurrentFunction = options.EntryPoint
+        call := Call{Name: options.EntryPoint}
+        writeCLines(output, call.TranslateToC(translator))
+        /* the entry point returned, so the program is done */
+        writeCLines(output, []string{"return 0;"})
+    }
+
+    return nil
+}
+
+/* Writes the whole program as a single C file that can be compiled with any C
+ * compiler. The resulting executable accepts -steps to bound execution,
+ * -screen to dump the screen as a PBM image and -ram to dump RAM on exit.
+ */
+func translateToC(output io.Writer, program *VMProgram, options BootstrapOptions) error {
+    var translator cTranslator
+    var body strings.Builder
+
+    err := writeCBootstrap(&body, program, options, &translator)
+    if err != nil {
+        return err
+    }
+
+    for _, vmFile := range program.Files {
+        translator.CurrentFile = vmFile.Class
+        fmt.Fprintf(&body, "    /* %v */\n", vmFile.Path)
+        for _, line := range vmFile.Lines {
+            command, ok := line.Command.(cCommand)
+            if !ok {
+                return unsupportedCommand(vmFile, line, "c")
+            }
+            fmt.Fprintf(&body, "    /* %v */\n", strings.ReplaceAll(strings.TrimSpace(line.Text), "*/", "* /"))
+            writeCLines(&body, command.TranslateToC(&translator))
+        }
+    }
+
+    /* a return id is saved on the stack, so it has to fit in a word */
+    if translator.returns > 1 << 16 {
+        return fmt.Errorf("The program has %v calls, but there are only %v return ids", translator.returns, 1 << 16)
+    }
+
+    io.WriteString(output, cPrelude)
+
+    io.WriteString(output, "static int run(void){\n")
+
+    /* every return point is known once all the calls have been translated */
+    if translator.dispatch {
+        io.WriteString(output, "    int pc = 0;\n")
+        io.WriteString(output, "    goto start;\n")
+        io.WriteString(output, "dispatch:\n")
+        io.WriteString(output, "    switch (pc){\n")
+        for id := 0; id < translator.returns; id++ {
+            fmt.Fprintf(output, "        case %v: goto R_%v;\n", id, id)
+        }
+        io.WriteString(output, "        default: return 1;\n")
+        io.WriteString(output, "    }\n")
+        io.WriteString(output, "start:\n")
+    }
+
+    io.WriteString(output, body.String())
+    io.WriteString(output, "    return 0;\n")
+    io.WriteString(output, "}\n")
+
+    io.WriteString(output, cMain)
+
+    return nil
+}
@@ -0,0 +1,181 @@
+package vm
+
+import (
+    "testing"
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+)
+
+/* sums 1..n in a loop, and calls it from two places so the return has to go
+ * through the dispatch switch
+ */
+func sumProgram() *VMProgram {
+    return &VMProgram{Files: []*VMFile{
+        commandsFile("Sys.vm", "Sys",
+            &Function{Name: "Sys.init"},
+            &PushConstant{Constant: 10},
+            &Call{Name: "Main.sum", Arguments: 1},
+            &PopTemp{Index: 0},
+            &PushConstant{Constant: 100},
+            &Call{Name: "Main.sum", Arguments: 1},
+            &PopStatic{Index: 0},
+            &PushConstant{Constant: 3},
+            &PushConstant{Constant: 5},
+            &Lt{},
+            &PopTemp{Index: 1},
+            &PushConstant{Constant: 0},
+            &Return{},
+        ),
+        commandsFile("Main.vm", "Main",
+            &Function{Name: "Main.sum", Locals: 1},
+            &Label{Name: "LOOP"},
+            &PushArgument{Index: 0},
+            &PushConstant{Constant: 0},
+            &Eq{},
+            &IfGoto{Name: "END"},
+            &PushLocal{Index: 0},
+            &PushArgument{Index: 0},
+            &Add{},
+            &PopLocal{Index: 0},
+            &PushArgument{Index: 0},
+            &PushConstant{Constant: 1},
+            &Sub{},
+            &PopArgument{Index: 0},
+            &Goto{Name: "LOOP"},
+            &Label{Name: "END"},
+            &PushLocal{Index: 0},
+            &Return{},
+        ),
+    }}
+}
+
+/* builds a translation of a program with cc, runs it and returns the RAM it
+ * left behind. name is the source file the translation is written to, which
+ * tells cc what language it is in.
+ */
+func runNative(test *testing.T, name string, translate func(io.Writer, *VMProgram, BootstrapOptions) error, program *VMProgram, options BootstrapOptions) map[int]int {
+    compiler, err := exec.LookPath("cc")
+    if err != nil {
+        test.Skip("no C compiler")
+    }
+
+    directory, err := ioutil.TempDir("", "vm")
+    if err != nil {
+        test.Fatalf("could not make a directory: %v", err)
+    }
+    defer os.RemoveAll(directory)
+
+    source := filepath.Join(directory, name)
+    output, err := os.Create(source)
+    if err != nil {
+        test.Fatalf("could not create %v: %v", source, err)
+    }
+    err = translate(output, program, options)
+    output.Close()
+    if err != nil {
+        test.Fatalf("could not translate: %v", err)
+    }
+
+    binary := filepath.Join(directory, "program")
+    out, err := exec.Command(compiler, "-o", binary, source).CombinedOutput()
+    if err != nil {
+        test.Fatalf("could not compile: %v\n%s", err, out)
+    }
+
+    dump := filepath.Join(directory, "ram.txt")
+    out, err = exec.Command(binary, "-steps", "1000000", "-ram", dump).CombinedOutput()
+    if err != nil {
+        test.Fatalf("the program failed: %v\n%s", err, out)
+    }
+
+    file, err := os.Open(dump)
+    if err != nil {
+        test.Fatalf("no ram dump: %v", err)
+    }
+    defer file.Close()
+
+    ram := make(map[int]int)
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        var address, value int
+        _, err := fmt.Sscanf(scanner.Text(), "%d %d", &address, &value)
+        if err != nil {
+            test.Fatalf("bad ram dump line '%v'", scanner.Text())
+        }
+        ram[address] = value
+    }
+
+    return ram
+}
+
+/* compiles the C translation of a program and runs it */
+func runC(test *testing.T, program *VMProgram, options BootstrapOptions) map[int]int {
+    return runNative(test, "program.c", translateToC, program, options)
+}
+
+func TestCBackend(test *testing.T){
+    ram := runC(test, sumProgram(), DefaultBootstrapOptions())
+
+    expected := map[int]int{
+        TempStart: 55,
+        TempStart + 1: -1,
+        StaticStart: 5050,
+    }
+    for address, value := range expected {
+        if ram[address] != value {
+            test.Errorf("RAM[%v] is %v instead of %v", address, ram[address], value)
+        }
+    }
+}
+
+/* a program that calls Main.count the given number of times, each call from
+ * its own place
+ */
+func manyCallsProgram(calls int) *VMProgram {
+    commands := []Command{&Function{Name: "Sys.init"}}
+    for i := 0; i < calls; i++ {
+        commands = append(commands, &Call{Name: "Main.count", Arguments: 0}, &PopTemp{Index: 0})
+    }
+    commands = append(commands, &PushConstant{Constant: 0}, &Return{})
+
+    return &VMProgram{Files: []*VMFile{
+        commandsFile("Sys.vm", "Sys", commands...),
+        commandsFile("Main.vm", "Main",
+            &Function{Name: "Main.count"},
+            &PushStatic{Index: 0},
+            &PushConstant{Constant: 1},
+            &Add{},
+            &PopStatic{Index: 0},
+            &PushConstant{Constant: 0},
+            &Return{},
+        ),
+    }}
+}
+
+/* return ids past 32767 do not fit in an int16_t, so the id is read back
+ * from the stack as an unsigned word. cc takes minutes to compile that many
+ * calls, so this only looks at the translation.
+ */
+func TestCManyReturns(test *testing.T){
+    var output strings.Builder
+    err := translateToC(&output, manyCallsProgram(40000), DefaultBootstrapOptions())
+    if err != nil {
+        test.Fatalf("could not translate: %v", err)
+    }
+    for _, expected := range []string{"int pc = 0;", "pc = (uint16_t) M(frame - 5);", "case 39999: goto R_39999;"} {
+        if !strings.Contains(output.String(), expected) {
+            test.Errorf("the translation has no '%v'", expected)
+        }
+    }
+
+    err = translateToC(ioutil.Discard, manyCallsProgram(1 << 16 + 1), DefaultBootstrapOptions())
+    if err == nil {
+        test.Errorf("more return ids than a word holds were accepted")
+    }
+}
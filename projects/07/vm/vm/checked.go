@@ -0,0 +1,156 @@
+package vm
+
+import (
+    "io"
+    "fmt"
+    "sort"
+)
+
+/* Checked translation. Before every push, call and function entry the
+ * translator emits a test of SP against the stack limit. If the stack would
+ * grow past the limit the program jumps to a trap routine, which stores an
+ * error code and the id of the function that was running in the two words just
+ * below the stack limit, and then halts. The stack is checked against the
+ * address of the trap block rather than the limit, so ordinary code never
+ * writes there and a test script can tell a trap from a normal halt by looking
+ * for a non-zero error code.
+ *
+ * Function ids are given in the order the functions are defined, starting at
+ * 1. Id 0 is code outside of any function. The trap routines list
+ * the ids with their function names in the generated assembly.
+ */
+
+/* the first address of the stack on the hack platform */
+const StackStart = 256
+
+/* the first address past the stack on the hack platform, where the heap starts */
+const DefaultStackLimit = 2048
+
+/* where the trap routine leaves its results, counted down from the stack
+ * limit
+ */
+const TrapCodeOffset = 2
+const TrapFunctionOffset = 1
+const TrapSize = 2
+
+/* error codes stored in TrapCode */
+const TrapStackOverflow = 1
+
+/* numbers the functions in the order they are defined */
+func (program *VMProgram) FunctionIDs() map[string]int {
+    ids := make(map[string]int)
+    for _, file := range program.Files {
+        for _, line := range file.Lines {
+            if function, ok := line.Command.(*Function); ok {
+                if _, ok := ids[function.Name]; !ok {
+                    ids[function.Name] = len(ids) + 1
+                }
+            }
+        }
+    }
+
+    return ids
+}
+
+/* code outside of any function, or in a function the ids were not assigned
+ * for, gets id 0
+ */
+func functionID(translator *asmTranslator, name string) int {
+    return translator.functionIDs[name]
+}
+
+func overflowLabel(id int) string {
+    return fmt.Sprintf("__vm_overflow_%v", id)
+}
+
+/* number of stack slots a command pushes before it could pop anything. the
+ * locals pushed on function entry are checked by the function itself, after
+ * its label.
+ */
+func stackGrowth(command Command) int {
+    switch command.(type) {
+        case *PushConstant, *PushLocal, *PushArgument, *PushThis, *PushThat,
+             *PushTemp, *PushPointer, *PushStatic:
+            return 1
+        case *Call:
+            /* return address, lcl, arg, this and that */
+            return 5
+    }
+
+    /* a tail call reuses the current frame, so it never ends up above the
+     * current SP
+     */
+    return 0
+}
+
+/* jumps to the trap if pushing 'growth' more values would run past the limit */
+func stackCheck(translator *asmTranslator, growth int) []string {
+    if !translator.CheckStack || growth == 0 {
+        return nil
+    }
+
+    id := functionID(translator, translator.CurrentFunction)
+    if translator.trapStubs == nil {
+        translator.trapStubs = make(map[int]bool)
+    }
+    translator.trapStubs[id] = true
+
+    return []string{
+        "@SP",
+        "D=M",
+        fmt.Sprintf("@%v", translator.StackLimit - growth),
+        "D=D-A",
+        fmt.Sprintf("@%v", overflowLabel(id)),
+        "D; JGT",
+    }
+}
+
+/* one small entry per function that loads its id and jumps to the shared trap */
+func writeTrapRoutines(output io.Writer, translator *asmTranslator) {
+    if len(translator.trapStubs) == 0 {
+        return
+    }
+
+    names := make(map[int]string)
+    for name, id := range translator.functionIDs {
+        names[id] = name
+    }
+
+    var ids []int
+    for id := range translator.trapStubs {
+        ids = append(ids, id)
+    }
+    sort.Ints(ids)
+
+    var out []string
+    for _, id := range ids {
+        name, ok := names[id]
+        if !ok {
+            name = "<top level>"
+        }
+
+        out = append(out,
+            fmt.Sprintf("// function id %v: %v", id, name),
+            fmt.Sprintf("(%v)", overflowLabel(id)),
+            fmt.Sprintf("@%v", id),
+            "D=A",
+            "@__vm_stack_overflow",
+            "0; JMP")
+    }
+
+    out = append(out,
+        "(__vm_stack_overflow)",
+        fmt.Sprintf("@%v", translator.trapLimit - TrapFunctionOffset),
+        "M=D",
+        fmt.Sprintf("@%v", TrapStackOverflow),
+        "D=A",
+        fmt.Sprintf("@%v", translator.trapLimit - TrapCodeOffset),
+        "M=D",
+        "@__vm_halt",
+        "0; JMP")
+
+    for _, line := range out {
+        io.WriteString(output, line)
+        output.Write([]byte{'\n'})
+    }
+}
@@ -0,0 +1,56 @@
+package vm
+
+import (
+    "testing"
+)
+
+/* recurses forever, so it can only stop by trapping */
+const recurseSource = `
+function Sys.init 0
+push constant 1
+call Sys.recurse 1
+label END
+goto END
+function Sys.recurse 0
+push argument 0
+call Sys.recurse 1
+return
+`
+
+func checkedOptions(limit int) TranslateOptions {
+    options := hackOptions()
+    options.CheckStack = true
+    options.StackLimit = limit
+    return options
+}
+
+func TestStackTrap(test *testing.T){
+    for _, cache := range []bool{false, true} {
+        options := checkedOptions(400)
+        options.CacheTop = cache
+        machine := runHack(test, translateSource(test, recurseSource, options))
+
+        code := machine.RAM[options.StackLimit - TrapCodeOffset]
+        function := machine.RAM[options.StackLimit - TrapFunctionOffset]
+        if code != TrapStackOverflow || function != 2 {
+            test.Errorf("cache %v: expected error %v in function 2 but got error %v in function %v", cache, TrapStackOverflow, code, function)
+        }
+
+        /* the check stops the stack below the trap block */
+        if int(machine.RAM[0]) > options.StackLimit - TrapSize {
+            test.Errorf("cache %v: the stack went into the trap block, SP is %v", cache, machine.RAM[0])
+        }
+    }
+}
+
+func TestNoTrap(test *testing.T){
+    options := checkedOptions(DefaultStackLimit)
+    machine := runHack(test, translateSource(test, everyCommandSource, options))
+
+    if machine.RAM[options.StackLimit - TrapCodeOffset] != 0 {
+        test.Fatalf("a program that does not overflow trapped with %v", machine.RAM[options.StackLimit - TrapCodeOffset])
+    }
+    if machine.RAM[TempStart] != 1 {
+        test.Errorf("checking the stack changed the result to %v", machine.RAM[TempStart])
+    }
+}
@@ -0,0 +1,614 @@
+package vm
+
+import (
+    "fmt"
+    "io/ioutil"
+    "sort"
+    "strings"
+
+    "github.com/kazzmir/nand2tetris/assembler"
+)
+
+/* Differential testing of the hack translation against the vm interpreter.
+ *
+ * The program runs in the interpreter and, translated to machine code, on a
+ * hack CPU. The two are kept in step one vm command at a time with the source
+ * map: after the interpreter runs a command the CPU runs until it reaches the
+ * code of the command the interpreter runs next. The addresses written by
+ * either side are compared after every command, the RAM below SP after every
+ * return and all of RAM once the program halts.
+ *
+ * R13-R15, the variables of the shared routines and the return addresses saved
+ * by calls are never compared, since the translation is free to use them as it
+ * likes.
+ *
+ * Inlining, tail calls and caching the top of the stack change the code so that
+ * it no longer follows the commands one at a time. With any of them only the
+ * end is compared: both sides run until they halt, and then RAM is compared
+ * except for the stack above SP, where the frames of finished calls are left
+ * behind, and the temp slots the inlined bodies are allowed to use. Statics
+ * are compared by name since inlining can change the order the assembler
+ * gives them addresses in.
+ */
+
+type DiffOptions struct {
+    /* how the program is translated, SourceMap is always turned on */
+    Translate TranslateOptions
+    /* stop after this many vm commands, 0 for no limit */
+    MaxCommands uint64
+    /* the most hack instructions a single vm command may take */
+    MaxInstructions uint64
+}
+
+func DefaultDiffOptions() DiffOptions {
+    return DiffOptions{
+        Translate: TranslateOptions{
+            Bootstrap: DefaultBootstrapOptions(),
+            StackLimit: DefaultStackLimit,
+        },
+        MaxCommands: 10000000,
+        MaxInstructions: 100000,
+    }
+}
+
+/* where the interpreter and the translation first disagreed */
+type Divergence struct {
+    /* the vm command that ran last, nil if the bootstrap code was running */
+    Instruction *Instruction
+    /* set when control flow went wrong rather than RAM */
+    Message string
+    Address int
+    /* what the address is, such as 'temp 2' or 'static Main.0' */
+    Name string
+    VMValue int16
+    HackValue int16
+    /* the ROM address of the instruction that last wrote Address, -1 if none */
+    Writer int
+    /* the assembly of the writer and the vm command it came from */
+    WriterText string
+    WriterSource string
+}
+
+func (divergence *Divergence) String() string {
+    var out strings.Builder
+    if divergence.Instruction == nil {
+        out.WriteString("in the bootstrap code\n")
+    } else {
+        instruction := divergence.Instruction
+        function := instruction.Function
+        if function == TopLevelFunction {
+            function = "<top level>"
+        }
+        fmt.Fprintf(&out, "%v: '%v' in %v\n", instruction.Position(), strings.TrimSpace(instruction.Text), function)
+    }
+
+    if divergence.Message != "" {
+        fmt.Fprintf(&out, "  %v\n", divergence.Message)
+        return out.String()
+    }
+
+    fmt.Fprintf(&out, "  %v is %v in the interpreter but %v in the assembly\n", divergence.Name, divergence.VMValue, divergence.HackValue)
+    if divergence.Writer == -1 {
+        out.WriteString("  the assembly never wrote it\n")
+    } else {
+        fmt.Fprintf(&out, "  last written by ROM[%v] '%v' from %v\n", divergence.Writer, divergence.WriterText, divergence.WriterSource)
+    }
+
+    return out.String()
+}
+
+type DiffResult struct {
+    /* vm commands and hack instructions run */
+    Commands uint64
+    Instructions uint64
+    Returns int
+    /* false if MaxCommands ran out first */
+    Halted bool
+    /* nil if the two agreed the whole way */
+    Divergence *Divergence
+}
+
+/* the two sides of a differential run and what is known about the code */
+type differential struct {
+    machine *Machine
+    cpu *HackCPU
+    entries []SourceMapEntry
+    /* the commands the entries were translated from */
+    code []Instruction
+    /* the text of every instruction in the ROM */
+    instructions []string
+    /* addresses that are not compared */
+    ignored map[int]bool
+    /* addresses holding a return address saved by a call */
+    returnSlots map[int]bool
+    /* the ROM address of the instruction that last wrote each RAM address */
+    writers map[int]int
+}
+
+/* the text of every instruction, leaving out labels and comments */
+func assemblyInstructions(assembly []byte) []string {
+    var out []string
+    for _, line := range strings.Split(string(assembly), "\n") {
+        code := line
+        if comment := strings.Index(code, "//"); comment != -1 {
+            code = code[:comment]
+        }
+        code = strings.TrimSpace(code)
+        if code == "" || strings.HasPrefix(code, "(") {
+            continue
+        }
+        out = append(out, code)
+    }
+    return out
+}
+
+/* the RAM addresses of the variables used by the shared routines */
+func routineVariables(assembly []byte, program *assembler.ParsedProgram) []int {
+    labels := make(map[string]bool)
+    for _, line := range strings.Split(string(assembly), "\n") {
+        line = strings.TrimSpace(line)
+        if strings.HasPrefix(line, "(") && strings.HasSuffix(line, ")") {
+            labels[line[1:len(line) - 1]] = true
+        }
+    }
+
+    var out []int
+    for _, code := range program.Code {
+        memory, ok := code.(*assembler.ParsedMemoryReference)
+        if ok && strings.HasPrefix(memory.LabelReference, "__vm_") && !labels[memory.LabelReference] {
+            out = append(out, int(memory.Constant))
+        }
+    }
+
+    return out
+}
+
+/* the ROM address the code of the command at pc starts at. The end of the
+ * code is where running off the last command goes
+ */
+func (diff *differential) romStart(pc int) int {
+    if pc < len(diff.entries) {
+        return diff.entries[pc].RomStart
+    }
+    if len(diff.entries) == 0 {
+        return 0
+    }
+    return diff.entries[len(diff.entries) - 1].RomEnd
+}
+
+/* the vm command whose code contains a ROM address */
+func (diff *differential) source(rom int) string {
+    index := sort.Search(len(diff.entries), func (i int) bool {
+        return diff.entries[i].RomEnd > rom
+    })
+    if index < len(diff.entries) && diff.entries[index].RomStart <= rom {
+        instruction := &diff.code[index]
+        return fmt.Sprintf("%v '%v'", instruction.Position(), strings.TrimSpace(instruction.Text))
+    }
+    return "code that is not part of any vm command"
+}
+
+/* describes a RAM address in terms of the vm */
+func (diff *differential) name(address int) string {
+    machine := diff.machine
+    switch {
+        case address < 5:
+            return []string{"SP", "LCL", "ARG", "THIS", "THAT"}[address]
+        case address >= TempStart && address < TempStart + TempSize:
+            return fmt.Sprintf("temp %v (RAM[%v])", address - TempStart, address)
+    }
+
+    for class, slots := range machine.statics {
+        for _, slot := range slots {
+            if slot.Address == address {
+                return fmt.Sprintf("static %v.%v (RAM[%v])", class, slot.Index, address)
+            }
+        }
+    }
+
+    lcl := int(machine.RAM[1])
+    arg := int(machine.RAM[2])
+    sp := int(machine.RAM[0])
+    switch {
+        case address >= lcl && address < sp:
+            return fmt.Sprintf("RAM[%v], LCL+%v", address, address - lcl)
+        case address >= arg && address < lcl - 5:
+            return fmt.Sprintf("RAM[%v], argument %v", address, address - arg)
+        case address >= StackStart && address < sp:
+            return fmt.Sprintf("RAM[%v] on the stack", address)
+    }
+
+    return fmt.Sprintf("RAM[%v]", address)
+}
+
+/* compares the given addresses, returning the first that differs */
+func (diff *differential) compare(addresses []int) *Divergence {
+    for _, address := range addresses {
+        if diff.ignored[address] || diff.returnSlots[address] {
+            continue
+        }
+
+        if diff.machine.RAM[address] != diff.cpu.RAM[address] {
+            divergence := &Divergence{
+                Address: address,
+                Name: diff.name(address),
+                VMValue: diff.machine.RAM[address],
+                HackValue: diff.cpu.RAM[address],
+                Writer: -1,
+            }
+            if writer, ok := diff.writers[address]; ok {
+                divergence.Writer = writer
+                divergence.WriterText = diff.instructions[writer]
+                divergence.WriterSource = diff.source(writer)
+            }
+            return divergence
+        }
+    }
+
+    return nil
+}
+
+func addressRange(start int, end int) []int {
+    var out []int
+    for address := start; address < end; address++ {
+        out = append(out, address)
+    }
+    return out
+}
+
+/* Runs the cpu until it reaches the ROM address target, returning the
+ * addresses it wrote on the way. With moveFirst at least one instruction runs
+ * even if the cpu is already there.
+ */
+func (diff *differential) runTo(target int, moveFirst bool, limit uint64) ([]int, string) {
+    cpu := diff.cpu
+    var written []int
+    start := cpu.Steps
+    for moveFirst || cpu.PC != target {
+        moveFirst = false
+        if cpu.Halted {
+            return written, fmt.Sprintf("the assembly halted at ROM[%v] instead of reaching ROM[%v]", cpu.PC, target)
+        }
+        if limit > 0 && cpu.Steps - start >= limit {
+            return written, fmt.Sprintf("the assembly did not reach ROM[%v] within %v instructions, it is at ROM[%v] in %v", target, limit, cpu.PC, diff.source(cpu.PC))
+        }
+
+        pc := cpu.PC
+        cpu.Step()
+        if cpu.Written != -1 {
+            written = append(written, cpu.Written)
+            diff.writers[cpu.Written] = pc
+        }
+    }
+
+    return written, ""
+}
+
+/* the commands of a program in the order they are translated in */
+func programInstructions(program *VMProgram) []Instruction {
+    var out []Instruction
+    for _, file := range program.Files {
+        for _, line := range file.Lines {
+            out = append(out, Instruction{
+                Command: line.Command,
+                File: file,
+                Line: line.Line,
+                Text: normalizeWhitespace(line.Text),
+            })
+        }
+    }
+    return out
+}
+
+/* a copy of the program that can be inlined or have its tail calls optimized
+ * without changing the original, which only replace the lines of each file
+ */
+func (program *VMProgram) copyFiles() *VMProgram {
+    var out VMProgram
+    for _, file := range program.Files {
+        copied := *file
+        out.Files = append(out.Files, &copied)
+    }
+    return &out
+}
+
+/* the RAM address the assembler gave each static, by its symbol */
+func staticSymbols(program *assembler.ParsedProgram) map[string]int {
+    out := make(map[string]int)
+    for _, code := range program.Code {
+        memory, ok := code.(*assembler.ParsedMemoryReference)
+        if ok && strings.HasPrefix(memory.LabelReference, "static.") {
+            out[memory.LabelReference] = int(memory.Constant)
+        }
+    }
+    return out
+}
+
+/* Runs a program in the interpreter and as translated hack machine code side
+ * by side, stopping at the first difference. Functions that can never be
+ * called are removed from the program first, as the translator does, so that
+ * larger programs fit in the ROM.
+ */
+func DiffProgram(program *VMProgram, options DiffOptions) (*DiffResult, error) {
+    translate := options.Translate
+    translate.SourceMap = true
+
+    program.EliminateDeadFunctions(entryRoots(program, translate.Bootstrap))
+
+    machine, err := NewMachine(program, translate.Bootstrap)
+    if err != nil {
+        return nil, err
+    }
+
+    lockstep := translate.Inline == 0 && !translate.TailCalls && !translate.CacheTop
+
+    translated := program
+    if !lockstep {
+        translated = program.copyFiles()
+        if translate.Inline > 0 {
+            translated.InlineFunctions(translate.Inline)
+        }
+        if translate.TailCalls {
+            translated.OptimizeTailCalls()
+        }
+    }
+
+    translator, err := translateToHack(ioutil.Discard, translated, translate)
+    if err != nil {
+        return nil, err
+    }
+
+    entries := translator.sourceMap.Entries
+    code := programInstructions(translated)
+    if len(entries) != len(code) {
+        return nil, fmt.Errorf("the source map has %v entries for %v commands", len(entries), len(code))
+    }
+
+    cpu, err := NewHackCPU(translator.machineCode)
+    if err != nil {
+        return nil, err
+    }
+
+    diff := differential{
+        machine: machine,
+        cpu: cpu,
+        entries: entries,
+        code: code,
+        instructions: assemblyInstructions(translator.assembly),
+        ignored: map[int]bool{13: true, 14: true, 15: true},
+        returnSlots: make(map[int]bool),
+        writers: make(map[int]int),
+    }
+
+    for _, address := range routineVariables(translator.assembly, translator.machineCode) {
+        diff.ignored[address] = true
+    }
+
+    /* the profile counters sit between the stack limit and the trap block */
+    if translate.Profile {
+        for i := 0; i < translated.ProfileCounterCount(); i++ {
+            diff.ignored[translator.StackLimit + i] = true
+        }
+    }
+
+    /* the first write of a call saves the return address, which includes the
+     * call the bootstrap makes
+     */
+    if len(machine.Writes) > 0 {
+        diff.returnSlots[machine.Writes[0]] = true
+    }
+
+    if !lockstep {
+        return diff.compareEnd(program, translator, options)
+    }
+
+    result := &DiffResult{}
+    finish := func (divergence *Divergence) (*DiffResult, error) {
+        result.Commands = machine.Steps
+        result.Instructions = cpu.Steps
+        result.Divergence = divergence
+        return result, nil
+    }
+
+    _, message := diff.runTo(diff.romStart(machine.PC), false, options.MaxInstructions)
+    if message != "" {
+        return finish(&Divergence{Message: message})
+    }
+    if divergence := diff.compare(addressRange(0, RAMSize)); divergence != nil {
+        return finish(divergence)
+    }
+
+    var last *Instruction
+    for !machine.Halted {
+        if options.MaxCommands > 0 && machine.Steps >= options.MaxCommands {
+            return finish(nil)
+        }
+
+        index := machine.PC
+        if machine.Current() == nil {
+            /* ran off the end, which the cpu has already reached */
+            machine.Step()
+            break
+        }
+        instruction := &machine.Code[index]
+        last = instruction
+
+        err := machine.Step()
+        if err != nil {
+            return finish(&Divergence{Instruction: instruction, Message: fmt.Sprintf("the interpreter failed: %v", err)})
+        }
+
+        _, isCall := instruction.Command.(*Call)
+        for i, address := range machine.Writes {
+            if isCall && i == 0 {
+                diff.returnSlots[address] = true
+            } else {
+                delete(diff.returnSlots, address)
+            }
+        }
+        vmWrites := append([]int(nil), machine.Writes...)
+
+        _, isReturn := instruction.Command.(*Return)
+        _, isFunction := instruction.Command.(*Function)
+
+        target := diff.romStart(machine.PC)
+        if isReturn && machine.Halted {
+            /* the entry point returned to the end of the bootstrap code */
+            target = diff.romStart(0)
+        }
+
+        var hackWrites []int
+        /* entering Sys.halt halts the interpreter before the function runs */
+        if entries[index].RomEnd > entries[index].RomStart && !(isFunction && machine.Halted) {
+            hackWrites, message = diff.runTo(target, true, options.MaxInstructions)
+            if message != "" {
+                return finish(&Divergence{Instruction: instruction, Message: message})
+            }
+        }
+
+        if divergence := diff.compare(append(vmWrites, hackWrites...)); divergence != nil {
+            divergence.Instruction = instruction
+            return finish(divergence)
+        }
+
+        if isReturn {
+            result.Returns += 1
+            if divergence := diff.compare(addressRange(0, int(machine.RAM[0]))); divergence != nil {
+                divergence.Instruction = instruction
+                return finish(divergence)
+            }
+        }
+
+    }
+
+    result.Halted = true
+    if divergence := diff.compare(addressRange(0, RAMSize)); divergence != nil {
+        divergence.Instruction = last
+        return finish(divergence)
+    }
+    return finish(nil)
+}
+
+/* Runs the interpreter and then the cpu until they halt, and compares the RAM
+ * they end up with, for code that does not follow the commands one at a time.
+ * program is the program the interpreter runs, before it was transformed.
+ */
+func (diff *differential) compareEnd(program *VMProgram, translator *asmTranslator, options DiffOptions) (*DiffResult, error) {
+    machine := diff.machine
+    cpu := diff.cpu
+    result := &DiffResult{}
+    finish := func (divergence *Divergence) (*DiffResult, error) {
+        result.Commands = machine.Steps
+        result.Instructions = cpu.Steps
+        result.Divergence = divergence
+        return result, nil
+    }
+
+    var last *Instruction
+    for !machine.Halted {
+        if options.MaxCommands > 0 && machine.Steps >= options.MaxCommands {
+            return finish(nil)
+        }
+
+        instruction := machine.Current()
+        err := machine.Step()
+        if err != nil {
+            return finish(&Divergence{Instruction: instruction, Message: fmt.Sprintf("the interpreter failed: %v", err)})
+        }
+        if instruction == nil {
+            break
+        }
+        last = instruction
+
+        _, isCall := instruction.Command.(*Call)
+        for i, address := range machine.Writes {
+            if isCall && i == 0 {
+                diff.returnSlots[address] = true
+            } else {
+                delete(diff.returnSlots, address)
+            }
+        }
+        if _, isReturn := instruction.Command.(*Return); isReturn {
+            result.Returns += 1
+        }
+    }
+    result.Halted = true
+
+    /* entering Sys.halt halts the interpreter before the function runs, so
+     * the cpu stops where the function starts
+     */
+    haltAt := -1
+    for i, instruction := range diff.code {
+        function, ok := instruction.Command.(*Function)
+        if ok && function.Name == "Sys.halt" {
+            haltAt = diff.entries[i].RomStart
+        }
+    }
+
+    limit := (machine.Steps + 1) * options.MaxInstructions
+    for !cpu.Halted && cpu.PC != haltAt {
+        if options.MaxInstructions > 0 && cpu.Steps >= limit {
+            return finish(&Divergence{Instruction: last, Message: fmt.Sprintf("the assembly did not halt within %v instructions, it is at ROM[%v] in %v", limit, cpu.PC, diff.source(cpu.PC))})
+        }
+
+        pc := cpu.PC
+        cpu.Step()
+        if cpu.Written != -1 {
+            diff.writers[cpu.Written] = pc
+        }
+    }
+
+    if translator.CheckStack {
+        code := cpu.RAM[translator.trapLimit - TrapCodeOffset]
+        if code != 0 {
+            return finish(&Divergence{Instruction: last, Message: fmt.Sprintf("the assembly trapped with code %v in function %v", code, cpu.RAM[translator.trapLimit - TrapFunctionOffset])})
+        }
+    }
+
+    usedTemps := program.usedTemps()
+    for slot, used := range usedTemps {
+        if !used {
+            diff.ignored[TempStart + slot] = true
+        }
+    }
+
+    /* statics are compared separately, by name */
+    symbols := staticSymbols(translator.machineCode)
+    for class, slots := range machine.statics {
+        for _, slot := range slots {
+            diff.ignored[slot.Address] = true
+            address, ok := symbols[fmt.Sprintf("static.%v.%v", class, slot.Index)]
+            if !ok {
+                return finish(&Divergence{Instruction: last, Message: fmt.Sprintf("the assembly has no static %v.%v", class, slot.Index)})
+            }
+            if machine.RAM[slot.Address] != cpu.RAM[address] {
+                divergence := &Divergence{
+                    Instruction: last,
+                    Address: slot.Address,
+                    Name: diff.name(slot.Address),
+                    VMValue: machine.RAM[slot.Address],
+                    HackValue: cpu.RAM[address],
+                    Writer: -1,
+                }
+                if writer, ok := diff.writers[address]; ok {
+                    divergence.Writer = writer
+                    divergence.WriterText = diff.instructions[writer]
+                    divergence.WriterSource = diff.source(writer)
+                }
+                return finish(divergence)
+            }
+        }
+    }
+
+    stackEnd := options.Translate.StackLimit
+    if stackEnd <= 0 {
+        stackEnd = DefaultStackLimit
+    }
+    sp := int(machine.RAM[0])
+    addresses := append(addressRange(0, sp), addressRange(stackEnd, RAMSize)...)
+    if divergence := diff.compare(addresses); divergence != nil {
+        divergence.Instruction = last
+        return finish(divergence)
+    }
+    return finish(nil)
+}
@@ -0,0 +1,137 @@
+package vm
+
+import (
+    "testing"
+    "strings"
+)
+
+func diffSource(test *testing.T, source string, options DiffOptions) {
+    file, err := ParseVMFile(strings.NewReader(source), "Test.vm", ParseOptions{})
+    if err != nil {
+        test.Fatalf("could not parse: %v", err)
+    }
+
+    program := &VMProgram{Files: []*VMFile{file}}
+    result, err := DiffProgram(program, options)
+    if err != nil {
+        test.Fatalf("could not run: %v", err)
+    }
+
+    if result.Divergence != nil {
+        test.Fatalf("the translation differs from the interpreter:\n%v", result.Divergence)
+    }
+    if !result.Halted {
+        test.Fatalf("the program did not halt")
+    }
+}
+
+/* operands more than 32767 apart overflow when subtracted */
+func TestComparisonOverflow(test *testing.T){
+    var lines []string
+    values := []string{"push constant 32767", "push constant 32767\nneg", "push constant 32767\nneg\npush constant 1\nsub", "push constant 0", "push constant 1\nneg"}
+    for _, x := range values {
+        for _, y := range values {
+            for _, operator := range []string{"lt", "gt", "eq"} {
+                lines = append(lines, x, y, operator, "pop temp 0")
+            }
+        }
+    }
+
+    source := "function Sys.init 0\n" + strings.Join(lines, "\n") + "\nlabel END\ngoto END\n"
+    diffSource(test, source, DefaultDiffOptions())
+}
+
+/* the same random programs for every translation option, and for all of them
+ * at once
+ */
+func TestRandomOptions(test *testing.T){
+    all := TranslateOptions{Inline: 60, TailCalls: true, CacheTop: true, CheckStack: true}
+    variations := map[string]TranslateOptions{
+        "plain": TranslateOptions{},
+        "inline": TranslateOptions{Inline: 60},
+        "tail calls": TranslateOptions{TailCalls: true},
+        "cache top": TranslateOptions{CacheTop: true},
+        "check stack": TranslateOptions{CheckStack: true},
+        "all": all,
+    }
+
+    for name, translate := range variations {
+        options := DefaultDiffOptions()
+        translate.Bootstrap = options.Translate.Bootstrap
+        translate.StackLimit = options.Translate.StackLimit
+        options.Translate = translate
+
+        for seed := int64(0); seed < 50; seed++ {
+            source := RandomProgram(seed, 5, 40)
+            file, err := ParseVMFile(strings.NewReader(source), "Random.vm", ParseOptions{})
+            if err != nil {
+                test.Fatalf("%v: seed %v made a program that does not parse: %v", name, seed, err)
+            }
+
+            result, err := DiffProgram(&VMProgram{Files: []*VMFile{file}}, options)
+            if err != nil {
+                test.Fatalf("%v: seed %v: %v", name, seed, err)
+            }
+            if result.Divergence != nil {
+                test.Fatalf("%v: seed %v differs from the interpreter:\n%v", name, seed, result.Divergence)
+            }
+            if !result.Halted {
+                test.Fatalf("%v: seed %v did not halt", name, seed)
+            }
+        }
+    }
+}
+
+/* Sys.halt loops forever like the one in the OS. The interpreter halts when
+ * Sys.halt is entered, so the translation has to get to Sys.halt as well
+ * instead of running an inlined copy of the loop.
+ */
+func TestHaltInlined(test *testing.T){
+    loops := map[string]string{
+        "goto": `
+label LOOP
+goto LOOP
+`,
+        "while": `
+label WHILE
+push constant 0
+not
+not
+if-goto END
+goto WHILE
+label END
+push constant 0
+return
+`,
+    }
+
+    for name, loop := range loops {
+        source := `
+function Sys.init 0
+push constant 5
+pop static 0
+call Sys.halt 0
+pop temp 0
+push constant 0
+return
+function Sys.halt 0` + loop
+
+        for _, tailCalls := range []bool{false, true} {
+            options := DefaultDiffOptions()
+            options.Translate.Inline = 20
+            options.Translate.TailCalls = tailCalls
+
+            file, err := ParseVMFile(strings.NewReader(source), "Test.vm", ParseOptions{})
+            if err != nil {
+                test.Fatalf("%v: could not parse: %v", name, err)
+            }
+            result, err := DiffProgram(&VMProgram{Files: []*VMFile{file}}, options)
+            if err != nil {
+                test.Fatalf("%v: could not run: %v", name, err)
+            }
+            if result.Divergence != nil || !result.Halted {
+                test.Errorf("%v with tail calls %v: halted %v, divergence %v", name, tailCalls, result.Halted, result.Divergence)
+            }
+        }
+    }
+}
@@ -0,0 +1,542 @@
+package vm
+
+import (
+    "io"
+    "fmt"
+)
+
+/* Extended vm commands that are not part of the standard vm language: mul,
+ * div, mod, shl, shr and xor. Each pops y then x and pushes x op y, all in 16-bit
+ * two's complement arithmetic.
+ *
+ *   mul  x*y, keeping the low 16 bits
+ *   div  x/y rounded towards zero, x/0 is 0
+ *   mod  the remainder of div, which has the sign of x, x%0 is x
+ *   shl  x shifted left by y&15 bits
+ *   shr  x shifted right by y&15 bits, keeping the sign
+ *   xor  bitwise exclusive or
+ *
+ * xor is translated inline. The others call a shared hack assembly routine
+ * that is only emitted if the program uses it. Routines take x in R13, y in
+ * R14 and the return address in R15, and leave their result in R13.
+ */
+
+type Mul struct {
+}
+
+type Div struct {
+}
+
+type Mod struct {
+}
+
+type Shl struct {
+}
+
+type Shr struct {
+}
+
+type Xor struct {
+}
+
+func (*Mul) vmCommand() {}
+func (*Div) vmCommand() {}
+func (*Mod) vmCommand() {}
+func (*Shl) vmCommand() {}
+func (*Shr) vmCommand() {}
+func (*Xor) vmCommand() {}
+
+/* pops y into R14 and x into R13, calls the routine and pushes whatever it
+ * left in the result register
+ */
+func callRoutine(translator *asmTranslator, routine string, result string) []string {
+    if translator.routines == nil {
+        translator.routines = make(map[string]bool)
+    }
+    translator.routines[routine] = true
+
+    returnAddress := translator.Gensym(fmt.Sprintf("%v_return", routine))
+
+    return []string{
+        "@SP",
+        "AM=M-1",
+        "D=M",
+        "@R14",
+        "M=D", // r14 = y
+        "@SP",
+        "AM=M-1",
+        "D=M",
+        "@R13",
+        "M=D", // r13 = x
+        fmt.Sprintf("@%v", returnAddress),
+        "D=A",
+        "@R15",
+        "M=D",
+        fmt.Sprintf("@%v", routine),
+        "0; JMP",
+        fmt.Sprintf("(%v)", returnAddress),
+        fmt.Sprintf("@%v", result),
+        "D=M",
+        "@SP",
+        "A=M",
+        "M=D",
+        "@SP",
+        "M=M+1",
+    }
+}
+
+func (mul *Mul) TranslateToAssembly(translator *asmTranslator) []string {
+    return callRoutine(translator, "__vm_multiply", "R13")
+}
+
+func (div *Div) TranslateToAssembly(translator *asmTranslator) []string {
+    return callRoutine(translator, "__vm_divide", "R13")
+}
+
+func (mod *Mod) TranslateToAssembly(translator *asmTranslator) []string {
+    /* the divide routine leaves the remainder in r14 */
+    return callRoutine(translator, "__vm_divide", "R14")
+}
+
+func (shl *Shl) TranslateToAssembly(translator *asmTranslator) []string {
+    return callRoutine(translator, "__vm_shift_left", "R13")
+}
+
+func (shr *Shr) TranslateToAssembly(translator *asmTranslator) []string {
+    return callRoutine(translator, "__vm_shift_right", "R13")
+}
+
+func (xor *Xor) TranslateToAssembly(translator *asmTranslator) []string {
+    /* x^y = (x|y) & !(x&y) */
+    return []string{
+        "@SP",
+        "AM=M-1",
+        "D=M",
+        "@R13",
+        "M=D", // r13 = y
+        "@SP",
+        "A=M-1",
+        "D=M", // d = x
+        "@R13",
+        "D=D&M",
+        "D=!D", // d = !(x&y)
+        "@R14",
+        "M=D",
+        "@SP",
+        "A=M-1",
+        "D=M",
+        "@R13",
+        "D=D|M", // d = x|y
+        "@R14",
+        "D=D&M",
+        "@SP",
+        "A=M-1",
+        "M=D",
+    }
+}
+
+func (mul *Mul) TranslateToC(translator *cTranslator) []string {
+    return cBinary("x * y")
+}
+
+func (div *Div) TranslateToC(translator *cTranslator) []string {
+    return cBinary("y == 0 ? 0 : x / y")
+}
+
+func (mod *Mod) TranslateToC(translator *cTranslator) []string {
+    return cBinary("y == 0 ? x : x % y")
+}
+
+func (shl *Shl) TranslateToC(translator *cTranslator) []string {
+    return cBinary("(uint16_t) x << (y & 15)")
+}
+
+func (shr *Shr) TranslateToC(translator *cTranslator) []string {
+    return cBinary("x >> (y & 15)")
+}
+
+func (xor *Xor) TranslateToC(translator *cTranslator) []string {
+    return cBinary("x ^ y")
+}
+
+func (mul *Mul) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmBinary("i32.mul")
+}
+
+func (div *Div) TranslateToWasm(translator *wasmTranslator) []string {
+    return []string{
+        "call $pop",
+        "local.set $y",
+        "call $pop",
+        "local.set $x",
+        /* x/0 = 0, and divide by 1 instead of 0 to avoid the trap */
+        "i32.const 0",
+        "local.get $x",
+        "i32.const 1",
+        "local.get $y",
+        "local.get $y",
+        "i32.eqz",
+        "select",
+        "i32.div_s",
+        "local.get $y",
+        "i32.eqz",
+        "select",
+        "call $push",
+    }
+}
+
+func (mod *Mod) TranslateToWasm(translator *wasmTranslator) []string {
+    return []string{
+        "call $pop",
+        "local.set $y",
+        "call $pop",
+        "local.set $x",
+        /* x%0 = x */
+        "local.get $x",
+        "local.get $x",
+        "i32.const 1",
+        "local.get $y",
+        "local.get $y",
+        "i32.eqz",
+        "select",
+        "i32.rem_s",
+        "local.get $y",
+        "i32.eqz",
+        "select",
+        "call $push",
+    }
+}
+
+func (shl *Shl) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmBinary("i32.const 15", "i32.and", "i32.shl")
+}
+
+func (shr *Shr) TranslateToWasm(translator *wasmTranslator) []string {
+    /* x was sign extended when it was loaded so shr_s keeps the sign */
+    return wasmBinary("i32.const 15", "i32.and", "i32.shr_s")
+}
+
+func (xor *Xor) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmBinary("i32.xor")
+}
+
+/* shift and add: for each bit of y add x shifted by that many bits */
+var multiplyRoutine = []string{
+    "(__vm_multiply)",
+    "@__vm_multiply_result",
+    "M=0",
+    "@__vm_multiply_bit",
+    "M=1",
+    "(__vm_multiply_loop)",
+    /* the bit becomes 0 once it has been shifted past bit 15 */
+    "@__vm_multiply_bit",
+    "D=M",
+    "@__vm_multiply_done",
+    "D; JEQ",
+    "@R14",
+    "D=D&M",
+    "@__vm_multiply_skip",
+    "D; JEQ",
+    "@R13",
+    "D=M",
+    "@__vm_multiply_result",
+    "M=D+M",
+    "(__vm_multiply_skip)",
+    "@R13",
+    "D=M",
+    "M=D+M", // x = x+x
+    "@__vm_multiply_bit",
+    "D=M",
+    "M=D+M", // bit = bit+bit
+    "@__vm_multiply_loop",
+    "0; JMP",
+    "(__vm_multiply_done)",
+    "@__vm_multiply_result",
+    "D=M",
+    "@R13",
+    "M=D",
+    "@R15",
+    "A=M",
+    "0; JMP",
+}
+
+/* Restoring division on the magnitudes of x and y, one bit of the quotient
+ * per iteration starting from the top bit, after which the signs are fixed up.
+ * Leaves the quotient in R13 and the remainder in R14.
+ */
+var divideRoutine = []string{
+    "(__vm_divide)",
+    "@__vm_divide_xneg",
+    "M=0",
+    "@__vm_divide_qneg",
+    "M=0",
+    "@R13",
+    "D=M",
+    "@__vm_divide_xpos",
+    "D; JGE",
+    "@__vm_divide_xneg",
+    "M=-1",
+    "@__vm_divide_qneg",
+    "M=-1",
+    "D=-D",
+    "(__vm_divide_xpos)",
+    /* n = |x|, which is 0x8000 for -32768 and is treated as unsigned */
+    "@__vm_divide_n",
+    "M=D",
+    "@R14",
+    "D=M",
+    "@__vm_divide_ypos",
+    "D; JGE",
+    "@__vm_divide_qneg",
+    "M=!M",
+    "D=-D",
+    "(__vm_divide_ypos)",
+    "@__vm_divide_d",
+    "M=D",
+    "@__vm_divide_zero",
+    "D; JEQ",
+    /* |y| is still negative only if y is -32768 */
+    "@__vm_divide_min",
+    "D; JLT",
+    "@__vm_divide_q",
+    "M=0",
+    "@__vm_divide_r",
+    "M=0",
+    "@16",
+    "D=A",
+    "@__vm_divide_count",
+    "M=D",
+    "(__vm_divide_loop)",
+    /* r = r+r + top bit of n, n = n+n, q = q+q */
+    "@__vm_divide_r",
+    "D=M",
+    "M=D+M",
+    "@__vm_divide_n",
+    "D=M",
+    "@__vm_divide_nobit",
+    "D; JGE",
+    "@__vm_divide_r",
+    "M=M+1",
+    "(__vm_divide_nobit)",
+    "@__vm_divide_n",
+    "D=M",
+    "M=D+M",
+    "@__vm_divide_q",
+    "D=M",
+    "M=D+M",
+    /* r >= d, where a negative r is really an unsigned value above 32767 */
+    "@__vm_divide_r",
+    "D=M",
+    "@__vm_divide_subtract",
+    "D; JLT",
+    "@__vm_divide_d",
+    "D=D-M",
+    "@__vm_divide_next",
+    "D; JLT",
+    "(__vm_divide_subtract)",
+    "@__vm_divide_d",
+    "D=M",
+    "@__vm_divide_r",
+    "M=M-D",
+    "@__vm_divide_q",
+    "M=M+1",
+    "(__vm_divide_next)",
+    "@__vm_divide_count",
+    "MD=M-1",
+    "@__vm_divide_loop",
+    "D; JGT",
+    "@__vm_divide_q",
+    "D=M",
+    "@R13",
+    "M=D",
+    "@__vm_divide_r",
+    "D=M",
+    "@R14",
+    "M=D",
+    /* the quotient is negative if the signs differ, the remainder has the
+     * sign of x
+     */
+    "@__vm_divide_qneg",
+    "D=M",
+    "@__vm_divide_qpos",
+    "D; JEQ",
+    "@R13",
+    "M=-M",
+    "(__vm_divide_qpos)",
+    "@__vm_divide_xneg",
+    "D=M",
+    "@__vm_divide_return",
+    "D; JEQ",
+    "@R14",
+    "M=-M",
+    "@__vm_divide_return",
+    "0; JMP",
+    /* x/0 = 0 and x%0 = x */
+    "(__vm_divide_zero)",
+    "@R13",
+    "D=M",
+    "@R14",
+    "M=D",
+    "@R13",
+    "M=0",
+    "@__vm_divide_return",
+    "0; JMP",
+    /* y is -32768, so the quotient is 1 if x is also -32768 and 0 otherwise */
+    "(__vm_divide_min)",
+    "@R13",
+    "D=M",
+    "@R14",
+    "M=D",
+    "@R13",
+    "M=0",
+    "@32767",
+    "D=D+A",
+    "D=D+1",
+    "@__vm_divide_return",
+    "D; JNE",
+    "@R13",
+    "M=1",
+    "@R14",
+    "M=0",
+    "(__vm_divide_return)",
+    "@R15",
+    "A=M",
+    "0; JMP",
+}
+
+var shiftLeftRoutine = []string{
+    "(__vm_shift_left)",
+    "@15",
+    "D=A",
+    "@R14",
+    "M=D&M", // count = y&15
+    "(__vm_shift_left_loop)",
+    "@R14",
+    "MD=M-1",
+    "@__vm_shift_left_done",
+    "D; JLT",
+    "@R13",
+    "D=M",
+    "M=D+M",
+    "@__vm_shift_left_loop",
+    "0; JMP",
+    "(__vm_shift_left_done)",
+    "@R15",
+    "A=M",
+    "0; JMP",
+}
+
+/* copies bit i+count of x to bit i of the result, then fills the top count
+ * bits with the sign of x
+ */
+var shiftRightRoutine = []string{
+    "(__vm_shift_right)",
+    "@15",
+    "D=A",
+    "@R14",
+    "M=D&M", // count = y&15
+    "@__vm_shift_right_source",
+    "M=1",
+    "(__vm_shift_right_start)",
+    "@R14",
+    "MD=M-1",
+    "@__vm_shift_right_copy",
+    "D; JLT",
+    "@__vm_shift_right_source",
+    "D=M",
+    "M=D+M",
+    "@__vm_shift_right_start",
+    "0; JMP",
+    "(__vm_shift_right_copy)",
+    "@__vm_shift_right_result",
+    "M=0",
+    "@__vm_shift_right_destination",
+    "M=1",
+    "(__vm_shift_right_loop)",
+    /* the source bit becomes 0 once it has been shifted past bit 15 */
+    "@__vm_shift_right_source",
+    "D=M",
+    "@__vm_shift_right_sign",
+    "D; JEQ",
+    "@R13",
+    "D=D&M",
+    "@__vm_shift_right_next",
+    "D; JEQ",
+    "@__vm_shift_right_destination",
+    "D=M",
+    "@__vm_shift_right_result",
+    "M=D|M",
+    "(__vm_shift_right_next)",
+    "@__vm_shift_right_source",
+    "D=M",
+    "M=D+M",
+    "@__vm_shift_right_destination",
+    "D=M",
+    "M=D+M",
+    "@__vm_shift_right_loop",
+    "0; JMP",
+    "(__vm_shift_right_sign)",
+    "@R13",
+    "D=M",
+    "@__vm_shift_right_done",
+    "D; JGE",
+    "(__vm_shift_right_fill)",
+    "@__vm_shift_right_destination",
+    "D=M",
+    "@__vm_shift_right_done",
+    "D; JEQ",
+    "@__vm_shift_right_result",
+    "M=D|M",
+    "@__vm_shift_right_destination",
+    "D=M",
+    "M=D+M",
+    "@__vm_shift_right_fill",
+    "0; JMP",
+    "(__vm_shift_right_done)",
+    "@__vm_shift_right_result",
+    "D=M",
+    "@R13",
+    "M=D",
+    "@R15",
+    "A=M",
+    "0; JMP",
+}
+
+/* in the order they are written out */
+var sharedRoutines = []struct{
+    Name string
+    Code []string
+}{
+    {"__vm_multiply", multiplyRoutine},
+    {"__vm_divide", divideRoutine},
+    {"__vm_shift_left", shiftLeftRoutine},
+    {"__vm_shift_right", shiftRightRoutine},
+}
+
+/* Writes the routines used by the extended commands after the rest of the
+ * program, behind a loop that stops execution from falling into them.
+ */
+func writeSharedRoutines(output io.Writer, translator *asmTranslator) {
+    if len(translator.routines) == 0 && len(translator.trapStubs) == 0 {
+        return
+    }
+
+    io.WriteString(output, "// shared routines for the extended vm commands and traps\n")
+    for _, line := range []string{"(__vm_halt)", "@__vm_halt", "0; JMP"} {
+        io.WriteString(output, line)
+        output.Write([]byte{'\n'})
+    }
+
+    for _, routine := range sharedRoutines {
+        if !translator.routines[routine.Name] {
+            continue
+        }
+
+        for _, line := range routine.Code {
+            io.WriteString(output, line)
+            output.Write([]byte{'\n'})
+        }
+    }
+
+    writeTrapRoutines(output, translator)
+}
@@ -0,0 +1,86 @@
+package vm
+
+import (
+    "testing"
+    "strings"
+)
+
+func TestParseExtensions(test *testing.T){
+    _, err := processVMLine("mul", ParseOptions{})
+    if err == nil {
+        test.Errorf("mul was accepted without extensions")
+    }
+
+    command, err := processVMLine("  XOR  ", ParseOptions{Extensions: true})
+    if err != nil {
+        test.Fatalf("could not parse xor: %v", err)
+    }
+    if _, ok := command.(*Xor); !ok {
+        test.Errorf("xor parsed as %T", command)
+    }
+}
+
+/* x op y for the extended commands, with x and y negated if negative */
+func extensionProgram(operations []struct{X, Y int; Op Command}) *VMProgram {
+    push := func(value int) []Command {
+        if value < 0 {
+            return []Command{&PushConstant{Constant: uint64(-value)}, &Neg{}}
+        }
+        return []Command{&PushConstant{Constant: uint64(value)}}
+    }
+
+    commands := []Command{&Function{Name: "Sys.init"}}
+    for i, operation := range operations {
+        commands = append(commands, push(operation.X)...)
+        commands = append(commands, push(operation.Y)...)
+        commands = append(commands, operation.Op, &PopStatic{Index: i})
+    }
+    commands = append(commands, &PushConstant{Constant: 0}, &Return{})
+
+    return &VMProgram{Files: []*VMFile{commandsFile("Sys.vm", "Sys", commands...)}}
+}
+
+func TestExtensionsInC(test *testing.T){
+    operations := []struct{X, Y int; Op Command}{
+        {300, 300, &Mul{}},
+        {-7, 2, &Div{}},
+        {7, 0, &Div{}},
+        {-7, 2, &Mod{}},
+        {7, 0, &Mod{}},
+        {1, 15, &Shl{}},
+        {3, 17, &Shl{}},
+        {-16, 2, &Shr{}},
+        {12, 10, &Xor{}},
+    }
+    expected := []int{24464, -3, 0, -1, 7, -32768, 6, -4, 6}
+
+    ram := runC(test, extensionProgram(operations), DefaultBootstrapOptions())
+    for i, value := range expected {
+        if ram[StaticStart + i] != value {
+            test.Errorf("operation %v: got %v instead of %v", i, ram[StaticStart + i], value)
+        }
+    }
+}
+
+/* each routine is written once, and only if a command needs it */
+func TestSharedRoutines(test *testing.T){
+    var translator asmTranslator
+    for _, command := range []asmCommand{&Mul{}, &Mul{}, &Div{}, &Mod{}, &Xor{}} {
+        command.TranslateToAssembly(&translator)
+    }
+
+    var output strings.Builder
+    writeSharedRoutines(&output, &translator)
+    assembly := output.String()
+
+    for _, routine := range []string{"__vm_multiply", "__vm_divide"} {
+        if strings.Count(assembly, "(" + routine + ")") != 1 {
+            test.Errorf("%v is not written exactly once", routine)
+        }
+    }
+    for _, routine := range []string{"__vm_shift_left", "__vm_shift_right"} {
+        if strings.Contains(assembly, "(" + routine + ")") {
+            test.Errorf("%v is written but not used", routine)
+        }
+    }
+}
@@ -0,0 +1,188 @@
+package vm
+
+import (
+    "io"
+    "fmt"
+    "bytes"
+    "strings"
+    "strconv"
+
+    "github.com/kazzmir/nand2tetris/assembler"
+)
+
+/* Translation straight to hack machine code. The assembly made by the hack
+ * backend stays in memory and goes through the parser and encoder of the
+ * assembler package, so there is no .asm file to write and read back unless
+ * one is asked for.
+ *
+ * The assembler has a single namespace for labels and variables, so names
+ * the translator makes up must not be usable by vm code. Every symbol made by
+ * Gensym starts with reservedSymbolPrefix, and the names of vm functions and
+ * labels are checked to be plain hack symbols, which can not contain it. The
+ * predefined symbols and the prefixes of the translator's own routines and
+ * static variables are refused as well.
+ */
+
+const reservedSymbolPrefix = "%"
+
+var reservedPrefixes = []string{"__vm_", "static."}
+
+/* symbols the assembler gives a fixed address, so a label of the same name
+ * would never be used
+ */
+func isPredefinedSymbol(name string) bool {
+    switch name {
+        case "SP", "LCL", "ARG", "THIS", "THAT", "SCREEN", "KBD": return true
+    }
+
+    /* only R0 to R15, R16 and up are ordinary symbols */
+    if len(name) > 1 && name[0] == 'R' {
+        number, err := strconv.Atoi(name[1:])
+        return err == nil && number >= 0 && number <= 15 && name[1:] == strconv.Itoa(number)
+    }
+
+    return false
+}
+
+/* letters, digits, '_', '.', '$' and ':', not starting with a digit */
+func isHackSymbol(name string) bool {
+    if name == "" || (name[0] >= '0' && name[0] <= '9') {
+        return false
+    }
+
+    for _, c := range name {
+        ok := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.ContainsRune("_.$:", c)
+        if !ok {
+            return false
+        }
+    }
+
+    return true
+}
+
+func checkSymbol(kind string, name string) string {
+    if !isHackSymbol(name) {
+        return fmt.Sprintf("%v name '%v' is not a valid hack symbol", kind, name)
+    }
+
+    if isPredefinedSymbol(name) {
+        return fmt.Sprintf("%v name '%v' is a predefined hack symbol", kind, name)
+    }
+
+    for _, prefix := range reservedPrefixes {
+        if strings.HasPrefix(name, prefix) {
+            return fmt.Sprintf("%v name '%v' starts with the reserved prefix '%v'", kind, name, prefix)
+        }
+    }
+
+    return ""
+}
+
+/* makes sure no function or label can collide with a symbol the translator
+ * makes up
+ */
+func checkSymbols(program *VMProgram) error {
+    var errors ValidationErrors
+    for _, file := range program.Files {
+        for _, line := range file.Lines {
+            message := ""
+            switch command := line.Command.(type) {
+                case *Function: message = checkSymbol("function", command.Name)
+                case *Label: message = checkSymbol("label", command.Name)
+            }
+
+            if message != "" {
+                errors = append(errors, &ValidationError{File: file.Path, Line: line.Line, Message: message})
+            }
+        }
+    }
+
+    if len(errors) > 0 {
+        return errors
+    }
+
+    return nil
+}
+
+/* parses and encodes assembly with the assembler package */
+func assembleHack(assembly []byte) (*assembler.ParsedProgram, error) {
+    var raw assembler.RawProgram
+    for i, line := range strings.Split(string(assembly), "\n") {
+        raw.AddLine(line, uint64(i + 1))
+    }
+
+    parsed, err := assembler.Parse(raw)
+    if err != nil {
+        return nil, err
+    }
+
+    if parsed.InstructionCount() > ROMSize {
+        return nil, fmt.Errorf("The program needs %v instructions but the ROM only holds %v", parsed.InstructionCount(), ROMSize)
+    }
+
+    return &parsed, nil
+}
+
+func translateToHack(output io.Writer, program *VMProgram, options TranslateOptions) (*asmTranslator, error) {
+    err := checkSymbols(program)
+    if err != nil {
+        return nil, err
+    }
+
+    translator := &asmTranslator{Translator: Translator{symbolPrefix: reservedSymbolPrefix}}
+
+    var assembly bytes.Buffer
+    err = translator.translateProgram(&assembly, program, options)
+    if err != nil {
+        return nil, err
+    }
+
+    parsed, err := assembleHack(assembly.Bytes())
+    if err != nil {
+        return nil, err
+    }
+
+    translator.assembly = assembly.Bytes()
+    translator.machineCode = parsed
+
+    _, err = io.WriteString(output, parsed.ToBinaryString())
+    if err != nil {
+        return nil, err
+    }
+    return translator, nil
+}
+
+/* Writes the assembly with the ROM address and encoding in front of every
+ * instruction. Labels and comments are kept so the listing reads like the
+ * assembly.
+ */
+func writeListing(output io.Writer, assembly []byte, program *assembler.ParsedProgram) error {
+    address := 0
+    for _, line := range strings.Split(string(assembly), "\n") {
+        text := strings.TrimSpace(line)
+        code := text
+        if comment := strings.Index(code, "//"); comment != -1 {
+            code = strings.TrimSpace(code[:comment])
+        }
+
+        var err error
+        switch {
+            case text == "":
+                continue
+            case code == "" || strings.HasPrefix(code, "("):
+                _, err = fmt.Fprintf(output, "%24v%v\n", "", text)
+            default:
+                if address >= len(program.Code) {
+                    return fmt.Errorf("the listing has more instructions than the program")
+                }
+                _, err = fmt.Fprintf(output, "%5v  %v  %v\n", address, program.Code[address].ToBinaryString(), text)
+                address += 1
+        }
+
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,453 @@
+package vm
+
+import (
+    "testing"
+    "os"
+    "fmt"
+    "strings"
+    "strconv"
+    "io/ioutil"
+    "path/filepath"
+)
+
+/* the options the tests translate with: hack assembly with the extended
+ * commands allowed
+ */
+func hackOptions() TranslateOptions {
+    return TranslateOptions{
+        Parse: ParseOptions{Extensions: true},
+        Bootstrap: DefaultBootstrapOptions(),
+        Target: "asm",
+    }
+}
+
+/* translates vm files the way the command line does, as a directory named
+ * Test, and returns the files written next to it by their extension
+ */
+func translateSources(test *testing.T, sources map[string]string, options TranslateOptions) map[string]string {
+    directory, err := ioutil.TempDir("", "vm")
+    if err != nil {
+        test.Fatalf("could not make a directory: %v", err)
+    }
+    defer os.RemoveAll(directory)
+
+    path := filepath.Join(directory, "Test")
+    err = os.Mkdir(path, 0755)
+    if err != nil {
+        test.Fatalf("could not make %v: %v", path, err)
+    }
+
+    for name, source := range sources {
+        err = ioutil.WriteFile(filepath.Join(path, name), []byte(source), 0644)
+        if err != nil {
+            test.Fatalf("could not write %v: %v", name, err)
+        }
+    }
+
+    err = Translate(path, options)
+    if err != nil {
+        test.Fatalf("could not translate: %v", err)
+    }
+
+    files, err := ioutil.ReadDir(directory)
+    if err != nil {
+        test.Fatalf("could not list %v: %v", directory, err)
+    }
+
+    outputs := make(map[string]string)
+    for _, file := range files {
+        if file.IsDir() {
+            continue
+        }
+        data, err := ioutil.ReadFile(filepath.Join(directory, file.Name()))
+        if err != nil {
+            test.Fatalf("could not read %v: %v", file.Name(), err)
+        }
+        outputs[strings.TrimPrefix(filepath.Ext(file.Name()), ".")] = string(data)
+    }
+
+    return outputs
+}
+
+/* translates vm source as the single file Test.vm */
+func translateOutputs(test *testing.T, source string, options TranslateOptions) map[string]string {
+    return translateSources(test, map[string]string{"Test.vm": source}, options)
+}
+
+/* the assembly written for vm source */
+func translateSource(test *testing.T, source string, options TranslateOptions) string {
+    assembly, ok := translateOutputs(test, source, options)["asm"]
+    if !ok {
+        test.Fatalf("no assembly was written")
+    }
+    return assembly
+}
+
+/* A hack computer that runs assembly text directly, enough to run what the
+ * translator writes without going through the assembler.
+ */
+type hackMachine struct {
+    RAM [32768]int16
+    /* the A and C instructions, and the ROM address of every label */
+    code []string
+    labels map[string]int
+    variables map[string]int
+    A, D int16
+    PC int
+    Steps int
+    /* set once the program jumps to the instruction that loaded the jump
+     * address, which is the loop the translator ends programs with
+     */
+    Halted bool
+}
+
+func newHackMachine(assembly string) *hackMachine {
+    machine := &hackMachine{
+        labels: make(map[string]int),
+        variables: make(map[string]int),
+    }
+
+    for _, line := range strings.Split(assembly, "\n") {
+        if comment := strings.Index(line, "//"); comment != -1 {
+            line = line[:comment]
+        }
+        line = strings.TrimSpace(line)
+        switch {
+            case line == "":
+            case strings.HasPrefix(line, "("):
+                machine.labels[strings.Trim(line, "()")] = len(machine.code)
+            default:
+                machine.code = append(machine.code, line)
+        }
+    }
+
+    /* variables get addresses in the order they first appear, as in the
+     * assembler
+     */
+    for _, instruction := range machine.code {
+        if strings.HasPrefix(instruction, "@") {
+            machine.symbol(instruction[1:])
+        }
+    }
+
+    return machine
+}
+
+var hackPredefined = map[string]int{
+    "SP": 0, "LCL": 1, "ARG": 2, "THIS": 3, "THAT": 4,
+    "SCREEN": 16384, "KBD": 24576,
+}
+
+func (machine *hackMachine) symbol(name string) int {
+    if value, err := strconv.Atoi(name); err == nil {
+        return value
+    }
+    if value, ok := hackPredefined[name]; ok {
+        return value
+    }
+    if strings.HasPrefix(name, "R") {
+        if value, err := strconv.Atoi(name[1:]); err == nil && value >= 0 && value < 16 && name[1:] == strconv.Itoa(value) {
+            return value
+        }
+    }
+    if value, ok := machine.labels[name]; ok {
+        return value
+    }
+    if _, ok := machine.variables[name]; !ok {
+        machine.variables[name] = 16 + len(machine.variables)
+    }
+    return machine.variables[name]
+}
+
+func (machine *hackMachine) compute(comp string) (int16, error) {
+    a := machine.A
+    d := machine.D
+    m := machine.RAM[uint16(machine.A) & 0x7fff]
+    values := map[string]int16{
+        "0": 0, "1": 1, "-1": -1,
+        "D": d, "A": a, "M": m,
+        "!D": ^d, "!A": ^a, "!M": ^m,
+        "-D": -d, "-A": -a, "-M": -m,
+        "D+1": d + 1, "A+1": a + 1, "M+1": m + 1,
+        "D-1": d - 1, "A-1": a - 1, "M-1": m - 1,
+        "D+A": d + a, "A+D": d + a, "D+M": d + m, "M+D": d + m,
+        "D-A": d - a, "D-M": d - m, "A-D": a - d, "M-D": m - d,
+        "D&A": d & a, "A&D": d & a, "D&M": d & m, "M&D": d & m,
+        "D|A": d | a, "A|D": d | a, "D|M": d | m, "M|D": d | m,
+    }
+
+    value, ok := values[comp]
+    if !ok {
+        return 0, fmt.Errorf("unknown computation '%v'", comp)
+    }
+    return value, nil
+}
+
+func (machine *hackMachine) step() error {
+    if machine.PC < 0 || machine.PC >= len(machine.code) {
+        return fmt.Errorf("jumped outside the program to %v", machine.PC)
+    }
+
+    instruction := machine.code[machine.PC]
+    machine.Steps += 1
+
+    if strings.HasPrefix(instruction, "@") {
+        machine.A = int16(machine.symbol(instruction[1:]))
+        machine.PC += 1
+        return nil
+    }
+
+    dest := ""
+    jump := ""
+    comp := instruction
+    if equals := strings.Index(comp, "="); equals != -1 {
+        dest = strings.TrimSpace(comp[:equals])
+        comp = comp[equals+1:]
+    }
+    if semicolon := strings.Index(comp, ";"); semicolon != -1 {
+        jump = strings.TrimSpace(comp[semicolon+1:])
+        comp = comp[:semicolon]
+    }
+
+    value, err := machine.compute(strings.ReplaceAll(comp, " ", ""))
+    if err != nil {
+        return fmt.Errorf("'%v': %v", instruction, err)
+    }
+
+    address := uint16(machine.A) & 0x7fff
+    if strings.Contains(dest, "M") {
+        machine.RAM[address] = value
+    }
+    if strings.Contains(dest, "D") {
+        machine.D = value
+    }
+    if strings.Contains(dest, "A") {
+        machine.A = value
+    }
+
+    jumps := map[string]bool{
+        "": false,
+        "JGT": value > 0, "JEQ": value == 0, "JGE": value >= 0,
+        "JLT": value < 0, "JNE": value != 0, "JLE": value <= 0,
+        "JMP": true,
+    }
+    taken, ok := jumps[jump]
+    if !ok {
+        return fmt.Errorf("'%v': unknown jump", instruction)
+    }
+
+    if taken {
+        target := int(uint16(machine.A))
+        if target == machine.PC - 1 && strings.HasPrefix(machine.code[target], "@") {
+            machine.Halted = true
+        }
+        machine.PC = target
+    } else {
+        machine.PC += 1
+    }
+
+    return nil
+}
+
+/* the value of a static variable such as static.Test.0 */
+func (machine *hackMachine) static(name string) int16 {
+    address, ok := machine.variables[name]
+    if !ok {
+        return 0
+    }
+    return machine.RAM[address]
+}
+
+/* runs until the program halts or has taken the given number of steps */
+func (machine *hackMachine) run(limit int) error {
+    for !machine.Halted && machine.Steps < limit {
+        err := machine.step()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/* runs assembly, failing the test if it does not halt */
+func runHack(test *testing.T, assembly string) *hackMachine {
+    machine := newHackMachine(assembly)
+    err := machine.run(1000000)
+    if err != nil {
+        test.Fatalf("the program failed after %v steps: %v", machine.Steps, err)
+    }
+    if !machine.Halted {
+        test.Fatalf("the program did not halt")
+    }
+    return machine
+}
+
+/* the hack target encodes the same assembly the asm target would write,
+ * and keeps it and a listing when asked to
+ */
+func TestHackTarget(test *testing.T){
+    options := hackOptions()
+    options.Target = "hack"
+    options.KeepAssembly = true
+    options.Listing = true
+    outputs := translateOutputs(test, everyCommandSource, options)
+
+    for _, extension := range []string{"hack", "asm", "lst"} {
+        if _, ok := outputs[extension]; !ok {
+            test.Fatalf("no .%v file was written", extension)
+        }
+    }
+
+    machineCode := strings.Split(strings.TrimSuffix(outputs["hack"], "\n"), "\n")
+    for _, line := range machineCode {
+        if len(line) != 16 || strings.Trim(line, "01") != "" {
+            test.Fatalf("'%v' is not a hack instruction", line)
+        }
+    }
+    /* the bootstrap starts with @256 */
+    if machineCode[0] != "0000000100000000" {
+        test.Errorf("the first instruction is %v", machineCode[0])
+    }
+
+    parsed, err := assembleHack([]byte(outputs["asm"]))
+    if err != nil {
+        test.Fatalf("the kept assembly does not assemble: %v", err)
+    }
+    if len(parsed.Code) != len(machineCode) {
+        test.Errorf("the kept assembly has %v instructions but the program has %v", len(parsed.Code), len(machineCode))
+    }
+
+    listed := 0
+    for _, line := range strings.Split(outputs["lst"], "\n") {
+        fields := strings.Fields(line)
+        if len(fields) >= 2 && fields[0] == strconv.Itoa(listed) {
+            if fields[1] != machineCode[listed] {
+                test.Errorf("the listing encodes instruction %v as %v instead of %v", listed, fields[1], machineCode[listed])
+            }
+            listed += 1
+        }
+    }
+    if listed != len(machineCode) {
+        test.Errorf("the listing has %v instructions instead of %v", listed, len(machineCode))
+    }
+
+    machine := runHack(test, outputs["asm"])
+    if machine.static("static.Test.1") != 1025 {
+        test.Errorf("static 1 is %v instead of 1025", machine.static("static.Test.1"))
+    }
+}
+
+func TestAssembleDuplicateLabel(test *testing.T){
+    _, err := assembleHack([]byte("(twice)\n@twice\n0; JMP\n(twice)\n"))
+    if err == nil {
+        test.Errorf("a label defined twice was assembled")
+    }
+}
+
+/* vm names that would collide with the assembler's symbols are refused */
+func TestCheckSymbols(test *testing.T){
+    for _, name := range []string{"Main.main", "LOOP$1", "a:b", "_start", "R16", "R100", "R01"} {
+        if message := checkSymbol("label", name); message != "" {
+            test.Errorf("%v", message)
+        }
+    }
+
+    for _, name := range []string{"1up", "has space", "a%b", "SP", "KBD", "R0", "R9", "R15", "__vm_multiply", "static.Main.0"} {
+        if checkSymbol("label", name) == "" {
+            test.Errorf("the label '%v' was accepted", name)
+        }
+    }
+
+    program := VMProgram{Files: []*VMFile{commandsFile("Main.vm", "Main",
+        &Function{Name: "Main.main"},
+        &Label{Name: "THIS"},
+        &Return{},
+    )}}
+    errors, ok := checkSymbols(&program).(ValidationErrors)
+    if !ok || len(errors) != 1 || !strings.Contains(errors[0].Message, "predefined") {
+        test.Errorf("expected one error for the label THIS but got %v", errors)
+    }
+}
+
+/* translates a single vm file to machine code and loads it into a hack cpu */
+func loadHack(source string, options TranslateOptions) (*HackCPU, error) {
+    file, err := ParseVMFile(strings.NewReader(source), "Test.vm", options.Parse)
+    if err != nil {
+        return nil, err
+    }
+
+    program := &VMProgram{Files: []*VMFile{file}}
+    err = program.Validate()
+    if err != nil {
+        return nil, err
+    }
+
+    if options.Inline > 0 {
+        program.InlineFunctions(options.Inline)
+    }
+
+    translator, err := translateToHack(ioutil.Discard, program, options)
+    if err != nil {
+        return nil, err
+    }
+
+    return NewHackCPU(translator.machineCode)
+}
+
+/* the cpu running the machine code ends up in the same state as the test
+ * machine running the assembly
+ */
+func TestHackCPU(test *testing.T){
+    for _, cache := range []bool{false, true} {
+        options := hackOptions()
+        options.CacheTop = cache
+
+        cpu, err := loadHack(everyCommandSource, options)
+        if err != nil {
+            test.Fatalf("could not translate: %v", err)
+        }
+        for !cpu.Halted && cpu.Steps < 1000000 {
+            cpu.Step()
+        }
+        if !cpu.Halted {
+            test.Fatalf("cache %v: the cpu did not halt", cache)
+        }
+
+        machine := runHack(test, translateSource(test, everyCommandSource, options))
+        if cpu.Steps != uint64(machine.Steps) {
+            test.Errorf("cache %v: the cpu took %v steps instead of %v", cache, cpu.Steps, machine.Steps)
+        }
+        for address := range cpu.RAM {
+            if cpu.RAM[address] != machine.RAM[address] {
+                test.Errorf("cache %v: RAM[%v] is %v instead of %v", cache, address, cpu.RAM[address], machine.RAM[address])
+            }
+        }
+    }
+}
+
+/* R16 is not a register, so it can name a function and be jumped to */
+func TestHackRegisterNames(test *testing.T){
+    source := `
+function Sys.init 0
+push constant 7
+call R16 1
+pop temp 0
+label END
+goto END
+function R16 0
+push argument 0
+push constant 1
+add
+return
+`
+    cpu, err := loadHack(source, hackOptions())
+    if err != nil {
+        test.Fatalf("could not translate: %v", err)
+    }
+    for !cpu.Halted && cpu.Steps < 10000 {
+        cpu.Step()
+    }
+    if cpu.RAM[TempStart] != 8 {
+        test.Errorf("R16 returned %v instead of 8", cpu.RAM[TempStart])
+    }
+}
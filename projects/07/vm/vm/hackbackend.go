@@ -0,0 +1,861 @@
+package vm
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "io/ioutil"
+    "path/filepath"
+
+    "github.com/kazzmir/nand2tetris/assembler"
+)
+
+/* Translation of vm commands to hack assembly. Besides the plain translation
+ * of every command the hack backend can keep the top of the stack in D (see
+ * cache.go), check the stack against a limit (checked.go), count calls
+ * (profile.go), map the assembly back to the vm code (sourcemap.go) and report
+ * the size of the code (stats.go). Files are translated in parallel, see
+ * parallel.go.
+ */
+
+/* the commands the hack backend can translate */
+type asmCommand interface {
+    TranslateToAssembly(*asmTranslator) []string
+}
+
+/* The state of the hack backend, which is also what it leaves behind for the
+ * sidecar files and for the hack machine code backend.
+ */
+type asmTranslator struct {
+    Translator
+
+    /* the assembly and the instructions it was assembled to, when translating
+     * straight to machine code
+     */
+    assembly []byte
+    machineCode *assembler.ParsedProgram
+
+    /* shared assembly routines needed by the extended commands */
+    routines map[string]bool
+
+    /* if true the top of the stack is kept in D where possible, and topInD
+     * says whether it currently is
+     */
+    CacheTop bool
+    topInD bool
+
+    /* checked mode: test SP against StackLimit before the stack grows. the
+     * ids given to functions and the functions that need a trap entry are
+     * kept here, and the trap block sits just below trapLimit
+     */
+    CheckStack bool
+    StackLimit int
+    trapLimit int
+    functionIDs map[string]int
+    trapStubs map[int]bool
+
+    /* profiling: counters are handed out from profileNext upwards */
+    Profile bool
+    profileNext int
+    ProfileCounters []ProfileCounter
+
+    /* if not nil, records where the assembly of each vm command ends up */
+    sourceMap *SourceMap
+    /* if not nil, counts the instructions generated */
+    stats *statisticsCollector
+    /* the code size report, once the hack backend is done */
+    Statistics *Statistics
+}
+
+/* writes the assembly of the whole program, with the shared routines the
+ * commands asked for at the end
+ */
+func (translator *asmTranslator) translateProgram(writer io.Writer, program *VMProgram, options TranslateOptions) error {
+    output := &countingWriter{output: writer}
+    if options.SourceMap {
+        translator.sourceMap = NewSourceMap(output)
+    }
+    if options.Statistics || options.StatisticsJSON != "" {
+        translator.stats = newStatisticsCollector()
+    }
+
+    translator.CacheTop = options.CacheTop
+    translator.CheckStack = options.CheckStack
+    translator.StackLimit = options.StackLimit
+    if options.CheckStack {
+        translator.functionIDs = program.FunctionIDs()
+        /* the trap block takes the top of the stack region */
+        translator.trapLimit = options.StackLimit
+        translator.StackLimit = options.StackLimit - TrapSize
+    }
+
+    if options.Profile {
+        /* the counters go below the trap block, so a checked stack has to
+         * stop below them
+         */
+        base := translator.StackLimit - program.ProfileCounterCount()
+        if base <= StackStart {
+            return fmt.Errorf("Not enough room below %v for %v profile counters", translator.StackLimit, program.ProfileCounterCount())
+        }
+        translator.Profile = true
+        translator.profileNext = base
+        translator.StackLimit = base
+    }
+
+    err := writeBootstrapCode(output, program, options.Bootstrap, translator)
+    if err != nil {
+        return err
+    }
+
+    err = translateFiles(output, program.Files, translator)
+    if err != nil {
+        return err
+    }
+
+    writeSharedRoutines(output, translator)
+
+    if translator.stats != nil {
+        statistics := translator.stats.Statistics(output.Instructions)
+        translator.Statistics = &statistics
+    }
+
+    return nil
+}
+
+func (constant *PushConstant) TranslateToAssembly(translator *asmTranslator) []string {
+    return []string{
+        fmt.Sprintf("@%v", constant.Constant), // a = constant
+        "D=A", // d = a
+        "@SP", // a=0
+        "A=M", // a = ram[0]
+        "M=D", // ram[a] = D
+        "@SP", // a = 0
+        "M=M+1", // ram[a] = ram[a] + 1
+    }
+}
+
+func (add *Add) TranslateToAssembly(translator *asmTranslator) []string {
+    /* a = pop sp
+     * b = pop sp
+     * out = a + b
+     * push out
+     */
+
+    return []string{
+        "@SP",   // sp=sp-1
+        "AM=M-1",
+        "D=M",   // d=ram[sp]
+        "@SP",
+        "AM=M-1", // sp=sp-1
+        "M=D+M", // ram[sp]=d+ram[sp]
+        "@SP",
+        "M=M+1",
+    }
+}
+
+func (sub *Sub) TranslateToAssembly(translator *asmTranslator) []string {
+    /* sp -> y
+     *    -> x
+     * out = x-y
+     * push out
+     */
+    return []string {
+        "@SP",
+        "AM=M-1",
+        "D=M",    // y
+        "@SP",
+        "AM=M-1",
+        "M=M-D",
+        "@SP",
+        "M=M+1",
+    }
+}
+
+/* With y in D and SP pointing at x, leaves a value in D that has the sign of
+ * x-y and is 0 only if they are equal. Subtracting overflows when x and y are
+ * more than 32767 apart, which can only happen if their signs differ, and then
+ * the sign of x is the answer.
+ */
+func signedDifference(translator *asmTranslator) []string {
+    xNegative := translator.Gensym("cmp_xneg")
+    sameSign := translator.Gensym("cmp_same")
+    done := translator.Gensym("cmp_sign")
+
+    return []string{
+        "@R13",
+        "M=D", // r13 = y
+        "@SP",
+        "A=M",
+        "D=M", // d = x
+        fmt.Sprintf("@%v", xNegative),
+        "D; JLT",
+        "@R13",
+        "D=M",
+        fmt.Sprintf("@%v", sameSign),
+        "D; JGE",
+        "D=1", // x >= 0 > y
+        fmt.Sprintf("@%v", done),
+        "0; JMP",
+        fmt.Sprintf("(%v)", xNegative),
+        "@R13",
+        "D=M",
+        fmt.Sprintf("@%v", sameSign),
+        "D; JLT",
+        "D=-1", // x < 0 <= y
+        fmt.Sprintf("@%v", done),
+        "0; JMP",
+        fmt.Sprintf("(%v)", sameSign),
+        "@SP",
+        "A=M",
+        "D=M",
+        "@R13",
+        "D=D-M", // x-y
+        fmt.Sprintf("(%v)", done),
+    }
+}
+
+/* pops y and x, works out x-y with difference and pushes true unless jumpFalse
+ * jumps on the result
+ */
+func generateComparison(translator *asmTranslator, difference func(*asmTranslator) []string, jumpFalse string) []string {
+    falseBranch := translator.Gensym("cmp_false")
+    done := translator.Gensym("cmp_done")
+
+    out := []string{
+        "@SP",
+        "AM=M-1",
+        "D=M", // y
+        "@SP",
+        "AM=M-1",
+    }
+    out = append(out, difference(translator)...)
+
+    return append(out,
+        fmt.Sprintf("@%v", falseBranch),
+        fmt.Sprintf("D; %v", jumpFalse),
+        "@SP",
+        "A=M",
+        "M=-1",
+        fmt.Sprintf("@%v", done),
+        "0; JMP",
+        fmt.Sprintf("(%v)", falseBranch),
+        "@SP",
+        "A=M",
+        "M=0",
+        fmt.Sprintf("(%v)", done),
+        "@SP",
+        "M=M+1")
+}
+
+/* x-y wraps around but is still 0 exactly when x equals y */
+func plainDifference(translator *asmTranslator) []string {
+    return []string{"D=M-D"}
+}
+
+func (lt *Lt) TranslateToAssembly(translator *asmTranslator) []string {
+    /* sp -> b
+     *    -> a
+     * a-b is true if a<b and false if a>=b
+     *
+     */
+    return generateComparison(translator, signedDifference, "JGE")
+}
+
+func (eq *Eq) TranslateToAssembly(translator *asmTranslator) []string {
+    /* a = pop sp
+     * b = pop sp
+     * out = a == b
+     * push out
+     */
+
+    return generateComparison(translator, plainDifference, "JNE")
+}
+
+func (gt *Gt) TranslateToAssembly(translator *asmTranslator) []string {
+    return generateComparison(translator, signedDifference, "JLE")
+}
+
+func (neg *Neg) TranslateToAssembly(translator *asmTranslator) []string {
+    return []string {
+        "@SP",
+        "AM=M-1",
+        "M=-M",
+        "@SP",
+        "M=M+1",
+    }
+}
+
+func (not *Not) TranslateToAssembly(translator *asmTranslator) []string {
+    return []string {
+        "@SP",
+        "AM=M-1",
+        "M=!M",
+        "@SP",
+        "M=M+1",
+    }
+}
+
+func (and *And) TranslateToAssembly(translator *asmTranslator) []string {
+    return []string {
+        "@SP",
+        "AM=M-1",
+        "D=M",
+        "@SP",
+        "AM=M-1",
+        "M=D&M",
+        "@SP",
+        "M=M+1",
+    }
+}
+
+func (or *Or) TranslateToAssembly(translator *asmTranslator) []string {
+    return []string {
+        "@SP",
+        "AM=M-1",
+        "D=M",
+        "@SP",
+        "AM=M-1",
+        "M=D|M",
+        "@SP",
+        "M=M+1",
+    }
+}
+
+func popToSegment(segment string, index int) []string {
+    /* ram[local+index] = sp--
+     *
+     * store ram[sp-1] in r13
+     * compute local+index, store in r14
+     * store r14 into ram[r13]
+     */
+    return []string{
+        "@SP",
+        "AM=M-1",
+        "D=M", // d = ram[sp]
+
+        "@R13",
+        "M=D", // ram[r13] = d
+
+        fmt.Sprintf("@%v", index),
+        "D=A",
+        fmt.Sprintf("@%v", segment),
+        "D=D+M", // ram[local+index]
+        "@R14",
+        "M=D",  // ram[r14] = local+index
+
+        "@R13", // a = r13
+        "D=M",
+
+        "@R14",
+        "A=M",
+        "M=D",
+    }
+}
+
+func pushToSegment(segment string, index int) []string {
+    return []string {
+        fmt.Sprintf("@%v", segment),
+        "D=M",
+        fmt.Sprintf("@%v", index),
+        "D=D+A", // d = segment+index
+        "A=D",
+        "D=M",  // d = ram[segment+index]
+
+        "@SP",
+        "A=M",
+        "M=D", // ram[sp] = d
+        "@SP",
+        "M=M+1", // sp++
+    }
+}
+
+func (local *PopLocal) TranslateToAssembly(translator *asmTranslator) []string {
+    return popToSegment("LCL", local.Index)
+}
+
+func (argument *PopArgument) TranslateToAssembly(translator *asmTranslator) []string {
+    return popToSegment("ARG", argument.Index)
+}
+
+func (this *PopThis) TranslateToAssembly(translator *asmTranslator) []string {
+    return popToSegment("THIS", this.Index)
+}
+
+func (that *PopThat) TranslateToAssembly(translator *asmTranslator) []string {
+    return popToSegment("THAT", that.Index)
+}
+
+func (temp *PopTemp) TranslateToAssembly(translator *asmTranslator) []string {
+    index := TempStart + temp.Index
+    return []string{
+        "@SP",
+        "AM=M-1",
+        "D=M",
+        fmt.Sprintf("@%v", index),
+        "M=D",
+    }
+}
+
+func (pointer *PopPointer) TranslateToAssembly(translator *asmTranslator) []string {
+    index := PointerStart + pointer.Index
+    return []string{
+        "@SP",
+        "AM=M-1",
+        "D=M",
+        fmt.Sprintf("@%v", index),
+        "M=D",
+    }
+}
+
+func (local *PushLocal) TranslateToAssembly(translator *asmTranslator) []string {
+    return pushToSegment("LCL", local.Index)
+}
+
+func (temp *PushTemp) TranslateToAssembly(translator *asmTranslator) []string {
+    index := TempStart + temp.Index
+    return []string{
+        fmt.Sprintf("@%v", index),
+        "D=M",
+        "@SP",
+        "A=M",
+        "M=D",
+        "@SP",
+        "M=M+1",
+    }
+}
+
+func (this *PushThis) TranslateToAssembly(translator *asmTranslator) []string {
+    return pushToSegment("THIS", this.Index)
+}
+
+func (that *PushThat) TranslateToAssembly(translator *asmTranslator) []string {
+    return pushToSegment("THAT", that.Index)
+}
+
+func (argument *PushArgument) TranslateToAssembly(translator *asmTranslator) []string {
+    return pushToSegment("ARG", argument.Index)
+}
+
+func (pointer *PushPointer) TranslateToAssembly(translator *asmTranslator) []string {
+    index := PointerStart + pointer.Index
+    return []string{
+        fmt.Sprintf("@%v", index),
+        "D=M",
+        "@SP",
+        "A=M",
+        "M=D",
+        "@SP",
+        "M=M+1",
+    }
+}
+
+func (static *PushStatic) TranslateToAssembly(translator *asmTranslator) []string {
+    return []string{
+        fmt.Sprintf("@static.%v.%v", translator.CurrentFile, static.Index),
+        "D=M",
+        "@SP",
+        "A=M",
+        "M=D",
+        "@SP",
+        "M=M+1",
+    }
+}
+
+func (static *PopStatic) TranslateToAssembly(translator *asmTranslator) []string {
+    return []string{
+        "@SP",
+        "AM=M-1",
+        "D=M",
+        fmt.Sprintf("@static.%v.%v", translator.CurrentFile, static.Index),
+        "M=D",
+    }
+}
+
+/* vm labels are local to the function they appear in, so the symbol includes
+ * the function name
+ */
+func asmLabel(translator *asmTranslator, name string) string {
+    return fmt.Sprintf("%v$%v", translator.CurrentFunction, name)
+}
+
+func (label *Label) TranslateToAssembly(translator *asmTranslator) []string {
+    return []string {
+        fmt.Sprintf("(%v)", asmLabel(translator, label.Name)),
+    }
+}
+
+func (ifgoto *IfGoto) TranslateToAssembly(translator *asmTranslator) []string {
+    /* if-goto X
+     * pop a; if a != 0: jump X
+     */
+    return []string {
+        "@SP",
+        "AM=M-1",
+        "D=M",
+        fmt.Sprintf("@%v", asmLabel(translator, ifgoto.Name)),
+        "D; JNE",
+    }
+}
+
+func (this *Goto) TranslateToAssembly(translator *asmTranslator) []string {
+    return []string {
+        fmt.Sprintf("@%v", asmLabel(translator, this.Name)),
+        "0; JMP",
+    }
+}
+
+func (function *Function) TranslateToAssembly(translator *asmTranslator) []string {
+    /* modifies the translator */
+    translator.CurrentFunction = function.Name
+
+    out := []string {
+        fmt.Sprintf("(%v)", function.Name),
+    }
+
+    out = append(out, profileEntry(translator, function.Name)...)
+    out = append(out, stackCheck(translator, function.Locals)...)
+
+    for i := 0; i < function.Locals; i++ {
+
+        local := []string {
+            "@SP",
+            "A=M",
+            "M=0",
+            "@SP",
+            "M=M+1",
+        }
+
+        out = append(out, local...)
+    }
+
+    return out
+}
+
+func (ret *Return) TranslateToAssembly(translator *asmTranslator) []string {
+    return []string {
+        /* frame = lcl, ret = *(frame-5) */
+        "@LCL",
+        "D=M", // d = LCL
+        "@R13",
+        "M=D", // save LCL in r13
+        "@5",
+        "A=D-A", // 5 = (return address, that, this, arg, lcl)
+        "D=M", // d=*(lcl-5), which is the return address
+        "@R14",
+        "M=D", // r14 = return address
+
+        /* *ARG = pop() */
+        "@SP",
+        "AM=M-1",
+        "D=M", // d = popped value
+        "@ARG",
+        "A=M",
+        "M=D", // *arg = d
+
+        "@ARG",
+        "D=M+1",
+        "@SP",
+        "M=D", // set sp to arg+1
+
+        /* that = *(frame-1) */
+        "@1",
+        "D=A",
+        "@R13",
+        "A=M-D",
+        "D=M",
+        "@THAT",
+        "M=D",
+
+        /* this = *(frame-2) */
+        "@2",
+        "D=A",
+        "@R13",
+        "A=M-D",
+        "D=M",
+        "@THIS",
+        "M=D",
+
+        /* arg = *(frame-3) */
+        "@3",
+        "D=A",
+        "@R13",
+        "A=M-D",
+        "D=M",
+        "@ARG",
+        "M=D",
+
+        /* lcl = *(frame-4) */
+        "@4",
+        "D=A",
+        "@R13",
+        "A=M-D",
+        "D=M",
+        "@LCL",
+        "M=D",
+
+        /* goto ret */
+        "@R14",
+        "A=M",
+        "0; JMP",
+    }
+}
+
+func (call *Call) TranslateToAssembly(translator *asmTranslator) []string {
+    returnAddress := translator.Gensym(fmt.Sprintf("%v_return", translator.CurrentFunction))
+
+    return []string {
+        /* push return address */
+        fmt.Sprintf("@%v", returnAddress),
+        "D=A",
+        "@SP",
+        "A=M",
+        "M=D",
+        "@SP",
+        "M=M+1",
+
+        /* push lcl */
+        "@LCL",
+        "D=M",
+        "@SP",
+        "A=M",
+        "M=D",
+        "@SP",
+        "M=M+1",
+
+        /* push arg */
+        "@ARG",
+        "D=M",
+        "@SP",
+        "A=M",
+        "M=D",
+        "@SP",
+        "M=M+1",
+
+        /* push this */
+        "@THIS",
+        "D=M",
+        "@SP",
+        "A=M",
+        "M=D",
+        "@SP",
+        "M=M+1",
+
+        /* push that */
+        "@THAT",
+        "D=M",
+        "@SP",
+        "A=M",
+        "M=D",
+        "@SP",
+        "M=M+1",
+
+        /* arg = sp-n-5 */
+        "@SP",
+        "D=M",
+        fmt.Sprintf("@%v", call.Arguments),
+        "D=D-A",
+        "@5",
+        "D=D-A",
+        "@ARG",
+        "M=D",
+
+        /* lcl = sp */
+        "@SP",
+        "D=M",
+        "@LCL",
+        "M=D",
+
+        /* goto f */
+        fmt.Sprintf("@%v", call.Name),
+        "0; JMP",
+
+        fmt.Sprintf("(%v)", returnAddress),
+    }
+}
+
+func translateVMFile(output io.Writer, vmFile *VMFile, translator *asmTranslator) error {
+    translator.CurrentFile = vmFile.Class
+
+    io.WriteString(output, fmt.Sprintf("// %v", vmFile.Path))
+    output.Write([]byte{'\n'})
+
+    for _, line := range vmFile.Lines {
+        command, ok := line.Command.(asmCommand)
+        if !ok {
+            return unsupportedCommand(vmFile, line, "hack")
+        }
+        io.WriteString(output, fmt.Sprintf("// %s\n", line.Text))
+        if translator.sourceMap != nil {
+            translator.sourceMap.Begin(vmFile.Path, line.Line)
+        }
+        assembly := profileCall(translator, line.Command, fmt.Sprintf("%v:%v", filepath.Base(vmFile.Path), line.Line))
+        if translator.CheckStack {
+            if growth := stackGrowth(line.Command); growth > 0 {
+                /* the check uses D, so the cached top has to go first */
+                assembly = append(assembly, spillCache(translator)...)
+                assembly = append(assembly, stackCheck(translator, growth)...)
+            }
+        }
+        if translator.CacheTop {
+            assembly = append(assembly, translateCached(command, translator)...)
+        } else {
+            assembly = append(assembly, command.TranslateToAssembly(translator)...)
+        }
+        for _, asmLine := range assembly {
+            io.WriteString(output, asmLine)
+            output.Write([]byte{'\n'})
+        }
+        if translator.sourceMap != nil {
+            translator.sourceMap.End(translator.CurrentFunction)
+        }
+        if translator.stats != nil {
+            translator.stats.Add(commandKind(line.Command), translator.CurrentFunction, vmFile.Path, instructionCount(assembly))
+        }
+    }
+
+    /* the next file may start with a label, so leave the stack in memory */
+    for _, asmLine := range spillCache(translator) {
+        io.WriteString(output, asmLine)
+        output.Write([]byte{'\n'})
+    }
+
+    return nil
+}
+
+func bootstrapCode(entry string) []string {
+    return []string {
+        fmt.Sprintf("call %v 0", entry),
+    }
+}
+
+func setPointer(output io.Writer, pointer string, value int) {
+    io.WriteString(output, fmt.Sprintf("@%v\n", value))
+    io.WriteString(output, "D=A\n")
+    io.WriteString(output, fmt.Sprintf("@%v\n", pointer))
+    io.WriteString(output, "M=D\n")
+}
+
+func writeBootstrapCode(output io.Writer, program *VMProgram, options BootstrapOptions, translator *asmTranslator) error {
+    if !options.Enabled {
+        return nil
+    }
+
+    pointers, callEntry, err := planBootstrap(program, options)
+    if err != nil {
+        return err
+    }
+
+    for _, pointer := range pointers {
+        setPointer(output, pointer.Name, pointer.Value)
+    }
+
+    if !callEntry {
+        return nil
+    }
+
+    translator.CurrentFunction = options.EntryPoint
+
+    /*
+    io.WriteString(output, "@Sys.init\n")
+    io.WriteString(output, "0; JMP\n")
+    */
+
+    for _, line := range bootstrapCode(options.EntryPoint) {
+        command, err := processVMLine(line, ParseOptions{})
+        if err != nil {
+            return fmt.Errorf("Error in bootstrap code '%v': %v", line, err)
+        }
+
+        bootstrap, ok := command.(asmCommand)
+        if !ok {
+            return fmt.Errorf("Did not produce a command for bootstrap code line '%v'", line)
+        }
+
+        for _, asmLine := range bootstrap.TranslateToAssembly(translator) {
+            io.WriteString(output, asmLine)
+            output.Write([]byte{'\n'})
+        }
+    }
+
+    return nil
+}
+
+/* writes the reports and maps collected while translating, saying where they
+ * went in log
+ */
+func (translator *asmTranslator) WriteSidecars(log io.Writer, path string, options TranslateOptions) error {
+    if translator.Statistics != nil {
+        statistics := translator.Statistics.Top(options.StatisticsTop)
+        if options.Statistics {
+            writeStatistics(log, statistics)
+        }
+
+        if options.StatisticsJSON != "" {
+            statsFile, err := os.Create(options.StatisticsJSON)
+            if err != nil {
+                return err
+            }
+            defer statsFile.Close()
+
+            err = writeStatisticsJSON(statsFile, statistics)
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    if translator.machineCode != nil {
+        if options.KeepAssembly {
+            asmPath := replaceExtension(path, "asm")
+            err := ioutil.WriteFile(asmPath, translator.assembly, 0644)
+            if err != nil {
+                return err
+            }
+            fmt.Fprintf(log, "Assembly written to %v\n", asmPath)
+        }
+
+        if options.Listing {
+            listingPath := replaceExtension(path, "lst")
+            listing, err := os.Create(listingPath)
+            if err != nil {
+                return err
+            }
+            defer listing.Close()
+
+            err = writeListing(listing, translator.assembly, translator.machineCode)
+            if err != nil {
+                return err
+            }
+            fmt.Fprintf(log, "Listing written to %v\n", listingPath)
+        }
+    }
+
+    if translator.sourceMap != nil {
+        mapPath := replaceExtension(path, "map.json")
+        mapFile, err := os.Create(mapPath)
+        if err != nil {
+            return err
+        }
+        defer mapFile.Close()
+
+        err = translator.sourceMap.Write(mapFile)
+        if err != nil {
+            return err
+        }
+        fmt.Fprintf(log, "Source map written to %v\n", mapPath)
+    }
+
+    if translator.Profile {
+        mapPath := replaceExtension(path, "profile")
+        profileMap, err := os.Create(mapPath)
+        if err != nil {
+            return err
+        }
+        defer profileMap.Close()
+
+        writeProfileMap(profileMap, translator.ProfileCounters)
+        fmt.Fprintf(log, "Profile counters at RAM[%v..%v] are described in %v\n", translator.StackLimit, translator.StackLimit + len(translator.ProfileCounters) - 1, mapPath)
+    }
+
+    return nil
+}
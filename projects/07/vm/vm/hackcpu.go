@@ -0,0 +1,119 @@
+package vm
+
+import (
+    "fmt"
+    "strconv"
+
+    "github.com/kazzmir/nand2tetris/assembler"
+)
+
+/* A hack CPU that runs machine code, used to check translated programs against
+ * the vm interpreter. RAM covers the whole 15-bit address space, so the screen
+ * and keyboard are just more memory.
+ */
+type HackCPU struct {
+    ROM []uint16
+    RAM [RAMSize]int16
+    A int16
+    D int16
+    PC int
+    Halted bool
+    Steps uint64
+    /* the RAM address written by the last instruction, -1 if none */
+    Written int
+}
+
+func NewHackCPU(program *assembler.ParsedProgram) (*HackCPU, error) {
+    cpu := &HackCPU{Written: -1}
+    for i, code := range program.Code {
+        word, err := strconv.ParseUint(code.ToBinaryString(), 2, 16)
+        if err != nil {
+            return nil, fmt.Errorf("instruction %v cannot be decoded: %v", i, err)
+        }
+        cpu.ROM = append(cpu.ROM, uint16(word))
+    }
+
+    return cpu, nil
+}
+
+/* the hack ALU, control holds the bits zx nx zy ny f no from high to low */
+func hackALU(x int16, y int16, control uint16) int16 {
+    if control & 0x20 != 0 {
+        x = 0
+    }
+    if control & 0x10 != 0 {
+        x = ^x
+    }
+    if control & 0x8 != 0 {
+        y = 0
+    }
+    if control & 0x4 != 0 {
+        y = ^y
+    }
+
+    var out int16
+    if control & 0x2 != 0 {
+        out = x + y
+    } else {
+        out = x & y
+    }
+
+    if control & 0x1 != 0 {
+        out = ^out
+    }
+
+    return out
+}
+
+/* Runs one instruction. Running past the end of the ROM halts the CPU, as
+ * does an unconditional jump to the A instruction right before it, which is
+ * the (LOOP) @LOOP 0;JMP that programs end with.
+ */
+func (cpu *HackCPU) Step() {
+    cpu.Written = -1
+    if cpu.Halted || cpu.PC < 0 || cpu.PC >= len(cpu.ROM) {
+        cpu.Halted = true
+        return
+    }
+
+    instruction := cpu.ROM[cpu.PC]
+    cpu.Steps += 1
+
+    if instruction & 0x8000 == 0 {
+        cpu.A = int16(instruction)
+        cpu.PC += 1
+        return
+    }
+
+    address := int(uint16(cpu.A)) & (RAMSize - 1)
+    target := int(uint16(cpu.A))
+
+    y := cpu.A
+    if instruction & 0x1000 != 0 {
+        y = cpu.RAM[address]
+    }
+    out := hackALU(cpu.D, y, (instruction >> 6) & 0x3f)
+
+    /* dest is A D M from high to low, and M is the address A had before */
+    if instruction & 0x8 != 0 {
+        cpu.RAM[address] = out
+        cpu.Written = address
+    }
+    if instruction & 0x20 != 0 {
+        cpu.A = out
+    }
+    if instruction & 0x10 != 0 {
+        cpu.D = out
+    }
+
+    /* jump is lt eq gt from high to low */
+    jump := instruction & 0x7
+    if (jump & 0x4 != 0 && out < 0) || (jump & 0x2 != 0 && out == 0) || (jump & 0x1 != 0 && out > 0) {
+        if jump == 0x7 && instruction & 0x38 == 0 && target == cpu.PC - 1 && cpu.ROM[target] == uint16(target) {
+            cpu.Halted = true
+        }
+        cpu.PC = target
+    } else {
+        cpu.PC += 1
+    }
+}
@@ -0,0 +1,418 @@
+package vm
+
+import (
+    "fmt"
+    "strings"
+)
+
+/* Inlining of small functions.
+ *
+ * A call to a small function that makes no calls itself is replaced by the
+ * body of the function. The arguments and locals of the callee are kept in
+ * temp slots that no function of the program uses. Temp is shared by every
+ * function, so a value put there may be read after any number of calls and
+ * returns, and only a slot nothing else touches is safe. The slots are only
+ * used while an inlined body runs, which makes no calls, so every inlined call
+ * can use the same ones. If the callee sets THIS or THAT through the pointer
+ * segment then the caller's values are saved in temp as well and put back
+ * when the body returns.
+ *
+ * A callee is only inlined if
+ *  - it has at most the threshold number of commands
+ *  - it makes no calls, so it cannot be recursive
+ *  - it only uses statics when it is in the same class as the caller
+ *  - it does not read arguments beyond the ones passed
+ *  - every return happens with exactly the return value on its stack, and
+ *    some return can be reached
+ *  - it is not Sys.halt, which the backends treat as the end of the program
+ *  - there are enough free temp slots for everything above
+ */
+
+/* a function that may be inlined */
+type inlineCandidate struct {
+    Name string
+    Class string
+    Locals int
+    Body []VMLine
+    /* pointer slots set by the body */
+    setsPointer [PointerSize]bool
+    /* the highest argument read or written, -1 if none */
+    maxArgument int
+    usesStatic bool
+}
+
+/* the change in stack depth a command causes, false for commands whose
+ * effect is not a fixed number such as call and return
+ */
+func stackEffect(command Command) (int, bool) {
+    switch command.(type) {
+        case *PushConstant, *PushLocal, *PushArgument, *PushThis, *PushThat,
+             *PushTemp, *PushPointer, *PushStatic:
+            return 1, true
+        case *PopLocal, *PopArgument, *PopThis, *PopThat, *PopTemp,
+             *PopPointer, *PopStatic:
+            return -1, true
+        case *Add, *Sub, *And, *Or, *Eq, *Lt, *Gt,
+             *Mul, *Div, *Mod, *Shl, *Shr, *Xor:
+            return -1, true
+        case *Neg, *Not:
+            return 0, true
+        case *IfGoto:
+            return -1, true
+        case *Label, *Goto:
+            return 0, true
+    }
+
+    return 0, false
+}
+
+/* true if some return in the body can be reached and every return is reached
+ * with exactly one value on the stack, following jumps to labels
+ */
+func balancedReturns(body []VMLine) bool {
+    depths := make(map[string]int)
+    /* the depth every label is jumped to with, found by repeating the walk
+     * until nothing changes
+     */
+    for pass := 0; pass < 2 + len(body); pass++ {
+        changed := false
+        depth := 0
+        known := true
+        returns := false
+
+        record := func (label string, at int) bool {
+            old, ok := depths[label]
+            if !ok {
+                depths[label] = at
+                changed = true
+                return true
+            }
+            return old == at
+        }
+
+        for _, line := range body {
+            switch command := line.Command.(type) {
+                case *Label:
+                    if known {
+                        if !record(command.Name, depth) {
+                            return false
+                        }
+                    } else if at, ok := depths[command.Name]; ok {
+                        depth = at
+                        known = true
+                    }
+                    continue
+                case *Return:
+                    if known && depth != 1 {
+                        return false
+                    }
+                    returns = returns || known
+                    known = false
+                    continue
+            }
+
+            effect, ok := stackEffect(line.Command)
+            if !ok {
+                return false
+            }
+
+            if !known {
+                /* unreachable until the next label */
+                continue
+            }
+
+            depth += effect
+            if depth < 0 {
+                return false
+            }
+
+            switch command := line.Command.(type) {
+                case *Goto:
+                    if !record(command.Name, depth) {
+                        return false
+                    }
+                    known = false
+                case *IfGoto:
+                    if !record(command.Name, depth) {
+                        return false
+                    }
+            }
+        }
+
+        /* falling off the end of a function is not a return */
+        if known {
+            return false
+        }
+
+        /* a body that never returns, such as a halt loop, would not
+         * continue the caller
+         */
+        if !changed {
+            return returns
+        }
+    }
+
+    return false
+}
+
+/* finds the functions that are small enough and simple enough to inline */
+func (program *VMProgram) inlineCandidates(threshold int) map[string]*inlineCandidate {
+    candidates := make(map[string]*inlineCandidate)
+
+    for _, file := range program.Files {
+        var current *inlineCandidate
+        eligible := false
+
+        finish := func () {
+            if current != nil && eligible && current.Name != "Sys.halt" && len(current.Body) <= threshold && balancedReturns(current.Body) {
+                candidates[current.Name] = current
+            }
+            current = nil
+        }
+
+        for _, line := range file.Lines {
+            if function, ok := line.Command.(*Function); ok {
+                finish()
+                current = &inlineCandidate{
+                    Name: function.Name,
+                    Class: file.Class,
+                    Locals: function.Locals,
+                    maxArgument: -1,
+                }
+                eligible = true
+                continue
+            }
+
+            if current == nil {
+                continue
+            }
+
+            current.Body = append(current.Body, line)
+
+            switch command := line.Command.(type) {
+                case *Call, *TailCall:
+                    eligible = false
+                case *PopPointer:
+                    current.setsPointer[command.Index] = true
+                case *PushArgument:
+                    if command.Index > current.maxArgument {
+                        current.maxArgument = command.Index
+                    }
+                case *PopArgument:
+                    if command.Index > current.maxArgument {
+                        current.maxArgument = command.Index
+                    }
+                case *PushStatic, *PopStatic:
+                    current.usesStatic = true
+            }
+        }
+
+        finish()
+    }
+
+    return candidates
+}
+
+/* where the arguments, locals, saved pointers and return value of one inlined
+ * call live
+ */
+type inlineFrame struct {
+    arguments []int
+    locals []int
+    /* saved pointer slot -> temp slot */
+    saved map[int]int
+    /* holds the return value while the pointers are restored */
+    result int
+}
+
+func (candidate *inlineCandidate) frame(arguments int, usedTemps [TempSize]bool) (inlineFrame, bool) {
+    var free []int
+    for slot := 0; slot < TempSize; slot++ {
+        if !usedTemps[slot] {
+            free = append(free, slot)
+        }
+    }
+
+    take := func () (int, bool) {
+        if len(free) == 0 {
+            return 0, false
+        }
+        slot := free[0]
+        free = free[1:]
+        return slot, true
+    }
+
+    frame := inlineFrame{saved: make(map[int]int)}
+    for i := 0; i < arguments; i++ {
+        slot, ok := take()
+        if !ok {
+            return frame, false
+        }
+        frame.arguments = append(frame.arguments, slot)
+    }
+
+    for i := 0; i < candidate.Locals; i++ {
+        slot, ok := take()
+        if !ok {
+            return frame, false
+        }
+        frame.locals = append(frame.locals, slot)
+    }
+
+    for pointer := 0; pointer < PointerSize; pointer++ {
+        if candidate.setsPointer[pointer] {
+            slot, ok := take()
+            if !ok {
+                return frame, false
+            }
+            frame.saved[pointer] = slot
+        }
+    }
+
+    if len(frame.saved) > 0 {
+        slot, ok := take()
+        if !ok {
+            return frame, false
+        }
+        frame.result = slot
+    }
+
+    return frame, true
+}
+
+/* the temp slots used anywhere in the program */
+func (program *VMProgram) usedTemps() [TempSize]bool {
+    var used [TempSize]bool
+    for _, file := range program.Files {
+        for _, line := range file.Lines {
+            switch command := line.Command.(type) {
+                case *PushTemp:
+                    used[command.Index] = true
+                case *PopTemp:
+                    used[command.Index] = true
+            }
+        }
+    }
+
+    return used
+}
+
+/* Replaces calls to small leaf functions with their bodies. threshold is the
+ * largest number of commands a function may have, not counting the function
+ * command itself. Returns the number of calls that were inlined.
+ */
+func (program *VMProgram) InlineFunctions(threshold int) int {
+    candidates := program.inlineCandidates(threshold)
+    /* found before any call is inlined, the inlined bodies can share slots */
+    usedTemps := program.usedTemps()
+    count := 0
+
+    for _, file := range program.Files {
+        var out []VMLine
+        for _, line := range file.Lines {
+            call, ok := line.Command.(*Call)
+            if !ok {
+                out = append(out, line)
+                continue
+            }
+
+            candidate, ok := candidates[call.Name]
+            if !ok || candidate.maxArgument >= call.Arguments || (candidate.usesStatic && candidate.Class != file.Class) {
+                out = append(out, line)
+                continue
+            }
+
+            frame, ok := candidate.frame(call.Arguments, usedTemps)
+            if !ok {
+                out = append(out, line)
+                continue
+            }
+
+            out = append(out, candidate.expand(frame, line, count)...)
+            count += 1
+        }
+
+        file.Lines = out
+    }
+
+    return count
+}
+
+/* the body of the candidate for the call at site, with its labels made unique
+ * by the number of the inlined call
+ */
+func (candidate *inlineCandidate) expand(frame inlineFrame, site VMLine, number int) []VMLine {
+    var out []VMLine
+    emit := func (command Command, text string) {
+        out = append(out, VMLine{
+            Command: command,
+            Text: fmt.Sprintf("%v (inlined %v)", text, candidate.Name),
+            Line: site.Line,
+        })
+    }
+
+    label := func (name string) string {
+        return fmt.Sprintf("%v$inline%v$%v", candidate.Name, number, name)
+    }
+    end := label("end")
+
+    /* the arguments are on the stack with the last one on top */
+    for i := len(frame.arguments) - 1; i >= 0; i-- {
+        emit(&PopTemp{Index: frame.arguments[i]}, fmt.Sprintf("pop temp %v", frame.arguments[i]))
+    }
+
+    for _, slot := range frame.locals {
+        emit(&PushConstant{Constant: 0}, "push constant 0")
+        emit(&PopTemp{Index: slot}, fmt.Sprintf("pop temp %v", slot))
+    }
+
+    for pointer := 0; pointer < PointerSize; pointer++ {
+        if slot, ok := frame.saved[pointer]; ok {
+            emit(&PushPointer{Index: pointer}, fmt.Sprintf("push pointer %v", pointer))
+            emit(&PopTemp{Index: slot}, fmt.Sprintf("pop temp %v", slot))
+        }
+    }
+
+    for i, line := range candidate.Body {
+        text := strings.TrimSpace(normalizeWhitespace(line.Text))
+        switch command := line.Command.(type) {
+            case *PushArgument:
+                emit(&PushTemp{Index: frame.arguments[command.Index]}, text)
+            case *PopArgument:
+                emit(&PopTemp{Index: frame.arguments[command.Index]}, text)
+            case *PushLocal:
+                emit(&PushTemp{Index: frame.locals[command.Index]}, text)
+            case *PopLocal:
+                emit(&PopTemp{Index: frame.locals[command.Index]}, text)
+            case *Label:
+                emit(&Label{Name: label(command.Name)}, text)
+            case *Goto:
+                emit(&Goto{Name: label(command.Name)}, text)
+            case *IfGoto:
+                emit(&IfGoto{Name: label(command.Name)}, text)
+            case *Return:
+                if len(frame.saved) > 0 {
+                    emit(&PopTemp{Index: frame.result}, text)
+                    for pointer := 0; pointer < PointerSize; pointer++ {
+                        if slot, ok := frame.saved[pointer]; ok {
+                            emit(&PushTemp{Index: slot}, text)
+                            emit(&PopPointer{Index: pointer}, text)
+                        }
+                    }
+                    emit(&PushTemp{Index: frame.result}, text)
+                }
+                /* the last command of a body is always a return or a jump,
+                 * so only other returns need to jump to the end
+                 */
+                if i != len(candidate.Body) - 1 {
+                    emit(&Goto{Name: end}, text)
+                }
+            default:
+                emit(line.Command, text)
+        }
+    }
+
+    emit(&Label{Name: end}, fmt.Sprintf("label %v", end))
+
+    return out
+}
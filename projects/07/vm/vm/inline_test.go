@@ -0,0 +1,144 @@
+package vm
+
+import (
+    "testing"
+    "strings"
+)
+
+/* Sys.init keeps a value in temp 1 across a call to Sys.b, which does not use
+ * temp itself but calls Sys.c. The locals of Sys.c must not go in temp 1 when
+ * it is inlined into Sys.b.
+ */
+func TestInlineKeepsCallerTemps(test *testing.T){
+    source := `
+function Sys.init 0
+push constant 42
+pop temp 1
+call Sys.b 0
+pop temp 0
+push temp 1
+pop static 0
+label END
+goto END
+function Sys.b 0
+push constant 3
+call Sys.c 1
+return
+function Sys.c 2
+push argument 0
+pop local 0
+push constant 6
+pop local 1
+push local 0
+push local 1
+add
+return
+`
+    for _, inline := range []int{0, 20} {
+        options := hackOptions()
+        options.Inline = inline
+
+        machine := runHack(test, translateSource(test, source, options))
+        if machine.static("static.Test.0") != 42 {
+            test.Errorf("with -inline %v the static is %v instead of 42", inline, machine.static("static.Test.0"))
+        }
+    }
+}
+
+func TestInlineCount(test *testing.T){
+    source := `
+function Sys.init 0
+push constant 1
+call Sys.c 1
+pop temp 0
+label END
+goto END
+function Sys.c 0
+push argument 0
+return
+`
+    file, err := ParseVMFile(strings.NewReader(source), "Sys.vm", ParseOptions{})
+    if err != nil {
+        test.Fatalf("could not parse: %v", err)
+    }
+
+    program := &VMProgram{Files: []*VMFile{file}}
+    if count := program.InlineFunctions(20); count != 1 {
+        test.Fatalf("inlined %v calls instead of 1", count)
+    }
+
+    for _, line := range file.Lines {
+        if _, ok := line.Command.(*Call); ok {
+            test.Fatalf("the call is still there: %v", line.Text)
+        }
+    }
+}
+
+/* inlining the leaf functions of a program does not change what it computes */
+func TestInlineEveryCommand(test *testing.T){
+    options := hackOptions()
+    options.Inline = 100
+    assembly := translateSource(test, everyCommandSource, options)
+    if strings.Contains(assembly, "@Test.mix\n") {
+        test.Errorf("Test.mix was not inlined")
+    }
+
+    machine := runHack(test, assembly)
+    if machine.RAM[TempStart] != 1 || machine.static("static.Test.1") != 1025 {
+        test.Errorf("inlining changed the results to %v and %v", machine.RAM[TempStart], machine.static("static.Test.1"))
+    }
+}
+
+/* Sys.halt and functions that can never return are left as calls */
+func TestInlineSkipsNonReturning(test *testing.T){
+    source := `
+function Sys.init 0
+push constant 1
+call Sys.spin 1
+push constant 2
+call Sys.loop 1
+push constant 3
+call Sys.halt 1
+push constant 4
+call Sys.small 1
+return
+function Sys.halt 0
+push constant 0
+return
+function Sys.loop 0
+label LOOP
+goto LOOP
+function Sys.spin 0
+push argument 0
+if-goto SPIN
+push constant 0
+return
+label SPIN
+goto SPIN
+function Sys.small 0
+push argument 0
+return
+`
+    file, err := ParseVMFile(strings.NewReader(source), "Sys.vm", ParseOptions{})
+    if err != nil {
+        test.Fatalf("could not parse: %v", err)
+    }
+
+    program := &VMProgram{Files: []*VMFile{file}}
+    candidates := program.inlineCandidates(20)
+    for _, name := range []string{"Sys.halt", "Sys.loop"} {
+        if _, ok := candidates[name]; ok {
+            test.Errorf("%v is a candidate for inlining", name)
+        }
+    }
+    /* Sys.spin can return when its argument is 0 */
+    for _, name := range []string{"Sys.spin", "Sys.small"} {
+        if _, ok := candidates[name]; !ok {
+            test.Errorf("%v is not a candidate for inlining", name)
+        }
+    }
+
+    if count := program.InlineFunctions(20); count != 2 {
+        test.Errorf("inlined %v calls instead of 2", count)
+    }
+}
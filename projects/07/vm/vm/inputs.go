@@ -0,0 +1,269 @@
+package vm
+
+import (
+    "os"
+    "fmt"
+    "bufio"
+    "sort"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+)
+
+/* Controls which .vm files make up the program */
+type InputOptions struct {
+    /* a file listing the inputs, see readManifest */
+    Manifest string
+    /* directories whose .vm and .vmb files are added unless every class they
+     * define was already given, such as a shared OS directory
+     */
+    SearchDirs []string
+    /* globs matched against the path of a file relative to the directory
+     * being scanned. a file is used if it matches some include pattern, or
+     * there are none, and no exclude pattern
+     */
+    Include []string
+    Exclude []string
+    /* look in subdirectories as well */
+    Recursive bool
+}
+
+func (options InputOptions) selects(relative string) (bool, error) {
+    matchAny := func (patterns []string) (bool, error) {
+        for _, pattern := range patterns {
+            /* a pattern without a directory also matches in subdirectories */
+            name := relative
+            if !strings.Contains(pattern, "/") {
+                name = filepath.Base(relative)
+            }
+
+            matched, err := filepath.Match(pattern, name)
+            if err != nil {
+                return false, fmt.Errorf("Bad pattern '%v': %v", pattern, err)
+            }
+            if matched {
+                return true, nil
+            }
+        }
+        return false, nil
+    }
+
+    if len(options.Include) > 0 {
+        included, err := matchAny(options.Include)
+        if err != nil || !included {
+            return false, err
+        }
+    }
+
+    excluded, err := matchAny(options.Exclude)
+    return !excluded, err
+}
+
+/* returns the .vm and .vmb files in root, sorted by path. only regular files
+ * count, so a directory named foo.vm is not mistaken for a vm file.
+ */
+func findVMFiles(root string, options InputOptions) ([]string, error) {
+    var out []string
+
+    consider := func (path string, info os.FileInfo) error {
+        extension := filepath.Ext(path)
+        if !info.Mode().IsRegular() || (extension != ".vm" && extension != BytecodeExtension) {
+            return nil
+        }
+
+        relative, err := filepath.Rel(root, path)
+        if err != nil {
+            return err
+        }
+
+        use, err := options.selects(filepath.ToSlash(relative))
+        if err != nil {
+            return err
+        }
+        if use {
+            out = append(out, path)
+        }
+        return nil
+    }
+
+    if options.Recursive {
+        err := filepath.Walk(root, func (path string, info os.FileInfo, err error) error {
+            if err != nil {
+                return err
+            }
+            return consider(path, info)
+        })
+        if err != nil {
+            return nil, err
+        }
+    } else {
+        entries, err := ioutil.ReadDir(root)
+        if err != nil {
+            return nil, err
+        }
+        for _, info := range entries {
+            err = consider(filepath.Join(root, info.Name()), info)
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    sort.Strings(out)
+    return out, nil
+}
+
+/* A manifest lists the inputs of a program, one per line:
+ *
+ *   # a comment
+ *   Main.vm          a vm file
+ *   lib              every .vm file in a directory
+ *   search ../os     a search directory, as with -search
+ *
+ * Relative paths are relative to the directory of the manifest. Returns the
+ * files and the search directories in the order they appear.
+ */
+func readManifest(path string, options InputOptions) ([]string, []string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, nil, err
+    }
+    defer file.Close()
+
+    base := filepath.Dir(path)
+    resolve := func (name string) string {
+        if filepath.IsAbs(name) {
+            return name
+        }
+        return filepath.Join(base, name)
+    }
+
+    var files []string
+    var searchDirs []string
+
+    scanner := bufio.NewScanner(file)
+    lineNumber := 0
+    for scanner.Scan() {
+        lineNumber += 1
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        fields := strings.Fields(line)
+        if fields[0] == "search" {
+            if len(fields) != 2 {
+                return nil, nil, fmt.Errorf("%v:%v: expected 'search <directory>'", path, lineNumber)
+            }
+            searchDirs = append(searchDirs, resolve(fields[1]))
+            continue
+        }
+
+        entry := resolve(line)
+        if isDir(entry) {
+            found, err := findVMFiles(entry, options)
+            if err != nil {
+                return nil, nil, err
+            }
+            files = append(files, found...)
+        } else if isFile(entry) {
+            files = append(files, entry)
+        } else {
+            return nil, nil, fmt.Errorf("%v:%v: no such file or directory '%v'", path, lineNumber, line)
+        }
+    }
+
+    return files, searchDirs, scanner.Err()
+}
+
+/* Works out the vm files to translate, given a .vm file, a directory or the
+ * manifest in the options. Files from search directories come after the
+ * others and are only used for classes that no other file provides. The
+ * classes of a .vmb file are read from the file, since it can hold many.
+ */
+func findInputs(path string, options InputOptions) ([]string, error) {
+    var files []string
+    searchDirs := options.SearchDirs
+
+    if options.Manifest != "" {
+        manifestFiles, manifestDirs, err := readManifest(options.Manifest, options)
+        if err != nil {
+            return nil, err
+        }
+        files = manifestFiles
+        searchDirs = append(append([]string(nil), manifestDirs...), searchDirs...)
+    } else {
+        resolved, err := filepath.EvalSymlinks(path)
+        if err != nil {
+            return nil, err
+        }
+
+        if isFile(resolved) {
+            files = []string{resolved}
+        } else if isDir(resolved) {
+            files, err = findVMFiles(resolved, options)
+            if err != nil {
+                return nil, err
+            }
+        } else {
+            return nil, fmt.Errorf("Not a file or directory?")
+        }
+    }
+
+    classes := make(map[string]bool)
+    seen := make(map[string]bool)
+    var out []string
+    for _, file := range files {
+        /* a file given twice is only translated once */
+        clean := filepath.Clean(file)
+        if !seen[clean] {
+            seen[clean] = true
+            names, err := fileClasses(file)
+            if err != nil {
+                return nil, err
+            }
+            for _, name := range names {
+                classes[name] = true
+            }
+            out = append(out, file)
+        }
+    }
+
+    for _, dir := range searchDirs {
+        found, err := findVMFiles(dir, options)
+        if err != nil {
+            return nil, err
+        }
+        for _, file := range found {
+            names, err := fileClasses(file)
+            if err != nil {
+                return nil, err
+            }
+
+            /* a bytecode file is used if it has any class that is missing,
+             * AddFile leaves out the ones that are not
+             */
+            missing := false
+            for _, name := range names {
+                if !classes[name] {
+                    missing = true
+                    classes[name] = true
+                }
+            }
+            if missing {
+                out = append(out, file)
+            }
+        }
+    }
+
+    /* bytecode files go last, so a class in a .vm file is always the one used */
+    sort.SliceStable(out, func (i int, j int) bool {
+        return filepath.Ext(out[i]) != BytecodeExtension && filepath.Ext(out[j]) == BytecodeExtension
+    })
+
+    if len(out) == 0 {
+        return nil, fmt.Errorf("No .vm files found")
+    }
+
+    return out, nil
+}
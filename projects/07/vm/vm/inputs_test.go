@@ -0,0 +1,134 @@
+package vm
+
+import (
+    "testing"
+    "os"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+)
+
+/* makes each file with empty contents, or a directory if the name ends in / */
+func makeTree(test *testing.T, files ...string) string {
+    root, err := ioutil.TempDir("", "inputs")
+    if err != nil {
+        test.Fatalf("could not make a directory: %v", err)
+    }
+
+    for _, name := range files {
+        path := filepath.Join(root, filepath.FromSlash(name))
+        err = os.MkdirAll(filepath.Dir(path), 0755)
+        if err == nil {
+            if strings.HasSuffix(name, "/") {
+                err = os.MkdirAll(path, 0755)
+            } else {
+                err = ioutil.WriteFile(path, nil, 0644)
+            }
+        }
+        if err != nil {
+            test.Fatalf("could not make %v: %v", name, err)
+        }
+    }
+
+    return root
+}
+
+/* the paths relative to root, with forward slashes */
+func relativePaths(test *testing.T, root string, paths []string) []string {
+    var out []string
+    for _, path := range paths {
+        relative, err := filepath.Rel(root, path)
+        if err != nil {
+            test.Fatalf("%v is not in %v", path, root)
+        }
+        out = append(out, filepath.ToSlash(relative))
+    }
+    return out
+}
+
+func checkPaths(test *testing.T, what string, got []string, expected ...string) {
+    if strings.Join(got, " ") != strings.Join(expected, " ") {
+        test.Errorf("%v: expected %v but got %v", what, expected, got)
+    }
+}
+
+func TestFindVMFiles(test *testing.T){
+    root := makeTree(test, "Main.vm", "Test.vm", "notes.txt", "dir.vm/", "lib/List.vm", "lib/ListTest.vm")
+    defer os.RemoveAll(root)
+
+    find := func (options InputOptions) []string {
+        files, err := findVMFiles(root, options)
+        if err != nil {
+            test.Fatalf("could not find files: %v", err)
+        }
+        return relativePaths(test, root, files)
+    }
+
+    checkPaths(test, "plain", find(InputOptions{}), "Main.vm", "Test.vm")
+    checkPaths(test, "recursive", find(InputOptions{Recursive: true}), "Main.vm", "Test.vm", "lib/List.vm", "lib/ListTest.vm")
+    checkPaths(test, "exclude", find(InputOptions{Recursive: true, Exclude: []string{"*Test.vm"}}), "Main.vm", "lib/List.vm")
+    checkPaths(test, "include with a directory", find(InputOptions{Recursive: true, Include: []string{"lib/*"}}), "lib/List.vm", "lib/ListTest.vm")
+    checkPaths(test, "include and exclude", find(InputOptions{Recursive: true, Include: []string{"lib/*"}, Exclude: []string{"*Test.vm"}}), "lib/List.vm")
+
+    _, err := findVMFiles(root, InputOptions{Include: []string{"["}})
+    if err == nil {
+        test.Errorf("a bad pattern was accepted")
+    }
+}
+
+func TestFindInputs(test *testing.T){
+    root := makeTree(test, "game/Main.vm", "game/Memory.vm", "os/Memory.vm", "os/Math.vm", "os/Sys.vm")
+    defer os.RemoveAll(root)
+
+    options := InputOptions{SearchDirs: []string{filepath.Join(root, "os")}}
+    files, err := findInputs(filepath.Join(root, "game"), options)
+    if err != nil {
+        test.Fatalf("could not find inputs: %v", err)
+    }
+    /* the game's own Memory comes first and hides the one in os */
+    checkPaths(test, "search", relativePaths(test, root, files), "game/Main.vm", "game/Memory.vm", "os/Math.vm", "os/Sys.vm")
+
+    manifest := filepath.Join(root, "game.manifest")
+    err = ioutil.WriteFile(manifest, []byte(`
+# the game and its own memory manager
+game/Main.vm
+game/Main.vm
+game/Memory.vm
+search os
+`), 0644)
+    if err != nil {
+        test.Fatalf("could not write the manifest: %v", err)
+    }
+
+    files, err = findInputs(manifest, InputOptions{Manifest: manifest})
+    if err != nil {
+        test.Fatalf("could not read the manifest: %v", err)
+    }
+    checkPaths(test, "manifest", relativePaths(test, root, files), "game/Main.vm", "game/Memory.vm", "os/Math.vm", "os/Sys.vm")
+
+    err = ioutil.WriteFile(manifest, []byte("game/Missing.vm\n"), 0644)
+    if err != nil {
+        test.Fatalf("could not write the manifest: %v", err)
+    }
+    _, err = findInputs(manifest, InputOptions{Manifest: manifest})
+    if err == nil || !strings.Contains(err.Error(), ":1:") {
+        test.Errorf("expected an error on line 1 of the manifest but got %v", err)
+    }
+}
+
+func TestReplaceExtension(test *testing.T){
+    root := makeTree(test, "v1.2/Main.vm", "v1.2/game.d/")
+    defer os.RemoveAll(root)
+
+    cases := map[string]string{
+        "v1.2/Main.vm": "v1.2/Main.asm",
+        "v1.2/game.d": "v1.2/game.d.asm",
+        "v1.2": "v1.2.asm",
+    }
+    for input, expected := range cases {
+        got := replaceExtension(filepath.Join(root, input), "asm")
+        if got != filepath.Join(root, expected) {
+            test.Errorf("%v became %v instead of %v", input, got, expected)
+        }
+    }
+}
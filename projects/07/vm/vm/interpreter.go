@@ -0,0 +1,443 @@
+package vm
+
+import (
+    "fmt"
+    "path/filepath"
+)
+
+/* An interpreter that runs vm commands directly. RAM is laid out exactly as
+ * the translated code would lay it out: the pointers, temp, statics in the
+ * order the assembler would allocate them, the stack and the heap. The only
+ * difference is what a call pushes as its return address, which here is the
+ * index of the instruction after the call.
+ */
+
+const RAMSize = 32768
+
+/* one vm command along with where it came from */
+type Instruction struct {
+    Command Command
+    File *VMFile
+    Line uint64
+    Text string
+    /* the function the command is part of */
+    Function string
+    /* the RAM address of the static a push or pop static uses */
+    staticAddress int
+}
+
+/* where the instruction came from, as file:line */
+func (instruction *Instruction) Position() string {
+    return fmt.Sprintf("%v:%v", instruction.File.Path, instruction.Line)
+}
+
+/* a static variable of a file and the RAM address it lives at */
+type StaticSlot struct {
+    Index int
+    Address int
+}
+
+type Machine struct {
+    RAM [RAMSize]int16
+    Code []Instruction
+    /* the index of the next instruction to run */
+    PC int
+    Halted bool
+    Steps uint64
+    /* the RAM addresses written by the last step */
+    Writes []int
+
+    functions map[string]int
+    /* keyed by function and label, since labels are local to a function */
+    labels map[string]int
+    statics map[string][]StaticSlot
+}
+
+func labelKey(function string, label string) string {
+    return fmt.Sprintf("%v$%v", function, label)
+}
+
+/* Loads a program and runs the same bootstrap code the translator would
+ * emit. If the entry point is called, returning from it halts the machine.
+ */
+func NewMachine(program *VMProgram, options BootstrapOptions) (*Machine, error) {
+    machine := &Machine{
+        functions: make(map[string]int),
+        labels: make(map[string]int),
+        statics: make(map[string][]StaticSlot),
+    }
+
+    /* statics get addresses in the order they are first used, which is the
+     * order the assembler sees them in
+     */
+    staticAddresses := make(map[string]int)
+    static := func (file *VMFile, index int) int {
+        key := fmt.Sprintf("%v.%v", file.Class, index)
+        address, ok := staticAddresses[key]
+        if !ok {
+            address = StaticStart + len(staticAddresses)
+            staticAddresses[key] = address
+            machine.statics[file.Class] = append(machine.statics[file.Class], StaticSlot{Index: index, Address: address})
+        }
+        return address
+    }
+
+    for _, file := range program.Files {
+        function := TopLevelFunction
+        for _, line := range file.Lines {
+            instruction := Instruction{
+                Command: line.Command,
+                File: file,
+                Line: line.Line,
+                Text: normalizeWhitespace(line.Text),
+            }
+
+            switch command := line.Command.(type) {
+                case *Function:
+                    function = command.Name
+                    machine.functions[function] = len(machine.Code)
+                case *Label:
+                    machine.labels[labelKey(function, command.Name)] = len(machine.Code)
+                case *PushStatic:
+                    instruction.staticAddress = static(file, command.Index)
+                case *PopStatic:
+                    instruction.staticAddress = static(file, command.Index)
+            }
+
+            instruction.Function = function
+            machine.Code = append(machine.Code, instruction)
+        }
+    }
+
+    if len(machine.Code) >= RAMSize {
+        return nil, fmt.Errorf("The program has %v commands, but return addresses only go up to %v", len(machine.Code), RAMSize - 1)
+    }
+
+    if !options.Enabled {
+        return machine, nil
+    }
+
+    pointers, callEntry, err := planBootstrap(program, options)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, pointer := range pointers {
+        address := map[string]int{"SP": 0, "LCL": 1, "ARG": 2, "THIS": 3, "THAT": 4}[pointer.Name]
+        machine.RAM[address] = int16(pointer.Value)
+    }
+
+    if callEntry {
+        /* returning to the end of the code halts */
+        machine.call(options.EntryPoint, 0, len(machine.Code))
+    }
+
+    return machine, nil
+}
+
+/* the instruction that runs next, or nil once the machine has halted */
+func (machine *Machine) Current() *Instruction {
+    if machine.Halted || machine.PC < 0 || machine.PC >= len(machine.Code) {
+        return nil
+    }
+    return &machine.Code[machine.PC]
+}
+
+/* the index of the first command of a function */
+func (machine *Machine) FunctionEntry(name string) (int, bool) {
+    index, ok := machine.functions[name]
+    return index, ok
+}
+
+/* the index of the command at file:line. The file may be given by its base
+ * name alone
+ */
+func (machine *Machine) FindLine(file string, line uint64) (int, bool) {
+    for i, instruction := range machine.Code {
+        if instruction.Line != line {
+            continue
+        }
+        path := instruction.File.Path
+        if path == file || filepath.Base(path) == file || filepath.Base(path) == file + ".vm" {
+            return i, true
+        }
+    }
+    return 0, false
+}
+
+/* the statics the program uses for a class, in the order they were first used */
+func (machine *Machine) Statics(class string) []StaticSlot {
+    return machine.statics[class]
+}
+
+func (machine *Machine) Read(address int) int16 {
+    return machine.RAM[address & (RAMSize - 1)]
+}
+
+func (machine *Machine) write(address int, value int16) {
+    address &= RAMSize - 1
+    machine.RAM[address] = value
+    machine.Writes = append(machine.Writes, address)
+}
+
+func (machine *Machine) push(value int16) {
+    sp := int(machine.RAM[0])
+    machine.write(sp, value)
+    machine.write(0, int16(sp + 1))
+}
+
+func (machine *Machine) pop() int16 {
+    sp := machine.RAM[0] - 1
+    machine.write(0, sp)
+    return machine.Read(int(sp))
+}
+
+func (machine *Machine) binary(operation func (x int16, y int16) int16) {
+    y := machine.pop()
+    x := machine.pop()
+    machine.push(operation(x, y))
+}
+
+func boolean(value bool) int16 {
+    if value {
+        return -1
+    }
+    return 0
+}
+
+/* pushes a frame and jumps to the function, the arguments are already on the
+ * stack
+ */
+func (machine *Machine) call(name string, arguments int, returnAddress int) error {
+    entry, ok := machine.functions[name]
+    if !ok {
+        return fmt.Errorf("call to undefined function '%v'", name)
+    }
+
+    machine.push(int16(returnAddress))
+    for pointer := 1; pointer <= 4; pointer++ {
+        machine.push(machine.RAM[pointer])
+    }
+
+    sp := int(machine.RAM[0])
+    machine.write(2, int16(sp - arguments - 5))
+    machine.write(1, int16(sp))
+    machine.PC = entry
+    return nil
+}
+
+func (machine *Machine) jump(function string, label string) error {
+    target, ok := machine.labels[labelKey(function, label)]
+    if !ok {
+        return fmt.Errorf("label '%v' is not defined in function '%v'", label, function)
+    }
+    machine.PC = target
+    return nil
+}
+
+/* RAM[RAM[pointer] + index] */
+func (machine *Machine) segmentAddress(pointer int, index int) int {
+    return int(machine.RAM[pointer]) + index
+}
+
+/* Runs one command. Reaching the end of the code, returning to it, entering
+ * Sys.halt or jumping back to a label just before the jump halts the machine.
+ */
+func (machine *Machine) Step() error {
+    machine.Writes = machine.Writes[:0]
+
+    instruction := machine.Current()
+    if instruction == nil {
+        machine.Halted = true
+        return nil
+    }
+
+    machine.Steps += 1
+    next := machine.PC + 1
+
+    switch command := instruction.Command.(type) {
+        case *PushConstant: machine.push(int16(command.Constant))
+        case *PushLocal: machine.push(machine.Read(machine.segmentAddress(1, command.Index)))
+        case *PushArgument: machine.push(machine.Read(machine.segmentAddress(2, command.Index)))
+        case *PushThis: machine.push(machine.Read(machine.segmentAddress(3, command.Index)))
+        case *PushThat: machine.push(machine.Read(machine.segmentAddress(4, command.Index)))
+        case *PushTemp: machine.push(machine.Read(TempStart + command.Index))
+        case *PushPointer: machine.push(machine.Read(PointerStart + command.Index))
+        case *PushStatic: machine.push(machine.Read(instruction.staticAddress))
+
+        /* the address is worked out before the pop, like the assembly does */
+        case *PopLocal:
+            address := machine.segmentAddress(1, command.Index)
+            machine.write(address, machine.pop())
+        case *PopArgument:
+            address := machine.segmentAddress(2, command.Index)
+            machine.write(address, machine.pop())
+        case *PopThis:
+            address := machine.segmentAddress(3, command.Index)
+            machine.write(address, machine.pop())
+        case *PopThat:
+            address := machine.segmentAddress(4, command.Index)
+            machine.write(address, machine.pop())
+        case *PopTemp: machine.write(TempStart + command.Index, machine.pop())
+        case *PopPointer: machine.write(PointerStart + command.Index, machine.pop())
+        case *PopStatic: machine.write(instruction.staticAddress, machine.pop())
+
+        case *Add: machine.binary(func (x int16, y int16) int16 { return x + y })
+        case *Sub: machine.binary(func (x int16, y int16) int16 { return x - y })
+        case *And: machine.binary(func (x int16, y int16) int16 { return x & y })
+        case *Or: machine.binary(func (x int16, y int16) int16 { return x | y })
+        case *Eq: machine.binary(func (x int16, y int16) int16 { return boolean(x == y) })
+        case *Lt: machine.binary(func (x int16, y int16) int16 { return boolean(x < y) })
+        case *Gt: machine.binary(func (x int16, y int16) int16 { return boolean(x > y) })
+        case *Neg: machine.push(-machine.pop())
+        case *Not: machine.push(^machine.pop())
+
+        case *Mul: machine.binary(func (x int16, y int16) int16 { return x * y })
+        case *Div:
+            machine.binary(func (x int16, y int16) int16 {
+                if y == 0 {
+                    return 0
+                }
+                return int16(int32(x) / int32(y))
+            })
+        case *Mod:
+            machine.binary(func (x int16, y int16) int16 {
+                if y == 0 {
+                    return x
+                }
+                return int16(int32(x) % int32(y))
+            })
+        case *Shl: machine.binary(func (x int16, y int16) int16 { return int16(uint16(x) << uint(y & 15)) })
+        case *Shr: machine.binary(func (x int16, y int16) int16 { return x >> uint(y & 15) })
+        case *Xor: machine.binary(func (x int16, y int16) int16 { return x ^ y })
+
+        case *Label:
+        case *Goto:
+            current := machine.PC
+            err := machine.jump(instruction.Function, command.Name)
+            /* a label followed by a goto to it loops forever without changing
+             * anything, which is how programs usually end
+             */
+            if err == nil && machine.PC == current - 1 {
+                machine.Halted = true
+            }
+            return err
+        case *IfGoto:
+            if machine.pop() != 0 {
+                return machine.jump(instruction.Function, command.Name)
+            }
+
+        case *Function:
+            if command.Name == "Sys.halt" {
+                machine.Halted = true
+                return nil
+            }
+            for i := 0; i < command.Locals; i++ {
+                machine.push(0)
+            }
+
+        case *Call:
+            return machine.call(command.Name, command.Arguments, next)
+
+        case *TailCall:
+            frame := int(machine.RAM[1])
+            returnAddress := machine.Read(frame - 5)
+            base := int(machine.RAM[2])
+            machine.write(4, machine.Read(frame - 1))
+            machine.write(3, machine.Read(frame - 2))
+            machine.write(2, machine.Read(frame - 3))
+            machine.write(1, machine.Read(frame - 4))
+            sp := int(machine.RAM[0])
+            for i := 0; i < command.Arguments; i++ {
+                machine.write(base + i, machine.Read(sp - command.Arguments + i))
+            }
+            machine.write(0, int16(base + command.Arguments))
+            return machine.call(command.Name, command.Arguments, int(returnAddress))
+
+        case *Return:
+            frame := int(machine.RAM[1])
+            returnAddress := int(machine.Read(frame - 5))
+            machine.write(int(machine.RAM[2]), machine.pop())
+            /* arg is read again in case the store went to arg itself */
+            machine.write(0, machine.RAM[2] + 1)
+            machine.write(4, machine.Read(frame - 1))
+            machine.write(3, machine.Read(frame - 2))
+            machine.write(2, machine.Read(frame - 3))
+            machine.write(1, machine.Read(frame - 4))
+
+            if returnAddress == len(machine.Code) {
+                machine.Halted = true
+                return nil
+            }
+            if returnAddress < 0 || returnAddress > len(machine.Code) {
+                return fmt.Errorf("%v: return to invalid address %v", instruction.Position(), returnAddress)
+            }
+            machine.PC = returnAddress
+            return nil
+
+        default:
+            return fmt.Errorf("%v: cannot interpret '%v'", instruction.Position(), instruction.Text)
+    }
+
+    machine.PC = next
+    return nil
+}
+
+/* a function on the call stack */
+type Frame struct {
+    Function string
+    /* the instruction the frame will continue at */
+    PC int
+    LCL int
+    ARG int
+    Locals int
+    /* -1 if the frame was not entered by a call, such as the entry point */
+    Arguments int
+}
+
+/* The call stack from the innermost frame outwards, worked out by following
+ * the saved LCL and return addresses. At most limit frames are returned.
+ */
+func (machine *Machine) Frames(limit int) []Frame {
+    var frames []Frame
+
+    pc := machine.PC
+    lcl := int(machine.RAM[1])
+    arg := int(machine.RAM[2])
+    for len(frames) < limit && pc >= 0 && pc < len(machine.Code) {
+        instruction := &machine.Code[pc]
+        frame := Frame{
+            Function: instruction.Function,
+            PC: pc,
+            LCL: lcl,
+            ARG: arg,
+            Arguments: -1,
+        }
+
+        if entry, ok := machine.functions[frame.Function]; ok {
+            if function, ok := machine.Code[entry].Command.(*Function); ok {
+                frame.Locals = function.Locals
+            }
+        }
+
+        /* the caller is found through the return address saved below lcl */
+        returnAddress := int(machine.Read(lcl - 5))
+        if returnAddress > 0 && returnAddress <= len(machine.Code) {
+            if call, ok := machine.Code[returnAddress - 1].Command.(*Call); ok && call.Name == frame.Function {
+                frame.Arguments = call.Arguments
+            }
+        }
+
+        frames = append(frames, frame)
+
+        if frame.Function == TopLevelFunction || returnAddress <= 0 || returnAddress >= len(machine.Code) {
+            break
+        }
+
+        pc = returnAddress
+        arg = int(machine.Read(lcl - 3))
+        lcl = int(machine.Read(lcl - 4))
+    }
+
+    return frames
+}
@@ -0,0 +1,80 @@
+package vm
+
+import (
+    "testing"
+)
+
+/* runs a machine until it halts, failing the test if it does not */
+func runMachine(test *testing.T, machine *Machine, limit uint64) {
+    for !machine.Halted && machine.Steps < limit {
+        err := machine.Step()
+        if err != nil {
+            test.Fatalf("%v: %v", machine.Current().Position(), err)
+        }
+    }
+    if !machine.Halted {
+        test.Fatalf("the program did not halt after %v steps", limit)
+    }
+}
+
+/* the interpreter leaves RAM as the translated program would */
+func TestInterpreter(test *testing.T){
+    machine, err := NewMachine(sumProgram(), DefaultBootstrapOptions())
+    if err != nil {
+        test.Fatalf("could not load the program: %v", err)
+    }
+    runMachine(test, machine, 100000)
+
+    expected := map[int]int16{
+        TempStart: 55,
+        TempStart + 1: -1,
+        StaticStart: 5050,
+    }
+    for address, value := range expected {
+        if machine.RAM[address] != value {
+            test.Errorf("RAM[%v] is %v instead of %v", address, machine.RAM[address], value)
+        }
+    }
+
+    if len(machine.Statics("Sys")) != 1 || machine.Statics("Sys")[0].Address != StaticStart {
+        test.Errorf("the statics of Sys are %v", machine.Statics("Sys"))
+    }
+}
+
+/* the call stack is worked out from the frames the calls saved */
+func TestInterpreterFrames(test *testing.T){
+    machine, err := NewMachine(sumProgram(), DefaultBootstrapOptions())
+    if err != nil {
+        test.Fatalf("could not load the program: %v", err)
+    }
+
+    entry, ok := machine.FunctionEntry("Main.sum")
+    if !ok {
+        test.Fatalf("no Main.sum")
+    }
+    for machine.PC != entry + 1 {
+        err := machine.Step()
+        if err != nil || machine.Halted {
+            test.Fatalf("the program never got into Main.sum: %v", err)
+        }
+    }
+
+    frames := machine.Frames(10)
+    if len(frames) != 2 {
+        test.Fatalf("expected 2 frames but got %v", frames)
+    }
+    if frames[0].Function != "Main.sum" || frames[0].Arguments != 1 || frames[0].Locals != 1 {
+        test.Errorf("the inner frame is %+v", frames[0])
+    }
+    if frames[1].Function != "Sys.init" {
+        test.Errorf("the outer frame is %+v", frames[1])
+    }
+    if machine.Read(frames[0].ARG) != 10 {
+        test.Errorf("the argument of Main.sum is %v instead of 10", machine.Read(frames[0].ARG))
+    }
+
+    index, ok := machine.FindLine("Main", 2)
+    if !ok || machine.Code[index].Function != "Main.sum" {
+        test.Errorf("Main:2 is not in Main.sum")
+    }
+}
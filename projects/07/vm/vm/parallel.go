@@ -0,0 +1,113 @@
+package vm
+
+import (
+    "bytes"
+    "sync"
+)
+
+/* Each vm file is translated on its own goroutine into a buffer, with its own
+ * asmTranslator. Symbols made by Gensym include the file name, function ids are
+ * assigned before translation starts and every file knows where its profile
+ * counters begin, so the result does not depend on the order the goroutines
+ * run in. The buffers are then written out in the order of the files.
+ */
+type fileTranslation struct {
+    assembly bytes.Buffer
+    translator *asmTranslator
+    err error
+}
+
+/* a translator for one file, with the settings of the template but none of its
+ * state
+ */
+func fileTranslator(template *asmTranslator, profileBase int, output *countingWriter) *asmTranslator {
+    translator := &asmTranslator{
+        Translator: Translator{symbolPrefix: template.symbolPrefix},
+        CacheTop: template.CacheTop,
+        CheckStack: template.CheckStack,
+        StackLimit: template.StackLimit,
+        functionIDs: template.functionIDs,
+        Profile: template.Profile,
+        profileNext: profileBase,
+    }
+
+    if template.sourceMap != nil {
+        translator.sourceMap = NewSourceMap(output)
+    }
+    if template.stats != nil {
+        translator.stats = newStatisticsCollector()
+    }
+
+    return translator
+}
+
+func translateFiles(output *countingWriter, files []*VMFile, translator *asmTranslator) error {
+    results := make([]fileTranslation, len(files))
+
+    var wait sync.WaitGroup
+    profileBase := translator.profileNext
+    for i, vmFile := range files {
+        result := &results[i]
+        counter := &countingWriter{output: &result.assembly}
+        result.translator = fileTranslator(translator, profileBase, counter)
+        if translator.Profile {
+            profileBase += vmFile.ProfileCounterCount()
+        }
+
+        wait.Add(1)
+        go func(vmFile *VMFile, output *countingWriter, result *fileTranslation){
+            defer wait.Done()
+            result.err = translateVMFile(output, vmFile, result.translator)
+            if result.translator.stats != nil {
+                result.translator.stats.AddFile(vmFile.Path, output.Instructions)
+            }
+        }(vmFile, counter, result)
+    }
+
+    wait.Wait()
+
+    for i := range results {
+        result := &results[i]
+        if result.err != nil {
+            return result.err
+        }
+
+        if translator.sourceMap != nil {
+            translator.sourceMap.Append(result.translator.sourceMap)
+        }
+
+        _, err := result.assembly.WriteTo(output)
+        if err != nil {
+            return err
+        }
+
+        translator.mergeFile(result.translator)
+    }
+
+    translator.profileNext = profileBase
+
+    return nil
+}
+
+/* collects what a file translator needs written after all the files */
+func (translator *asmTranslator) mergeFile(file *asmTranslator) {
+    for routine := range file.routines {
+        if translator.routines == nil {
+            translator.routines = make(map[string]bool)
+        }
+        translator.routines[routine] = true
+    }
+
+    for id := range file.trapStubs {
+        if translator.trapStubs == nil {
+            translator.trapStubs = make(map[int]bool)
+        }
+        translator.trapStubs[id] = true
+    }
+
+    translator.ProfileCounters = append(translator.ProfileCounters, file.ProfileCounters...)
+
+    if translator.stats != nil {
+        translator.stats.Merge(file.stats)
+    }
+}
@@ -0,0 +1,88 @@
+package vm
+
+import (
+    "testing"
+    "fmt"
+    "strings"
+)
+
+/* Sys.init calls a function in each of several classes that all compare
+ * values, so every file makes the same gensym names
+ */
+func parallelSources(classes int) map[string]string {
+    var init strings.Builder
+    init.WriteString("function Sys.init 0\n")
+    for i := 0; i < classes; i++ {
+        fmt.Fprintf(&init, "push constant %v\ncall Class%v.compare 1\npop static %v\n", i, i, i)
+    }
+    init.WriteString("label END\ngoto END\n")
+
+    sources := map[string]string{"Sys.vm": init.String()}
+    for i := 0; i < classes; i++ {
+        sources[fmt.Sprintf("Class%v.vm", i)] = fmt.Sprintf(`function Class%v.compare 0
+push argument 0
+push constant %v
+eq
+push argument 0
+push constant 2
+lt
+and
+return
+`, i, i)
+    }
+
+    return sources
+}
+
+func TestParallelTranslation(test *testing.T){
+    const classes = 8
+    sources := parallelSources(classes)
+
+    options := hackOptions()
+    options.CheckStack = true
+    options.StackLimit = DefaultStackLimit
+    options.Profile = true
+    assembly := translateSources(test, sources, options)["asm"]
+
+    /* the goroutines finish in a different order each time, but apart from
+     * the comments naming the files in the temporary directory the output
+     * should not change
+     */
+    withoutPaths := func(assembly string) string {
+        var lines []string
+        for _, line := range strings.Split(assembly, "\n") {
+            if !(strings.HasPrefix(line, "// ") && strings.HasSuffix(line, ".vm")) {
+                lines = append(lines, line)
+            }
+        }
+        return strings.Join(lines, "\n")
+    }
+
+    for i := 0; i < 10; i++ {
+        again := translateSources(test, sources, options)["asm"]
+        if withoutPaths(again) != withoutPaths(assembly) {
+            test.Fatalf("translation %v is different from the first", i + 2)
+        }
+    }
+
+    labels := make(map[string]bool)
+    for _, line := range strings.Split(assembly, "\n") {
+        if strings.HasPrefix(line, "(") {
+            if labels[line] {
+                test.Errorf("label %v is defined twice", line)
+            }
+            labels[line] = true
+        }
+    }
+
+    machine := runHack(test, assembly)
+    for i := 0; i < classes; i++ {
+        expected := int16(0)
+        if i < 2 {
+            expected = -1
+        }
+        if value := machine.static(fmt.Sprintf("static.Sys.%v", i)); value != expected {
+            test.Errorf("class %v returned %v instead of %v", i, value, expected)
+        }
+    }
+}
@@ -0,0 +1,107 @@
+package vm
+
+import (
+    "io"
+    "fmt"
+)
+
+/* Profiling instrumentation. Every function entry and every call site gets a
+ * counter in a block of RAM just below the stack limit, and the code emitted
+ * for them starts with '@counter / M=M+1'. Since that does not touch D it works
+ * with the cached stack top as well.
+ *
+ * The counters rely on RAM being zero when the program starts and wrap after
+ * 65535 increments. A map from counter address to what it counts is written
+ * next to the assembly, and vmprof reads it together with a RAM dump.
+ */
+type ProfileCounter struct {
+    Address int
+    /* the function that is entered, or that makes the call */
+    Function string
+    /* the function being called, empty for the entry counter of Function */
+    Callee string
+    /* file:line of the call */
+    Position string
+}
+
+/* the number of counters the file needs */
+func (file *VMFile) ProfileCounterCount() int {
+    count := 0
+    for _, line := range file.Lines {
+        switch line.Command.(type) {
+            case *Function, *Call, *TailCall:
+                count += 1
+        }
+    }
+
+    return count
+}
+
+func (program *VMProgram) ProfileCounterCount() int {
+    count := 0
+    for _, file := range program.Files {
+        count += file.ProfileCounterCount()
+    }
+
+    return count
+}
+
+func nextProfileCounter(translator *asmTranslator, counter ProfileCounter) []string {
+    counter.Address = translator.profileNext
+    translator.profileNext += 1
+    translator.ProfileCounters = append(translator.ProfileCounters, counter)
+
+    return []string{
+        fmt.Sprintf("@%v", counter.Address),
+        "M=M+1",
+    }
+}
+
+func profileEntry(translator *asmTranslator, name string) []string {
+    if !translator.Profile {
+        return nil
+    }
+
+    return nextProfileCounter(translator, ProfileCounter{Function: name})
+}
+
+func profileCall(translator *asmTranslator, command Command, position string) []string {
+    if !translator.Profile {
+        return nil
+    }
+
+    var callee string
+    switch call := command.(type) {
+        case *Call:
+            callee = call.Name
+        case *TailCall:
+            callee = call.Name
+        default:
+            return nil
+    }
+
+    return nextProfileCounter(translator, ProfileCounter{
+        Function: translator.CurrentFunction,
+        Callee: callee,
+        Position: position,
+    })
+}
+
+/* Writes one counter per line, either
+ *   address function name
+ * or
+ *   address call caller callee file:line
+ */
+func writeProfileMap(output io.Writer, counters []ProfileCounter) {
+    for _, counter := range counters {
+        if counter.Callee == "" {
+            fmt.Fprintf(output, "%v function %v\n", counter.Address, counter.Function)
+        } else {
+            caller := counter.Function
+            if caller == TopLevelFunction {
+                caller = "-"
+            }
+            fmt.Fprintf(output, "%v call %v %v %v\n", counter.Address, caller, counter.Callee, counter.Position)
+        }
+    }
+}
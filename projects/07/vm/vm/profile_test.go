@@ -0,0 +1,84 @@
+package vm
+
+import (
+    "testing"
+    "fmt"
+    "strings"
+)
+
+/* Sys.init calls f three times from one place, and f calls g from two */
+const profileSource = `
+function Sys.init 0
+push constant 3
+pop temp 0
+label LOOP
+call Test.f 0
+pop temp 1
+push temp 0
+push constant 1
+sub
+pop temp 0
+push temp 0
+if-goto LOOP
+label END
+goto END
+function Test.f 0
+call Test.g 0
+call Test.g 0
+add
+return
+function Test.g 0
+push constant 1
+return
+`
+
+func TestProfile(test *testing.T){
+    for _, check := range []bool{false, true} {
+        options := hackOptions()
+        options.Profile = true
+        options.CheckStack = check
+        options.StackLimit = 1000
+
+        outputs := translateOutputs(test, profileSource, options)
+        machine := runHack(test, outputs["asm"])
+
+        top := options.StackLimit
+        if check {
+            top -= TrapSize
+        }
+
+        /* what each counter counts, in the format of the profile map */
+        counts := make(map[string]int)
+        for _, line := range strings.Split(strings.TrimSpace(outputs["profile"]), "\n") {
+            var address int
+            var what string
+            fmt.Sscanf(line, "%d", &address)
+            what = strings.SplitN(line, " ", 2)[1]
+            if address < StackStart || address >= top {
+                test.Errorf("check %v: counter '%v' is not in the stack region", check, line)
+            }
+            counts[what] = int(machine.RAM[address])
+        }
+
+        expected := map[string]int{
+            "function Sys.init": 1,
+            "function Test.f": 3,
+            "function Test.g": 6,
+            "call Sys.init Test.f Test.vm:6": 3,
+            "call Test.f Test.g Test.vm:17": 3,
+            "call Test.f Test.g Test.vm:18": 3,
+        }
+        for what, count := range counts {
+            if expected[what] != count {
+                test.Errorf("check %v: '%v' counted %v instead of %v", check, what, count, expected[what])
+            }
+        }
+        if len(counts) != len(expected) {
+            test.Errorf("check %v: unexpected counters %v", check, counts)
+        }
+
+        if machine.RAM[TempStart + 1] != 2 {
+            test.Errorf("check %v: counting changed the result to %v", check, machine.RAM[TempStart + 1])
+        }
+    }
+}
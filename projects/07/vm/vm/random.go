@@ -0,0 +1,175 @@
+package vm
+
+import (
+    "fmt"
+    "math/rand"
+    "strings"
+)
+
+/* Random straight-line vm programs for differential testing.
+ *
+ * A program is a class Random with functions f0 .. fn-1 and a Sys.init that
+ * calls some of them and then stops in a loop. Functions have no branches, and
+ * fk only calls functions with a lower number so nothing recurses. THIS and
+ * THAT are pointed at a block of RAM of their own before use. Functions
+ * return with only the return value on the stack and leave half of temp
+ * alone, so the ones that make no calls can be inlined.
+ *
+ * Values take the whole 16-bit range, so arithmetic wraps around and
+ * comparisons see operands that are more than 32767 apart.
+ */
+
+/* each function makes at most this many calls, which keeps the number of
+ * calls a program makes from growing exponentially with its functions
+ */
+const maxRandomCalls = 2
+
+/* only the low temp slots are used, which leaves room for the inliner to keep
+ * the frames of inlined calls in the others
+ */
+const randomTemps = TempSize / 2
+
+type randomFunction struct {
+    Name string
+    Arguments int
+    Locals int
+}
+
+type randomGenerator struct {
+    random *rand.Rand
+    lines []string
+    functions []randomFunction
+    depth int
+    /* calls made by the current function */
+    calls int
+}
+
+func (generator *randomGenerator) emit(format string, args ...interface{}) {
+    generator.lines = append(generator.lines, fmt.Sprintf(format, args...))
+}
+
+func (generator *randomGenerator) push(segment string, index int) {
+    generator.emit("push %v %v", segment, index)
+    generator.depth += 1
+}
+
+func (generator *randomGenerator) pop(segment string, index int) {
+    generator.emit("pop %v %v", segment, index)
+    generator.depth -= 1
+}
+
+/* push or pop a random segment the function can use */
+func (generator *randomGenerator) access(function randomFunction, pop bool) {
+    random := generator.random
+    segments := []string{"temp", "static", "this", "that"}
+    if function.Locals > 0 {
+        segments = append(segments, "local")
+    }
+    if function.Arguments > 0 {
+        segments = append(segments, "argument")
+    }
+    if !pop {
+        segments = append(segments, "constant", "pointer")
+    }
+
+    segment := segments[random.Intn(len(segments))]
+    index := 0
+    switch segment {
+        case "temp": index = random.Intn(randomTemps)
+        case "static", "this", "that": index = random.Intn(8)
+        case "local": index = random.Intn(function.Locals)
+        case "argument": index = random.Intn(function.Arguments)
+        case "constant": index = random.Intn(32768)
+        case "pointer": index = random.Intn(PointerSize)
+    }
+
+    if pop {
+        generator.pop(segment, index)
+    } else {
+        generator.push(segment, index)
+    }
+}
+
+/* one random command, or a few that belong together */
+func (generator *randomGenerator) command(function randomFunction, callable []randomFunction) {
+    random := generator.random
+    switch choice := random.Intn(10); {
+        /* keep the stack from growing without bound */
+        case generator.depth == 0 || (choice < 3 && generator.depth < 12):
+            generator.access(function, false)
+        case choice < 5:
+            generator.access(function, true)
+        case choice < 8 && generator.depth >= 2:
+            operator := []string{"add", "sub", "and", "or", "eq", "lt", "gt"}[random.Intn(7)]
+            generator.emit(operator)
+            generator.depth -= 1
+        case choice < 9:
+            generator.emit([]string{"neg", "not"}[random.Intn(2)])
+        default:
+            var possible []randomFunction
+            for _, callee := range callable {
+                if callee.Arguments <= generator.depth && generator.calls < maxRandomCalls {
+                    possible = append(possible, callee)
+                }
+            }
+            if len(possible) == 0 {
+                generator.access(function, false)
+                return
+            }
+            callee := possible[random.Intn(len(possible))]
+            generator.emit("call %v %v", callee.Name, callee.Arguments)
+            generator.depth += 1 - callee.Arguments
+            generator.calls += 1
+    }
+}
+
+func (generator *randomGenerator) body(function randomFunction, callable []randomFunction, length int) {
+    generator.depth = 0
+    generator.calls = 0
+    random := generator.random
+    generator.emit("function %v %v", function.Name, function.Locals)
+    for pointer := 0; pointer < PointerSize; pointer++ {
+        generator.push("constant", 2048 + random.Intn(12000))
+        generator.pop("pointer", pointer)
+    }
+
+    for i := 0; i < length; i++ {
+        generator.command(function, callable)
+    }
+}
+
+/* Makes a random program with the given number of functions besides
+ * Sys.init, each about length commands long. The same seed always gives the
+ * same program.
+ */
+func RandomProgram(seed int64, functions int, length int) string {
+    generator := randomGenerator{random: rand.New(rand.NewSource(seed))}
+
+    for i := 0; i < functions; i++ {
+        function := randomFunction{
+            Name: fmt.Sprintf("Random.f%v", i),
+            Arguments: generator.random.Intn(4),
+            Locals: generator.random.Intn(4),
+        }
+        generator.body(function, generator.functions, length)
+        /* returning with exactly one value on the stack lets the function be
+         * inlined
+         */
+        for generator.depth > 1 {
+            generator.emit([]string{"add", "sub", "and", "or"}[generator.random.Intn(4)])
+            generator.depth -= 1
+        }
+        if generator.depth == 0 {
+            generator.push("constant", generator.random.Intn(32768))
+        }
+        generator.emit("return")
+        generator.functions = append(generator.functions, function)
+    }
+
+    generator.body(randomFunction{Name: "Sys.init"}, generator.functions, length)
+    generator.emit("label END")
+    generator.emit("goto END")
+
+    header := fmt.Sprintf("// random program, seed %v", seed)
+    return header + "\n" + strings.Join(generator.lines, "\n") + "\n"
+}
@@ -0,0 +1,109 @@
+package vm
+
+import (
+    "io"
+    "fmt"
+    "encoding/json"
+)
+
+/* Keeps track of the line number and ROM address of the assembly written so
+ * far. Every line that is not a label or a comment becomes one instruction.
+ */
+type countingWriter struct {
+    output io.Writer
+    /* complete lines written */
+    Lines int
+    /* instructions written, which is the ROM address of the next one */
+    Instructions int
+    midLine bool
+}
+
+func (writer *countingWriter) Write(data []byte) (int, error) {
+    for _, b := range data {
+        if !writer.midLine && b != '(' && b != '/' && b != '\n' {
+            writer.Instructions += 1
+        }
+        writer.midLine = b != '\n'
+        if b == '\n' {
+            writer.Lines += 1
+        }
+    }
+
+    return writer.output.Write(data)
+}
+
+/* The assembly produced by one vm command. Lines are 1-based and ROM addresses
+ * start at 0, and both ranges exclude their end. Code that does not come from a
+ * vm command, such as the bootstrap and shared routines, has no entry.
+ */
+type SourceMapEntry struct {
+    AsmStart int `json:"asmStart"`
+    AsmEnd int `json:"asmEnd"`
+    RomStart int `json:"romStart"`
+    RomEnd int `json:"romEnd"`
+    VMFile string `json:"vmFile"`
+    VMLine uint64 `json:"vmLine"`
+    Function string `json:"function"`
+}
+
+type SourceMap struct {
+    writer *countingWriter
+    Entries []SourceMapEntry
+}
+
+func NewSourceMap(writer *countingWriter) *SourceMap {
+    return &SourceMap{writer: writer}
+}
+
+/* starts an entry at the current position of the output */
+func (sourceMap *SourceMap) Begin(path string, line uint64) {
+    sourceMap.Entries = append(sourceMap.Entries, SourceMapEntry{
+        AsmStart: sourceMap.writer.Lines + 1,
+        RomStart: sourceMap.writer.Instructions,
+        VMFile: path,
+        VMLine: line,
+    })
+}
+
+/* ends the entry started by Begin */
+func (sourceMap *SourceMap) End(function string) {
+    entry := &sourceMap.Entries[len(sourceMap.Entries) - 1]
+    entry.AsmEnd = sourceMap.writer.Lines + 1
+    entry.RomEnd = sourceMap.writer.Instructions
+    entry.Function = function
+}
+
+/* adds the entries of a map whose output is about to be written at the
+ * current position of this one
+ */
+func (sourceMap *SourceMap) Append(other *SourceMap) {
+    for _, entry := range other.Entries {
+        entry.AsmStart += sourceMap.writer.Lines
+        entry.AsmEnd += sourceMap.writer.Lines
+        entry.RomStart += sourceMap.writer.Instructions
+        entry.RomEnd += sourceMap.writer.Instructions
+        sourceMap.Entries = append(sourceMap.Entries, entry)
+    }
+}
+
+/* writes the entries as a json list with one entry per line */
+func (sourceMap *SourceMap) Write(output io.Writer) error {
+    io.WriteString(output, "[\n")
+    for i, entry := range sourceMap.Entries {
+        data, err := json.Marshal(entry)
+        if err != nil {
+            return err
+        }
+
+        separator := ","
+        if i == len(sourceMap.Entries) - 1 {
+            separator = ""
+        }
+        _, err = fmt.Fprintf(output, "  %s%v\n", data, separator)
+        if err != nil {
+            return err
+        }
+    }
+    _, err := io.WriteString(output, "]\n")
+    return err
+}
@@ -0,0 +1,64 @@
+package vm
+
+import (
+    "testing"
+    "strings"
+    "encoding/json"
+)
+
+/* the ROM address of every assembly line, counting only instructions */
+func romAddresses(assembly []string) []int {
+    addresses := make([]int, len(assembly) + 1)
+    next := 0
+    for i, line := range assembly {
+        addresses[i] = next
+        line = strings.TrimSpace(line)
+        if line != "" && !strings.HasPrefix(line, "(") && !strings.HasPrefix(line, "//") {
+            next += 1
+        }
+    }
+    addresses[len(assembly)] = next
+    return addresses
+}
+
+func TestSourceMap(test *testing.T){
+    options := hackOptions()
+    options.SourceMap = true
+    outputs := translateOutputs(test, everyCommandSource, options)
+
+    var entries []SourceMapEntry
+    err := json.Unmarshal([]byte(outputs["json"]), &entries)
+    if err != nil {
+        test.Fatalf("could not decode the source map: %v", err)
+    }
+
+    source := strings.Split(everyCommandSource, "\n")
+    assembly := strings.Split(outputs["asm"], "\n")
+    addresses := romAddresses(assembly)
+
+    commands := 0
+    for _, line := range source {
+        if strings.TrimSpace(line) != "" {
+            commands += 1
+        }
+    }
+    if len(entries) != commands {
+        test.Fatalf("the map has %v entries for %v vm commands", len(entries), commands)
+    }
+
+    for _, entry := range entries {
+        /* the translator writes the vm line as a comment just before its code */
+        comment := assembly[entry.AsmStart - 2]
+        if comment != "// " + strings.TrimSpace(source[entry.VMLine - 1]) {
+            test.Errorf("%v:%v maps to assembly after '%v'", entry.VMFile, entry.VMLine, comment)
+        }
+        if entry.RomStart != addresses[entry.AsmStart - 1] || entry.RomEnd != addresses[entry.AsmEnd - 1] {
+            test.Errorf("%v:%v has rom %v-%v but its assembly is at %v-%v", entry.VMFile, entry.VMLine,
+                        entry.RomStart, entry.RomEnd, addresses[entry.AsmStart - 1], addresses[entry.AsmEnd - 1])
+        }
+    }
+
+    if entries[0].Function != "Sys.init" || entries[len(entries) - 1].Function != "Test.pointers" {
+        test.Errorf("the map starts in %v and ends in %v", entries[0].Function, entries[len(entries) - 1].Function)
+    }
+}
@@ -0,0 +1,245 @@
+package vm
+
+import (
+    "io"
+    "fmt"
+    "sort"
+    "encoding/json"
+)
+
+/* the number of instructions that fit in the hack ROM */
+const ROMSize = 32768
+
+/* Counts the instructions generated for each kind of vm command, function and
+ * file. Support code is whatever is not part of a file: the bootstrap and the
+ * shared routines.
+ */
+type Statistics struct {
+    Total int `json:"total"`
+    ROMSize int `json:"romSize"`
+    Fits bool `json:"fits"`
+    Support int `json:"support"`
+    Commands []CommandStatistic `json:"commands"`
+    Functions []FunctionStatistic `json:"functions"`
+    Files []FileStatistic `json:"files"`
+}
+
+type CommandStatistic struct {
+    Name string `json:"name"`
+    /* how many of these commands were translated */
+    Count int `json:"count"`
+    Instructions int `json:"instructions"`
+}
+
+type FunctionStatistic struct {
+    Name string `json:"name"`
+    File string `json:"file"`
+    Instructions int `json:"instructions"`
+}
+
+type FileStatistic struct {
+    Path string `json:"path"`
+    Instructions int `json:"instructions"`
+}
+
+/* collects the numbers while translating */
+type statisticsCollector struct {
+    commands map[string]*CommandStatistic
+    functions map[string]*FunctionStatistic
+    /* functions in the order they were first seen */
+    functionOrder []string
+    files []FileStatistic
+}
+
+func newStatisticsCollector() *statisticsCollector {
+    return &statisticsCollector{
+        commands: make(map[string]*CommandStatistic),
+        functions: make(map[string]*FunctionStatistic),
+    }
+}
+
+/* Push and pop are split up by segment, everything else goes by its name.
+ * The kind comes from the command itself, since inlining and tail calls
+ * leave the text of the line a command replaced.
+ */
+func commandKind(command Command) string {
+    switch command.(type) {
+        case *PushConstant: return "push constant"
+        case *PushLocal: return "push local"
+        case *PushArgument: return "push argument"
+        case *PushThis: return "push this"
+        case *PushThat: return "push that"
+        case *PushTemp: return "push temp"
+        case *PushPointer: return "push pointer"
+        case *PushStatic: return "push static"
+        case *PopLocal: return "pop local"
+        case *PopArgument: return "pop argument"
+        case *PopThis: return "pop this"
+        case *PopThat: return "pop that"
+        case *PopTemp: return "pop temp"
+        case *PopPointer: return "pop pointer"
+        case *PopStatic: return "pop static"
+        case *Label: return "label"
+        case *Goto: return "goto"
+        case *IfGoto: return "if-goto"
+        case *Function: return "function"
+        case *Call: return "call"
+        case *Return: return "return"
+        case *TailCall: return "tail call"
+        case *Add: return "add"
+        case *Sub: return "sub"
+        case *Neg: return "neg"
+        case *Eq: return "eq"
+        case *Gt: return "gt"
+        case *Lt: return "lt"
+        case *And: return "and"
+        case *Or: return "or"
+        case *Not: return "not"
+        case *Mul: return "mul"
+        case *Div: return "div"
+        case *Mod: return "mod"
+        case *Shl: return "shl"
+        case *Shr: return "shr"
+        case *Xor: return "xor"
+    }
+
+    return fmt.Sprintf("%T", command)
+}
+
+func (collector *statisticsCollector) Add(kind string, function string, file string, instructions int) {
+    command, ok := collector.commands[kind]
+    if !ok {
+        command = &CommandStatistic{Name: kind}
+        collector.commands[kind] = command
+    }
+    command.Count += 1
+    command.Instructions += instructions
+
+    if function == TopLevelFunction {
+        function = fmt.Sprintf("(top level of %v)", file)
+    }
+    stat, ok := collector.functions[function]
+    if !ok {
+        stat = &FunctionStatistic{Name: function, File: file}
+        collector.functions[function] = stat
+        collector.functionOrder = append(collector.functionOrder, function)
+    }
+    stat.Instructions += instructions
+}
+
+func (collector *statisticsCollector) AddFile(path string, instructions int) {
+    collector.files = append(collector.files, FileStatistic{Path: path, Instructions: instructions})
+}
+
+func (collector *statisticsCollector) Merge(other *statisticsCollector) {
+    for _, command := range other.commands {
+        mine, ok := collector.commands[command.Name]
+        if !ok {
+            mine = &CommandStatistic{Name: command.Name}
+            collector.commands[command.Name] = mine
+        }
+        mine.Count += command.Count
+        mine.Instructions += command.Instructions
+    }
+
+    for _, name := range other.functionOrder {
+        function := other.functions[name]
+        mine, ok := collector.functions[name]
+        if !ok {
+            mine = &FunctionStatistic{Name: name, File: function.File}
+            collector.functions[name] = mine
+            collector.functionOrder = append(collector.functionOrder, name)
+        }
+        mine.Instructions += function.Instructions
+    }
+
+    collector.files = append(collector.files, other.files...)
+}
+
+/* the final numbers, each list sorted from largest to smallest */
+func (collector *statisticsCollector) Statistics(total int) Statistics {
+    statistics := Statistics{
+        Total: total,
+        ROMSize: ROMSize,
+        Fits: total <= ROMSize,
+        Support: total,
+        Files: append([]FileStatistic(nil), collector.files...),
+    }
+
+    for _, file := range statistics.Files {
+        statistics.Support -= file.Instructions
+    }
+
+    for _, command := range collector.commands {
+        statistics.Commands = append(statistics.Commands, *command)
+    }
+    sort.Slice(statistics.Commands, func (a, b int) bool {
+        first := statistics.Commands[a]
+        second := statistics.Commands[b]
+        if first.Instructions != second.Instructions {
+            return first.Instructions > second.Instructions
+        }
+        return first.Name < second.Name
+    })
+
+    for _, name := range collector.functionOrder {
+        statistics.Functions = append(statistics.Functions, *collector.functions[name])
+    }
+    sort.SliceStable(statistics.Functions, func (a, b int) bool {
+        return statistics.Functions[a].Instructions > statistics.Functions[b].Instructions
+    })
+
+    sort.SliceStable(statistics.Files, func (a, b int) bool {
+        return statistics.Files[a].Instructions > statistics.Files[b].Instructions
+    })
+
+    return statistics
+}
+
+/* keeps only the top largest functions, if top is positive */
+func (statistics Statistics) Top(top int) Statistics {
+    if top > 0 && len(statistics.Functions) > top {
+        statistics.Functions = statistics.Functions[:top]
+    }
+    return statistics
+}
+
+func percent(part int, total int) float64 {
+    if total == 0 {
+        return 0
+    }
+    return float64(part) * 100 / float64(total)
+}
+
+func writeStatistics(output io.Writer, statistics Statistics) {
+    fits := "fits"
+    if !statistics.Fits {
+        fits = "does not fit"
+    }
+    fmt.Fprintf(output, "ROM estimate: %v of %v instructions (%.1f%%), %v\n", statistics.Total, statistics.ROMSize, percent(statistics.Total, statistics.ROMSize), fits)
+    fmt.Fprintf(output, "Bootstrap and shared routines: %v instructions\n", statistics.Support)
+
+    fmt.Fprintf(output, "\nBy command\n")
+    for _, command := range statistics.Commands {
+        fmt.Fprintf(output, "  %-20v %6v commands %8v instructions %5.1f%%\n", command.Name, command.Count, command.Instructions, percent(command.Instructions, statistics.Total))
+    }
+
+    fmt.Fprintf(output, "\nLargest functions\n")
+    for _, function := range statistics.Functions {
+        fmt.Fprintf(output, "  %-40v %8v %5.1f%%  %v\n", function.Name, function.Instructions, percent(function.Instructions, statistics.Total), function.File)
+    }
+
+    fmt.Fprintf(output, "\nBy file\n")
+    for _, file := range statistics.Files {
+        fmt.Fprintf(output, "  %-40v %8v %5.1f%%\n", file.Path, file.Instructions, percent(file.Instructions, statistics.Total))
+    }
+}
+
+func writeStatisticsJSON(output io.Writer, statistics Statistics) error {
+    data, err := json.MarshalIndent(statistics, "", "  ")
+    if err != nil {
+        return err
+    }
+    _, err = output.Write(append(data, '\n'))
+    return err
+}
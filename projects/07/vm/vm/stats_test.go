@@ -0,0 +1,117 @@
+package vm
+
+import (
+    "testing"
+    "os"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/json"
+)
+
+/* translates with -stats-json and reads the statistics back */
+func translateStatistics(test *testing.T, source string, options TranslateOptions) (Statistics, string) {
+    directory := makeTree(test)
+    defer os.RemoveAll(directory)
+
+    options.StatisticsJSON = filepath.Join(directory, "stats.json")
+    assembly := translateSource(test, source, options)
+
+    data, err := ioutil.ReadFile(options.StatisticsJSON)
+    if err != nil {
+        test.Fatalf("could not read the statistics: %v", err)
+    }
+
+    var statistics Statistics
+    err = json.Unmarshal(data, &statistics)
+    if err != nil {
+        test.Fatalf("could not decode the statistics: %v", err)
+    }
+
+    return statistics, assembly
+}
+
+func TestStatistics(test *testing.T){
+    statistics, assembly := translateStatistics(test, everyCommandSource, hackOptions())
+
+    lines := strings.Split(assembly, "\n")
+    total := romAddresses(lines)[len(lines)]
+    if statistics.Total != total || !statistics.Fits {
+        test.Errorf("the total is %v but the assembly has %v instructions", statistics.Total, total)
+    }
+
+    files := 0
+    for _, file := range statistics.Files {
+        files += file.Instructions
+    }
+    if files + statistics.Support != total {
+        test.Errorf("files have %v instructions and support code %v, which is not %v", files, statistics.Support, total)
+    }
+
+    commands := 0
+    kinds := make(map[string]int)
+    for _, command := range statistics.Commands {
+        commands += command.Instructions
+        kinds[command.Name] = command.Count
+    }
+    if commands != files {
+        test.Errorf("commands have %v instructions but files have %v", commands, files)
+    }
+
+    for _, kind := range []string{"push constant", "call", "return", "xor"} {
+        count := strings.Count(everyCommandSource, "\n" + kind)
+        if kinds[kind] != count {
+            test.Errorf("counted %v '%v' commands instead of %v", kinds[kind], kind, count)
+        }
+    }
+
+    functions := make(map[string]bool)
+    for _, function := range statistics.Functions {
+        functions[function.Name] = true
+    }
+    for _, name := range []string{"Sys.init", "Test.mix", "Test.pointers"} {
+        if !functions[name] {
+            test.Errorf("%v is not in the statistics", name)
+        }
+    }
+
+    if len(statistics.Top(1).Functions) != 1 {
+        test.Errorf("Top(1) kept %v functions", len(statistics.Top(1).Functions))
+    }
+}
+
+/* inlining rewrites the arguments of the inlined function to temps and its
+ * return to a jump, while the lines keep their text
+ */
+func TestStatisticsInline(test *testing.T){
+    source := `
+function Sys.init 0
+push constant 3
+push constant 4
+call Sys.add 2
+pop temp 0
+label END
+goto END
+function Sys.add 0
+push argument 0
+push argument 1
+add
+return
+`
+    options := hackOptions()
+    options.Inline = 10
+    statistics, _ := translateStatistics(test, source, options)
+
+    kinds := make(map[string]int)
+    for _, command := range statistics.Commands {
+        kinds[command.Name] = command.Count
+    }
+
+    /* Sys.add is never called once it is inlined, so it is left out */
+    expected := map[string]int{"push argument": 0, "push temp": 2, "pop temp": 3, "call": 0, "return": 0}
+    for kind, count := range expected {
+        if kinds[kind] != count {
+            test.Errorf("counted %v '%v' commands instead of %v: %v", kinds[kind], kind, count, kinds)
+        }
+    }
+}
@@ -0,0 +1,277 @@
+package vm
+
+import (
+    "fmt"
+)
+
+/* A call that is immediately followed by a return. Instead of building a new
+ * frame on top of the current one, the arguments are moved down into the
+ * current function's argument area and the callee gets a frame that returns
+ * straight to our caller, so a chain of tail calls runs in constant stack.
+ *
+ * Because the callee's return goes to our caller, the value it returns ends
+ * up in the same place our own return would have put it.
+ */
+type TailCall struct {
+    Name string
+    Arguments int
+}
+
+func (*TailCall) vmCommand() {}
+
+/* Replaces every 'call f n' that is directly followed by 'return' with a tail
+ * call. Returns the number of calls that were replaced.
+ */
+func (program *VMProgram) OptimizeTailCalls() int {
+    count := 0
+
+    for _, file := range program.Files {
+        var out []VMLine
+        for i := 0; i < len(file.Lines); i++ {
+            line := file.Lines[i]
+            call, ok := line.Command.(*Call)
+            if ok && i + 1 < len(file.Lines) {
+                if _, isReturn := file.Lines[i+1].Command.(*Return); isReturn {
+                    out = append(out, VMLine{
+                        Command: &TailCall{Name: call.Name, Arguments: call.Arguments},
+                        Text: fmt.Sprintf("%v (tail call)", line.Text),
+                        Line: line.Line,
+                    })
+                    /* skip the return */
+                    i += 1
+                    count += 1
+                    continue
+                }
+            }
+
+            out = append(out, line)
+        }
+
+        file.Lines = out
+    }
+
+    return count
+}
+
+func (call *TailCall) TranslateToAssembly(translator *asmTranslator) []string {
+    out := []string{
+        /* r14 = return address = *(lcl-5) */
+        "@LCL",
+        "D=M",
+        "@5",
+        "A=D-A",
+        "D=M",
+        "@R14",
+        "M=D",
+
+        /* r15 = arg, where the arguments of the callee will go */
+        "@ARG",
+        "D=M",
+        "@R15",
+        "M=D",
+
+        /* restore that, this, arg and lcl of our caller, so that the frame
+         * pushed below looks like the one our caller pushed for us
+         */
+        "@LCL",
+        "D=M",
+        "@R13",
+        "M=D", // r13 = frame
+        "@1",
+        "D=A",
+        "@R13",
+        "A=M-D",
+        "D=M",
+        "@THAT",
+        "M=D",
+        "@2",
+        "D=A",
+        "@R13",
+        "A=M-D",
+        "D=M",
+        "@THIS",
+        "M=D",
+        "@3",
+        "D=A",
+        "@R13",
+        "A=M-D",
+        "D=M",
+        "@ARG",
+        "M=D",
+        "@4",
+        "D=A",
+        "@R13",
+        "A=M-D",
+        "D=M",
+        "@LCL",
+        "M=D",
+    }
+
+    /* copy the arguments down, lowest first since the destination is always
+     * below the source
+     */
+    for i := 0; i < call.Arguments; i++ {
+        out = append(out,
+            "@R15",
+            "D=M",
+            fmt.Sprintf("@%v", i),
+            "D=D+A",
+            "@R13",
+            "M=D", // r13 = r15 + i
+            "@SP",
+            "D=M",
+            fmt.Sprintf("@%v", call.Arguments - i),
+            "A=D-A",
+            "D=M", // d = ram[sp - (n - i)]
+            "@R13",
+            "A=M",
+            "M=D")
+    }
+
+    out = append(out,
+        /* sp = r15 + n */
+        "@R15",
+        "D=M",
+        fmt.Sprintf("@%v", call.Arguments),
+        "D=D+A",
+        "@SP",
+        "M=D",
+
+        /* push the return address of our caller */
+        "@R14",
+        "D=M",
+        "@SP",
+        "A=M",
+        "M=D",
+        "@SP",
+        "M=M+1")
+
+    /* push lcl, arg, this and that, which are now our caller's values */
+    for _, pointer := range []string{"LCL", "ARG", "THIS", "THAT"} {
+        out = append(out,
+            fmt.Sprintf("@%v", pointer),
+            "D=M",
+            "@SP",
+            "A=M",
+            "M=D",
+            "@SP",
+            "M=M+1")
+    }
+
+    return append(out,
+        /* arg = r15 */
+        "@R15",
+        "D=M",
+        "@ARG",
+        "M=D",
+
+        /* lcl = sp */
+        "@SP",
+        "D=M",
+        "@LCL",
+        "M=D",
+
+        /* goto f */
+        fmt.Sprintf("@%v", call.Name),
+        "0; JMP")
+}
+
+func (call *TailCall) TranslateToC(translator *cTranslator) []string {
+    out := []string{
+        "STEP();",
+        "{",
+        "    int16_t frame = LCL;",
+        "    int16_t returnAddress = M(frame - 5);",
+        "    int16_t base = ARG;",
+        "    int i;",
+        "    THAT = M(frame - 1);",
+        "    THIS = M(frame - 2);",
+        "    ARG = M(frame - 3);",
+        "    LCL = M(frame - 4);",
+        fmt.Sprintf("    for (i = 0; i < %v; i++){", call.Arguments),
+        fmt.Sprintf("        M(base + i) = M(SP - %v + i);", call.Arguments),
+        "    }",
+        fmt.Sprintf("    SP = W(base + %v);", call.Arguments),
+        "    PUSH(returnAddress);",
+        "    PUSH(LCL);",
+        "    PUSH(ARG);",
+        "    PUSH(THIS);",
+        "    PUSH(THAT);",
+        "    ARG = base;",
+        "    LCL = SP;",
+        "}",
+        fmt.Sprintf("goto %v;", cFunctionLabel(call.Name)),
+    }
+
+    return out
+}
+
+func (call *TailCall) TranslateToWasm(translator *wasmTranslator) []string {
+    out := []string{
+        /* frame = lcl, the return block is *(frame-5) and y holds the base of
+         * the argument area
+         */
+        fmt.Sprintf("i32.const %v", wasmLCL),
+        "call $get",
+        "local.set $frame",
+        fmt.Sprintf("i32.const %v", wasmARG),
+        "call $get",
+        "local.set $y",
+    }
+
+    out = append(out, wasmRestorePointer(wasmTHAT, 1)...)
+    out = append(out, wasmRestorePointer(wasmTHIS, 2)...)
+    out = append(out, wasmRestorePointer(wasmARG, 3)...)
+
+    /* lcl is restored last since it is the frame pointer, so keep the return
+     * block in x before that
+     */
+    out = append(out,
+        "local.get $frame",
+        "i32.const 5",
+        "i32.sub",
+        "call $get",
+        "local.set $x")
+    out = append(out, wasmRestorePointer(wasmLCL, 4)...)
+
+    for i := 0; i < call.Arguments; i++ {
+        out = append(out,
+            "local.get $y",
+            fmt.Sprintf("i32.const %v", i),
+            "i32.add",
+            fmt.Sprintf("i32.const %v", wasmSP),
+            "call $get",
+            fmt.Sprintf("i32.const %v", call.Arguments - i),
+            "i32.sub",
+            "call $get",
+            "call $set")
+    }
+
+    out = append(out,
+        /* sp = base + n */
+        fmt.Sprintf("i32.const %v", wasmSP),
+        "local.get $y",
+        fmt.Sprintf("i32.const %v", call.Arguments),
+        "i32.add",
+        "call $set",
+        "local.get $x",
+        "call $push")
+
+    for _, pointer := range []int{wasmLCL, wasmARG, wasmTHIS, wasmTHAT} {
+        out = append(out, wasmPushAddress([]string{fmt.Sprintf("i32.const %v", pointer)})...)
+    }
+
+    out = append(out,
+        /* arg = base */
+        fmt.Sprintf("i32.const %v", wasmARG),
+        "local.get $y",
+        "call $set",
+
+        /* lcl = sp */
+        fmt.Sprintf("i32.const %v", wasmLCL),
+        fmt.Sprintf("i32.const %v", wasmSP),
+        "call $get",
+        "call $set")
+
+    return append(out, wasmJump(wasmFunctionTarget(translator, call.Name))...)
+}
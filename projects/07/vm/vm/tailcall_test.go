@@ -0,0 +1,66 @@
+package vm
+
+import (
+    "testing"
+)
+
+/* counts n down to 0 through a tail call, returning how many calls it made */
+func countdownProgram(n int) *VMProgram {
+    return &VMProgram{Files: []*VMFile{
+        commandsFile("Sys.vm", "Sys",
+            &Function{Name: "Sys.init"},
+            &PushConstant{Constant: uint64(n)},
+            &PushConstant{Constant: 0},
+            &Call{Name: "Main.count", Arguments: 2},
+            &PopTemp{Index: 0},
+            &PushConstant{Constant: 0},
+            &Return{},
+        ),
+        commandsFile("Main.vm", "Main",
+            &Function{Name: "Main.count"},
+            &PushArgument{Index: 0},
+            &IfGoto{Name: "MORE"},
+            &PushArgument{Index: 1},
+            &Return{},
+            &Label{Name: "MORE"},
+            &PushArgument{Index: 0},
+            &PushConstant{Constant: 1},
+            &Sub{},
+            &PushArgument{Index: 1},
+            &PushConstant{Constant: 1},
+            &Add{},
+            &Call{Name: "Main.count", Arguments: 2},
+            &Return{},
+        ),
+    }}
+}
+
+func TestOptimizeTailCalls(test *testing.T){
+    program := countdownProgram(10)
+    count := program.OptimizeTailCalls()
+    if count != 1 {
+        test.Fatalf("replaced %v calls instead of 1", count)
+    }
+
+    lines := program.Files[1].Lines
+    tail, ok := lines[len(lines)-1].Command.(*TailCall)
+    if !ok || tail.Name != "Main.count" || tail.Arguments != 2 {
+        test.Errorf("the last command is %#v instead of a tail call", lines[len(lines)-1].Command)
+    }
+    if _, ok := program.Files[0].Lines[3].Command.(*Call); !ok {
+        test.Errorf("a call that is not followed by return was replaced")
+    }
+}
+
+/* 20000 nested frames would not fit in RAM, so this only works if the tail
+ * calls reuse the frame
+ */
+func TestTailCallsInC(test *testing.T){
+    program := countdownProgram(20000)
+    program.OptimizeTailCalls()
+
+    ram := runC(test, program, DefaultBootstrapOptions())
+    if ram[TempStart] != 20000 {
+        test.Errorf("the countdown returned %v instead of 20000", ram[TempStart])
+    }
+}
@@ -0,0 +1,822 @@
+package vm
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "bufio"
+    "bytes"
+    "io/ioutil"
+    "path/filepath"
+    "strings"
+    "strconv"
+
+)
+
+func normalizeWhitespace(line string) string {
+    commentStart := strings.Index(line, "//")
+    if commentStart != -1 {
+        line = line[0:commentStart]
+    }
+
+    return strings.TrimSpace(line)
+}
+
+/* The state every backend keeps while translating: where in the program it is
+ * and the symbols it has made up so far. Each backend builds its own
+ * translator around one, with whatever else it has to keep track of, and a
+ * zero Translator is ready to use.
+ */
+type Translator struct {
+    gensym uint64
+    /* put in front of every symbol made by Gensym, see reservedSymbolPrefix */
+    symbolPrefix string
+    CurrentFile string
+    CurrentFunction string
+}
+
+/* the first RAM address used for static variables, same as the assembler */
+const StaticStart = 16
+
+/* RAM addresses given to static variables by backends that do not go through
+ * the assembler, by the name the assembler would use
+ */
+type staticTable map[string]int
+
+/* the RAM address of a static variable, allocated the same way the assembler
+ * allocates variables
+ */
+func (statics *staticTable) address(file string, index int) int {
+    name := fmt.Sprintf("static.%v.%v", file, index)
+    if *statics == nil {
+        *statics = make(staticTable)
+    }
+
+    address, ok := (*statics)[name]
+    if !ok {
+        address = StaticStart + len(*statics)
+        (*statics)[name] = address
+    }
+
+    return address
+}
+
+/* symbols are namespaced by the file being translated, so files can be
+ * translated independently without their labels colliding
+ */
+func (translator *Translator) Gensym(name string) string {
+    use := translator.gensym
+    translator.gensym += 1
+    if translator.CurrentFile == "" {
+        return fmt.Sprintf("%v%v_%v", translator.symbolPrefix, name, use)
+    }
+    return fmt.Sprintf("%v%v$%v_%v", translator.symbolPrefix, translator.CurrentFile, name, use)
+}
+
+/* One parsed vm command. The command types only describe the command, the
+ * backends translate them: each has an interface of its own, such as
+ * asmCommand or cCommand, for the commands it supports.
+ */
+type Command interface {
+    vmCommand()
+}
+
+func (*PushConstant) vmCommand() {}
+func (*PushLocal) vmCommand() {}
+func (*PushArgument) vmCommand() {}
+func (*PushThis) vmCommand() {}
+func (*PushThat) vmCommand() {}
+func (*PushTemp) vmCommand() {}
+func (*PushPointer) vmCommand() {}
+func (*PushStatic) vmCommand() {}
+func (*PopLocal) vmCommand() {}
+func (*PopArgument) vmCommand() {}
+func (*PopThis) vmCommand() {}
+func (*PopThat) vmCommand() {}
+func (*PopTemp) vmCommand() {}
+func (*PopPointer) vmCommand() {}
+func (*PopStatic) vmCommand() {}
+func (*Add) vmCommand() {}
+func (*Sub) vmCommand() {}
+func (*Neg) vmCommand() {}
+func (*Eq) vmCommand() {}
+func (*Lt) vmCommand() {}
+func (*Gt) vmCommand() {}
+func (*And) vmCommand() {}
+func (*Or) vmCommand() {}
+func (*Not) vmCommand() {}
+func (*Label) vmCommand() {}
+func (*Goto) vmCommand() {}
+func (*IfGoto) vmCommand() {}
+func (*Function) vmCommand() {}
+func (*Call) vmCommand() {}
+func (*Return) vmCommand() {}
+
+type PushConstant struct {
+    Constant uint64
+}
+
+type Add struct {
+}
+
+type Sub struct {
+}
+
+type Lt struct {
+}
+
+/* the temp segment starts at ram 5 */
+const TempStart = 5
+/* the pointer segment starts at ram 3 */
+const PointerStart = 3
+
+type Eq struct {
+}
+
+type Gt struct {
+}
+
+type Neg struct {
+}
+
+type Not struct {
+}
+
+type And struct {
+}
+
+type Or struct {
+}
+
+type PopLocal struct {
+    Index int
+}
+
+type PopArgument struct {
+    Index int
+}
+
+type PopThis struct {
+    Index int
+}
+
+type PopThat struct {
+    Index int
+}
+
+type PopTemp struct {
+    Index int
+}
+
+type PopPointer struct {
+    Index int
+}
+
+type PushLocal struct {
+    Index int
+}
+
+type PushTemp struct {
+    Index int
+}
+
+type PushThis struct {
+    Index int
+}
+
+type PushThat struct {
+    Index int
+}
+
+type PushArgument struct {
+    Index int
+}
+
+type PushPointer struct {
+    Index int
+}
+
+type PushStatic struct {
+    Index int
+}
+
+type PopStatic struct {
+    Index int
+}
+
+type Label struct {
+    Name string
+}
+
+func getPushPopParts(parts []string) (string, int, error) {
+    if len(parts) == 3 {
+        where := parts[1]
+        number := parts[2]
+
+        value, err := strconv.ParseInt(number, 10, 64)
+        if err != nil {
+            return "", 0, fmt.Errorf("push/pop value must be an integer: %v", err)
+        }
+
+        return where, int(value), nil
+    } else {
+        return "", 0, fmt.Errorf("push/pop needs 3 parts, but only given %v: %v", len(parts), parts)
+    }
+}
+
+type IfGoto struct {
+    Name string
+}
+
+type Goto struct {
+    Name string
+}
+
+type Function struct {
+    Name string
+    Locals int
+}
+
+type Return struct {
+}
+
+type Call struct {
+    Name string
+    Arguments int
+}
+
+/* controls which commands the parser accepts */
+type ParseOptions struct {
+    /* accept the extended commands mul, div, mod, shl, shr and xor */
+    Extensions bool
+}
+
+/* parses one of the extended commands, or returns nil if the name is not one */
+func parseExtension(name string) Command {
+    switch name {
+        case "mul": return &Mul{}
+        case "div": return &Div{}
+        case "mod": return &Mod{}
+        case "shl": return &Shl{}
+        case "shr": return &Shr{}
+        case "xor": return &Xor{}
+    }
+
+    return nil
+}
+
+func parseLine(line string, options ParseOptions) (Command, error) {
+    parts := strings.Split(line, " ")
+    var useParts []string
+    for _, part := range parts {
+        if len(part) > 0 {
+            useParts = append(useParts, part)
+        }
+    }
+
+    if len(useParts) == 0 {
+        return nil, fmt.Errorf("no command given")
+    }
+
+    switch strings.ToLower(useParts[0]) {
+        case "push":
+            where, index, err := getPushPopParts(useParts)
+            if err != nil {
+                return nil, err
+            }
+
+            switch where {
+                case "constant": return &PushConstant{Constant: uint64(index)}, nil
+                case "local": return &PushLocal{Index: index}, nil
+                case "that": return &PushThat{Index: index}, nil
+                case "this": return &PushThis{Index: index}, nil
+                case "argument": return &PushArgument{Index: index}, nil
+                case "temp": return &PushTemp{Index: index}, nil
+                case "pointer": return &PushPointer{Index: index}, nil
+                case "static": return &PushStatic{Index: index}, nil
+            }
+
+            return nil, fmt.Errorf("Unknown push command '%v'", where)
+        case "pop":
+            where, index, err := getPushPopParts(useParts)
+            if err != nil {
+                return nil, err
+            }
+            switch where {
+                case "local": return &PopLocal{Index: index}, nil
+                case "argument": return &PopArgument{Index: index}, nil
+                case "this": return &PopThis{Index: index}, nil
+                case "that": return &PopThat{Index: index}, nil
+                case "temp": return &PopTemp{Index: index}, nil
+                case "pointer": return &PopPointer{Index: index}, nil
+                case "static": return &PopStatic{Index: index}, nil
+                case "constant": return nil, fmt.Errorf("cannot pop to the constant segment")
+            }
+            return nil, fmt.Errorf("Unknown memory area '%v'", where)
+        case "function":
+            if len(useParts) == 3 {
+                locals, err := strconv.Atoi(useParts[2])
+                if err != nil {
+                    return nil, fmt.Errorf("Expected a number for the locals '%v': %v", useParts[2], err)
+                }
+
+                return &Function{
+                    Name: useParts[1],
+                    Locals: locals,
+                }, nil
+            } else {
+                return nil, fmt.Errorf("Expected a name and number of locals for function")
+            }
+        case "return":
+            return &Return{}, nil
+        case "call":
+            if len(useParts) == 3 {
+                name := useParts[1]
+                arguments, err := strconv.Atoi(useParts[2])
+                if err != nil {
+                    return nil, fmt.Errorf("Expected a number of arguments for call '%v': %v", useParts[2], err)
+                }
+
+                return &Call{Name: name, Arguments: arguments}, nil
+            } else {
+                return nil, fmt.Errorf("Call needs a function name and number of arguments")
+            }
+        case "label":
+                if len(useParts) == 2 {
+                    return &Label{Name: useParts[1]}, nil
+                } else {
+                    return nil, fmt.Errorf("Missing label name")
+                }
+        case "if-goto":
+            if len(useParts) == 2 {
+                return &IfGoto{Name: useParts[1]}, nil
+            } else {
+                return nil, fmt.Errorf("Missing label name")
+            }
+        case "goto":
+            if len(useParts) == 2 {
+                return &Goto{Name: useParts[1]}, nil
+            } else {
+                return nil, fmt.Errorf("Missing label name")
+            }
+        case "lt":
+            return &Lt{}, nil
+        case "gt":
+            return &Gt{}, nil
+        case "eq":
+            return &Eq{}, nil
+        case "add":
+            return &Add{}, nil
+        case "sub":
+            return &Sub{}, nil
+        case "neg":
+            return &Neg{}, nil
+        case "and":
+            return &And{}, nil
+        case "or":
+            return &Or{}, nil
+        case "not":
+            return &Not{}, nil
+    }
+
+    extension := parseExtension(strings.ToLower(useParts[0]))
+    if extension != nil {
+        if !options.Extensions {
+            return nil, fmt.Errorf("'%v' is an extended command, which must be enabled with -extensions", useParts[0])
+        }
+        return extension, nil
+    }
+
+    return nil, fmt.Errorf("unknown command '%v'", useParts[0])
+}
+
+func processVMLine(line string, options ParseOptions) (Command, error) {
+    processed := normalizeWhitespace(line)
+    if len(processed) == 0 {
+        return nil, nil
+    }
+
+    // fmt.Printf("Processing line '%v'\n", processed)
+
+    command, err := parseLine(processed, options)
+    if err != nil {
+        return nil, err
+    }
+
+    /*
+    assembly := command.TranslateToAssembly()
+    for _, assemblyLine := range assembly {
+        fmt.Printf("%v\n", assemblyLine)
+    }
+    */
+
+    return command, nil
+}
+
+/* foo/bar.vm becomes foo/bar.what, and a directory foo/ or foo.d becomes
+ * foo.what or foo.d.what next to it
+ */
+func replaceExtension(path string, what string) string {
+    path = filepath.Clean(path)
+    if !isDir(path) {
+        path = removeExtension(path)
+    }
+
+    return fmt.Sprintf("%v.%v", path, what)
+}
+
+/* removes the last extension of the file name, leaving dots in directory
+ * names alone
+ */
+func removeExtension(path string) string {
+    return strings.TrimSuffix(path, filepath.Ext(path))
+}
+
+func className(path string) string {
+    return removeExtension(filepath.Base(path))
+}
+
+/* a single parsed vm command along with where it came from */
+type VMLine struct {
+    Command Command
+    /* the original source text */
+    Text string
+    Line uint64
+}
+
+/* all the commands of one .vm file */
+type VMFile struct {
+    Path string
+    Class string
+    Lines []VMLine
+}
+
+/* the whole set of .vm files being translated together */
+type VMProgram struct {
+    Files []*VMFile
+}
+
+/* the first function in the program, which is where execution ends up if
+ * the bootstrap code does not call anything
+ */
+func (program *VMProgram) FirstFunction() string {
+    for _, file := range program.Files {
+        for _, line := range file.Lines {
+            function, ok := line.Command.(*Function)
+            if ok {
+                return function.Name
+            }
+        }
+    }
+
+    return TopLevelFunction
+}
+
+func (program *VMProgram) DefinesFunction(name string) bool {
+    for _, file := range program.Files {
+        for _, line := range file.Lines {
+            function, ok := line.Command.(*Function)
+            if ok && function.Name == name {
+                return true
+            }
+        }
+    }
+
+    return false
+}
+
+func parseVMFile(path string, options ParseOptions) (*VMFile, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    return ParseVMFile(file, path, options)
+}
+
+/* parses vm text, using path for the class name and in errors */
+func ParseVMFile(input io.Reader, path string, options ParseOptions) (*VMFile, error) {
+    vmFile := VMFile{
+        Path: path,
+        Class: className(path),
+    }
+
+    scanner := bufio.NewScanner(input)
+    var sourceLine uint64
+    for scanner.Scan() {
+        line := scanner.Text()
+        // fmt.Printf("%v: %v\n", i, line)
+        sourceLine += 1
+
+        command, err := processVMLine(line, options)
+        if err != nil {
+            return nil, &ValidationError{
+                File: path,
+                Line: sourceLine,
+                Message: fmt.Sprintf("could not process '%v': %v", strings.TrimSpace(line), err),
+            }
+        }
+
+        if command == nil {
+            continue
+        }
+
+        vmFile.Lines = append(vmFile.Lines, VMLine{
+            Command: command,
+            Text: line,
+            Line: sourceLine,
+        })
+    }
+
+    err := scanner.Err()
+    if err != nil {
+        return nil, err
+    }
+
+    return &vmFile, nil
+}
+
+/* Controls the code emitted before the first vm file. The defaults match the
+ * standard bootstrap: SP=256 followed by 'call Sys.init 0'.
+ */
+type BootstrapOptions struct {
+    /* if false then no bootstrap code is emitted at all */
+    Enabled bool
+    /* the function called by the bootstrap code */
+    EntryPoint string
+    /* true if the user explicitly chose the entry point */
+    ExplicitEntry bool
+
+    /* initial values for the SP, LCL, ARG, THIS and THAT pointers, as the .tst
+     * scripts would set them. a negative value leaves the pointer alone, except
+     * that SP defaults to 256 when the entry point is called.
+     */
+    SP int
+    LCL int
+    ARG int
+    THIS int
+    THAT int
+}
+
+func DefaultBootstrapOptions() BootstrapOptions {
+    return BootstrapOptions{
+        Enabled: true,
+        EntryPoint: "Sys.init",
+        SP: -1,
+        LCL: -1,
+        ARG: -1,
+        THIS: -1,
+        THAT: -1,
+    }
+}
+
+/* an initial value for one of the segment pointers */
+type pointerValue struct {
+    Name string
+    Value int
+}
+
+/* works out which pointers the bootstrap code sets and whether it calls the
+ * entry point
+ */
+func planBootstrap(program *VMProgram, options BootstrapOptions) ([]pointerValue, bool, error) {
+    /* programs such as the 07 tests have no Sys.init, in which case execution
+     * should just fall into the first vm file
+     */
+    callEntry := program.DefinesFunction(options.EntryPoint)
+    if !callEntry && options.ExplicitEntry {
+        return nil, false, fmt.Errorf("Entry point '%v' is not defined by any vm file", options.EntryPoint)
+    }
+
+    sp := options.SP
+    if sp < 0 && callEntry {
+        /* initialize SP to 256 */
+        sp = 256
+    }
+
+    all := []pointerValue{
+        {"SP", sp},
+        {"LCL", options.LCL},
+        {"ARG", options.ARG},
+        {"THIS", options.THIS},
+        {"THAT", options.THAT},
+    }
+
+    var pointers []pointerValue
+    for _, pointer := range all {
+        if pointer.Value >= 0 {
+            pointers = append(pointers, pointer)
+        }
+    }
+
+    return pointers, callEntry, nil
+}
+
+func isFile(path string) bool {
+    stat, err := os.Stat(path)
+    if err != nil {
+        return false
+    }
+
+    return !stat.IsDir()
+}
+
+func isDir(path string) bool {
+    stat, err := os.Stat(path)
+    if err != nil {
+        return false
+    }
+
+    return stat.IsDir()
+}
+
+type TranslateOptions struct {
+    Parse ParseOptions
+    Bootstrap BootstrapOptions
+    Inputs InputOptions
+    /* what kind of code to generate: "asm", "hack", "c", "wasm" or "x86-64" */
+    Target string
+    /* emit functions even if they can never be called */
+    KeepDeadFunctions bool
+    /* turn a call directly followed by a return into a jump that reuses the
+     * current frame
+     */
+    TailCalls bool
+    /* replace calls to leaf functions of at most this many commands with the
+     * body of the function, 0 to never inline
+     */
+    Inline int
+    /* keep the top of the stack in the D register between commands */
+    CacheTop bool
+    /* trap instead of letting the stack grow to StackLimit or beyond */
+    CheckStack bool
+    StackLimit int
+    /* count function entries and calls in RAM just below StackLimit */
+    Profile bool
+    /* write a json map from assembly lines back to vm commands */
+    SourceMap bool
+    /* print a code size report, and write it as json if a path is given.
+     * StatisticsTop limits the number of functions listed
+     */
+    Statistics bool
+    StatisticsJSON string
+    StatisticsTop int
+    /* for the hack target, also write the assembly and a listing of the
+     * address and encoding of every instruction
+     */
+    KeepAssembly bool
+    Listing bool
+    /* where Translate reports what it did and prints the statistics, nil to
+     * report nothing
+     */
+    Log io.Writer
+}
+
+/* Refuses options the target has no use for, by the name of their flag, so
+ * they are not silently ignored. Everything that works on the generated hack
+ * assembly needs the asm or hack target.
+ */
+func checkTargetOptions(options TranslateOptions) error {
+    assembly := options.Target == "asm" || options.Target == "hack"
+    hackOnly := []struct{
+        Flag string
+        Set bool
+        Allowed bool
+    }{
+        {"cache-top", options.CacheTop, assembly},
+        {"check-stack", options.CheckStack, assembly},
+        {"profile", options.Profile, assembly},
+        {"source-map", options.SourceMap, assembly},
+        {"stats", options.Statistics, assembly},
+        {"stats-json", options.StatisticsJSON != "", assembly},
+        {"keep-asm", options.KeepAssembly, options.Target == "hack"},
+        {"listing", options.Listing, options.Target == "hack"},
+    }
+
+    for _, option := range hackOnly {
+        if option.Set && !option.Allowed {
+            return fmt.Errorf("-%v cannot be used with the %v target", option.Flag, options.Target)
+        }
+    }
+
+    return nil
+}
+
+/* the functions that execution can start in */
+func entryRoots(program *VMProgram, options BootstrapOptions) []string {
+    if options.Enabled && program.DefinesFunction(options.EntryPoint) {
+        return []string{options.EntryPoint}
+    }
+
+    return []string{program.FirstFunction()}
+}
+
+/* Reads and validates the vm files selected by path and the input options,
+ * for tools that work on a whole program without translating it.
+ */
+func LoadProgram(path string, parse ParseOptions, inputs InputOptions) (*VMProgram, error) {
+    vmFiles, err := findInputs(path, inputs)
+    if err != nil {
+        return nil, err
+    }
+
+    var program VMProgram
+    for _, vmFile := range vmFiles {
+        err = program.AddFile(vmFile, parse)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    err = program.Validate()
+    if err != nil {
+        return nil, err
+    }
+
+    return &program, nil
+}
+
+/* Translates a .vm file, .vmb file, directory or manifest into a file next to
+ * it, named after it with the extension of the target backend. Sidecar files
+ * asked for by the options are written as well.
+ */
+func Translate(path string, options TranslateOptions) error {
+    backend, ok := Backends[options.Target]
+    if !ok {
+        return fmt.Errorf("Unknown target '%v'", options.Target)
+    }
+
+    err := checkTargetOptions(options)
+    if err != nil {
+        return err
+    }
+
+    vmFiles, err := findInputs(path, options.Inputs)
+    if err != nil {
+        return err
+    }
+
+    log := options.Log
+    if log == nil {
+        log = ioutil.Discard
+    }
+
+    fmt.Fprintf(log, "Translating files %v\n", vmFiles)
+
+    var program VMProgram
+    for _, vmFile := range vmFiles {
+        err = program.AddFile(vmFile, options.Parse)
+        if err != nil {
+            return err
+        }
+    }
+
+    err = program.Validate()
+    if err != nil {
+        return err
+    }
+
+    bootstrap := options.Bootstrap
+    if bootstrap.Enabled && !bootstrap.ExplicitEntry && !program.DefinesFunction(bootstrap.EntryPoint) {
+        fmt.Fprintf(log, "No %v function found, not calling an entry point\n", bootstrap.EntryPoint)
+    }
+
+    if options.Inline > 0 {
+        count := program.InlineFunctions(options.Inline)
+        fmt.Fprintf(log, "Inlined %v calls\n", count)
+    }
+
+    if !options.KeepDeadFunctions {
+        removed := program.EliminateDeadFunctions(entryRoots(&program, options.Bootstrap))
+        if len(removed) > 0 {
+            writeDeadFunctionReport(log, removed)
+        }
+    }
+
+    if options.TailCalls {
+        count := program.OptimizeTailCalls()
+        fmt.Fprintf(log, "Optimized %v tail calls\n", count)
+    }
+
+    /* the output is only written once the backend is done, so a failed
+     * translation does not leave behind a file that looks like it worked
+     */
+    var output bytes.Buffer
+    sidecars, err := backend.Translate(&output, &program, options)
+    if err != nil {
+        return err
+    }
+
+    err = ioutil.WriteFile(replaceExtension(path, backend.Extension()), output.Bytes(), 0644)
+    if err != nil {
+        return err
+    }
+
+    if sidecars != nil {
+        return sidecars.WriteSidecars(log, path, options)
+    }
+
+    return nil
+}
+
@@ -0,0 +1,135 @@
+package vm
+
+import (
+    "testing"
+    "os"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+)
+
+/* a backend that fails must not leave an output file behind */
+func TestTranslateFailure(test *testing.T){
+    directory, err := ioutil.TempDir("", "vm")
+    if err != nil {
+        test.Fatalf("could not make a directory: %v", err)
+    }
+    defer os.RemoveAll(directory)
+
+    path := filepath.Join(directory, "Sys.vm")
+    err = ioutil.WriteFile(path, []byte("function Sys.init 0\ncall Sys.init 0\nreturn\n"), 0644)
+    if err != nil {
+        test.Fatalf("could not write %v: %v", path, err)
+    }
+
+    options := TranslateOptions{
+        Bootstrap: DefaultBootstrapOptions(),
+        Target: "hack",
+        /* no room for the profile counters */
+        Profile: true,
+        StackLimit: StackStart + 1,
+    }
+
+    err = Translate(path, options)
+    if err == nil {
+        test.Fatalf("the translation should have failed")
+    }
+
+    if _, err := os.Stat(filepath.Join(directory, "Sys.hack")); err == nil {
+        test.Fatalf("a failed translation wrote Sys.hack")
+    }
+}
+
+/* a command that only the hack backend knows how to translate */
+type hackOnlyCommand struct {
+}
+
+func (*hackOnlyCommand) vmCommand() {}
+
+func (*hackOnlyCommand) TranslateToAssembly(translator *asmTranslator) []string {
+    return []string{"D=0"}
+}
+
+/* every backend translates the commands it has a translation for and rejects
+ * the rest with the line they are on
+ */
+func TestUnsupportedCommand(test *testing.T){
+    program := VMProgram{
+        Files: []*VMFile{&VMFile{
+            Path: "Sys.vm",
+            Class: "Sys",
+            Lines: []VMLine{
+                VMLine{Command: &Function{Name: "Sys.init", Locals: 0}, Text: "function Sys.init 0", Line: 1},
+                VMLine{Command: &hackOnlyCommand{}, Text: "hack only", Line: 2},
+            },
+        }},
+    }
+
+    for _, name := range BackendNames() {
+        _, err := Backends[name].Translate(ioutil.Discard, &program, TranslateOptions{})
+        hack := name == "asm" || name == "hack"
+        if hack && err != nil {
+            test.Errorf("%v: %v", name, err)
+        }
+        if !hack {
+            unsupported, ok := err.(*ValidationError)
+            if !ok {
+                test.Errorf("%v: expected a validation error but got %v", name, err)
+            } else if unsupported.Line != 2 {
+                test.Errorf("%v: the error is on line %v instead of 2", name, unsupported.Line)
+            }
+        }
+    }
+}
+
+/* the package reports what it did only through Log */
+func TestTranslateLog(test *testing.T){
+    var log strings.Builder
+    options := hackOptions()
+    options.Log = &log
+    options.TailCalls = true
+    translateOutputs(test, everyCommandSource, options)
+
+    for _, expected := range []string{"Translating files", "Optimized 0 tail calls"} {
+        if !strings.Contains(log.String(), expected) {
+            test.Errorf("the log does not say '%v':\n%v", expected, log.String())
+        }
+    }
+}
+
+/* options for the hack assembly are refused by the other targets instead of
+ * being ignored
+ */
+func TestTargetOptions(test *testing.T){
+    settings := map[string]func(*TranslateOptions){
+        "cache-top": func(options *TranslateOptions){ options.CacheTop = true },
+        "check-stack": func(options *TranslateOptions){ options.CheckStack = true },
+        "profile": func(options *TranslateOptions){ options.Profile = true },
+        "source-map": func(options *TranslateOptions){ options.SourceMap = true },
+        "stats": func(options *TranslateOptions){ options.Statistics = true },
+        "stats-json": func(options *TranslateOptions){ options.StatisticsJSON = "stats.json" },
+        "keep-asm": func(options *TranslateOptions){ options.KeepAssembly = true },
+        "listing": func(options *TranslateOptions){ options.Listing = true },
+    }
+
+    for _, target := range BackendNames() {
+        for flag, set := range settings {
+            options := TranslateOptions{Target: target}
+            set(&options)
+            err := checkTargetOptions(options)
+
+            allowed := target == "hack" || (target == "asm" && flag != "keep-asm" && flag != "listing")
+            if allowed && err != nil {
+                test.Errorf("-%v with %v: %v", flag, target, err)
+            }
+            if !allowed && (err == nil || !strings.Contains(err.Error(), "-" + flag)) {
+                test.Errorf("-%v with %v gave %v", flag, target, err)
+            }
+        }
+    }
+
+    err := Translate("does-not-matter.vm", TranslateOptions{Target: "c", CacheTop: true})
+    if err == nil || !strings.Contains(err.Error(), "cache-top") {
+        test.Errorf("Translate did not refuse -cache-top with the c target: %v", err)
+    }
+}
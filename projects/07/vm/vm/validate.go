@@ -0,0 +1,216 @@
+package vm
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+/* the largest value that 'push constant' can load, since the A instruction
+ * only has 15 bits for its value
+ */
+const MaxConstant = 32767
+
+const TempSize = 8
+const PointerSize = 2
+
+/* a problem found in a vm program, along with where it is */
+type ValidationError struct {
+    File string
+    Line uint64
+    Message string
+}
+
+func (err *ValidationError) Error() string {
+    return fmt.Sprintf("%v:%v: %v", err.File, err.Line, err.Message)
+}
+
+/* all the problems found in a program */
+type ValidationErrors []*ValidationError
+
+func (errors ValidationErrors) Error() string {
+    var out []string
+    for _, err := range errors {
+        out = append(out, err.Error())
+    }
+    return strings.Join(out, "\n")
+}
+
+/* where a function was defined or first called */
+type functionSite struct {
+    File string
+    Line uint64
+    Arguments int
+}
+
+type labelUse struct {
+    Name string
+    Line uint64
+}
+
+type programValidator struct {
+    errors ValidationErrors
+
+    defined map[string]functionSite
+    called map[string]functionSite
+    /* calls in the order they appear, checked once all functions are known */
+    calls []struct{
+        Call *Call
+        Site functionSite
+    }
+
+    /* labels of the function currently being checked */
+    labels map[string]bool
+    jumps []labelUse
+}
+
+func (validator *programValidator) report(file string, line uint64, format string, args ...interface{}) {
+    validator.errors = append(validator.errors, &ValidationError{
+        File: file,
+        Line: line,
+        Message: fmt.Sprintf(format, args...),
+    })
+}
+
+/* every goto and if-goto must name a label of the function it is in */
+func (validator *programValidator) finishFunction(file string) {
+    for _, jump := range validator.jumps {
+        if !validator.labels[jump.Name] {
+            validator.report(file, jump.Line, "label '%v' is not defined in this function", jump.Name)
+        }
+    }
+
+    validator.labels = make(map[string]bool)
+    validator.jumps = nil
+}
+
+func checkIndex(segment string, index int, size int) string {
+    if index < 0 || index >= size {
+        return fmt.Sprintf("%v index %v is out of range 0..%v", segment, index, size - 1)
+    }
+    return ""
+}
+
+func checkNegative(segment string, index int) string {
+    if index < 0 {
+        return fmt.Sprintf("%v index %v must not be negative", segment, index)
+    }
+    return ""
+}
+
+/* returns a message if the command uses an invalid segment index */
+func checkSegmentIndex(command Command) string {
+    switch command := command.(type) {
+        case *PushConstant:
+            if command.Constant > MaxConstant {
+                return fmt.Sprintf("constant %v is out of range 0..%v", int64(command.Constant), MaxConstant)
+            }
+        case *PushTemp: return checkIndex("temp", command.Index, TempSize)
+        case *PopTemp: return checkIndex("temp", command.Index, TempSize)
+        case *PushPointer: return checkIndex("pointer", command.Index, PointerSize)
+        case *PopPointer: return checkIndex("pointer", command.Index, PointerSize)
+        case *PushLocal: return checkNegative("local", command.Index)
+        case *PopLocal: return checkNegative("local", command.Index)
+        case *PushArgument: return checkNegative("argument", command.Index)
+        case *PopArgument: return checkNegative("argument", command.Index)
+        case *PushThis: return checkNegative("this", command.Index)
+        case *PopThis: return checkNegative("this", command.Index)
+        case *PushThat: return checkNegative("that", command.Index)
+        case *PopThat: return checkNegative("that", command.Index)
+        case *PushStatic: return checkNegative("static", command.Index)
+        case *PopStatic: return checkNegative("static", command.Index)
+    }
+
+    return ""
+}
+
+func (validator *programValidator) checkFile(file *VMFile) {
+    validator.labels = make(map[string]bool)
+    validator.jumps = nil
+
+    for _, line := range file.Lines {
+        if message := checkSegmentIndex(line.Command); message != "" {
+            validator.report(file.Path, line.Line, "%v", message)
+        }
+
+        switch command := line.Command.(type) {
+            case *Function:
+                validator.finishFunction(file.Path)
+
+                if previous, ok := validator.defined[command.Name]; ok {
+                    validator.report(file.Path, line.Line, "function '%v' is already defined at %v:%v", command.Name, previous.File, previous.Line)
+                } else {
+                    validator.defined[command.Name] = functionSite{File: file.Path, Line: line.Line}
+                }
+
+                if command.Locals < 0 {
+                    validator.report(file.Path, line.Line, "function '%v' has a negative number of locals", command.Name)
+                }
+            case *Call:
+                if command.Arguments < 0 {
+                    validator.report(file.Path, line.Line, "call to '%v' has a negative number of arguments", command.Name)
+                }
+                validator.calls = append(validator.calls, struct{
+                    Call *Call
+                    Site functionSite
+                }{command, functionSite{File: file.Path, Line: line.Line, Arguments: command.Arguments}})
+            case *Label:
+                if validator.labels[command.Name] {
+                    validator.report(file.Path, line.Line, "label '%v' is defined more than once in this function", command.Name)
+                }
+                validator.labels[command.Name] = true
+            case *Goto:
+                validator.jumps = append(validator.jumps, labelUse{Name: command.Name, Line: line.Line})
+            case *IfGoto:
+                validator.jumps = append(validator.jumps, labelUse{Name: command.Name, Line: line.Line})
+        }
+    }
+
+    validator.finishFunction(file.Path)
+}
+
+func (validator *programValidator) checkCalls() {
+    for _, call := range validator.calls {
+        name := call.Call.Name
+        if _, ok := validator.defined[name]; !ok {
+            validator.report(call.Site.File, call.Site.Line, "call to undefined function '%v'", name)
+        }
+
+        first, ok := validator.called[name]
+        if !ok {
+            validator.called[name] = call.Site
+        } else if first.Arguments != call.Site.Arguments {
+            validator.report(call.Site.File, call.Site.Line, "function '%v' is called with %v arguments, but with %v arguments at %v:%v", name, call.Site.Arguments, first.Arguments, first.File, first.Line)
+        }
+    }
+}
+
+/* Checks the whole program for mistakes that would otherwise produce assembly
+ * that silently misbehaves: undefined or duplicate functions, inconsistent
+ * argument counts, undefined labels and out of range segment indexes.
+ */
+func (program *VMProgram) Validate() error {
+    validator := programValidator{
+        defined: make(map[string]functionSite),
+        called: make(map[string]functionSite),
+    }
+
+    for _, file := range program.Files {
+        validator.checkFile(file)
+    }
+
+    validator.checkCalls()
+
+    if len(validator.errors) > 0 {
+        errors := validator.errors
+        sort.SliceStable(errors, func (a, b int) bool {
+            if errors[a].File != errors[b].File {
+                return errors[a].File < errors[b].File
+            }
+            return errors[a].Line < errors[b].Line
+        })
+        return errors
+    }
+
+    return nil
+}
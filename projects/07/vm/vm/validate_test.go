@@ -0,0 +1,67 @@
+package vm
+
+import (
+    "testing"
+)
+
+func TestValidateGood(test *testing.T){
+    program := &VMProgram{Files: []*VMFile{
+        commandsFile("Main.vm", "Main",
+            &Function{Name: "Main.main", Locals: 1},
+            &Label{Name: "LOOP"},
+            &PushTemp{Index: 7},
+            &IfGoto{Name: "LOOP"},
+            &Call{Name: "Main.f", Arguments: 1},
+            &Return{},
+            &Function{Name: "Main.f"},
+            /* labels belong to their function, so this one is not a duplicate */
+            &Label{Name: "LOOP"},
+            &Goto{Name: "LOOP"},
+        ),
+    }}
+
+    err := program.Validate()
+    if err != nil {
+        test.Errorf("a valid program failed to validate: %v", err)
+    }
+}
+
+/* every mistake is reported with its line, not just the first */
+func TestValidateErrors(test *testing.T){
+    program := &VMProgram{Files: []*VMFile{
+        commandsFile("Main.vm", "Main",
+            &Function{Name: "Main.main"},
+            &PushConstant{Constant: 40000},
+            &PopPointer{Index: 2},
+            &Goto{Name: "NOWHERE"},
+            &Call{Name: "Main.missing", Arguments: 0},
+            &Call{Name: "Main.main", Arguments: 0},
+            &Call{Name: "Main.main", Arguments: 1},
+            &Function{Name: "Main.main"},
+        ),
+    }}
+
+    err := program.Validate()
+    errors, ok := err.(ValidationErrors)
+    if !ok {
+        test.Fatalf("expected validation errors but got %v", err)
+    }
+
+    expected := []ValidationError{
+        {File: "Main.vm", Line: 2, Message: "constant 40000 is out of range 0..32767"},
+        {File: "Main.vm", Line: 3, Message: "pointer index 2 is out of range 0..1"},
+        {File: "Main.vm", Line: 4, Message: "label 'NOWHERE' is not defined in this function"},
+        {File: "Main.vm", Line: 5, Message: "call to undefined function 'Main.missing'"},
+        {File: "Main.vm", Line: 7, Message: "function 'Main.main' is called with 1 arguments, but with 0 arguments at Main.vm:6"},
+        {File: "Main.vm", Line: 8, Message: "function 'Main.main' is already defined at Main.vm:1"},
+    }
+
+    if len(errors) != len(expected) {
+        test.Fatalf("expected %v errors but got %v:\n%v", len(expected), len(errors), errors)
+    }
+    for i := range expected {
+        if *errors[i] != expected[i] {
+            test.Errorf("error %v: expected '%v' but got '%v'", i, expected[i].Error(), errors[i].Error())
+        }
+    }
+}
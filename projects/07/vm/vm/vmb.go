@@ -0,0 +1,187 @@
+package vm
+
+import (
+    "os"
+    "fmt"
+    "path/filepath"
+
+    "github.com/kazzmir/nand2tetris/bytecode"
+)
+
+/* the extension of vm bytecode files, as written by vmasm */
+const BytecodeExtension = ".vmb"
+
+/* Reads a bytecode file. Every class in it becomes a VMFile named as if it
+ * were a .vm file inside the bytecode file, and each instruction goes through
+ * parseLine like a line of text would, with its position in the class as the
+ * line number.
+ */
+func parseBytecodeFile(path string, options ParseOptions) ([]*VMFile, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    classes, err := bytecode.Decode(file)
+    if err != nil {
+        return nil, fmt.Errorf("%v: %v", path, err)
+    }
+
+    var out []*VMFile
+    for _, class := range classes {
+        vmFile := VMFile{
+            Path: filepath.Join(path, class.Name + ".vm"),
+            Class: class.Name,
+        }
+
+        for i, instruction := range class.Instructions {
+            text := instruction.String()
+            command, err := processVMLine(text, options)
+            if err != nil {
+                return nil, &ValidationError{
+                    File: vmFile.Path,
+                    Line: uint64(i + 1),
+                    Message: fmt.Sprintf("could not process '%v': %v", text, err),
+                }
+            }
+
+            vmFile.Lines = append(vmFile.Lines, VMLine{
+                Command: command,
+                Text: text,
+                Line: uint64(i + 1),
+            })
+        }
+
+        out = append(out, &vmFile)
+    }
+
+    return out, nil
+}
+
+/* the classes a .vm or .vmb file defines */
+func fileClasses(path string) ([]string, error) {
+    if filepath.Ext(path) != BytecodeExtension {
+        return []string{className(path)}, nil
+    }
+
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    names, err := bytecode.ReadClassNames(file)
+    if err != nil {
+        return nil, fmt.Errorf("%v: %v", path, err)
+    }
+    return names, nil
+}
+
+/* Parses a .vm or .vmb file. Classes from a bytecode file that are already
+ * in the program are left out, so a project can replace single classes of a
+ * precompiled library.
+ */
+func (program *VMProgram) AddFile(path string, options ParseOptions) error {
+    if filepath.Ext(path) != BytecodeExtension {
+        parsed, err := parseVMFile(path, options)
+        if err != nil {
+            return err
+        }
+        program.Files = append(program.Files, parsed)
+        return nil
+    }
+
+    classes, err := parseBytecodeFile(path, options)
+    if err != nil {
+        return err
+    }
+
+    for _, class := range classes {
+        if !program.HasClass(class.Class) {
+            program.Files = append(program.Files, class)
+        }
+    }
+
+    return nil
+}
+
+/* the bytecode instruction for a command made by the parser */
+func bytecodeInstruction(command Command) (bytecode.Instruction, error) {
+    push := func (segment string, index int) (bytecode.Instruction, error) {
+        return bytecode.Instruction{Op: bytecode.OpPush, Segment: segment, Index: index}, nil
+    }
+    pop := func (segment string, index int) (bytecode.Instruction, error) {
+        return bytecode.Instruction{Op: bytecode.OpPop, Segment: segment, Index: index}, nil
+    }
+    simple := func (op bytecode.Opcode) (bytecode.Instruction, error) {
+        return bytecode.Instruction{Op: op}, nil
+    }
+
+    switch command := command.(type) {
+        case *PushConstant: return push("constant", int(command.Constant))
+        case *PushLocal: return push("local", command.Index)
+        case *PushArgument: return push("argument", command.Index)
+        case *PushThis: return push("this", command.Index)
+        case *PushThat: return push("that", command.Index)
+        case *PushTemp: return push("temp", command.Index)
+        case *PushPointer: return push("pointer", command.Index)
+        case *PushStatic: return push("static", command.Index)
+        case *PopLocal: return pop("local", command.Index)
+        case *PopArgument: return pop("argument", command.Index)
+        case *PopThis: return pop("this", command.Index)
+        case *PopThat: return pop("that", command.Index)
+        case *PopTemp: return pop("temp", command.Index)
+        case *PopPointer: return pop("pointer", command.Index)
+        case *PopStatic: return pop("static", command.Index)
+        case *Label: return bytecode.Instruction{Op: bytecode.OpLabel, Name: command.Name}, nil
+        case *Goto: return bytecode.Instruction{Op: bytecode.OpGoto, Name: command.Name}, nil
+        case *IfGoto: return bytecode.Instruction{Op: bytecode.OpIfGoto, Name: command.Name}, nil
+        case *Function: return bytecode.Instruction{Op: bytecode.OpFunction, Name: command.Name, Count: command.Locals}, nil
+        case *Call: return bytecode.Instruction{Op: bytecode.OpCall, Name: command.Name, Count: command.Arguments}, nil
+        case *Return: return simple(bytecode.OpReturn)
+        case *Add: return simple(bytecode.OpAdd)
+        case *Sub: return simple(bytecode.OpSub)
+        case *Neg: return simple(bytecode.OpNeg)
+        case *Eq: return simple(bytecode.OpEq)
+        case *Gt: return simple(bytecode.OpGt)
+        case *Lt: return simple(bytecode.OpLt)
+        case *And: return simple(bytecode.OpAnd)
+        case *Or: return simple(bytecode.OpOr)
+        case *Not: return simple(bytecode.OpNot)
+        case *Mul: return simple(bytecode.OpMul)
+        case *Div: return simple(bytecode.OpDiv)
+        case *Mod: return simple(bytecode.OpMod)
+        case *Shl: return simple(bytecode.OpShl)
+        case *Shr: return simple(bytecode.OpShr)
+        case *Xor: return simple(bytecode.OpXor)
+    }
+
+    return bytecode.Instruction{}, fmt.Errorf("%T has no bytecode", command)
+}
+
+/* Encodes a parsed vm file as a bytecode class. The commands are the ones the
+ * translator parsed, so anything it accepts can be encoded and the decoded
+ * text goes back through the same parser.
+ */
+func BytecodeClass(file *VMFile) (bytecode.Class, error) {
+    class := bytecode.Class{Name: file.Class}
+    for _, line := range file.Lines {
+        instruction, err := bytecodeInstruction(line.Command)
+        if err != nil {
+            return class, &ValidationError{File: file.Path, Line: line.Line, Message: err.Error()}
+        }
+        class.Instructions = append(class.Instructions, instruction)
+    }
+
+    return class, nil
+}
+
+func (program *VMProgram) HasClass(name string) bool {
+    for _, file := range program.Files {
+        if file.Class == name {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,217 @@
+package vm
+
+import (
+    "os"
+    "testing"
+    "bytes"
+    "reflect"
+    "strings"
+    "io/ioutil"
+    "path/filepath"
+
+    "github.com/kazzmir/nand2tetris/bytecode"
+)
+
+/* text goes through parseLine, is encoded and decoded, and the decoded text
+ * parses to the same commands
+ */
+func TestBytecodeRoundTrip(test *testing.T){
+    source := `
+function Main.main 2
+push constant 32767
+pop static 3
+push static 3
+push local 1
+xor
+if-goto END
+call Main.main 0
+label END
+return
+`
+    options := ParseOptions{Extensions: true}
+    file, err := ParseVMFile(strings.NewReader(source), "Main.vm", options)
+    if err != nil {
+        test.Fatalf("could not parse: %v", err)
+    }
+
+    class, err := BytecodeClass(file)
+    if err != nil {
+        test.Fatalf("could not make bytecode: %v", err)
+    }
+
+    var data bytes.Buffer
+    err = bytecode.Encode(&data, []bytecode.Class{class})
+    if err != nil {
+        test.Fatalf("could not encode: %v", err)
+    }
+
+    classes, err := bytecode.Decode(&data)
+    if err != nil {
+        test.Fatalf("could not decode: %v", err)
+    }
+
+    if len(classes) != 1 || len(classes[0].Instructions) != len(file.Lines) {
+        test.Fatalf("decoded %+v", classes)
+    }
+
+    for i, instruction := range classes[0].Instructions {
+        command, err := processVMLine(instruction.String(), options)
+        if err != nil {
+            test.Fatalf("could not parse decoded '%v': %v", instruction, err)
+        }
+        if !reflect.DeepEqual(command, file.Lines[i].Command) {
+            test.Errorf("line %v became %#v instead of %#v", i, command, file.Lines[i].Command)
+        }
+    }
+}
+
+func encodeClasses(test *testing.T, classes ...bytecode.Class) string {
+    var data bytes.Buffer
+    err := bytecode.Encode(&data, classes)
+    if err != nil {
+        test.Fatalf("could not encode: %v", err)
+    }
+    return data.String()
+}
+
+/* a library with its own Sys and a Lib class, where the Sys of the project
+ * replaces the one in the library
+ */
+func TestTranslateBytecode(test *testing.T){
+    library := encodeClasses(test,
+        bytecode.Class{Name: "Sys", Instructions: []bytecode.Instruction{
+            {Op: bytecode.OpFunction, Name: "Sys.init", Count: 0},
+            {Op: bytecode.OpPush, Segment: "constant", Index: 1},
+            {Op: bytecode.OpPop, Segment: "temp", Index: 0},
+            {Op: bytecode.OpLabel, Name: "END"},
+            {Op: bytecode.OpGoto, Name: "END"},
+        }},
+        bytecode.Class{Name: "Lib", Instructions: []bytecode.Instruction{
+            {Op: bytecode.OpFunction, Name: "Lib.mix", Count: 0},
+            {Op: bytecode.OpPush, Segment: "argument", Index: 0},
+            {Op: bytecode.OpPush, Segment: "constant", Index: 7},
+            {Op: bytecode.OpXor},
+            {Op: bytecode.OpReturn},
+        }},
+    )
+
+    sources := map[string]string{
+        "Sys.vm": `
+function Sys.init 0
+push constant 12
+call Lib.mix 1
+pop temp 0
+label END
+goto END
+`,
+        "lib.vmb": library,
+    }
+
+    machine := runHack(test, translateSources(test, sources, hackOptions())["asm"])
+    if machine.RAM[TempStart] != 12 ^ 7 {
+        test.Errorf("got %v instead of %v", machine.RAM[TempStart], 12 ^ 7)
+    }
+}
+
+func TestBadBytecode(test *testing.T){
+    program := VMProgram{}
+    library := encodeClasses(test, bytecode.Class{Name: "Lib", Instructions: []bytecode.Instruction{
+        {Op: bytecode.OpFunction, Name: "Lib.f", Count: 0},
+        {Op: bytecode.OpMul},
+    }})
+
+    root := makeTree(test)
+    defer os.RemoveAll(root)
+    path := filepath.Join(root, "lib.vmb")
+    err := ioutil.WriteFile(path, []byte(library), 0644)
+    if err != nil {
+        test.Fatalf("could not write %v: %v", path, err)
+    }
+
+    err = program.AddFile(path, ParseOptions{})
+    validation, ok := err.(*ValidationError)
+    if !ok || validation.Line != 2 {
+        test.Errorf("expected an error for the mul on line 2 without extensions but got %v", err)
+    }
+}
+
+/* a library in a search directory holds Memory and Sys. The project's own
+ * Memory.vm is used instead of the one in the library, and the Sys.vm of a
+ * later search directory is not used at all since the library has Sys
+ */
+func TestSearchBytecode(test *testing.T){
+    root := makeTree(test, "game/", "os/", "more/")
+    defer os.RemoveAll(root)
+
+    files := map[string]string{
+        "game/Main.vm": "function Main.main 0\ncall Memory.alloc 0\nreturn\n",
+        "game/Memory.vm": "function Memory.alloc 0\npush constant 5\nreturn\n",
+        "more/Sys.vm": "function Sys.init 0\npush constant 0\nreturn\n",
+        "os/os.vmb": encodeClasses(test,
+            bytecode.Class{Name: "Memory", Instructions: []bytecode.Instruction{
+                {Op: bytecode.OpFunction, Name: "Memory.alloc", Count: 0},
+                {Op: bytecode.OpPush, Segment: "constant", Index: 9},
+                {Op: bytecode.OpReturn},
+            }},
+            bytecode.Class{Name: "Sys", Instructions: []bytecode.Instruction{
+                {Op: bytecode.OpFunction, Name: "Sys.init", Count: 0},
+                {Op: bytecode.OpCall, Name: "Main.main", Count: 0},
+                {Op: bytecode.OpPop, Segment: "temp", Index: 0},
+                {Op: bytecode.OpLabel, Name: "END"},
+                {Op: bytecode.OpGoto, Name: "END"},
+            }},
+        ),
+    }
+    for name, contents := range files {
+        err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0644)
+        if err != nil {
+            test.Fatalf("could not write %v: %v", name, err)
+        }
+    }
+
+    options := hackOptions()
+    options.Inputs.SearchDirs = []string{filepath.Join(root, "os"), filepath.Join(root, "more")}
+
+    inputs, err := findInputs(filepath.Join(root, "game"), options.Inputs)
+    if err != nil {
+        test.Fatalf("could not find inputs: %v", err)
+    }
+    checkPaths(test, "search", relativePaths(test, root, inputs), "game/Main.vm", "game/Memory.vm", "os/os.vmb")
+
+    err = Translate(filepath.Join(root, "game"), options)
+    if err != nil {
+        test.Fatalf("could not translate: %v", err)
+    }
+    assembly, err := ioutil.ReadFile(filepath.Join(root, "game.asm"))
+    if err != nil {
+        test.Fatalf("no assembly: %v", err)
+    }
+
+    machine := runHack(test, string(assembly))
+    if machine.RAM[TempStart] != 5 {
+        test.Errorf("Memory.alloc gave %v instead of the 5 of game/Memory.vm", machine.RAM[TempStart])
+    }
+}
+
+/* a class in a .vm file wins over the same class in a .vmb file next to it,
+ * whichever comes first by name
+ */
+func TestBytecodeOrder(test *testing.T){
+    root := makeTree(test)
+    defer os.RemoveAll(root)
+
+    library := encodeClasses(test, bytecode.Class{Name: "Memory"}, bytecode.Class{Name: "Math"})
+    err := ioutil.WriteFile(filepath.Join(root, "Boot.vmb"), []byte(library), 0644)
+    if err == nil {
+        err = ioutil.WriteFile(filepath.Join(root, "Memory.vm"), nil, 0644)
+    }
+    if err != nil {
+        test.Fatalf("could not write the files: %v", err)
+    }
+
+    inputs, err := findInputs(root, InputOptions{})
+    if err != nil {
+        test.Fatalf("could not find inputs: %v", err)
+    }
+    checkPaths(test, "order", relativePaths(test, root, inputs), "Memory.vm", "Boot.vmb")
+}
@@ -0,0 +1,587 @@
+package vm
+
+import (
+    "io"
+    "fmt"
+    "strings"
+)
+
+/* Translation of vm commands to a WebAssembly text module. RAM is one page of
+ * linear memory holding 32K 16-bit words, so address n lives at byte 2n.
+ *
+ * WebAssembly has no goto, so the program is split into blocks at every label,
+ * function entry and return point, and control moves between blocks by storing
+ * the block number in $pc and branching back to a dispatch loop that selects
+ * the block with br_table. A call pushes the block number of its return point
+ * where the hack code would push a ROM address, so the stack frames have the
+ * same layout as on the hack platform.
+ *
+ * The module exports its memory and run(steps). run executes at most steps
+ * jumps and returns 1 if the program is still running, or 0 once it halted.
+ * Calling run again continues where the previous call stopped.
+ */
+
+/* the commands the wasm backend can translate */
+type wasmCommand interface {
+    TranslateToWasm(*wasmTranslator) []string
+}
+
+/* the state of the wasm backend: where the statics live and the block numbers
+ * given to labels, functions and return points
+ */
+type wasmTranslator struct {
+    Translator
+    statics staticTable
+    targets map[string]int
+}
+
+/* written into $pc once the program is done */
+const wasmHalted = -1
+
+/* a line produced by a command that starts a new block */
+const wasmBlockMarker = "@block "
+
+/* the block a label, function or return point starts */
+func wasmTarget(translator *wasmTranslator, key string) int {
+    if translator.targets == nil {
+        translator.targets = make(map[string]int)
+    }
+
+    id, ok := translator.targets[key]
+    if !ok {
+        id = len(translator.targets)
+        translator.targets[key] = id
+    }
+
+    return id
+}
+
+func wasmFunctionTarget(translator *wasmTranslator, name string) int {
+    return wasmTarget(translator, "function " + name)
+}
+
+/* vm labels are local to the function they appear in */
+func wasmLabelTarget(translator *wasmTranslator, name string) int {
+    return wasmTarget(translator, fmt.Sprintf("label %v %v", translator.CurrentFunction, name))
+}
+
+func wasmStartBlock(id int) string {
+    return fmt.Sprintf("%v%v", wasmBlockMarker, id)
+}
+
+func wasmJump(id int) []string {
+    return []string{
+        fmt.Sprintf("i32.const %v", id),
+        "global.set $pc",
+        "br $dispatch",
+    }
+}
+
+/* pushes the value of RAM[address] */
+func wasmPushAddress(address []string) []string {
+    return append(append(address, "call $get"), "call $push")
+}
+
+func wasmPushSegment(pointer int, index int) []string {
+    return wasmPushAddress([]string{
+        fmt.Sprintf("i32.const %v", pointer),
+        "call $get",
+        fmt.Sprintf("i32.const %v", index),
+        "i32.add",
+    })
+}
+
+func wasmPopSegment(pointer int, index int) []string {
+    return []string{
+        fmt.Sprintf("i32.const %v", pointer),
+        "call $get",
+        fmt.Sprintf("i32.const %v", index),
+        "i32.add",
+        "local.set $x",
+        "local.get $x",
+        "call $pop",
+        "call $set",
+    }
+}
+
+func wasmPopAddress(address int) []string {
+    return []string{
+        fmt.Sprintf("i32.const %v", address),
+        "call $pop",
+        "call $set",
+    }
+}
+
+func wasmBinary(operation ...string) []string {
+    out := []string{
+        "call $pop",
+        "local.set $y",
+        "call $pop",
+        "local.set $x",
+        "local.get $x",
+        "local.get $y",
+    }
+    out = append(out, operation...)
+    return append(out, "call $push")
+}
+
+func wasmComparison(compare string) []string {
+    return []string{
+        "call $pop",
+        "local.set $y",
+        "call $pop",
+        "local.set $x",
+        "i32.const -1",
+        "i32.const 0",
+        "local.get $x",
+        "local.get $y",
+        compare,
+        "select",
+        "call $push",
+    }
+}
+
+const (
+    wasmSP = 0
+    wasmLCL = 1
+    wasmARG = 2
+    wasmTHIS = 3
+    wasmTHAT = 4
+)
+
+func (constant *PushConstant) TranslateToWasm(translator *wasmTranslator) []string {
+    return []string{
+        fmt.Sprintf("i32.const %v", constant.Constant),
+        "call $push",
+    }
+}
+
+func (add *Add) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmBinary("i32.add")
+}
+
+func (sub *Sub) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmBinary("i32.sub")
+}
+
+func (and *And) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmBinary("i32.and")
+}
+
+func (or *Or) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmBinary("i32.or")
+}
+
+func (lt *Lt) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmComparison("i32.lt_s")
+}
+
+func (eq *Eq) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmComparison("i32.eq")
+}
+
+func (gt *Gt) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmComparison("i32.gt_s")
+}
+
+func (neg *Neg) TranslateToWasm(translator *wasmTranslator) []string {
+    return []string{
+        "i32.const 0",
+        "call $pop",
+        "i32.sub",
+        "call $push",
+    }
+}
+
+func (not *Not) TranslateToWasm(translator *wasmTranslator) []string {
+    return []string{
+        "call $pop",
+        "i32.const -1",
+        "i32.xor",
+        "call $push",
+    }
+}
+
+func (local *PopLocal) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPopSegment(wasmLCL, local.Index)
+}
+
+func (argument *PopArgument) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPopSegment(wasmARG, argument.Index)
+}
+
+func (this *PopThis) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPopSegment(wasmTHIS, this.Index)
+}
+
+func (that *PopThat) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPopSegment(wasmTHAT, that.Index)
+}
+
+func (temp *PopTemp) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPopAddress(TempStart + temp.Index)
+}
+
+func (pointer *PopPointer) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPopAddress(PointerStart + pointer.Index)
+}
+
+func (static *PopStatic) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPopAddress(translator.statics.address(translator.CurrentFile, static.Index))
+}
+
+func (local *PushLocal) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPushSegment(wasmLCL, local.Index)
+}
+
+func (argument *PushArgument) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPushSegment(wasmARG, argument.Index)
+}
+
+func (this *PushThis) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPushSegment(wasmTHIS, this.Index)
+}
+
+func (that *PushThat) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPushSegment(wasmTHAT, that.Index)
+}
+
+func (temp *PushTemp) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPushAddress([]string{fmt.Sprintf("i32.const %v", TempStart + temp.Index)})
+}
+
+func (pointer *PushPointer) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPushAddress([]string{fmt.Sprintf("i32.const %v", PointerStart + pointer.Index)})
+}
+
+func (static *PushStatic) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmPushAddress([]string{fmt.Sprintf("i32.const %v", translator.statics.address(translator.CurrentFile, static.Index))})
+}
+
+func (label *Label) TranslateToWasm(translator *wasmTranslator) []string {
+    return []string{wasmStartBlock(wasmLabelTarget(translator, label.Name))}
+}
+
+func (ifgoto *IfGoto) TranslateToWasm(translator *wasmTranslator) []string {
+    out := []string{
+        "call $pop",
+        "if",
+    }
+    out = append(out, wasmJump(wasmLabelTarget(translator, ifgoto.Name))...)
+    return append(out, "end")
+}
+
+func (this *Goto) TranslateToWasm(translator *wasmTranslator) []string {
+    return wasmJump(wasmLabelTarget(translator, this.Name))
+}
+
+func (function *Function) TranslateToWasm(translator *wasmTranslator) []string {
+    translator.CurrentFunction = function.Name
+
+    out := []string{wasmStartBlock(wasmFunctionTarget(translator, function.Name))}
+
+    /* the os never returns from Sys.halt, so treat entering it as the end of
+     * the program
+     */
+    if function.Name == "Sys.halt" {
+        out = append(out,
+            fmt.Sprintf("i32.const %v", wasmHalted),
+            "global.set $pc",
+            "i32.const 0",
+            "return")
+    }
+
+    for i := 0; i < function.Locals; i++ {
+        out = append(out, "i32.const 0", "call $push")
+    }
+
+    return out
+}
+
+/* pointer = RAM[frame - offset] */
+func wasmRestorePointer(pointer int, offset int) []string {
+    return []string{
+        fmt.Sprintf("i32.const %v", pointer),
+        "local.get $frame",
+        fmt.Sprintf("i32.const %v", offset),
+        "i32.sub",
+        "call $get",
+        "call $set",
+    }
+}
+
+func (ret *Return) TranslateToWasm(translator *wasmTranslator) []string {
+    out := []string{
+        /* frame = lcl, the return block is *(frame-5) */
+        fmt.Sprintf("i32.const %v", wasmLCL),
+        "call $get",
+        "local.set $frame",
+        "local.get $frame",
+        "i32.const 5",
+        "i32.sub",
+        "call $get",
+        "global.set $pc",
+
+        /* *ARG = pop() */
+        fmt.Sprintf("i32.const %v", wasmARG),
+        "call $get",
+        "call $pop",
+        "call $set",
+
+        /* sp = arg+1 */
+        fmt.Sprintf("i32.const %v", wasmSP),
+        fmt.Sprintf("i32.const %v", wasmARG),
+        "call $get",
+        "i32.const 1",
+        "i32.add",
+        "call $set",
+    }
+
+    out = append(out, wasmRestorePointer(wasmTHAT, 1)...)
+    out = append(out, wasmRestorePointer(wasmTHIS, 2)...)
+    out = append(out, wasmRestorePointer(wasmARG, 3)...)
+    out = append(out, wasmRestorePointer(wasmLCL, 4)...)
+
+    return append(out, "br $dispatch")
+}
+
+func (call *Call) TranslateToWasm(translator *wasmTranslator) []string {
+    returnBlock := wasmTarget(translator, translator.Gensym(fmt.Sprintf("return %v", translator.CurrentFunction)))
+
+    out := []string{
+        fmt.Sprintf("i32.const %v", returnBlock),
+        "call $push",
+    }
+
+    for _, pointer := range []int{wasmLCL, wasmARG, wasmTHIS, wasmTHAT} {
+        out = append(out, wasmPushAddress([]string{fmt.Sprintf("i32.const %v", pointer)})...)
+    }
+
+    out = append(out,
+        /* arg = sp-n-5 */
+        fmt.Sprintf("i32.const %v", wasmARG),
+        fmt.Sprintf("i32.const %v", wasmSP),
+        "call $get",
+        fmt.Sprintf("i32.const %v", call.Arguments + 5),
+        "i32.sub",
+        "call $set",
+
+        /* lcl = sp */
+        fmt.Sprintf("i32.const %v", wasmLCL),
+        fmt.Sprintf("i32.const %v", wasmSP),
+        "call $get",
+        "call $set")
+
+    out = append(out, wasmJump(wasmFunctionTarget(translator, call.Name))...)
+
+    return append(out, wasmStartBlock(returnBlock))
+}
+
+const wasmPrelude = `;; generated by the nand2tetris vm translator
+(module
+  (memory (export "memory") 1)
+  (global $pc (mut i32) (i32.const 0))
+
+  ;; the byte offset of a 16-bit RAM word
+  (func $address (param $a i32) (result i32)
+    local.get $a
+    i32.const 32767
+    i32.and
+    i32.const 1
+    i32.shl)
+
+  (func $get (param $a i32) (result i32)
+    local.get $a
+    call $address
+    i32.load16_s)
+
+  (func $set (param $a i32) (param $v i32)
+    local.get $a
+    call $address
+    local.get $v
+    i32.store16)
+
+  (func $push (param $v i32)
+    i32.const 0
+    call $get
+    local.get $v
+    call $set
+    i32.const 0
+    i32.const 0
+    call $get
+    i32.const 1
+    i32.add
+    call $set)
+
+  (func $pop (result i32)
+    i32.const 0
+    i32.const 0
+    call $get
+    i32.const 1
+    i32.sub
+    call $set
+    i32.const 0
+    call $get
+    call $get)
+
+`
+
+/* one straight line piece of code that can be jumped to */
+type wasmBlock struct {
+    ID int
+    Code []string
+}
+
+/* the wasm version of the bootstrap code, see writeBootstrapCode */
+func wasmBootstrap(program *VMProgram, options BootstrapOptions, translator *wasmTranslator) ([]string, error) {
+    if !options.Enabled {
+        return nil, nil
+    }
+
+    pointers, callEntry, err := planBootstrap(program, options)
+    if err != nil {
+        return nil, err
+    }
+
+    var out []string
+    for _, pointer := range pointers {
+        address := map[string]int{"SP": wasmSP, "LCL": wasmLCL, "ARG": wasmARG, "THIS": wasmTHIS, "THAT": wasmTHAT}[pointer.Name]
+        out = append(out,
+            fmt.Sprintf("i32.const %v", address),
+            fmt.Sprintf("i32.const %v", pointer.Value),
+            "call $set")
+    }
+
+    if callEntry {
+        translator.CurrentFunction = options.EntryPoint
+        call := Call{Name: options.EntryPoint}
+        out = append(out, call.TranslateToWasm(translator)...)
+        /* the entry point returned, so the program is done */
+        out = append(out,
+            fmt.Sprintf("i32.const %v", wasmHalted),
+            "global.set $pc",
+            "i32.const 0",
+            "return")
+    }
+
+    return out, nil
+}
+
+func writeWasmLines(output io.Writer, indent string, lines []string) {
+    for _, line := range lines {
+        io.WriteString(output, indent)
+        io.WriteString(output, line)
+        output.Write([]byte{'\n'})
+    }
+}
+
+/* Writes the whole program as a WebAssembly text module, see the comment at
+ * the top of this file for how it is laid out.
+ */
+func translateToWasm(output io.Writer, program *VMProgram, options BootstrapOptions) error {
+    translator := &wasmTranslator{}
+    start := wasmTarget(translator, "start")
+    current := &wasmBlock{ID: start}
+    blocks := []*wasmBlock{current}
+
+    add := func(lines []string) {
+        for _, line := range lines {
+            if strings.HasPrefix(line, wasmBlockMarker) {
+                var id int
+                fmt.Sscanf(line[len(wasmBlockMarker):], "%d", &id)
+                current = &wasmBlock{ID: id}
+                blocks = append(blocks, current)
+            } else {
+                current.Code = append(current.Code, line)
+            }
+        }
+    }
+
+    bootstrap, err := wasmBootstrap(program, options, translator)
+    if err != nil {
+        return err
+    }
+    add(bootstrap)
+
+    for _, vmFile := range program.Files {
+        translator.CurrentFile = vmFile.Class
+        add([]string{fmt.Sprintf(";; %v", vmFile.Path)})
+        for _, line := range vmFile.Lines {
+            command, ok := line.Command.(wasmCommand)
+            if !ok {
+                return unsupportedCommand(vmFile, line, "wasm")
+            }
+            add([]string{fmt.Sprintf(";; %v", strings.TrimSpace(line.Text))})
+            add(command.TranslateToWasm(translator))
+        }
+    }
+
+    io.WriteString(output, wasmPrelude)
+    io.WriteString(output, "  (func $run (export \"run\") (param $steps i32) (result i32)\n")
+    io.WriteString(output, "    (local $x i32) (local $y i32) (local $frame i32)\n")
+    writeWasmLines(output, "    ", []string{
+        "global.get $pc",
+        fmt.Sprintf("i32.const %v", wasmHalted),
+        "i32.eq",
+        "if",
+        "  i32.const 0",
+        "  return",
+        "end",
+        "loop $dispatch",
+        "  local.get $steps",
+        "  i32.eqz",
+        "  if",
+        "    i32.const 1",
+        "    return",
+        "  end",
+        "  local.get $steps",
+        "  i32.const 1",
+        "  i32.sub",
+        "  local.set $steps",
+        "  block $bad",
+    })
+
+    for i := len(blocks) - 1; i >= 0; i-- {
+        fmt.Fprintf(output, "      block $b%v\n", i)
+    }
+
+    /* br_table is indexed by block id, but the blocks are nested in the order
+     * they appear in the program
+     */
+    targets := make([]string, len(translator.targets))
+    for i := range targets {
+        targets[i] = "$bad"
+    }
+    for i, block := range blocks {
+        targets[block.ID] = fmt.Sprintf("$b%v", i)
+    }
+
+    writeWasmLines(output, "        ", []string{
+        "global.get $pc",
+        fmt.Sprintf("br_table %v $bad", strings.Join(targets, " ")),
+    })
+
+    for i, block := range blocks {
+        fmt.Fprintf(output, "      end ;; $b%v\n", i)
+        writeWasmLines(output, "        ", block.Code)
+    }
+
+    writeWasmLines(output, "        ", []string{
+        ";; fell off the end of the program",
+        fmt.Sprintf("i32.const %v", wasmHalted),
+        "global.set $pc",
+        "i32.const 0",
+        "return",
+    })
+    writeWasmLines(output, "    ", []string{
+        "  end ;; $bad",
+        "  ;; returned to an address that is not a return point",
+        "  unreachable",
+        "end ;; $dispatch",
+        "unreachable)",
+    })
+
+    io.WriteString(output, ")\n")
+
+    return nil
+}
@@ -0,0 +1,63 @@
+package vm
+
+import (
+    "testing"
+    "strings"
+)
+
+/* there is no wasm runtime to run the module in, so this checks its shape:
+ * the parentheses balance and every block number the dispatch table can be
+ * given is a block of the program
+ */
+func TestWasmBackend(test *testing.T){
+    var output strings.Builder
+    err := translateToWasm(&output, sumProgram(), DefaultBootstrapOptions())
+    if err != nil {
+        test.Fatalf("could not translate: %v", err)
+    }
+    module := output.String()
+
+    if !strings.Contains(module, "\n(module\n") {
+        test.Errorf("the output is not a module")
+    }
+
+    depth := 0
+    for _, line := range strings.Split(module, "\n") {
+        /* comments hold vm source, which may have parentheses of its own */
+        if comment := strings.Index(line, ";;"); comment != -1 {
+            line = line[:comment]
+        }
+        depth += strings.Count(line, "(") - strings.Count(line, ")")
+        if depth < 0 {
+            test.Fatalf("unbalanced ')' in '%v'", line)
+        }
+    }
+    if depth != 0 {
+        test.Errorf("%v unclosed '('", depth)
+    }
+
+    /* the start, both functions, both labels and the return points of the
+     * bootstrap call and the two calls to Main.sum
+     */
+    blocks := strings.Count(module, "block $b") - strings.Count(module, "block $bad")
+    if blocks != 8 {
+        test.Errorf("expected 8 blocks but got %v", blocks)
+    }
+
+    var table string
+    for _, line := range strings.Split(module, "\n") {
+        if strings.Contains(line, "br_table") {
+            table = line
+        }
+    }
+    fields := strings.Fields(table)
+    if len(fields) != blocks + 2 {
+        test.Fatalf("the dispatch table has the wrong size: %v", table)
+    }
+    /* the last entry is the default */
+    for _, target := range fields[1:len(fields)-1] {
+        if target == "$bad" {
+            test.Errorf("a block number has no block: %v", table)
+        }
+    }
+}
@@ -0,0 +1,808 @@
+package vm
+
+import (
+    "io"
+    "fmt"
+    "strings"
+)
+
+/* Translation of vm commands to x86-64 assembly for Linux in GNU as syntax.
+ * RAM is a static array of 32K 16-bit words, so the stack, the segment
+ * pointers and the heap all live where they would on the hack platform, and
+ * every address is masked to 15 bits the same way the C backend does it.
+ * %rbx holds the address of the array while the program runs.
+ *
+ * Like the C backend a call pushes a small integer for its return point, and
+ * return jumps through a table of return points indexed by that integer.
+ *
+ * The output contains a small runtime with main, so it can be turned into an
+ * executable with 'cc -o program program.s'. The screen and keyboard are plain
+ * RAM: nothing is drawn and no key is ever pressed, but the screen can be
+ * written out as an image when the program ends. The executable accepts the
+ * same -steps, -screen and -ram options as the one made from the C backend.
+ */
+
+/* the commands the x86-64 backend can translate */
+type x86Command interface {
+    TranslateToX86(*x86Translator) []string
+}
+
+/* the state of the x86-64 backend, the same as for the c backend */
+type x86Translator struct {
+    Translator
+    statics staticTable
+    returns int
+    dispatch bool
+}
+
+/* labels are built the same way as in C, which keeps them valid for gas */
+func x86FunctionLabel(name string) string {
+    return fmt.Sprintf("F_%v", mangleC(name))
+}
+
+/* vm labels are local to the function they appear in */
+func x86Label(translator *x86Translator, name string) string {
+    return fmt.Sprintf("L_%v_%v", mangleC(translator.CurrentFunction), mangleC(name))
+}
+
+/* the byte offset of a RAM address in the ram array */
+func x86Address(address int) string {
+    return fmt.Sprintf("%v(%%rbx)", address * 2)
+}
+
+func x86PushSegment(pointer int, index int) []string {
+    return []string{
+        fmt.Sprintf("vmload %v, %v, %%cx", pointer, index),
+        "vmpush %cx",
+    }
+}
+
+func x86PopSegment(pointer int, index int) []string {
+    /* compute the address first, the same way the assembly does */
+    return []string{
+        fmt.Sprintf("movzwl %v, %%esi", x86Address(pointer)),
+        fmt.Sprintf("addl $%v, %%esi", index),
+        "andl $0x7fff, %esi",
+        "vmpop %cx",
+        "movw %cx, (%rbx,%rsi,2)",
+    }
+}
+
+func x86PushAddress(address int) []string {
+    return []string{
+        fmt.Sprintf("movw %v, %%cx", x86Address(address)),
+        "vmpush %cx",
+    }
+}
+
+func x86PopAddress(address int) []string {
+    return []string{
+        "vmpop %cx",
+        fmt.Sprintf("movw %%cx, %v", x86Address(address)),
+    }
+}
+
+/* pops y into %dx and x into %cx, applies the operation and pushes %cx */
+func x86Binary(operation ...string) []string {
+    out := []string{"vmpop %dx", "vmpop %cx"}
+    out = append(out, operation...)
+    return append(out, "vmpush %cx")
+}
+
+/* true is -1 and false is 0 */
+func x86Comparison(set string) []string {
+    return x86Binary(
+        "cmpw %dx, %cx",
+        fmt.Sprintf("%v %%cl", set),
+        "movzbl %cl, %ecx",
+        "negl %ecx")
+}
+
+const (
+    x86SP = 0
+    x86LCL = 1
+    x86ARG = 2
+    x86THIS = 3
+    x86THAT = 4
+)
+
+func (constant *PushConstant) TranslateToX86(translator *x86Translator) []string {
+    return []string{fmt.Sprintf("vmpush $%v", constant.Constant)}
+}
+
+func (add *Add) TranslateToX86(translator *x86Translator) []string {
+    return x86Binary("addw %dx, %cx")
+}
+
+func (sub *Sub) TranslateToX86(translator *x86Translator) []string {
+    return x86Binary("subw %dx, %cx")
+}
+
+func (lt *Lt) TranslateToX86(translator *x86Translator) []string {
+    return x86Comparison("setl")
+}
+
+func (eq *Eq) TranslateToX86(translator *x86Translator) []string {
+    return x86Comparison("sete")
+}
+
+func (gt *Gt) TranslateToX86(translator *x86Translator) []string {
+    return x86Comparison("setg")
+}
+
+func (and *And) TranslateToX86(translator *x86Translator) []string {
+    return x86Binary("andw %dx, %cx")
+}
+
+func (or *Or) TranslateToX86(translator *x86Translator) []string {
+    return x86Binary("orw %dx, %cx")
+}
+
+func (neg *Neg) TranslateToX86(translator *x86Translator) []string {
+    return []string{"vmpop %cx", "negw %cx", "vmpush %cx"}
+}
+
+func (not *Not) TranslateToX86(translator *x86Translator) []string {
+    return []string{"vmpop %cx", "notw %cx", "vmpush %cx"}
+}
+
+func (local *PopLocal) TranslateToX86(translator *x86Translator) []string {
+    return x86PopSegment(x86LCL, local.Index)
+}
+
+func (argument *PopArgument) TranslateToX86(translator *x86Translator) []string {
+    return x86PopSegment(x86ARG, argument.Index)
+}
+
+func (this *PopThis) TranslateToX86(translator *x86Translator) []string {
+    return x86PopSegment(x86THIS, this.Index)
+}
+
+func (that *PopThat) TranslateToX86(translator *x86Translator) []string {
+    return x86PopSegment(x86THAT, that.Index)
+}
+
+func (temp *PopTemp) TranslateToX86(translator *x86Translator) []string {
+    return x86PopAddress(TempStart + temp.Index)
+}
+
+func (pointer *PopPointer) TranslateToX86(translator *x86Translator) []string {
+    return x86PopAddress(PointerStart + pointer.Index)
+}
+
+func (static *PopStatic) TranslateToX86(translator *x86Translator) []string {
+    return x86PopAddress(translator.statics.address(translator.CurrentFile, static.Index))
+}
+
+func (local *PushLocal) TranslateToX86(translator *x86Translator) []string {
+    return x86PushSegment(x86LCL, local.Index)
+}
+
+func (argument *PushArgument) TranslateToX86(translator *x86Translator) []string {
+    return x86PushSegment(x86ARG, argument.Index)
+}
+
+func (this *PushThis) TranslateToX86(translator *x86Translator) []string {
+    return x86PushSegment(x86THIS, this.Index)
+}
+
+func (that *PushThat) TranslateToX86(translator *x86Translator) []string {
+    return x86PushSegment(x86THAT, that.Index)
+}
+
+func (temp *PushTemp) TranslateToX86(translator *x86Translator) []string {
+    return x86PushAddress(TempStart + temp.Index)
+}
+
+func (pointer *PushPointer) TranslateToX86(translator *x86Translator) []string {
+    return x86PushAddress(PointerStart + pointer.Index)
+}
+
+func (static *PushStatic) TranslateToX86(translator *x86Translator) []string {
+    return x86PushAddress(translator.statics.address(translator.CurrentFile, static.Index))
+}
+
+func (label *Label) TranslateToX86(translator *x86Translator) []string {
+    return []string{fmt.Sprintf("%v:", x86Label(translator, label.Name))}
+}
+
+func (ifgoto *IfGoto) TranslateToX86(translator *x86Translator) []string {
+    return []string{
+        "vmstep",
+        "vmpop %cx",
+        "testw %cx, %cx",
+        fmt.Sprintf("jnz %v", x86Label(translator, ifgoto.Name)),
+    }
+}
+
+func (this *Goto) TranslateToX86(translator *x86Translator) []string {
+    return []string{
+        "vmstep",
+        fmt.Sprintf("jmp %v", x86Label(translator, this.Name)),
+    }
+}
+
+func (function *Function) TranslateToX86(translator *x86Translator) []string {
+    translator.CurrentFunction = function.Name
+
+    out := []string{fmt.Sprintf("%v:", x86FunctionLabel(function.Name))}
+
+    /* the os never returns from Sys.halt, so treat entering it as the end of
+     * the program
+     */
+    if function.Name == "Sys.halt" {
+        out = append(out, "xorl %eax, %eax", "jmp vm_done")
+    }
+
+    for i := 0; i < function.Locals; i++ {
+        out = append(out, "vmpush $0")
+    }
+
+    return out
+}
+
+func (ret *Return) TranslateToX86(translator *x86Translator) []string {
+    translator.dispatch = true
+    return []string{
+        /* frame = lcl, the return point goes in %r12 */
+        fmt.Sprintf("movzwl %v, %%esi", x86Address(x86LCL)),
+        "leal -5(%rsi), %eax",
+        "andl $0x7fff, %eax",
+        "movzwl (%rbx,%rax,2), %r12d",
+        /* *arg = pop, sp = arg + 1 */
+        "vmpop %cx",
+        fmt.Sprintf("movzwl %v, %%edi", x86Address(x86ARG)),
+        "andl $0x7fff, %edi",
+        "movw %cx, (%rbx,%rdi,2)",
+        /* arg is read again in case the store went to arg itself */
+        fmt.Sprintf("movzwl %v, %%edi", x86Address(x86ARG)),
+        "incl %edi",
+        fmt.Sprintf("movw %%di, %v", x86Address(x86SP)),
+        "vmget %rsi, -1, %cx",
+        fmt.Sprintf("movw %%cx, %v", x86Address(x86THAT)),
+        "vmget %rsi, -2, %cx",
+        fmt.Sprintf("movw %%cx, %v", x86Address(x86THIS)),
+        "vmget %rsi, -3, %cx",
+        fmt.Sprintf("movw %%cx, %v", x86Address(x86ARG)),
+        "vmget %rsi, -4, %cx",
+        fmt.Sprintf("movw %%cx, %v", x86Address(x86LCL)),
+        "jmp vm_dispatch",
+    }
+}
+
+/* pushes lcl, arg, this and that */
+func x86PushFrame() []string {
+    var out []string
+    for _, pointer := range []int{x86LCL, x86ARG, x86THIS, x86THAT} {
+        out = append(out, x86PushAddress(pointer)...)
+    }
+    return out
+}
+
+func (call *Call) TranslateToX86(translator *x86Translator) []string {
+    id := translator.returns
+    translator.returns += 1
+
+    out := []string{
+        "vmstep",
+        fmt.Sprintf("vmpush $%v", id),
+    }
+    out = append(out, x86PushFrame()...)
+    return append(out,
+        /* arg = sp - n - 5, lcl = sp */
+        fmt.Sprintf("movw %v, %%cx", x86Address(x86SP)),
+        fmt.Sprintf("movw %%cx, %v", x86Address(x86LCL)),
+        fmt.Sprintf("subw $%v, %%cx", call.Arguments + 5),
+        fmt.Sprintf("movw %%cx, %v", x86Address(x86ARG)),
+        fmt.Sprintf("jmp %v", x86FunctionLabel(call.Name)),
+        fmt.Sprintf("R_%v:", id))
+}
+
+func (mul *Mul) TranslateToX86(translator *x86Translator) []string {
+    return x86Binary("imulw %dx, %cx")
+}
+
+/* Division in 32 bits, so that -32768 / -1 wraps around instead of trapping.
+ * x/0 is 0 and x%0 is x, as in the other backends.
+ */
+func x86Divide(result string, byZero string) []string {
+    return x86Binary(
+        "movswl %cx, %eax",
+        "movswl %dx, %esi",
+        "testl %esi, %esi",
+        "jz 1f",
+        "cltd",
+        "idivl %esi",
+        fmt.Sprintf("movw %v, %%cx", result),
+        "jmp 2f",
+        "1:",
+        byZero,
+        "2:")
+}
+
+func (div *Div) TranslateToX86(translator *x86Translator) []string {
+    return x86Divide("%ax", "xorl %ecx, %ecx")
+}
+
+func (mod *Mod) TranslateToX86(translator *x86Translator) []string {
+    /* %cx still holds x when y is 0 */
+    return x86Divide("%dx", "nop")
+}
+
+/* the shift count has to be in %cl, so x goes in %si */
+func x86Shift(operation string) []string {
+    return []string{
+        "vmpop %dx",
+        "vmpop %si",
+        "movl %edx, %ecx",
+        "andb $15, %cl",
+        fmt.Sprintf("%v %%cl, %%si", operation),
+        "vmpush %si",
+    }
+}
+
+func (shl *Shl) TranslateToX86(translator *x86Translator) []string {
+    return x86Shift("shlw")
+}
+
+func (shr *Shr) TranslateToX86(translator *x86Translator) []string {
+    return x86Shift("sarw")
+}
+
+func (xor *Xor) TranslateToX86(translator *x86Translator) []string {
+    return x86Binary("xorw %dx, %cx")
+}
+
+func (call *TailCall) TranslateToX86(translator *x86Translator) []string {
+    out := []string{
+        "vmstep",
+        /* frame = lcl in %rsi, the return point in %r8 and the base of the
+         * argument area in %rdi
+         */
+        fmt.Sprintf("movzwl %v, %%esi", x86Address(x86LCL)),
+        "vmget %rsi, -5, %r8w",
+        fmt.Sprintf("movzwl %v, %%edi", x86Address(x86ARG)),
+        "vmget %rsi, -1, %cx",
+        fmt.Sprintf("movw %%cx, %v", x86Address(x86THAT)),
+        "vmget %rsi, -2, %cx",
+        fmt.Sprintf("movw %%cx, %v", x86Address(x86THIS)),
+        "vmget %rsi, -3, %cx",
+        fmt.Sprintf("movw %%cx, %v", x86Address(x86ARG)),
+        "vmget %rsi, -4, %cx",
+        fmt.Sprintf("movw %%cx, %v", x86Address(x86LCL)),
+    }
+
+    for i := 0; i < call.Arguments; i++ {
+        out = append(out,
+            fmt.Sprintf("movzwl %v, %%ecx", x86Address(x86SP)),
+            fmt.Sprintf("vmget %%rcx, %v, %%dx", i - call.Arguments),
+            fmt.Sprintf("leal %v(%%rdi), %%eax", i),
+            "andl $0x7fff, %eax",
+            "movw %dx, (%rbx,%rax,2)")
+    }
+
+    out = append(out,
+        /* sp = base + n */
+        fmt.Sprintf("leal %v(%%rdi), %%ecx", call.Arguments),
+        fmt.Sprintf("movw %%cx, %v", x86Address(x86SP)),
+        "vmpush %r8w")
+    out = append(out, x86PushFrame()...)
+
+    return append(out,
+        /* arg = base, lcl = sp */
+        fmt.Sprintf("movw %%di, %v", x86Address(x86ARG)),
+        fmt.Sprintf("movw %v, %%cx", x86Address(x86SP)),
+        fmt.Sprintf("movw %%cx, %v", x86Address(x86LCL)),
+        fmt.Sprintf("jmp %v", x86FunctionLabel(call.Name)))
+}
+
+const x86Prelude = `# generated by the nand2tetris vm translator
+# build with: cc -o program program.s
+
+    .bss
+    .align 16
+ram:
+    .zero 65536
+steps:
+    .zero 8
+limit:
+    .zero 8
+
+    .section .rodata
+usage_message:
+    .string "usage: %s [-steps n] [-screen out.pbm] [-ram out.txt]\n"
+bad_return_message:
+    .string "bad return address\n"
+step_limit_message:
+    .string "step limit reached after %lld steps\n"
+steps_option:
+    .string "-steps"
+screen_option:
+    .string "-screen"
+ram_option:
+    .string "-ram"
+write_mode:
+    .string "w"
+write_binary_mode:
+    .string "wb"
+pbm_header:
+    .string "P4\n512 256\n"
+ram_line:
+    .string "%d %d\n"
+
+# addresses wrap around at 32K like RAM does on the hack platform
+
+# push a 16-bit register or immediate, clobbers %eax
+.macro vmpush value
+    movzwl (%rbx), %eax
+    andl $0x7fff, %eax
+    movw \value, (%rbx,%rax,2)
+    incw (%rbx)
+.endm
+
+# pop into a 16-bit register, clobbers %eax
+.macro vmpop register
+    decw (%rbx)
+    movzwl (%rbx), %eax
+    andl $0x7fff, %eax
+    movw (%rbx,%rax,2), \register
+.endm
+
+# register = RAM[base + offset], base is a 64-bit register holding an address
+.macro vmget base, offset, register
+    leal \offset(\base), %eax
+    andl $0x7fff, %eax
+    movw (%rbx,%rax,2), \register
+.endm
+
+# register = RAM[RAM[pointer] + index]
+.macro vmload pointer, index, register
+    movzwl 2*\pointer(%rbx), %eax
+    addl $\index, %eax
+    andl $0x7fff, %eax
+    movw (%rbx,%rax,2), \register
+.endm
+
+# gives up once the step limit is reached, so that programs which never halt
+# can still be run headless
+.macro vmstep
+    incq steps(%rip)
+    movq limit(%rip), %rax
+    testq %rax, %rax
+    jz 1f
+    cmpq %rax, steps(%rip)
+    jg vm_step_limit
+1:
+.endm
+
+    .text
+`
+
+const x86Runtime = `
+# prints the byte in %edi to the file in %rsi with its bits reversed, since the
+# leftmost pixel of a hack word is its lowest bit but the highest bit of a PBM
+# byte
+put_reversed:
+    xorl %eax, %eax
+    movl $8, %ecx
+1:
+    shll $1, %eax
+    movl %edi, %edx
+    andl $1, %edx
+    orl %edx, %eax
+    shrl $1, %edi
+    decl %ecx
+    jnz 1b
+    movl %eax, %edi
+    jmp fputc@PLT
+
+# writes the screen memory map as a binary PBM image to the path in %rdi,
+# returns non-zero on failure
+dump_screen:
+    pushq %rbx
+    pushq %r12
+    pushq %r13
+    pushq %r14
+    subq $8, %rsp
+    movq %rdi, %r13
+    leaq write_binary_mode(%rip), %rsi
+    call fopen@PLT
+    testq %rax, %rax
+    jz 3f
+    movq %rax, %r12
+    leaq pbm_header(%rip), %rdi
+    movq %r12, %rsi
+    call fputs@PLT
+    xorl %ebx, %ebx
+1:
+    cmpl $8192, %ebx
+    jge 2f
+    leaq ram(%rip), %rax
+    movzwl 2*16384(%rax,%rbx,2), %r14d
+    movl %r14d, %edi
+    andl $0xff, %edi
+    movq %r12, %rsi
+    call put_reversed
+    movl %r14d, %edi
+    shrl $8, %edi
+    movq %r12, %rsi
+    call put_reversed
+    incl %ebx
+    jmp 1b
+2:
+    movq %r12, %rdi
+    call fclose@PLT
+    xorl %eax, %eax
+    jmp 4f
+3:
+    movq %r13, %rdi
+    call perror@PLT
+    movl $1, %eax
+4:
+    addq $8, %rsp
+    popq %r14
+    popq %r13
+    popq %r12
+    popq %rbx
+    ret
+
+# writes every non-zero RAM location as 'address value' to the path in %rdi,
+# returns non-zero on failure
+dump_ram:
+    pushq %rbx
+    pushq %r12
+    pushq %r13
+    movq %rdi, %r13
+    leaq write_mode(%rip), %rsi
+    call fopen@PLT
+    testq %rax, %rax
+    jz 3f
+    movq %rax, %r12
+    xorl %ebx, %ebx
+1:
+    cmpl $32768, %ebx
+    jge 2f
+    leaq ram(%rip), %rax
+    movswl (%rax,%rbx,2), %ecx
+    testl %ecx, %ecx
+    jz 5f
+    movq %r12, %rdi
+    leaq ram_line(%rip), %rsi
+    movl %ebx, %edx
+    xorl %eax, %eax
+    call fprintf@PLT
+5:
+    incl %ebx
+    jmp 1b
+2:
+    movq %r12, %rdi
+    call fclose@PLT
+    xorl %eax, %eax
+    jmp 4f
+3:
+    movq %r13, %rdi
+    call perror@PLT
+    movl $1, %eax
+4:
+    popq %r13
+    popq %r12
+    popq %rbx
+    ret
+
+# prints the string in %rsi with the argument in %rdx to stderr
+print_error:
+    subq $8, %rsp
+    movq stderr@GOTPCREL(%rip), %rax
+    movq (%rax), %rdi
+    xorl %eax, %eax
+    call fprintf@PLT
+    addq $8, %rsp
+    ret
+
+    .globl main
+main:
+    pushq %rbp
+    pushq %r12
+    pushq %r13
+    pushq %r14
+    pushq %r15
+    pushq %rbx
+    subq $8, %rsp
+    # %r12 = argc, %r13 = argv, %r14 = i, %r15 = screen path, %rbx = ram path
+    movl %edi, %r12d
+    movq %rsi, %r13
+    xorl %r15d, %r15d
+    xorl %ebx, %ebx
+    movl $1, %r14d
+1:
+    cmpl %r12d, %r14d
+    jge 5f
+    # every option takes a value
+    leal 1(%r14), %eax
+    cmpl %r12d, %eax
+    jge 4f
+    movq (%r13,%r14,8), %rdi
+    leaq steps_option(%rip), %rsi
+    call strcmp@PLT
+    testl %eax, %eax
+    jnz 2f
+    movq 8(%r13,%r14,8), %rdi
+    call atoll@PLT
+    movq %rax, limit(%rip)
+    jmp 3f
+2:
+    movq (%r13,%r14,8), %rdi
+    leaq screen_option(%rip), %rsi
+    call strcmp@PLT
+    testl %eax, %eax
+    jnz 2f
+    movq 8(%r13,%r14,8), %r15
+    jmp 3f
+2:
+    movq (%r13,%r14,8), %rdi
+    leaq ram_option(%rip), %rsi
+    call strcmp@PLT
+    testl %eax, %eax
+    jnz 4f
+    movq 8(%r13,%r14,8), %rbx
+3:
+    addl $2, %r14d
+    jmp 1b
+4:
+    leaq usage_message(%rip), %rsi
+    movq (%r13), %rdx
+    call print_error
+    movl $1, %eax
+    jmp 9f
+5:
+    call vm_run
+    movl %eax, %r14d
+    cmpl $1, %r14d
+    jne 6f
+    leaq bad_return_message(%rip), %rsi
+    call print_error
+6:
+    cmpl $2, %r14d
+    jne 7f
+    leaq step_limit_message(%rip), %rsi
+    movq steps(%rip), %rdx
+    call print_error
+7:
+    testq %r15, %r15
+    jz 8f
+    movq %r15, %rdi
+    call dump_screen
+    testl %eax, %eax
+    jnz 9f
+8:
+    testq %rbx, %rbx
+    jz 8f
+    movq %rbx, %rdi
+    call dump_ram
+    testl %eax, %eax
+    jnz 9f
+8:
+    movl %r14d, %eax
+9:
+    addq $8, %rsp
+    popq %rbx
+    popq %r15
+    popq %r14
+    popq %r13
+    popq %r12
+    popq %rbp
+    ret
+
+    .section .note.GNU-stack,"",@progbits
+`
+
+func writeX86Lines(output io.Writer, lines []string) {
+    for _, line := range lines {
+        if !strings.HasSuffix(line, ":") {
+            io.WriteString(output, "    ")
+        }
+        io.WriteString(output, line)
+        output.Write([]byte{'\n'})
+    }
+}
+
+/* the x86 version of the bootstrap code, see writeBootstrapCode */
+func writeX86Bootstrap(output io.Writer, program *VMProgram, options BootstrapOptions, translator *x86Translator) error {
+    if !options.Enabled {
+        return nil
+    }
+
+    pointers, callEntry, err := planBootstrap(program, options)
+    if err != nil {
+        return err
+    }
+
+    for _, pointer := range pointers {
+        address := map[string]int{"SP": x86SP, "LCL": x86LCL, "ARG": x86ARG, "THIS": x86THIS, "THAT": x86THAT}[pointer.Name]
+        writeX86Lines(output, []string{fmt.Sprintf("movw $%v, %v", pointer.Value, x86Address(address))})
+    }
+
+    if callEntry {
+        translator.CurrentFunction = options.EntryPoint
+        call := Call{Name: options.EntryPoint}
+        writeX86Lines(output, call.TranslateToX86(translator))
+        /* the entry point returned, so the program is done */
+        writeX86Lines(output, []string{"xorl %eax, %eax", "jmp vm_done"})
+    }
+
+    return nil
+}
+
+/* Writes the whole program as x86-64 assembly with the runtime it needs. The
+ * vm code runs in vm_run, which returns 0 when the program halts, 1 for a bad
+ * return address and 2 once the step limit is reached.
+ */
+func translateToX86(output io.Writer, program *VMProgram, options BootstrapOptions) error {
+    translator := &x86Translator{}
+    io.WriteString(output, x86Prelude)
+
+    writeX86Lines(output, []string{
+        "vm_run:",
+        "pushq %rbx",
+        "pushq %r12",
+        "leaq ram(%rip), %rbx",
+    })
+
+    err := writeX86Bootstrap(output, program, options, translator)
+    if err != nil {
+        return err
+    }
+
+    for _, vmFile := range program.Files {
+        translator.CurrentFile = vmFile.Class
+        fmt.Fprintf(output, "# %v\n", vmFile.Path)
+        for _, line := range vmFile.Lines {
+            command, ok := line.Command.(x86Command)
+            if !ok {
+                return unsupportedCommand(vmFile, line, "x86-64")
+            }
+            fmt.Fprintf(output, "# %v\n", strings.TrimSpace(line.Text))
+            writeX86Lines(output, command.TranslateToX86(translator))
+        }
+    }
+
+    writeX86Lines(output, []string{
+        "# fell off the end of the program",
+        "xorl %eax, %eax",
+        "jmp vm_done",
+        "vm_step_limit:",
+        "movl $2, %eax",
+        "jmp vm_done",
+        "vm_bad_return:",
+        "movl $1, %eax",
+        "jmp vm_done",
+    })
+
+    /* every return point is known once all the calls have been translated */
+    if translator.dispatch {
+        writeX86Lines(output, []string{
+            "vm_dispatch:",
+            fmt.Sprintf("cmpl $%v, %%r12d", translator.returns),
+            "jae vm_bad_return",
+            "leaq vm_returns(%rip), %rdx",
+            "movslq (%rdx,%r12,4), %rax",
+            "addq %rdx, %rax",
+            "jmp *%rax",
+            "vm_returns:",
+        })
+        for id := 0; id < translator.returns; id++ {
+            writeX86Lines(output, []string{fmt.Sprintf(".long R_%v - vm_returns", id)})
+        }
+    }
+
+    writeX86Lines(output, []string{
+        "vm_done:",
+        "popq %r12",
+        "popq %rbx",
+        "ret",
+    })
+
+    io.WriteString(output, x86Runtime)
+
+    return nil
+}
@@ -0,0 +1,65 @@
+package vm
+
+import (
+    "testing"
+    "runtime"
+)
+
+/* assembles the x86-64 translation of a program and runs it, on the machines
+ * it is written for
+ */
+func runX86(test *testing.T, program *VMProgram, options BootstrapOptions) map[int]int {
+    if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+        test.Skip("not an x86-64 linux machine")
+    }
+    return runNative(test, "program.s", translateToX86, program, options)
+}
+
+func TestX86Backend(test *testing.T){
+    ram := runX86(test, sumProgram(), DefaultBootstrapOptions())
+
+    expected := map[int]int{
+        TempStart: 55,
+        TempStart + 1: -1,
+        StaticStart: 5050,
+    }
+    for address, value := range expected {
+        if ram[address] != value {
+            test.Errorf("RAM[%v] is %v instead of %v", address, ram[address], value)
+        }
+    }
+}
+
+/* the extended commands give the same results as in C */
+func TestX86Extensions(test *testing.T){
+    operations := []struct{X, Y int; Op Command}{
+        {300, 300, &Mul{}},
+        {-7, 2, &Div{}},
+        {7, 0, &Div{}},
+        {-7, 2, &Mod{}},
+        {7, 0, &Mod{}},
+        {1, 15, &Shl{}},
+        {3, 17, &Shl{}},
+        {-16, 2, &Shr{}},
+        {12, 10, &Xor{}},
+    }
+
+    program := extensionProgram(operations)
+    c := runC(test, program, DefaultBootstrapOptions())
+    x86 := runX86(test, program, DefaultBootstrapOptions())
+    for i := range operations {
+        if x86[StaticStart + i] != c[StaticStart + i] {
+            test.Errorf("operation %v: got %v but C got %v", i, x86[StaticStart + i], c[StaticStart + i])
+        }
+    }
+}
+
+func TestX86TailCalls(test *testing.T){
+    program := countdownProgram(20000)
+    program.OptimizeTailCalls()
+
+    ram := runX86(test, program, DefaultBootstrapOptions())
+    if ram[TempStart] != 20000 {
+        test.Errorf("the countdown returned %v instead of 20000", ram[TempStart])
+    }
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+    "strings"
+)
+
+/* Checks a class before code is generated for it, catching mistakes that
+ * would otherwise compile into vm code that misbehaves when it runs:
+ * undeclared variables, assignments between types that do not mix, calls
+ * that use the wrong kind of subroutine or number of arguments, missing
+ * return values, void calls used as values and 'this' in functions.
+ *
+ * Jack is loosely typed so the checks are too. A char is the number of the
+ * character so int and char mix freely, and Array is used as a pointer to
+ * anything so it mixes with int and with every class. Types that are not
+ * jack types or classes of the program are not checked at all. Much jack code,
+ * the OS included, writes null as the constant 0, so that is accepted for
+ * objects as well.
+ */
+
+/* a type that is not checked, such as that of an array element */
+const typeUnknown = ""
+
+/* the type of 'null', which can be assigned to any object */
+const typeNull = "null"
+
+type CheckErrors []error
+
+func (errors CheckErrors) Error() string {
+    var lines []string
+    for _, err := range errors {
+        lines = append(lines, err.Error())
+    }
+    return strings.Join(lines, "\n")
+}
+
+type TypeChecker struct {
+    Classes *ClassTable
+    ClassName string
+    Fields map[string]string
+    Statics map[string]string
+
+    /* the subroutine being checked */
+    Subroutine *SubroutineSignature
+    Locals map[string]string
+    Parameters map[string]string
+
+    Errors CheckErrors
+}
+
+func isPrimitive(type_ string) bool {
+    switch type_ {
+        case "int", "char", "boolean", "void": return true
+    }
+    return false
+}
+
+func isNumeric(type_ string) bool {
+    return type_ == "int" || type_ == "char"
+}
+
+/* whether a value of type value can be stored in a variable of type target */
+func assignable(target string, value string) bool {
+    switch {
+        case target == value || value == typeUnknown || target == typeUnknown:
+            return true
+        case isNumeric(target) && isNumeric(value):
+            return true
+        case target == "boolean" || value == "boolean":
+            return false
+        case target == "Array" || value == "Array":
+            return true
+        case value == typeNull:
+            return !isPrimitive(target)
+    }
+
+    return false
+}
+
+/* like assignable, but also lets the constant 0 stand for null */
+func assignableExpression(target string, value string, ast ASTExpression) bool {
+    if assignable(target, value) {
+        return true
+    }
+
+    constant, ok := ast.(*ASTConstant)
+    return ok && constant.Number == "0" && assignable(target, typeNull)
+}
+
+/* the type to check with for a declared type */
+func (checker *TypeChecker) known(type_ string) string {
+    if isPrimitive(type_) || checker.Classes.IsClass(type_) {
+        return type_
+    }
+    return typeUnknown
+}
+
+/* the type of a variable that is in scope */
+func (checker *TypeChecker) variable(name string, position Position) (string, error) {
+    if type_, ok := checker.Locals[name]; ok {
+        return type_, nil
+    }
+
+    if type_, ok := checker.Parameters[name]; ok {
+        return type_, nil
+    }
+
+    if type_, ok := checker.Fields[name]; ok {
+        if checker.Subroutine.Kind == SubroutineFunction {
+            return "", errorAt(position, "field %v cannot be used in a function", name)
+        }
+        return type_, nil
+    }
+
+    if type_, ok := checker.Statics[name]; ok {
+        return type_, nil
+    }
+
+    return "", errorAt(position, "undeclared variable %v", name)
+}
+
+/* checks an expression whose value is used, and returns its type */
+func (checker *TypeChecker) expression(ast ASTExpression) (string, error) {
+    result, err := ast.Visit(checker)
+    if err != nil {
+        return "", err
+    }
+
+    type_ := result.(string)
+    if type_ == "void" {
+        return "", errorAt(ast.SourcePosition(), "the void subroutine call %v has no value", ast.ToSExpression())
+    }
+
+    return type_, nil
+}
+
+func (checker *TypeChecker) call(position Position, signature *SubroutineSignature, arguments []ASTExpression) (interface{}, error) {
+    if len(arguments) != len(signature.Parameters) {
+        return nil, errorAt(position, "%v takes %v arguments but is given %v", signature.FullName(), len(signature.Parameters), len(arguments))
+    }
+
+    for _, argument := range arguments {
+        _, err := checker.expression(argument)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return checker.known(signature.ReturnType), nil
+}
+
+/* whether the statements end in a return on every path through them */
+func alwaysReturns(statements []ASTNode) bool {
+    if len(statements) == 0 {
+        return false
+    }
+
+    switch last := statements[len(statements)-1].(type) {
+        case *ASTReturn:
+            return true
+        case *ASTIf:
+            return last.Else != nil && alwaysReturns(last.Then.Statements) && alwaysReturns(last.Else.Statements)
+    }
+
+    return false
+}
+
+func (checker *TypeChecker) subroutine(position Position, name string, parameters []*ASTParameter, body *ASTBlock) error {
+    signature, err := checker.Classes.LookupSubroutine(checker.ClassName, name)
+    if err != nil {
+        return positionError(position, err)
+    }
+
+    checker.Subroutine = signature
+    checker.Locals = make(map[string]string)
+    checker.Parameters = make(map[string]string)
+
+    for i, parameter := range parameters {
+        checker.Parameters[parameter.Name] = checker.known(signature.Parameters[i])
+    }
+
+    _, err = body.Visit(checker)
+    if err != nil {
+        return err
+    }
+
+    if signature.ReturnType != "void" && !alwaysReturns(body.Statements) {
+        checker.Errors = append(checker.Errors, errorAt(position, "%v does not return a value at the end", signature.FullName()))
+    }
+
+    return nil
+}
+
+func (checker *TypeChecker) VisitClass(ast *ASTClass) (interface{}, error) {
+    checker.ClassName = ast.Name
+
+    for _, body := range ast.Body {
+        switch body.(type) {
+            case *ASTField, *ASTStatic:
+                _, err := body.Visit(checker)
+                if err != nil {
+                    return nil, err
+                }
+        }
+    }
+
+    for _, body := range ast.Body {
+        switch body.(type) {
+            case *ASTField, *ASTStatic:
+            default:
+                _, err := body.Visit(checker)
+                if err != nil {
+                    return nil, err
+                }
+        }
+    }
+
+    return nil, nil
+}
+
+func (checker *TypeChecker) VisitStatic(ast *ASTStatic) (interface{}, error) {
+    type_, err := typeName(ast.Type)
+    if err != nil {
+        return nil, err
+    }
+    for _, name := range ast.Names {
+        checker.Statics[name.Name] = checker.known(type_)
+    }
+    return nil, nil
+}
+
+func (checker *TypeChecker) VisitField(ast *ASTField) (interface{}, error) {
+    type_, err := typeName(ast.Type)
+    if err != nil {
+        return nil, err
+    }
+    for _, name := range ast.Names {
+        checker.Fields[name] = checker.known(type_)
+    }
+    return nil, nil
+}
+
+func (checker *TypeChecker) VisitConstructor(ast *ASTConstructor) (interface{}, error) {
+    return nil, checker.subroutine(ast.Position, ast.Name, ast.Parameters, ast.Body)
+}
+
+func (checker *TypeChecker) VisitFunction(ast *ASTFunction) (interface{}, error) {
+    return nil, checker.subroutine(ast.Position, ast.Name, ast.Parameters, ast.Body)
+}
+
+func (checker *TypeChecker) VisitMethod(ast *ASTMethod) (interface{}, error) {
+    return nil, checker.subroutine(ast.Position, ast.Name, ast.Parameters, ast.Body)
+}
+
+func (checker *TypeChecker) VisitVar(ast *ASTVar) (interface{}, error) {
+    type_, err := typeName(ast.Type)
+    if err != nil {
+        return nil, err
+    }
+    for _, name := range ast.Names {
+        checker.Locals[name] = checker.known(type_)
+    }
+    return nil, nil
+}
+
+/* an error in one statement does not stop the others from being checked */
+func (checker *TypeChecker) VisitBlock(ast *ASTBlock) (interface{}, error) {
+    for _, statement := range ast.Statements {
+        _, err := statement.Visit(checker)
+        if err != nil {
+            checker.Errors = append(checker.Errors, err)
+        }
+    }
+    return nil, nil
+}
+
+func (checker *TypeChecker) VisitLet(ast *ASTLet) (interface{}, error) {
+    target, err := checker.variable(ast.Name, ast.Position)
+    if err != nil {
+        return nil, err
+    }
+
+    if ast.ArrayIndex != nil {
+        _, err = checker.expression(ast.ArrayIndex)
+        if err != nil {
+            return nil, err
+        }
+        /* array elements can hold anything */
+        target = typeUnknown
+    }
+
+    value, err := checker.expression(ast.Expression)
+    if err != nil {
+        return nil, err
+    }
+
+    if !assignableExpression(target, value, ast.Expression) {
+        return nil, errorAt(ast.Position, "cannot assign %v to %v of type %v", value, ast.Name, target)
+    }
+
+    return nil, nil
+}
+
+func (checker *TypeChecker) VisitIf(ast *ASTIf) (interface{}, error) {
+    _, err := checker.expression(ast.Condition)
+    if err != nil {
+        return nil, err
+    }
+
+    _, err = ast.Then.Visit(checker)
+    if err != nil {
+        return nil, err
+    }
+
+    if ast.Else != nil {
+        _, err = ast.Else.Visit(checker)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return nil, nil
+}
+
+func (checker *TypeChecker) VisitWhile(ast *ASTWhile) (interface{}, error) {
+    _, err := checker.expression(ast.Condition)
+    if err != nil {
+        return nil, err
+    }
+
+    return ast.Body.Visit(checker)
+}
+
+/* the value of a do is thrown away, so void calls are fine here */
+func (checker *TypeChecker) VisitDo(ast *ASTDo) (interface{}, error) {
+    _, err := ast.Expression.Visit(checker)
+    return nil, err
+}
+
+func (checker *TypeChecker) VisitReturn(ast *ASTReturn) (interface{}, error) {
+    returnType := checker.known(checker.Subroutine.ReturnType)
+
+    if ast.Expression == nil {
+        if returnType != "void" {
+            return nil, errorAt(ast.Position, "return without a value in a subroutine that returns %v", returnType)
+        }
+        return nil, nil
+    }
+
+    if returnType == "void" {
+        return nil, errorAt(ast.Position, "return with a value in a void subroutine")
+    }
+
+    value, err := checker.expression(ast.Expression)
+    if err != nil {
+        return nil, err
+    }
+
+    if !assignableExpression(returnType, value, ast.Expression) {
+        return nil, errorAt(ast.Position, "returns %v but the return type is %v", value, returnType)
+    }
+
+    return nil, nil
+}
+
+func (checker *TypeChecker) VisitIdentifier(ast *ASTIdentifier) (interface{}, error) {
+    return nil, errorAt(ast.Position, "type checker: should not visit identifier")
+}
+
+func (checker *TypeChecker) VisitReference(ast *ASTReference) (interface{}, error) {
+    return checker.variable(ast.Name, ast.Position)
+}
+
+func (checker *TypeChecker) VisitConstant(ast *ASTConstant) (interface{}, error) {
+    return "int", nil
+}
+
+func (checker *TypeChecker) VisitString(ast *ASTString) (interface{}, error) {
+    return "String", nil
+}
+
+func (checker *TypeChecker) VisitBoolean(ast *ASTBoolean) (interface{}, error) {
+    return "boolean", nil
+}
+
+func (checker *TypeChecker) VisitNull(ast *ASTNull) (interface{}, error) {
+    return typeNull, nil
+}
+
+func (checker *TypeChecker) VisitThis(ast *ASTThis) (interface{}, error) {
+    if checker.Subroutine.Kind == SubroutineFunction {
+        return nil, errorAt(ast.Position, "'this' cannot be used in a function")
+    }
+    return checker.ClassName, nil
+}
+
+func (checker *TypeChecker) VisitIndexExpression(ast *ASTIndexExpression) (interface{}, error) {
+    _, err := checker.expression(ast.Left)
+    if err != nil {
+        return nil, err
+    }
+
+    _, err = checker.expression(ast.Index)
+    if err != nil {
+        return nil, err
+    }
+
+    return typeUnknown, nil
+}
+
+func (checker *TypeChecker) VisitNegation(ast *ASTNegation) (interface{}, error) {
+    _, err := checker.expression(ast.Expression)
+    if err != nil {
+        return nil, err
+    }
+    return "int", nil
+}
+
+/* ~ is logical on booleans and bitwise on numbers */
+func (checker *TypeChecker) VisitNot(ast *ASTNot) (interface{}, error) {
+    type_, err := checker.expression(ast.Expression)
+    if err != nil {
+        return nil, err
+    }
+    if type_ == "boolean" {
+        return "boolean", nil
+    }
+    return "int", nil
+}
+
+func (checker *TypeChecker) VisitOperator(ast *ASTOperator) (interface{}, error) {
+    left, err := checker.expression(ast.Left)
+    if err != nil {
+        return nil, err
+    }
+
+    right, err := checker.expression(ast.Right)
+    if err != nil {
+        return nil, err
+    }
+
+    switch ast.Operator {
+        case TokenEquals, TokenLessThan, TokenGreaterThan:
+            return "boolean", nil
+        case TokenAnd, TokenOr:
+            if left == "boolean" && right == "boolean" {
+                return "boolean", nil
+            }
+    }
+
+    return "int", nil
+}
+
+func (checker *TypeChecker) VisitParenthesized(ast *ASTParenthesized) (interface{}, error) {
+    return ast.Expression.Visit(checker)
+}
+
+func (checker *TypeChecker) VisitCall(ast *ASTCall) (interface{}, error) {
+    signature, err := checker.Classes.LookupSubroutine(checker.ClassName, ast.Name)
+    if err != nil {
+        return nil, positionError(ast.Position, err)
+    }
+
+    if signature.Kind == SubroutineMethod && checker.Subroutine.Kind == SubroutineFunction {
+        return nil, errorAt(ast.Position, "method %v cannot be called from a function, which has no 'this'", signature.FullName())
+    }
+
+    return checker.call(ast.Position, signature, ast.Arguments)
+}
+
+func (checker *TypeChecker) VisitMethodCall(ast *ASTMethodCall) (interface{}, error) {
+    var class string
+    object := false
+
+    switch left := ast.Left.(type) {
+        case *ASTThis:
+            type_, err := checker.expression(left)
+            if err != nil {
+                return nil, err
+            }
+            class = type_
+            object = true
+        case *ASTReference:
+            _, local := checker.Locals[left.Name]
+            _, parameter := checker.Parameters[left.Name]
+            _, field := checker.Fields[left.Name]
+            _, static := checker.Statics[left.Name]
+
+            if local || parameter || field || static {
+                type_, err := checker.expression(left)
+                if err != nil {
+                    return nil, err
+                }
+                if isPrimitive(type_) {
+                    return nil, errorAt(left.Position, "%v has type %v, which has no subroutines", left.Name, type_)
+                }
+                if type_ == typeUnknown {
+                    /* nothing is known about the subroutines of the type */
+                    for _, argument := range ast.Call.Arguments {
+                        _, err := checker.expression(argument)
+                        if err != nil {
+                            return nil, err
+                        }
+                    }
+                    return typeUnknown, nil
+                }
+                class = type_
+                object = true
+            } else if checker.Classes.IsClass(left.Name) {
+                class = left.Name
+            } else {
+                return nil, errorAt(left.Position, "undeclared variable or class %v", left.Name)
+            }
+        default:
+            return nil, errorAt(ast.Position, "cannot call %v on %v", ast.Call.Name, ast.Left.ToSExpression())
+    }
+
+    signature, err := checker.Classes.LookupSubroutine(class, ast.Call.Name)
+    if err != nil {
+        return nil, positionError(ast.Position, err)
+    }
+
+    if object && signature.Kind != SubroutineMethod {
+        return nil, errorAt(ast.Position, "%v %v is called through an object instead of the class name", signature.Kind.Name(), signature.FullName())
+    }
+
+    if !object && signature.Kind == SubroutineMethod {
+        return nil, errorAt(ast.Position, "method %v is called through the class name instead of an object", signature.FullName())
+    }
+
+    return checker.call(ast.Position, signature, ast.Call.Arguments)
+}
+
+/* checks a class that is already in the class table, returning every
+ * problem found as CheckErrors
+ */
+func CheckClass(ast ASTNode, classes *ClassTable) error {
+    checker := TypeChecker{
+        Classes: classes,
+        Fields: make(map[string]string),
+        Statics: make(map[string]string),
+    }
+
+    _, err := ast.Visit(&checker)
+    if err != nil {
+        return err
+    }
+
+    if len(checker.Errors) > 0 {
+        return checker.Errors
+    }
+
+    return nil
+}
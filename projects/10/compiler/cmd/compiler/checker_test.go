@@ -0,0 +1,142 @@
+package main
+
+import (
+    "testing"
+    "strings"
+)
+
+func doCheck(text string) error {
+    classes, err := NewClassTable()
+    if err != nil {
+        return err
+    }
+
+    ast, err := parse(strings.NewReader(text))
+    if err != nil {
+        return err
+    }
+
+    err = classes.AddClass(ast)
+    if err != nil {
+        return err
+    }
+
+    return CheckClass(ast, classes)
+}
+
+func TestCheckValid(test *testing.T){
+    text := `
+class p {
+    field int x;
+    field p next;
+    static Array cache;
+
+    constructor p new(int start){
+        let x = start;
+        let next = null;
+        let next = 0;
+        return this;
+    }
+
+    method char get(){
+        var String s;
+        var char c;
+        let s = "ab";
+        let c = s.charAt(x) + 1;
+        let cache[c] = s;
+        return c;
+    }
+
+    method boolean less(p other){
+        if ((x < 3) & ~(other = null)) {
+            return true;
+        } else {
+            return false;
+        }
+    }
+
+    function int twice(int a){
+        do Output.printInt(a);
+        return a * 2;
+    }
+}
+`
+    err := doCheck(text)
+    if err != nil {
+        test.Fatalf("unexpected errors: %v", err)
+    }
+}
+
+func TestCheckErrors(test *testing.T){
+    type Case struct {
+        Body string
+        Error string
+    }
+
+    cases := []Case{
+        Case{Body: "let y = 1; return;", Error: "undeclared variable y"},
+        Case{Body: "let n = true; return;", Error: "cannot assign boolean to n of type int"},
+        Case{Body: "let o = 3; return;", Error: "cannot assign int to o of type p"},
+        Case{Body: "let n = o; return;", Error: "cannot assign p to n of type int"},
+        Case{Body: "do p.get(); return;", Error: "called through the class name"},
+        Case{Body: "do o.make(); return;", Error: "called through an object"},
+        Case{Body: "do Math.abs(1, 2); return;", Error: "takes 1 arguments but is given 2"},
+        Case{Body: "let n = p.nothing(); return;", Error: "has no value"},
+        Case{Body: "let o = this; return;", Error: "'this' cannot be used in a function"},
+        Case{Body: "let n = x; return;", Error: "field x cannot be used in a function"},
+        Case{Body: "do get(); return;", Error: "cannot be called from a function"},
+        Case{Body: "return 1;", Error: "return with a value in a void subroutine"},
+    }
+
+    for _, check := range cases {
+        text := `
+class p {
+    field int x;
+
+    method int get(){ return x; }
+    function p make(){ return null; }
+    function void nothing(){ return; }
+
+    function void test(){
+        var int n;
+        var p o;
+        ` + check.Body + `
+    }
+}
+`
+        err := doCheck(text)
+        if err == nil {
+            test.Errorf("expected an error for %v", check.Body)
+            continue
+        }
+
+        if !strings.Contains(err.Error(), check.Error) {
+            test.Errorf("expected the error for %v to mention '%v' but got: %v", check.Body, check.Error, err)
+        }
+    }
+}
+
+func TestCheckMissingReturn(test *testing.T){
+    text := `
+class p {
+    function int f(int a){
+        if (a < 0) {
+            return 0;
+        }
+    }
+
+    function int g(){
+        return;
+    }
+}
+`
+    err := doCheck(text)
+    if err == nil {
+        test.Fatalf("expected errors for the missing return values")
+    }
+
+    errors, ok := err.(CheckErrors)
+    if !ok || len(errors) != 2 {
+        test.Fatalf("expected 2 errors but got: %v", err)
+    }
+}
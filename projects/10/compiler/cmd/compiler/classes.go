@@ -0,0 +1,279 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+/* The classes of a whole program with the signatures of their subroutines, so
+ * that code generation can tell a function call from a method call and report
+ * calls to classes or subroutines that do not exist. The classes of the
+ * project are registered on top of stubs for the OS classes of project 12.
+ */
+
+type SubroutineKind int
+
+const (
+    SubroutineFunction SubroutineKind = iota
+    SubroutineMethod
+    SubroutineConstructor
+)
+
+func (kind SubroutineKind) Name() string {
+    switch kind {
+        case SubroutineFunction: return "function"
+        case SubroutineMethod: return "method"
+        case SubroutineConstructor: return "constructor"
+    }
+
+    return "??"
+}
+
+type SubroutineSignature struct {
+    Kind SubroutineKind
+    Class string
+    Name string
+    ReturnType string
+    /* the types of the parameters, not counting 'this' */
+    Parameters []string
+}
+
+func (signature *SubroutineSignature) FullName() string {
+    return fmt.Sprintf("%v.%v", signature.Class, signature.Name)
+}
+
+type ClassSignature struct {
+    Name string
+    Subroutines map[string]*SubroutineSignature
+    /* declared by the OS stubs rather than by the project */
+    Stub bool
+}
+
+type ClassTable struct {
+    Classes map[string]*ClassSignature
+}
+
+/* The api of the OS classes, given as jack with empty bodies, with the same
+ * signatures as the OS in projects/12. Main is here too because Sys.init
+ * calls Main.main, so the OS can be compiled without a program.
+ */
+const osStubs = `
+class Math {
+    function void init() {}
+    function int abs(int x) {}
+    function int multiply(int x, int y) {}
+    function int divide(int x, int y) {}
+    function int min(int x, int y) {}
+    function int max(int x, int y) {}
+    function int sqrt(int x) {}
+}
+
+class String {
+    constructor String new(int maxLength) {}
+    method void dispose() {}
+    method int length() {}
+    method char charAt(int j) {}
+    method void setCharAt(int j, char c) {}
+    method String appendChar(char c) {}
+    method void eraseLastChar() {}
+    method int intValue() {}
+    method void setInt(int val) {}
+    function char backSpace() {}
+    function char doubleQuote() {}
+    function char newLine() {}
+}
+
+class Array {
+    function Array new(int size) {}
+    method void dispose() {}
+}
+
+class Output {
+    function void init() {}
+    function void moveCursor(int i, int j) {}
+    function void printChar(char c) {}
+    function void printString(String s) {}
+    function void printInt(int i) {}
+    function void println() {}
+    function void backSpace() {}
+}
+
+class Screen {
+    function void init() {}
+    function void clearScreen() {}
+    function void setColor(boolean b) {}
+    function void drawPixel(int x, int y) {}
+    function void drawLine(int x1, int y1, int x2, int y2) {}
+    function void drawRectangle(int x1, int y1, int x2, int y2) {}
+    function void drawCircle(int x, int y, int r) {}
+}
+
+class Keyboard {
+    function void init() {}
+    function char keyPressed() {}
+    function char readChar() {}
+    function String readLine(String message) {}
+    function int readInt(String message) {}
+}
+
+class Memory {
+    function void init() {}
+    function int peek(int address) {}
+    function void poke(int address, int value) {}
+    function int alloc(int size) {}
+    function void deAlloc(Array o) {}
+}
+
+class Sys {
+    function void init() {}
+    function void halt() {}
+    function void error(int errorCode) {}
+    function void wait(int duration) {}
+}
+
+class Main {
+    function void main() {}
+}
+`
+
+/* a class table that holds the OS classes */
+func NewClassTable() (*ClassTable, error) {
+    table := &ClassTable{
+        Classes: make(map[string]*ClassSignature),
+    }
+
+    /* the parser reads one class at a time */
+    for _, source := range strings.SplitAfter(osStubs, "\n}\n") {
+        if strings.TrimSpace(source) == "" {
+            continue
+        }
+
+        ast, err := parse(strings.NewReader(source))
+        if err != nil {
+            return nil, fmt.Errorf("could not parse the os stubs: %v", err)
+        }
+
+        class, err := makeClassSignature(ast)
+        if err != nil {
+            return nil, err
+        }
+        class.Stub = true
+        table.Classes[class.Name] = class
+    }
+
+    return table, nil
+}
+
+func typeName(type_ *ASTType) (string, error) {
+    identifier, ok := type_.Type.(*ASTIdentifier)
+    if !ok {
+        return "", errorAt(type_.Position, "unknown type node %v", type_.ToSExpression())
+    }
+    return identifier.Name, nil
+}
+
+func makeSubroutineSignature(kind SubroutineKind, class string, name string, returnType *ASTType, parameters []*ASTParameter) (*SubroutineSignature, error) {
+    signature := &SubroutineSignature{
+        Kind: kind,
+        Class: class,
+        Name: name,
+    }
+
+    if returnType != nil {
+        type_, err := typeName(returnType)
+        if err != nil {
+            return nil, err
+        }
+        signature.ReturnType = type_
+    } else {
+        /* constructors return their class */
+        signature.ReturnType = class
+    }
+
+    for _, parameter := range parameters {
+        type_, err := typeName(parameter.Type)
+        if err != nil {
+            return nil, err
+        }
+        signature.Parameters = append(signature.Parameters, type_)
+    }
+
+    return signature, nil
+}
+
+func makeClassSignature(ast ASTNode) (*ClassSignature, error) {
+    classAST, ok := ast.(*ASTClass)
+    if !ok {
+        return nil, errorAt(ast.SourcePosition(), "not a class: %v", ast.ToSExpression())
+    }
+
+    class := &ClassSignature{
+        Name: classAST.Name,
+        Subroutines: make(map[string]*SubroutineSignature),
+    }
+
+    for _, body := range classAST.Body {
+        var signature *SubroutineSignature
+        var err error
+
+        switch body := body.(type) {
+            case *ASTFunction:
+                signature, err = makeSubroutineSignature(SubroutineFunction, class.Name, body.Name, body.ReturnType, body.Parameters)
+            case *ASTMethod:
+                signature, err = makeSubroutineSignature(SubroutineMethod, class.Name, body.Name, body.ReturnType, body.Parameters)
+            case *ASTConstructor:
+                signature, err = makeSubroutineSignature(SubroutineConstructor, class.Name, body.Name, nil, body.Parameters)
+            default:
+                continue
+        }
+
+        if err != nil {
+            return nil, err
+        }
+
+        if _, exists := class.Subroutines[signature.Name]; exists {
+            return nil, errorAt(body.SourcePosition(), "subroutine %v is declared more than once", signature.FullName())
+        }
+        class.Subroutines[signature.Name] = signature
+    }
+
+    return class, nil
+}
+
+/* Registers a class of the project. A project class replaces an OS stub of the
+ * same name, so the OS itself can be compiled, but two project classes cannot
+ * share a name.
+ */
+func (table *ClassTable) AddClass(ast ASTNode) error {
+    class, err := makeClassSignature(ast)
+    if err != nil {
+        return err
+    }
+
+    existing, ok := table.Classes[class.Name]
+    if ok && !existing.Stub {
+        return errorAt(ast.SourcePosition(), "class %v is declared more than once", class.Name)
+    }
+
+    table.Classes[class.Name] = class
+    return nil
+}
+
+func (table *ClassTable) IsClass(name string) bool {
+    _, ok := table.Classes[name]
+    return ok
+}
+
+func (table *ClassTable) LookupSubroutine(class string, name string) (*SubroutineSignature, error) {
+    classSignature, ok := table.Classes[class]
+    if !ok {
+        return nil, fmt.Errorf("unknown class %v", class)
+    }
+
+    signature, ok := classSignature.Subroutines[name]
+    if !ok {
+        return nil, fmt.Errorf("class %v has no subroutine %v", class, name)
+    }
+
+    return signature, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+    "testing"
+    "os"
+    "path/filepath"
+    "reflect"
+)
+
+/* the OS of project 12 */
+const osDirectory = "../../../../12"
+
+/* the stubs have to agree with the real OS, otherwise a program type checks
+ * differently depending on whether the OS is compiled along with it
+ */
+func TestStubsMatchOS(test *testing.T){
+    stubs, err := NewClassTable()
+    if err != nil {
+        test.Fatalf("could not make the class table: %v", err)
+    }
+
+    for name, stub := range stubs.Classes {
+        if name == "Main" {
+            continue
+        }
+
+        file, err := os.Open(filepath.Join(osDirectory, name + ".jack"))
+        if err != nil {
+            test.Fatalf("could not open the OS class %v: %v", name, err)
+        }
+
+        ast, err := parse(file)
+        file.Close()
+        if err != nil {
+            test.Fatalf("could not parse the OS class %v: %v", name, err)
+        }
+
+        class, err := makeClassSignature(ast)
+        if err != nil {
+            test.Fatalf("could not read the OS class %v: %v", name, err)
+        }
+
+        for _, signature := range stub.Subroutines {
+            real, ok := class.Subroutines[signature.Name]
+            if !ok {
+                test.Errorf("the OS does not have %v", signature.FullName())
+                continue
+            }
+
+            if !reflect.DeepEqual(signature, real) {
+                test.Errorf("the stub of %v is %+v but the OS has %+v", signature.FullName(), signature, real)
+            }
+        }
+    }
+}
+
+func TestStubMain(test *testing.T){
+    text := `
+class Sys {
+    function void init(){
+        do Main.main();
+        return;
+    }
+}
+`
+    _, err := doCodeGen(text)
+    if err != nil {
+        test.Fatalf("could not call Main.main without a Main class: %v", err)
+    }
+
+    /* a Main in the program replaces the stub */
+    _, err = doCodeGen(text, "class Main { function int main(){ return 1; } }")
+    if err != nil {
+        test.Fatalf("could not call Main.main of the program: %v", err)
+    }
+}
@@ -22,6 +22,8 @@ type FunctionGenerator struct {
     ParameterCount int
     gensym int
     Preamble []string
+    /* methods and constructors have a 'this', functions do not */
+    HasThis bool
 }
 
 func (function *FunctionGenerator) Gensym(name string) string {
@@ -84,14 +86,28 @@ func (function *FunctionGenerator) VisitBoolean(ast *ASTBoolean) (interface{}, e
     return nil, nil
 }
 
+/* a call without a class or object, foo(1), is to a subroutine of this class.
+ * methods are passed this as an implicit first argument
+ */
 func (function *FunctionGenerator) VisitCall(ast *ASTCall) (interface{}, error) {
-    this := &ASTThis{}
-    _, err := this.Visit(function)
+    signature, err := function.CodeGenerator.Classes.LookupSubroutine(function.CodeGenerator.ClassName, ast.Name)
     if err != nil {
-        return nil, err
+        return nil, positionError(ast.Position, err)
     }
 
-    name := fmt.Sprintf("%v.%v", function.CodeGenerator.ClassName, ast.Name)
+    passThis := 0
+    if signature.Kind == SubroutineMethod {
+        if !function.HasThis {
+            return nil, errorAt(ast.Position, "method %v cannot be called from a function", signature.FullName())
+        }
+
+        this := &ASTThis{Position: ast.Position}
+        _, err := this.Visit(function)
+        if err != nil {
+            return nil, err
+        }
+        passThis = 1
+    }
 
     for _, argument := range ast.Arguments {
         _, err := argument.Visit(function)
@@ -100,13 +116,13 @@ func (function *FunctionGenerator) VisitCall(ast *ASTCall) (interface{}, error)
         }
     }
 
-    function.CodeGenerator.Emit <- fmt.Sprintf("call %v %v", name, len(ast.Arguments) + 1)
+    function.CodeGenerator.Emit <- fmt.Sprintf("call %v %v", signature.FullName(), len(ast.Arguments) + passThis)
 
     return nil, nil
 }
 
 func (function *FunctionGenerator) VisitClass(ast *ASTClass) (interface{}, error) {
-    return nil, fmt.Errorf("function generator: should not visit class")
+    return nil, errorAt(ast.Position, "function generator: should not visit class")
 }
 
 func (function *FunctionGenerator) VisitConstant(ast *ASTConstant) (interface{}, error) {
@@ -115,7 +131,7 @@ func (function *FunctionGenerator) VisitConstant(ast *ASTConstant) (interface{},
 }
 
 func (function *FunctionGenerator) VisitConstructor(ast *ASTConstructor) (interface{}, error) {
-    return nil, fmt.Errorf("function generator: should not visit constructor")
+    return nil, errorAt(ast.Position, "function generator: should not visit constructor")
 }
 
 func (function *FunctionGenerator) VisitDo(ast *ASTDo) (interface{}, error) {
@@ -129,7 +145,7 @@ func (function *FunctionGenerator) VisitDo(ast *ASTDo) (interface{}, error) {
 }
 
 func (function *FunctionGenerator) VisitField(ast *ASTField) (interface{}, error) {
-    return nil, fmt.Errorf("function generator: should not visit field")
+    return nil, errorAt(ast.Position, "function generator: should not visit field")
 }
 
 func (function *FunctionGenerator) VisitBlock(ast *ASTBlock) (interface{}, error) {
@@ -144,7 +160,7 @@ func (function *FunctionGenerator) VisitBlock(ast *ASTBlock) (interface{}, error
 }
 
 func (function *FunctionGenerator) VisitIdentifier(ast *ASTIdentifier) (interface{}, error) {
-    return nil, fmt.Errorf("function generator: unimplemented identifier")
+    return nil, errorAt(ast.Position, "function generator: unimplemented identifier")
 }
 
 func (function *FunctionGenerator) VisitIf(ast *ASTIf) (interface{}, error) {
@@ -280,7 +296,11 @@ func (function *FunctionGenerator) VisitOperator(ast *ASTOperator) (interface{},
         return nil, nil
     }
 
-    return nil, fmt.Errorf("function generator: unknown operator %v", ast.Operator.Name())
+    return nil, errorAt(ast.Position, "function generator: unknown operator %v", ast.Operator.Name())
+}
+
+func (function *FunctionGenerator) VisitParenthesized(ast *ASTParenthesized) (interface{}, error) {
+    return ast.Expression.Visit(function)
 }
 
 func (function *FunctionGenerator) VisitReference(ast *ASTReference) (interface{}, error) {
@@ -306,7 +326,7 @@ func (function *FunctionGenerator) VisitReference(ast *ASTReference) (interface{
         return nil, nil
     }
 
-    return nil, fmt.Errorf("function generator: unknown reference %v at %v", ast.Name, ast.SourceLocation())
+    return nil, errorAt(ast.Position, "function generator: unknown reference %v", ast.Name)
 }
 
 func (function *FunctionGenerator) VisitReturn(ast *ASTReturn) (interface{}, error) {
@@ -315,6 +335,9 @@ func (function *FunctionGenerator) VisitReturn(ast *ASTReturn) (interface{}, err
         if err != nil {
             return nil, err
         }
+    } else {
+        /* always return some value */
+        function.CodeGenerator.Emit <- "push constant 0"
     }
 
     function.CodeGenerator.Emit <- "return"
@@ -322,7 +345,7 @@ func (function *FunctionGenerator) VisitReturn(ast *ASTReturn) (interface{}, err
 }
 
 func (function *FunctionGenerator) VisitStatic(ast *ASTStatic) (interface{}, error) {
-    return nil, fmt.Errorf("function generator: static should not be visited")
+    return nil, errorAt(ast.Position, "function generator: static should not be visited")
 }
 
 func (function *FunctionGenerator) VisitThis(ast *ASTThis) (interface{}, error) {
@@ -334,7 +357,7 @@ func (function *FunctionGenerator) VisitVar(ast *ASTVar) (interface{}, error) {
 
     type_, ok := ast.Type.Type.(*ASTIdentifier)
     if !ok {
-        return nil, fmt.Errorf("unknown type node %v", ast.Type.ToSExpression())
+        return nil, errorAt(ast.Position, "unknown type node %v", ast.Type.ToSExpression())
     }
 
     for _, name := range ast.Names {
@@ -398,37 +421,63 @@ func (function *FunctionGenerator) GetType(ast *ASTReference) (string, error) {
         return mapping.Type, nil
     }
 
-    return "", fmt.Errorf("unknown reference %v", ast.Name)
+    if function.CodeGenerator.IsStatic(ast.Name) {
+        mapping := function.CodeGenerator.Statics[ast.Name]
+        return mapping.Type, nil
+    }
+
+    return "", errorAt(ast.Position, "unknown reference %v", ast.Name)
 }
 
 func (function *FunctionGenerator) VisitMethodCall(ast *ASTMethodCall) (interface{}, error) {
-    var name string
+    var class string
 
-    passThis := 0
-    reference, ok := ast.Left.(*ASTReference)
-    /* try to determine if this is a call to a static function or a method call on
-     * a live variable. for a variable call like foo.xyz(), we implicitly pass this as
-     * argument 1, so the number of arguments passed in is 1 + actual arguments, e.g:
-     * foo.xyz(4) -> has 2 arguments: this and the number 4
+    /* foo.xyz() is a method call when foo is a variable, and the object is
+     * passed as an implicit first argument, so foo.xyz(4) has 2 arguments:
+     * foo and the number 4. when foo is a class it is a call to a function
+     * or constructor of that class
      */
-    if ok {
-        _, err := reference.Visit(function)
-        if err != nil {
-            /* hopefully its some existing type.. */
-            name = fmt.Sprintf("%v.%v", reference.Name, ast.Call.Name)
-        } else {
-            type_, err := function.GetType(reference)
+    passThis := 0
+    switch left := ast.Left.(type) {
+        case *ASTThis:
+            if !function.HasThis {
+                return nil, errorAt(ast.Position, "'this' cannot be used in a function")
+            }
+            _, err := left.Visit(function)
             if err != nil {
-                return nil, fmt.Errorf("unknown type for reference %v", reference.Name)
+                return nil, err
             }
-            name = fmt.Sprintf("%v.%v", type_, ast.Call.Name)
+            class = function.CodeGenerator.ClassName
             passThis = 1
-        }
-    } else {
-        _, err := ast.Left.Visit(function)
-        if err != nil {
-            return nil, err
-        }
+        case *ASTReference:
+            type_, err := function.GetType(left)
+            if err == nil {
+                _, err = left.Visit(function)
+                if err != nil {
+                    return nil, err
+                }
+                class = type_
+                passThis = 1
+            } else if function.CodeGenerator.Classes.IsClass(left.Name) {
+                class = left.Name
+            } else {
+                return nil, errorAt(left.Position, "unknown class or variable %v", left.Name)
+            }
+        default:
+            return nil, errorAt(ast.Position, "cannot call %v on %v", ast.Call.Name, ast.Left.ToSExpression())
+    }
+
+    signature, err := function.CodeGenerator.Classes.LookupSubroutine(class, ast.Call.Name)
+    if err != nil {
+        return nil, positionError(ast.Position, err)
+    }
+
+    if passThis == 1 && signature.Kind != SubroutineMethod {
+        return nil, errorAt(ast.Position, "%v %v cannot be called on an object", signature.Kind.Name(), signature.FullName())
+    }
+
+    if passThis == 0 && signature.Kind == SubroutineMethod {
+        return nil, errorAt(ast.Position, "method %v needs an object to be called on", signature.FullName())
     }
 
     for _, argument := range ast.Call.Arguments {
@@ -438,7 +487,7 @@ func (function *FunctionGenerator) VisitMethodCall(ast *ASTMethodCall) (interfac
         }
     }
 
-    function.CodeGenerator.Emit <- fmt.Sprintf("call %v %v", name, len(ast.Call.Arguments) + passThis)
+    function.CodeGenerator.Emit <- fmt.Sprintf("call %v %v", signature.FullName(), len(ast.Call.Arguments) + passThis)
     return nil, nil
 }
 
@@ -450,7 +499,7 @@ func (function *FunctionGenerator) VisitLet(ast *ASTLet) (interface{}, error) {
 
     if ast.ArrayIndex != nil {
         /* compute the array offset */
-        reference := &ASTReference{Name: ast.Name}
+        reference := &ASTReference{Name: ast.Name, Position: ast.Position}
         _, err := reference.Visit(function)
         if err != nil {
             return nil, err
@@ -482,7 +531,7 @@ func (function *FunctionGenerator) VisitLet(ast *ASTLet) (interface{}, error) {
         return nil, nil
     }
 
-    return nil, fmt.Errorf("let: unknown name %v", ast.Name)
+    return nil, errorAt(ast.Position, "let: unknown name %v", ast.Name)
 }
 
 func (function *FunctionGenerator) processFunctionOrMethod(ast ASTNode) (interface{}, error) {
@@ -505,13 +554,13 @@ func (function *FunctionGenerator) processFunctionOrMethod(ast ASTNode) (interfa
         body = functionAST.Body
         name = functionAST.Name
     } else {
-        return nil, fmt.Errorf("not a method or function")
+        return nil, errorAt(ast.SourcePosition(), "not a method or function")
     }
 
     for _, parameter := range parameters {
         type_, ok := parameter.Type.Type.(*ASTIdentifier)
         if !ok {
-            return nil, fmt.Errorf("unknown type %v", parameter.Type.ToSExpression())
+            return nil, errorAt(parameter.Type.Position, "unknown type %v", parameter.Type.ToSExpression())
         }
         function.RegisterParameter(parameter.Name, type_.Name)
     }
@@ -564,7 +613,8 @@ func (function *FunctionGenerator) VisitMethod(ast *ASTMethod) (interface{}, err
 type CodeGenerator struct {
     Emit chan(string)
     ClassName string
-    Classes map[string]bool
+    /* every class of the program */
+    Classes *ClassTable
 
     Fields map[string]VariableMapping
     FieldCount int
@@ -573,15 +623,6 @@ type CodeGenerator struct {
     StaticCount int
 }
 
-func (generator *CodeGenerator) RegisterClass(name string){
-    generator.Classes[name] = true
-}
-
-func (generator *CodeGenerator) IsClass(name string) bool {
-    _, ok := generator.Classes[name]
-    return ok
-}
-
 func (generator *CodeGenerator) RegisterStatic(name string, type_ string){
     generator.Statics[name] = VariableMapping{
         Slot: generator.StaticCount,
@@ -626,7 +667,9 @@ func (generator *CodeGenerator) GetField(name string) int {
 }
 
 func (generator *CodeGenerator) VisitClass(ast *ASTClass) (interface{}, error) {
-    generator.RegisterClass(ast.Name)
+    if !generator.Classes.IsClass(ast.Name) {
+        return nil, errorAt(ast.Position, "class %v is not in the class table", ast.Name)
+    }
     generator.ClassName = ast.Name
 
     for _, body := range ast.Body {
@@ -689,75 +732,79 @@ func (generator *CodeGenerator) VisitClass(ast *ASTClass) (interface{}, error) {
         }
 
 
-        return nil, fmt.Errorf("code generator: unknown class body %v", body.ToSExpression())
+        return nil, errorAt(ast.Position, "code generator: unknown class body %v", body.ToSExpression())
     }
 
     return nil, nil
 }
 
-func (generator *CodeGenerator) VisitIdentifier(*ASTIdentifier) (interface{}, error) {
-    return nil, fmt.Errorf("unimplemented identifier")
+func (generator *CodeGenerator) VisitIdentifier(ast *ASTIdentifier) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented identifier")
 }
 
-func (generator *CodeGenerator) VisitBoolean(*ASTBoolean) (interface{}, error) {
-    return nil, fmt.Errorf("unimplemented boolean")
+func (generator *CodeGenerator) VisitBoolean(ast *ASTBoolean) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented boolean")
 }
 
 func (generator *CodeGenerator) VisitString(ast *ASTString) (interface{}, error) {
-    return nil, fmt.Errorf("code generator should not visit string")
+    return nil, errorAt(ast.Position, "code generator should not visit string")
 }
 
-func (generator *CodeGenerator) VisitNull(*ASTNull) (interface{}, error) {
-    return nil, fmt.Errorf("unimplemented null")
+func (generator *CodeGenerator) VisitNull(ast *ASTNull) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented null")
 }
 
-func (generator *CodeGenerator) VisitCall(*ASTCall) (interface{}, error) {
-    return nil, fmt.Errorf("unimplemented call")
+func (generator *CodeGenerator) VisitCall(ast *ASTCall) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented call")
 }
 
-func (generator *CodeGenerator) VisitIndexExpression(*ASTIndexExpression) (interface{}, error) {
-    return nil, fmt.Errorf("unimplemented index expression")
+func (generator *CodeGenerator) VisitIndexExpression(ast *ASTIndexExpression) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented index expression")
 }
 
-func (generator *CodeGenerator) VisitVar(*ASTVar) (interface{}, error) {
-    return nil, fmt.Errorf("code generator should not visit var")
+func (generator *CodeGenerator) VisitVar(ast *ASTVar) (interface{}, error) {
+    return nil, errorAt(ast.Position, "code generator should not visit var")
 }
 
 func (generator *CodeGenerator) VisitMethodCall(ast *ASTMethodCall) (interface{}, error) {
-    return nil, fmt.Errorf("code generator should not visit method call")
+    return nil, errorAt(ast.Position, "code generator should not visit method call")
+}
+
+func (generator *CodeGenerator) VisitNot(ast *ASTNot) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented not")
 }
 
-func (generator *CodeGenerator) VisitNot(*ASTNot) (interface{}, error) {
-    return nil, fmt.Errorf("unimplemented not")
+func (generator *CodeGenerator) VisitNegation(ast *ASTNegation) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented negation")
 }
 
-func (generator *CodeGenerator) VisitNegation(*ASTNegation) (interface{}, error) {
-    return nil, fmt.Errorf("unimplemented negation")
+func (generator *CodeGenerator) VisitOperator(ast *ASTOperator) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented operator")
 }
 
-func (generator *CodeGenerator) VisitOperator(*ASTOperator) (interface{}, error) {
-    return nil, fmt.Errorf("unimplemented operator")
+func (generator *CodeGenerator) VisitParenthesized(ast *ASTParenthesized) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented parenthesized expression")
 }
 
-func (generator *CodeGenerator) VisitThis(*ASTThis) (interface{}, error) {
-    return nil, fmt.Errorf("unimplemented this")
+func (generator *CodeGenerator) VisitThis(ast *ASTThis) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented this")
 }
 
-func (generator *CodeGenerator) VisitConstant(*ASTConstant) (interface{}, error) {
-    return nil, fmt.Errorf("code generator: constant should not be visited")
+func (generator *CodeGenerator) VisitConstant(ast *ASTConstant) (interface{}, error) {
+    return nil, errorAt(ast.Position, "code generator: constant should not be visited")
 }
 
-func (generator *CodeGenerator) VisitReference(*ASTReference) (interface{}, error) {
-    return nil, fmt.Errorf("code generator: reference should not be visited")
+func (generator *CodeGenerator) VisitReference(ast *ASTReference) (interface{}, error) {
+    return nil, errorAt(ast.Position, "code generator: reference should not be visited")
 }
 
-func (generator *CodeGenerator) VisitWhile(*ASTWhile) (interface{}, error) {
-    return nil, fmt.Errorf("unimplemented while")
+func (generator *CodeGenerator) VisitWhile(ast *ASTWhile) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented while")
 }
 
 func (generator *CodeGenerator) VisitConstructor(ast *ASTConstructor) (interface{}, error) {
     if ast.Class != generator.ClassName {
-        return nil, fmt.Errorf("class name does not match the constructor: class=%v constructor=%v", generator.ClassName, ast.Class)
+        return nil, errorAt(ast.Position, "class name does not match the constructor: class=%v constructor=%v", generator.ClassName, ast.Class)
     }
 
     classSize := generator.FieldCount
@@ -767,6 +814,7 @@ func (generator *CodeGenerator) VisitConstructor(ast *ASTConstructor) (interface
         LocalVariables: make(map[string]VariableMapping),
         Parameters: make(map[string]VariableMapping),
         ParameterCount: 0,
+        HasThis: true,
         Preamble: []string{
             fmt.Sprintf("push constant %v", classSize),
             "call Memory.alloc 1",
@@ -776,17 +824,18 @@ func (generator *CodeGenerator) VisitConstructor(ast *ASTConstructor) (interface
 
     /* compile constructor body as if it was a function */
     method := &ASTFunction{
-        ReturnType: &ASTType{Type: &ASTIdentifier{Name: ast.Class}},
+        ReturnType: &ASTType{Type: &ASTIdentifier{Name: ast.Class, Position: ast.Position}, Position: ast.Position},
         Name: "new",
         Parameters: ast.Parameters,
         Body: ast.Body,
+        Position: ast.Position,
     }
 
     return method.Visit(&function)
 }
 
-func (generator *CodeGenerator) VisitIf(*ASTIf) (interface{}, error) {
-    return nil, fmt.Errorf("unimplemented if")
+func (generator *CodeGenerator) VisitIf(ast *ASTIf) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented if")
 }
 
 func (generator *CodeGenerator) VisitMethod(ast *ASTMethod) (interface{}, error) {
@@ -795,13 +844,14 @@ func (generator *CodeGenerator) VisitMethod(ast *ASTMethod) (interface{}, error)
         LocalVariables: make(map[string]VariableMapping),
         Parameters: make(map[string]VariableMapping),
         ParameterCount: 1,
+        HasThis: true,
     }
 
     return ast.Visit(&function)
 }
 
 func (generator *CodeGenerator) VisitBlock(ast *ASTBlock) (interface{}, error) {
-    return nil, fmt.Errorf("code generator should not visit block")
+    return nil, errorAt(ast.Position, "code generator should not visit block")
 }
 
 func (generator *CodeGenerator) VisitFunction(ast *ASTFunction) (interface{}, error) {
@@ -815,21 +865,21 @@ func (generator *CodeGenerator) VisitFunction(ast *ASTFunction) (interface{}, er
 }
 
 func (generator *CodeGenerator) VisitLet(ast *ASTLet) (interface{}, error) {
-    return nil, fmt.Errorf("code generator should not visit let")
+    return nil, errorAt(ast.Position, "code generator should not visit let")
 }
 
-func (generator *CodeGenerator) VisitDo(*ASTDo) (interface{}, error) {
-    return nil, fmt.Errorf("unimplemented do")
+func (generator *CodeGenerator) VisitDo(ast *ASTDo) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented do")
 }
 
-func (generator *CodeGenerator) VisitReturn(*ASTReturn) (interface{}, error) {
-    return nil, fmt.Errorf("unimplemented return")
+func (generator *CodeGenerator) VisitReturn(ast *ASTReturn) (interface{}, error) {
+    return nil, errorAt(ast.Position, "unimplemented return")
 }
 
 func (generator *CodeGenerator) VisitStatic(ast *ASTStatic) (interface{}, error) {
     type_, ok := ast.Type.Type.(*ASTIdentifier)
     if !ok {
-        return nil, fmt.Errorf("unknown type node %v", ast.Type.ToSExpression())
+        return nil, errorAt(ast.Position, "unknown type node %v", ast.Type.ToSExpression())
     }
 
     for _, name := range ast.Names {
@@ -842,7 +892,7 @@ func (generator *CodeGenerator) VisitStatic(ast *ASTStatic) (interface{}, error)
 func (generator *CodeGenerator) VisitField(ast *ASTField) (interface{}, error) {
     type_, ok := ast.Type.Type.(*ASTIdentifier)
     if !ok {
-        return nil, fmt.Errorf("unknown type node %v", ast.Type.ToSExpression())
+        return nil, errorAt(ast.Position, "unknown type node %v", ast.Type.ToSExpression())
     }
 
     for _, name := range ast.Names {
@@ -852,12 +902,9 @@ func (generator *CodeGenerator) VisitField(ast *ASTField) (interface{}, error) {
     return nil, nil
 }
 
-func GenerateCode(ast ASTNode, writer io.Writer) error {
+/* classes must already hold the class in ast and every class it uses */
+func GenerateCode(ast ASTNode, classes *ClassTable, writer io.Writer) error {
     vmChannel := make(chan string, 10)
-    classes := make(map[string]bool)
-    classes["Keyboard"] = true
-    classes["Array"] = true
-    classes["Output"] = true
     generator := CodeGenerator{
         Emit: vmChannel,
         Fields: make(map[string]VariableMapping),
@@ -3,6 +3,7 @@ package main
 import (
     "testing"
     "strings"
+    "fmt"
 )
 
 func filterEmpty(values []string) []string {
@@ -17,15 +18,37 @@ func filterEmpty(values []string) []string {
     return out
 }
 
-func doCodeGen(text string) ([]string, error) {
+/* others are more classes of the program that text can use */
+func doCodeGen(text string, others ...string) ([]string, error) {
+    classes, err := NewClassTable()
+    if err != nil {
+        return nil, err
+    }
+
+    for _, other := range others {
+        ast, err := parse(strings.NewReader(other))
+        if err != nil {
+            return nil, err
+        }
+        err = classes.AddClass(ast)
+        if err != nil {
+            return nil, err
+        }
+    }
+
     ast, err := parse(strings.NewReader(text))
     if err != nil {
         return nil, err
     }
 
+    err = classes.AddClass(ast)
+    if err != nil {
+        return nil, err
+    }
+
     var out strings.Builder
 
-    err = GenerateCode(ast, &out)
+    err = GenerateCode(ast, classes, &out)
     if err != nil {
         return nil, err
     }
@@ -463,7 +486,14 @@ class y {
     }
 }
 `
-    generated, err := doCodeGen(text)
+    squareGame := `
+class SquareGame {
+    constructor SquareGame new() { return this; }
+    method void run() { return; }
+    method void dispose() { return; }
+}
+`
+    generated, err := doCodeGen(text, squareGame)
     if err != nil {
         test.Fatalf("could not generate code: %v", err)
     }
@@ -573,3 +603,77 @@ class p {
         test.Fatalf("unexpected generated code: actual %v vs expected %v\n", generated, expected)
     }
 }
+
+func TestCallResolution(test *testing.T){
+    text := `
+class p {
+    method int foo(int a){
+        return a;
+    }
+
+    function int bar(){
+        return 1;
+    }
+
+    method void baz(){
+        do this.foo(bar());
+        do Math.abs(2);
+        return;
+    }
+}
+`
+    generated, err := doCodeGen(text)
+    if err != nil {
+        test.Fatalf("could not generate code: %v", err)
+    }
+
+    expected := []string{
+        "function p.foo 0",
+        "push argument 0",
+        "pop pointer 0",
+        "push argument 1",
+        "return",
+        "function p.bar 0",
+        "push constant 1",
+        "return",
+        "function p.baz 0",
+        "push argument 0",
+        "pop pointer 0",
+        "push pointer 0",
+        "call p.bar 0",
+        "call p.foo 2",
+        "pop temp 0",
+        "push constant 2",
+        "call Math.abs 1",
+        "pop temp 0",
+        "push constant 0",
+        "return",
+    }
+
+    if !compareCode(generated, expected) {
+        test.Fatalf("unexpected generated code: actual %v vs expected %v\n", generated, expected)
+    }
+}
+
+func TestCallErrors(test *testing.T){
+    bodies := []string{
+        /* unknown class */
+        "do Foo.bar();",
+        /* unknown subroutine */
+        "do Math.cube(2);",
+        /* method through the class name */
+        "do String.length();",
+        /* function through an object */
+        "var String s; let s = String.new(1); do s.newLine();",
+        /* method from a function */
+        "do foo();",
+    }
+
+    for _, body := range bodies {
+        text := fmt.Sprintf("class p { method void foo(){ return; } function void bar(){ %v return; } }", body)
+        _, err := doCodeGen(text)
+        if err == nil {
+            test.Errorf("expected an error for %v", body)
+        }
+    }
+}
@@ -8,6 +8,7 @@ import (
     "bytes"
     "errors"
     "unicode"
+    "sort"
 )
 
 type LexerStateMachine interface {
@@ -142,6 +143,11 @@ func (kind *TokenKind) Precedence() int {
     return 0
 }
 
+/* the keywords of jack are exactly the tokens with the keyword precedence */
+func (kind *TokenKind) IsKeyword() bool {
+    return kind.Precedence() == 10
+}
+
 func removeWhitespaceTokens(tokens []Token) []Token {
     var out []Token = nil
 
@@ -157,14 +163,44 @@ func removeWhitespaceTokens(tokens []Token) []Token {
 type Token struct {
     Kind TokenKind
     Value string
-    /* source location within the input */
+    /* source location within the input. Start and End are byte offsets,
+     * the lines and columns start at 1 and the end is just past the token
+     */
     Line uint64
+    Column uint64
+    EndLine uint64
+    EndColumn uint64
     Start uint64
     End uint64
 }
 
 func (token *Token) String() string {
-    return fmt.Sprintf("'%v' at line %v position %v", token.Kind.Name(), token.Line, token.Start)
+    return fmt.Sprintf("'%v'", token.Kind.Name())
+}
+
+func (token *Token) Position() Position {
+    return Position{
+        Line: token.Line,
+        Column: token.Column,
+        EndLine: token.EndLine,
+        EndColumn: token.EndColumn,
+    }
+}
+
+/* the byte offsets at which each line of the input starts */
+type lineStarts []uint64
+
+/* the line and column of a byte offset that has already been read */
+func (starts lineStarts) locate(offset uint64) (uint64, uint64) {
+    line := sort.Search(len(starts), func(i int) bool {
+        return starts[i] > offset
+    }) - 1
+    return uint64(line + 1), offset - starts[line] + 1
+}
+
+func (starts lineStarts) place(token *Token) {
+    token.Line, token.Column = starts.locate(token.Start)
+    token.EndLine, token.EndColumn = starts.locate(token.End)
 }
 
 type WhiteSpaceMachine struct {
@@ -225,6 +261,9 @@ func (literal *LiteralMachine) Reset() {
 
 var NoToken error = errors.New("no-token")
 
+/* a string constant that reaches the end of its line or of the input */
+var UnterminatedString error = errors.New("unterminated string constant")
+
 func (literal *LiteralMachine) Token(line uint64, start uint64, end uint64) (Token, error) {
     if literal.position == len(literal.Literal) /* && literal.emit */ {
         return Token{
@@ -474,6 +513,14 @@ func (machine *StringMachine) Consume(c byte) bool {
             return true
         }
     } else if machine.Quote == 1 {
+        /* a string constant cannot go past the end of the line, and the
+         * lexer gives 0 once the input is over
+         */
+        if c == '\n' || c == 0 {
+            machine.stopped = true
+            return false
+        }
+
         if c == '"' {
             machine.Quote = 2
         } else {
@@ -498,6 +545,10 @@ func (machine *StringMachine) Token(line uint64, start uint64, end uint64) (Toke
         }, nil
     }
 
+    if machine.Quote == 1 {
+        return Token{}, UnterminatedString
+    }
+
     return Token{}, fmt.Errorf("did not parse a string")
 }
 
@@ -816,10 +867,19 @@ func lexer(machines []LexerStateMachine, reader io.Reader, emitToken chan Token)
     }
 
     var line uint64 = 1
-    inLine := 1
+    starts := lineStarts{0}
 
     if c == '\n' {
         line += 1
+        starts = append(starts, 1)
+    }
+
+    /* the machines give tokens the line they end on, so the tokens are
+     * placed again from their offsets
+     */
+    tokenizeError := func() error {
+        line, column := starts.locate(start)
+        return errorAt(Position{Line: line, Column: column, EndLine: line, EndColumn: column}, "could not tokenize '%v'", string(partial.Bytes()))
     }
 
     for {
@@ -856,6 +916,11 @@ func lexer(machines []LexerStateMachine, reader io.Reader, emitToken chan Token)
             if emitters == 1 {
                 machine := machines[emitter]
                 token, err := machine.Token(line, start, end-1)
+                if err == UnterminatedString {
+                    /* reported at the opening quote */
+                    line, column := starts.locate(start)
+                    return errorAt(Position{Line: line, Column: column, EndLine: line, EndColumn: column + 1}, "%v", err)
+                }
                 if err != nil {
                     for i := 0; i < 10; i++ {
                         b, err := bufferedReader.ReadByte()
@@ -866,8 +931,9 @@ func lexer(machines []LexerStateMachine, reader io.Reader, emitToken chan Token)
                         }
                     }
 
-                    return fmt.Errorf("Could not tokenize '%v' at line %v position %v", string(partial.Bytes()), line, inLine)
+                    return tokenizeError()
                 }
+                starts.place(&token)
                 emitToken <- token
             } else {
                 var longest uint64 = 0
@@ -905,10 +971,11 @@ func lexer(machines []LexerStateMachine, reader io.Reader, emitToken chan Token)
                         }
                     }
 
-                    return fmt.Errorf("Could not tokenize '%v' at line %v position %v", string(partial.Bytes()), line, inLine)
+                    return tokenizeError()
                 }
 
                 token := breakTies(possible)
+                starts.place(&token)
                 emitToken <- token
             }
 
@@ -920,8 +987,10 @@ func lexer(machines []LexerStateMachine, reader io.Reader, emitToken chan Token)
             // fmt.Printf("Parsed %v\n", token)
             // out = append(out, token)
 
+            /* c ended the last token and starts the next one */
             partial.Reset()
             partial.Grow(10)
+            partial.WriteByte(c)
             start = end - 1
 
             if readErr == io.EOF {
@@ -945,9 +1014,7 @@ func lexer(machines []LexerStateMachine, reader io.Reader, emitToken chan Token)
 
             if c == '\n' {
                 line += 1
-                inLine = 1
-            } else {
-                inLine += 1
+                starts = append(starts, end)
             }
 
             if readErr != nil {
@@ -282,3 +282,62 @@ func TestLexerString(test *testing.T){
         test.Fatalf("did not parse a number as the third token: %v", tokens)
     }
 }
+
+func TestLexerPosition(test *testing.T) {
+    text := "let x\n  = 12;"
+
+    tokens, err := standardLexerTokenSequence(strings.NewReader(text))
+    if err != nil {
+        test.Fatalf("did not parse: %v", err)
+    }
+
+    tokens = removeWhitespaceTokens(tokens)
+
+    /* line, column, end line, end column of let x = 12 ; */
+    expected := [][]uint64{
+        []uint64{1, 1, 1, 4},
+        []uint64{1, 5, 1, 6},
+        []uint64{2, 3, 2, 4},
+        []uint64{2, 5, 2, 7},
+        []uint64{2, 7, 2, 8},
+    }
+
+    if len(tokens) != len(expected) {
+        test.Fatalf("wrong number of tokens: %v", tokens)
+    }
+
+    for i, token := range tokens {
+        actual := []uint64{token.Line, token.Column, token.EndLine, token.EndColumn}
+        for j := range actual {
+            if actual[j] != expected[i][j] {
+                test.Fatalf("token %v is at %v but should be at %v", i, actual, expected[i])
+            }
+        }
+    }
+}
+
+func TestLexerErrorPosition(test *testing.T) {
+    _, err := standardLexerTokenSequence(strings.NewReader("1 +\n  2 $ 3"))
+    if err == nil {
+        test.Fatalf("expected an error for '$'")
+    }
+
+    if !strings.HasPrefix(err.Error(), "2:5: ") {
+        test.Fatalf("wrong position for the error: %v", err)
+    }
+}
+
+/* the error is at the opening quote, whether the line or the input ends first */
+func TestLexerUnterminatedString(test *testing.T) {
+    inputs := map[string]string{
+        "let s = 1;\n  let t = \"abc;\n  return;": "2:11: unterminated string constant",
+        "let s = \"abc": "1:9: unterminated string constant",
+    }
+
+    for input, expected := range inputs {
+        _, err := standardLexerTokenSequence(strings.NewReader(input))
+        if err == nil || err.Error() != expected {
+            test.Errorf("expected '%v' but got %v", expected, err)
+        }
+    }
+}
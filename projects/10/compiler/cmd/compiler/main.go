@@ -3,9 +3,14 @@ package main
 import (
     "os"
     "fmt"
+    "flag"
     "bufio"
+    "bytes"
     "strings"
     "time"
+    "sort"
+    "io/ioutil"
+    "path/filepath"
     // "strings"
 
     _ "runtime/pprof"
@@ -53,24 +58,28 @@ func replaceExtension(path string, ending string, newEnding string) string {
     return path
 }
 
-func compile(path string) error {
+func parseFile(path string) (ASTNode, error) {
     file, err := os.Open(path)
     if err != nil {
-        return err
+        return nil, err
     }
     defer file.Close()
 
     start := time.Now()
 
-    ast, err := parse(file)
+    ast, err := parseSource(file, path)
     if err != nil {
-        return err
+        return nil, err
     }
 
     end := time.Now()
 
     fmt.Printf("Parsed %v in %v\n", path, end.Sub(start))
 
+    return ast, nil
+}
+
+func compile(path string, ast ASTNode, classes *ClassTable) error {
     /*
     fmt.Printf("%v\n", ast.ToSExpression())
     */
@@ -86,23 +95,172 @@ func compile(path string) error {
     buffer := bufio.NewWriter(output)
     defer buffer.Flush()
 
-    start = time.Now()
+    start := time.Now()
 
-    err = GenerateCode(ast, buffer)
+    err = GenerateCode(ast, classes, buffer)
     if err != nil {
         return err
     }
 
-    end = time.Now()
+    end := time.Now()
     fmt.Printf("Codegen %v in %v\n", path, end.Sub(start))
     fmt.Printf("Wrote to %v\n", outPath)
 
     return nil
 }
 
+/* the given .jack files and the other .jack files in their directories,
+ * which the given files may use
+ */
+func projectFiles(paths []string) ([]string, error) {
+    seen := make(map[string]bool)
+    var out []string
+    add := func(path string){
+        path = filepath.Clean(path)
+        if !seen[path] {
+            seen[path] = true
+            out = append(out, path)
+        }
+    }
+
+    for _, path := range paths {
+        add(path)
+        siblings, err := filepath.Glob(filepath.Join(filepath.Dir(path), "*.jack"))
+        if err != nil {
+            return nil, err
+        }
+        for _, sibling := range siblings {
+            add(sibling)
+        }
+    }
+
+    return out, nil
+}
+
+/* parses every class of the project before generating code for any of them,
+ * so calls to other classes can be resolved
+ */
 func compileAll(paths []string) error {
+    classes, err := NewClassTable()
+    if err != nil {
+        return err
+    }
+
+    project, err := projectFiles(paths)
+    if err != nil {
+        return err
+    }
+
+    asts := make(map[string]ASTNode)
+    for _, path := range project {
+        ast, err := parseFile(path)
+        if err != nil {
+            return err
+        }
+
+        err = classes.AddClass(ast)
+        if err != nil {
+            return err
+        }
+        asts[filepath.Clean(path)] = ast
+    }
+
+    /* check everything first so all the errors are reported together */
+    var problems []string
+    for _, path := range paths {
+        err := CheckClass(asts[filepath.Clean(path)], classes)
+        if err != nil {
+            problems = append(problems, err.Error())
+        }
+    }
+
+    if len(problems) > 0 {
+        return fmt.Errorf("%v", strings.Join(problems, "\n"))
+    }
+
+    for _, path := range paths {
+        err := compile(path, asts[filepath.Clean(path)], classes)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+type XMLOptions struct {
+    /* write the tokens to XxxT.xml */
+    Tokens bool
+    /* write the parse tree to Xxx.xml */
+    ParseTree bool
+    /* where to write the xml files, next to the .jack file if empty */
+    Directory string
+}
+
+func xmlPath(path string, ending string, options XMLOptions) string {
+    out := replaceExtension(path, ".jack", ending)
+    if options.Directory != "" {
+        out = filepath.Join(options.Directory, filepath.Base(out))
+    }
+    return out
+}
+
+/* writes the xml files of the project 10 analyzer instead of vm code */
+func analyze(path string, options XMLOptions) error {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return err
+    }
+
+    var out bytes.Buffer
+
+    if options.Tokens {
+        err = writeTokensXML(bytes.NewReader(data), &out)
+        if err != nil {
+            return errorInFile(err, path)
+        }
+
+        outPath := xmlPath(path, "T.xml", options)
+        err = ioutil.WriteFile(outPath, out.Bytes(), 0644)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("Wrote to %v\n", outPath)
+        out.Reset()
+    }
+
+    if options.ParseTree {
+        ast, err := parseSource(bytes.NewReader(data), path)
+        if err != nil {
+            return err
+        }
+
+        err = writeParseTreeXML(ast, &out)
+        if err != nil {
+            return err
+        }
+
+        outPath := xmlPath(path, ".xml", options)
+        err = ioutil.WriteFile(outPath, out.Bytes(), 0644)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("Wrote to %v\n", outPath)
+    }
+
+    return nil
+}
+
+func analyzeAll(paths []string, options XMLOptions) error {
+    if options.Directory != "" {
+        err := os.MkdirAll(options.Directory, 0755)
+        if err != nil {
+            return err
+        }
+    }
+
     for _, path := range paths {
-        err := compile(path)
+        err := analyze(path, options)
         if err != nil {
             return err
         }
@@ -111,6 +269,34 @@ func compileAll(paths []string) error {
     return nil
 }
 
+/* directories are replaced by the .jack files in them */
+func jackFiles(paths []string) ([]string, error) {
+    var out []string
+    for _, path := range paths {
+        info, err := os.Stat(path)
+        if err != nil {
+            return nil, err
+        }
+
+        if !info.IsDir() {
+            out = append(out, path)
+            continue
+        }
+
+        files, err := filepath.Glob(filepath.Join(path, "*.jack"))
+        if err != nil {
+            return nil, err
+        }
+        if len(files) == 0 {
+            return nil, fmt.Errorf("no .jack files in %v", path)
+        }
+        sort.Strings(files)
+        out = append(out, files...)
+    }
+
+    return out, nil
+}
+
 func test(){
     /*
     tokens, err := standardLexer(strings.NewReader("1 + 2"))
@@ -124,16 +310,35 @@ func main(){
     // test()
 
     // TestL()
-    if len(os.Args) == 1 {
-        fmt.Printf("Give a directory of .jack files or a list of .jack files")
+    var xml XMLOptions
+    flag.BoolVar(&xml.Tokens, "tokens-xml", false, "write the tokens of each class to XxxT.xml instead of compiling")
+    flag.BoolVar(&xml.ParseTree, "xml", false, "write the parse tree of each class to Xxx.xml instead of compiling")
+    flag.StringVar(&xml.Directory, "xml-dir", "", "directory to write the xml files to (default next to the .jack files)")
+    flag.Parse()
+
+    if flag.NArg() == 0 {
+        fmt.Printf("Give a directory of .jack files or a list of .jack files\n")
+        flag.PrintDefaults()
         return
-    } else {
-        err := compileAll(os.Args[1:])
-        if err != nil {
-            fmt.Printf("Error: %v\n", err)
+    }
+
+    paths, err := jackFiles(flag.Args())
+    if err == nil {
+        if xml.Tokens || xml.ParseTree {
+            err = analyzeAll(paths, xml)
+        } else {
+            err = compileAll(paths)
         }
     }
 
+    if err != nil {
+        /* errors in the source start with file:line:col so editors can
+         * jump to them
+         */
+        fmt.Fprintf(os.Stderr, "%v\n", err)
+        os.Exit(1)
+    }
+
     /*
     memory, _ := os.Create("memory.prof")
     runtime.GC()
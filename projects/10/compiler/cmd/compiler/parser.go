@@ -38,6 +38,7 @@ const (
     ASTKindConstructor
     ASTKindMethod
     ASTKindWhile
+    ASTKindParenthesized
 )
 
 func (kind Kind) Name() string {
@@ -71,6 +72,7 @@ func (kind Kind) Name() string {
     case ASTKindConstructor: return "constructor"
     case ASTKindMethod: return "method"
     case ASTKindWhile: return "while"
+    case ASTKindParenthesized: return "parenthesized expression"
     }
 
     return "??"
@@ -103,12 +105,15 @@ type ASTVisitor interface {
     VisitReturn(*ASTReturn) (interface{}, error)
     VisitStatic(*ASTStatic) (interface{}, error)
     VisitField(*ASTField) (interface{}, error)
+    VisitParenthesized(*ASTParenthesized) (interface{}, error)
 }
 
 type ASTNode interface {
     Kind() Kind
     ToSExpression() string
     Visit(ASTVisitor) (interface{}, error)
+    /* the part of the source the node was parsed from */
+    SourcePosition() Position
 }
 
 type ASTClass struct {
@@ -116,6 +121,11 @@ type ASTClass struct {
 
     Name string
     Body []ASTNode
+    Position Position
+}
+
+func (ast *ASTClass) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTClass) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -138,6 +148,11 @@ func (ast *ASTClass) Kind() Kind {
 type ASTWhile struct {
     Condition ASTExpression
     Body *ASTBlock
+    Position Position
+}
+
+func (ast *ASTWhile) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTWhile) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -157,6 +172,11 @@ type ASTConstructor struct {
     Name string
     Parameters []*ASTParameter
     Body *ASTBlock
+    Position Position
+}
+
+func (ast *ASTConstructor) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTConstructor) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -190,6 +210,11 @@ func (ast *ASTConstructor) ToSExpression() string {
 type ASTCall struct {
     Name string
     Arguments []ASTExpression
+    Position Position
+}
+
+func (ast *ASTCall) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTCall) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -217,6 +242,11 @@ func (ast *ASTCall) ToSExpression() string {
 
 type ASTString struct {
     Value string
+    Position Position
+}
+
+func (ast *ASTString) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTString) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -232,6 +262,11 @@ func (ast *ASTString) ToSExpression() string {
 }
 
 type ASTNull struct {
+    Position Position
+}
+
+func (ast *ASTNull) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTNull) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -249,6 +284,11 @@ func (ast *ASTNull) ToSExpression() string {
 type ASTIndexExpression struct {
     Left ASTExpression
     Index ASTExpression
+    Position Position
+}
+
+func (ast *ASTIndexExpression) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTIndexExpression) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -266,6 +306,11 @@ func (ast *ASTIndexExpression) Kind() Kind {
 type ASTMethodCall struct {
     Left ASTExpression
     Call *ASTCall
+    Position Position
+}
+
+func (ast *ASTMethodCall) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTMethodCall) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -282,6 +327,11 @@ func (ast *ASTMethodCall) Kind() Kind {
 
 type ASTNot struct {
     Expression ASTExpression
+    Position Position
+}
+
+func (ast *ASTNot) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTNot) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -298,6 +348,11 @@ func (ast *ASTNot) Kind() Kind {
 
 type ASTNegation struct {
     Expression ASTExpression
+    Position Position
+}
+
+func (ast *ASTNegation) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTNegation) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -312,8 +367,37 @@ func (ast *ASTNegation) Kind() Kind {
     return ASTKindNegation
 }
 
+/* an expression in parentheses, kept so the parse tree can be printed the way
+ * it was written
+ */
+type ASTParenthesized struct {
+    Expression ASTExpression
+    Position Position
+}
+
+func (ast *ASTParenthesized) SourcePosition() Position {
+    return ast.Position
+}
+
+func (ast *ASTParenthesized) Visit(visitor ASTVisitor) (interface{}, error) {
+    return visitor.VisitParenthesized(ast)
+}
+
+func (ast *ASTParenthesized) ToSExpression() string {
+    return ast.Expression.ToSExpression()
+}
+
+func (ast *ASTParenthesized) Kind() Kind {
+    return ASTKindParenthesized
+}
+
 type ASTBoolean struct {
     Value bool
+    Position Position
+}
+
+func (ast *ASTBoolean) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTBoolean) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -331,6 +415,11 @@ func (ast *ASTBoolean) Kind() Kind {
 type ASTType struct {
     /* will either be an int, char, boolean, or identifier */
     Type ASTNode
+    Position Position
+}
+
+func (ast *ASTType) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTType) ToSExpression() string {
@@ -345,6 +434,11 @@ type ASTIf struct {
     Condition ASTExpression
     Then *ASTBlock
     Else *ASTBlock
+    Position Position
+}
+
+func (ast *ASTIf) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTIf) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -373,6 +467,11 @@ type ASTOperator struct {
     Operator TokenKind // lame to use TokenKind here
     Left ASTExpression
     Right ASTExpression
+    Position Position
+}
+
+func (ast *ASTOperator) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTOperator) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -388,6 +487,11 @@ func (ast *ASTOperator) Kind() Kind {
 }
 
 type ASTThis struct {
+    Position Position
+}
+
+func (ast *ASTThis) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTThis) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -404,6 +508,11 @@ func (ast *ASTThis) Kind() Kind {
 
 type ASTConstant struct {
     Number string
+    Position Position
+}
+
+func (ast *ASTConstant) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTConstant) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -420,11 +529,11 @@ func (ast *ASTConstant) Kind() Kind {
 
 type ASTReference struct {
     Name string
-    Location string
+    Position Position
 }
 
-func (ast *ASTReference) SourceLocation() string {
-    return ast.Location
+func (ast *ASTReference) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTReference) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -444,6 +553,11 @@ type ASTMethod struct {
     Name string
     Parameters []*ASTParameter
     Body *ASTBlock
+    Position Position
+}
+
+func (ast *ASTMethod) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTMethod) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -477,6 +591,11 @@ type ASTFunction struct {
     Name string
     Parameters []*ASTParameter
     Body *ASTBlock
+    Position Position
+}
+
+func (ast *ASTFunction) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTFunction) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -509,6 +628,11 @@ func (ast *ASTFunction) Kind() Kind {
 type ASTParameter struct {
     Type *ASTType
     Name string
+    Position Position
+}
+
+func (ast *ASTParameter) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTParameter) Kind() Kind {
@@ -521,6 +645,11 @@ func (ast *ASTParameter) ToSExpression() string {
 
 type ASTBlock struct {
     Statements []ASTNode
+    Position Position
+}
+
+func (ast *ASTBlock) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTBlock) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -545,6 +674,11 @@ func (ast *ASTBlock) Kind() Kind {
 type ASTVar struct {
     Type *ASTType
     Names []string
+    Position Position
+}
+
+func (ast *ASTVar) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTVar) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -575,6 +709,11 @@ type ASTLet struct {
     Name string
     ArrayIndex ASTExpression
     Expression ASTExpression
+    Position Position
+}
+
+func (ast *ASTLet) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTLet) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -598,6 +737,11 @@ func (ast *ASTLet) Kind() Kind {
 
 type ASTDo struct {
     Expression ASTExpression
+    Position Position
+}
+
+func (ast *ASTDo) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTDo) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -613,7 +757,13 @@ func (ast *ASTDo) Kind() Kind {
 }
 
 type ASTReturn struct {
+    /* nil for a plain 'return;' */
     Expression ASTExpression
+    Position Position
+}
+
+func (ast *ASTReturn) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTReturn) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -640,6 +790,11 @@ func (ast *ASTReturn) Kind() Kind {
 type ASTStatic struct {
     Type *ASTType
     Names []*ASTIdentifier
+    Position Position
+}
+
+func (ast *ASTStatic) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTStatic) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -666,6 +821,11 @@ func (ast *ASTStatic) Kind() Kind {
 
 type ASTIdentifier struct {
     Name string
+    Position Position
+}
+
+func (ast *ASTIdentifier) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTIdentifier) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -683,6 +843,11 @@ func (ast *ASTIdentifier) ToSExpression() string {
 type ASTField struct {
     Type *ASTType
     Names []string
+    Position Position
+}
+
+func (ast *ASTField) SourcePosition() Position {
+    return ast.Position
 }
 
 func (ast *ASTField) Visit(visitor ASTVisitor) (interface{}, error) {
@@ -710,7 +875,8 @@ func (ast *ASTField) Kind() Kind {
 func isExpression(ast ASTNode) bool {
     switch ast.Kind() {
         case ASTKindCall, ASTKindReference, ASTKindThis, ASTKindOperator,
-             ASTKindMethodCall, ASTKindNegation, ASTKindNot: return true
+             ASTKindMethodCall, ASTKindNegation, ASTKindNot,
+             ASTKindParenthesized: return true
         default: return false
     }
 }
@@ -720,6 +886,51 @@ type TokenStream struct {
     tokens chan Token
     next Token
     hasNext bool
+    /* the file the tokens come from */
+    file string
+    /* the last token consumed, where the node being parsed ends so far */
+    last Token
+}
+
+func (stream *TokenStream) Position(token Token) Position {
+    position := token.Position()
+    position.File = stream.file
+    return position
+}
+
+/* where the next token starts, or the end of the input if there are none */
+func (stream *TokenStream) Start() Position {
+    next, err := stream.Next()
+    if err != nil {
+        return stream.endPosition()
+    }
+    return stream.Position(next)
+}
+
+/* from start to the end of the last token consumed */
+func (stream *TokenStream) Span(start Position) Position {
+    return spanPositions(start, stream.Position(stream.last))
+}
+
+func (stream *TokenStream) endPosition() Position {
+    position := stream.Position(stream.last)
+    position.Line = position.EndLine
+    position.Column = position.EndColumn
+    if position.Line == 0 {
+        position.Line = 1
+        position.Column = 1
+        position.EndLine = 1
+        position.EndColumn = 1
+    }
+    return position
+}
+
+func (stream *TokenStream) outOfTokens() error {
+    return errorAt(stream.endPosition(), "unexpected end of input")
+}
+
+func (stream *TokenStream) Errorf(token Token, format string, args ...interface{}) error {
+    return errorAt(stream.Position(token), format, args...)
 }
 
 func (stream *TokenStream) Next() (Token, error) {
@@ -730,7 +941,7 @@ func (stream *TokenStream) Next() (Token, error) {
     for {
         token, ok := <-stream.tokens
         if !ok {
-            return Token{}, fmt.Errorf("out of tokens")
+            return Token{}, stream.outOfTokens()
         }
 
         if token.Kind == TokenWhitespace {
@@ -746,40 +957,59 @@ func (stream *TokenStream) Next() (Token, error) {
 func (stream *TokenStream) Consume() (Token, error) {
     if stream.hasNext {
         stream.hasNext = false
+        stream.last = stream.next
         return stream.next, nil
     }
 
     for {
         token, ok := <-stream.tokens
         if !ok {
-            return Token{}, fmt.Errorf("out of tokens")
+            return Token{}, stream.outOfTokens()
         }
 
         if token.Kind == TokenWhitespace {
             continue
         }
 
+        stream.last = token
         return token, nil
     }
 }
 
 func parse(reader io.Reader) (ASTNode, error) {
+    return parseSource(reader, "")
+}
+
+/* file is the name used in the positions of the nodes and in errors */
+func parseSource(reader io.Reader, file string) (ASTNode, error) {
     tokens := make(chan Token, 1000)
 
     var lexerError error
+    lexed := make(chan bool)
 
     go func(){
         lexerError = standardLexer(reader, tokens)
+        close(lexed)
     }()
 
     stream := &TokenStream{
         tokens: tokens,
         hasNext: false,
+        file: file,
     }
 
     class, err := parseClass(stream)
 
     if err != nil {
+        /* the parser runs out of tokens when the lexer fails, so the
+         * lexer error is the one to report
+         */
+        for range tokens {
+        }
+        <-lexed
+        if lexerError != nil {
+            return nil, errorInFile(lexerError, file)
+        }
         return nil, err
     }
 
@@ -794,12 +1024,13 @@ func parse(reader io.Reader) (ASTNode, error) {
         unparsed = true
     }
 
+    <-lexed
     if lexerError != nil {
-        return nil, lexerError
+        return nil, errorInFile(lexerError, file)
     }
 
     if unparsed {
-        return nil, fmt.Errorf("unparsed token %v", unparsedToken)
+        return nil, stream.Errorf(unparsedToken, "unparsed token %v", unparsedToken.String())
     }
 
     return class, err
@@ -808,11 +1039,11 @@ func parse(reader io.Reader) (ASTNode, error) {
 func consumeToken(tokens *TokenStream, kind TokenKind) error {
     token, err := tokens.Consume()
     if err != nil {
-        return fmt.Errorf("out of tokens")
+        return err
     }
 
     if token.Kind != kind {
-        return fmt.Errorf("expected token %v but found %v", kind.Name(), token.String())
+        return tokens.Errorf(token, "expected token '%v' but found %v", kind.Name(), token.String())
     }
 
     return nil
@@ -824,41 +1055,39 @@ func parseTypeNode(tokens *TokenStream) (*ASTType, error) {
         return nil, err
     }
 
+    position := tokens.Position(next)
+    makeType := func(name string) *ASTType {
+        return &ASTType{
+            Type: &ASTIdentifier{Name: name, Position: position},
+            Position: position,
+        }
+    }
+
     switch next.Kind {
         case TokenInt:
-            return &ASTType{
-                Type: &ASTIdentifier{Name: "int"},
-            }, nil
+            return makeType("int"), nil
         case TokenChar:
-            return &ASTType{
-                Type: &ASTIdentifier{Name: "char"},
-            }, nil
+            return makeType("char"), nil
         case TokenBoolean:
-            return &ASTType{
-                Type: &ASTIdentifier{Name: "boolean"},
-            }, nil
+            return makeType("boolean"), nil
         case TokenIdentifier:
-            return &ASTType{
-                Type: &ASTIdentifier{Name: next.Value},
-            }, nil
+            return makeType(next.Value), nil
         case TokenVoid:
-            return &ASTType{
-                Type: &ASTIdentifier{Name: "void"},
-            }, nil
+            return makeType("void"), nil
     }
 
-    return nil, fmt.Errorf("expected a type to be one of int, char, boolean, or identifier but was %v", next.String())
+    return nil, tokens.Errorf(next, "expected a type to be one of int, char, boolean, or identifier but was %v", next.String())
 }
 
 /* static <type> <identifier> ...; */
 func parseStaticDeclaration(tokens *TokenStream) (*ASTStatic, error) {
     static, err := tokens.Consume()
     if err != nil {
-        return nil, fmt.Errorf("could not parse static field: %v", err)
+        return nil, wrapError(err, "could not parse static field")
     }
 
     if static.Kind != TokenStatic {
-        return nil, fmt.Errorf("expected a 'static' keyword but found %v", static.String())
+        return nil, tokens.Errorf(static, "expected a 'static' keyword but found %v", static.String())
     }
 
     typeNode, err := parseTypeNode(tokens)
@@ -879,13 +1108,14 @@ func parseStaticDeclaration(tokens *TokenStream) (*ASTStatic, error) {
         }
 
         if next.Kind == TokenIdentifier {
-            names = append(names, &ASTIdentifier{Name: next.Value})
+            names = append(names, &ASTIdentifier{Name: next.Value, Position: tokens.Position(next)})
         }
     }
 
     return &ASTStatic{
         Type: typeNode,
         Names: names,
+        Position: tokens.Span(tokens.Position(static)),
     }, nil
 }
 
@@ -898,7 +1128,7 @@ func parseIdentifierList(tokens *TokenStream) ([]string, error) {
     }
 
     if name.Kind != TokenIdentifier {
-        return nil, fmt.Errorf("expected an identifier but got %v", name.String())
+        return nil, tokens.Errorf(name, "expected an identifier but got %v", name.String())
     }
 
     names = append(names, name.Value)
@@ -922,7 +1152,7 @@ func parseIdentifierList(tokens *TokenStream) ([]string, error) {
         }
 
         if name.Kind != TokenIdentifier {
-            return nil, fmt.Errorf("expected an identifier but got %v", name.String())
+            return nil, tokens.Errorf(name, "expected an identifier but got %v", name.String())
         }
 
         names = append(names, name.Value)
@@ -932,6 +1162,7 @@ func parseIdentifierList(tokens *TokenStream) ([]string, error) {
 }
 
 func parseFieldDeclaration(tokens *TokenStream) (*ASTField, error) {
+    start := tokens.Start()
     err := consumeToken(tokens, TokenField)
     if err != nil {
         return nil, err
@@ -955,10 +1186,12 @@ func parseFieldDeclaration(tokens *TokenStream) (*ASTField, error) {
     return &ASTField{
         Type: typeNode,
         Names: names,
+        Position: tokens.Span(start),
     }, nil
 }
 
 func parseVarDeclaration(tokens *TokenStream) (*ASTVar, error) {
+    start := tokens.Start()
     err := consumeToken(tokens, TokenVar)
     if err != nil {
         return nil, err
@@ -984,7 +1217,7 @@ func parseVarDeclaration(tokens *TokenStream) (*ASTVar, error) {
         tokens.Consume()
 
         if name.Kind != TokenIdentifier {
-            return nil, fmt.Errorf("expected an identifier in a var declaration: %v", name.String())
+            return nil, tokens.Errorf(name, "expected an identifier in a var declaration but got %v", name.String())
         }
 
         names = append(names, name.Value)
@@ -1006,12 +1239,13 @@ func parseVarDeclaration(tokens *TokenStream) (*ASTVar, error) {
     }
 
     if len(names) == 0 {
-        return nil, fmt.Errorf("no identifiers given in a var declaration")
+        return nil, errorAt(tokens.Span(start), "no identifiers given in a var declaration")
     }
 
     return &ASTVar{
         Type: typeNode,
         Names: names,
+        Position: tokens.Span(start),
     }, nil
 }
 
@@ -1023,7 +1257,7 @@ func parseCall(tokens *TokenStream) (*ASTCall, error) {
     }
 
     if name.Kind != TokenIdentifier {
-        return nil, fmt.Errorf("call must start with identifier but got %v", name.String())
+        return nil, tokens.Errorf(name, "call must start with identifier but got %v", name.String())
     }
 
     err = consumeToken(tokens, TokenLeftParens)
@@ -1069,6 +1303,7 @@ func parseCall(tokens *TokenStream) (*ASTCall, error) {
     return &ASTCall{
         Name: name.Value,
         Arguments: arguments,
+        Position: tokens.Span(tokens.Position(name)),
     }, nil
 }
 
@@ -1078,6 +1313,8 @@ func parseExpressionNoOp(tokens *TokenStream) (ASTExpression, error) {
         return nil, err
     }
 
+    start := tokens.Position(next)
+
     switch next.Kind {
         case TokenLeftParens:
             tokens.Consume()
@@ -1089,21 +1326,21 @@ func parseExpressionNoOp(tokens *TokenStream) (ASTExpression, error) {
             if err != nil {
                 return nil, err
             }
-            return expression, nil
+            return &ASTParenthesized{Expression: expression, Position: tokens.Span(start)}, nil
         case TokenTrue, TokenFalse:
             tokens.Consume()
             isTrue := next.Kind == TokenTrue
-            return &ASTBoolean{Value: isTrue}, nil
+            return &ASTBoolean{Value: isTrue, Position: start}, nil
         case TokenString:
             tokens.Consume()
-            return &ASTString{Value: next.Value}, nil
+            return &ASTString{Value: next.Value, Position: start}, nil
         case TokenNull:
             tokens.Consume()
-            return &ASTNull{}, nil
+            return &ASTNull{Position: start}, nil
         case TokenNumber:
             number := next
             tokens.Consume()
-            return &ASTConstant{Number: number.Value}, nil
+            return &ASTConstant{Number: number.Value, Position: start}, nil
         case TokenThis, TokenIdentifier:
             /* either a variable reference or a x.y() call,
              * or a method call f()
@@ -1115,11 +1352,11 @@ func parseExpressionNoOp(tokens *TokenStream) (ASTExpression, error) {
 
             switch id.Kind {
                 case TokenThis:
-                    left = &ASTThis{}
+                    left = &ASTThis{Position: start}
                 case TokenIdentifier:
-                    left = &ASTReference{Name: id.Value, Location: fmt.Sprintf("line %v", id.Line)}
+                    left = &ASTReference{Name: id.Value, Position: start}
                 default:
-                    return nil, fmt.Errorf("unknown token on the left side of a dot expression: %v", id.String())
+                    return nil, tokens.Errorf(id, "unknown token on the left side of a dot expression: %v", id.String())
             }
 
             /* Use an ASTThis node? */
@@ -1137,6 +1374,7 @@ func parseExpressionNoOp(tokens *TokenStream) (ASTExpression, error) {
                     return &ASTMethodCall{
                         Left: left,
                         Call: call,
+                        Position: tokens.Span(start),
                     }, nil
                 case TokenLeftParens:
                     var arguments []ASTExpression
@@ -1179,12 +1417,13 @@ func parseExpressionNoOp(tokens *TokenStream) (ASTExpression, error) {
                     return &ASTCall{
                         Name: id.Value,
                         Arguments: arguments,
+                        Position: tokens.Span(start),
                     }, nil
             }
 
             return left, nil
         default:
-            return nil, fmt.Errorf("unknown token in expression: %v", next.String())
+            return nil, tokens.Errorf(next, "unknown token in expression: %v", next.String())
     }
 }
 
@@ -1216,6 +1455,7 @@ func parseExpressionArrayIndex(tokens *TokenStream) (ASTExpression, error) {
         return &ASTIndexExpression{
             Left: left,
             Index: index,
+            Position: tokens.Span(left.SourcePosition()),
         }, nil
     } else {
         return left, nil
@@ -1236,16 +1476,19 @@ func parseExpressionUnary(tokens *TokenStream) (ASTExpression, error) {
                 return nil, err
             }
 
+            start := tokens.Position(next)
             if next.Kind == TokenNot {
                 return &ASTNot{
                     Expression: expression,
+                    Position: tokens.Span(start),
                 }, nil
             } else if next.Kind == TokenNegation {
                 return &ASTNegation{
                     Expression: expression,
+                    Position: tokens.Span(start),
                 }, nil
             } else {
-                return nil, fmt.Errorf("internal error")
+                return nil, tokens.Errorf(next, "internal error")
             }
         default:
             return parseExpressionArrayIndex(tokens)
@@ -1273,13 +1516,14 @@ func parseExpression(tokens *TokenStream) (ASTExpression, error) {
 
                 right, err := parseExpressionUnary(tokens)
                 if err != nil {
-                    return nil, fmt.Errorf("could not parse operator expression: %v", err)
+                    return nil, wrapError(err, "could not parse operator expression")
                 }
 
                 left = &ASTOperator{
                     Operator: operator.Kind,
                     Left: left,
                     Right: right,
+                    Position: spanPositions(left.SourcePosition(), right.SourcePosition()),
                 }
             default:
                 return left, nil
@@ -1290,6 +1534,7 @@ func parseExpression(tokens *TokenStream) (ASTExpression, error) {
 /* let <name> [<array-expression>] = <expression> ;
  */
 func parseLet(tokens *TokenStream) (*ASTLet, error) {
+    start := tokens.Start()
     err := consumeToken(tokens, TokenLet)
     if err != nil {
         return nil, err
@@ -1301,7 +1546,7 @@ func parseLet(tokens *TokenStream) (*ASTLet, error) {
     }
 
     if name.Kind != TokenIdentifier {
-        return nil, fmt.Errorf("expected a name to follow 'let': %v", name)
+        return nil, tokens.Errorf(name, "expected a name to follow 'let' but found %v", name.String())
     }
 
     next, err := tokens.Next()
@@ -1335,23 +1580,25 @@ func parseLet(tokens *TokenStream) (*ASTLet, error) {
 
     expression, err := parseExpression(tokens)
     if err != nil {
-        return nil, fmt.Errorf("could not parse expression on the right hand side of a let: %v", err)
+        return nil, wrapError(err, "could not parse expression on the right hand side of a let")
     }
 
     err = consumeToken(tokens, TokenSemicolon)
     if err != nil {
-        return nil, fmt.Errorf("missing a semicolon after a let: %v", err)
+        return nil, wrapError(err, "missing a semicolon after a let")
     }
 
     return &ASTLet{
         Name: name.Value,
         ArrayIndex: arrayIndex,
         Expression: expression,
+        Position: tokens.Span(start),
     }, nil
 }
 
 /* do <expression>; */
 func parseDo(tokens *TokenStream) (*ASTDo, error) {
+    start := tokens.Start()
     err := consumeToken(tokens, TokenDo)
     if err != nil {
         return nil, err
@@ -1369,6 +1616,7 @@ func parseDo(tokens *TokenStream) (*ASTDo, error) {
 
     return &ASTDo{
         Expression: expression,
+        Position: tokens.Span(start),
     }, nil
 }
 
@@ -1380,7 +1628,7 @@ func parseReturn(tokens *TokenStream) (*ASTReturn, error) {
     }
 
     if ret.Kind != TokenReturn {
-        return nil, fmt.Errorf("expected 'return' but found %v", ret.String())
+        return nil, tokens.Errorf(ret, "expected 'return' but found %v", ret.String())
     }
 
     next, err := tokens.Next()
@@ -1394,9 +1642,6 @@ func parseReturn(tokens *TokenStream) (*ASTReturn, error) {
         if err != nil {
             return nil, err
         }
-    } else {
-        /* always return some value */
-        expression = &ASTConstant{Number: "0"}
     }
 
     err = consumeToken(tokens, TokenSemicolon)
@@ -1406,10 +1651,12 @@ func parseReturn(tokens *TokenStream) (*ASTReturn, error) {
 
     return &ASTReturn{
         Expression: expression,
+        Position: tokens.Span(tokens.Position(ret)),
     }, nil
 }
 
 func parseIf(tokens *TokenStream) (*ASTIf, error) {
+    start := tokens.Start()
     err := consumeToken(tokens, TokenIf)
     if err != nil {
         return nil, err
@@ -1454,10 +1701,12 @@ func parseIf(tokens *TokenStream) (*ASTIf, error) {
         Condition: condition,
         Then: thenBlock,
         Else: elseBlock,
+        Position: tokens.Span(start),
     }, nil
 }
 
 func parseWhile(tokens *TokenStream) (*ASTWhile, error) {
+    start := tokens.Start()
     err := consumeToken(tokens, TokenWhile)
     if err != nil {
         return nil, err
@@ -1486,12 +1735,14 @@ func parseWhile(tokens *TokenStream) (*ASTWhile, error) {
     return &ASTWhile{
         Condition: condition,
         Body: body,
+        Position: tokens.Span(start),
     }, nil
 }
 
 func parseBlock(tokens *TokenStream) (*ASTBlock, error) {
     var statements []ASTNode
 
+    start := tokens.Start()
     err := consumeToken(tokens, TokenLeftCurly)
     if err != nil {
         return nil, err
@@ -1541,6 +1792,7 @@ func parseBlock(tokens *TokenStream) (*ASTBlock, error) {
                 }
                 return &ASTBlock{
                     Statements: statements,
+                    Position: tokens.Span(start),
                 }, nil
             case TokenReturn:
                 ret, err := parseReturn(tokens)
@@ -1549,7 +1801,7 @@ func parseBlock(tokens *TokenStream) (*ASTBlock, error) {
                 }
                 statements = append(statements, ret)
             default:
-                return nil, fmt.Errorf("unexpected token %v in a block", next.String())
+                return nil, tokens.Errorf(next, "unexpected token %v in a block", next.String())
         }
     }
 }
@@ -1597,10 +1849,10 @@ func parseParameterList(tokens *TokenStream) ([]*ASTParameter, error) {
         }
 
         if name.Kind != TokenIdentifier {
-            return nil, fmt.Errorf("expected an identifier but got %v", name.String())
+            return nil, tokens.Errorf(name, "expected an identifier but got %v", name.String())
         }
 
-        parameters = append(parameters, &ASTParameter{Type: type_, Name: name.Value})
+        parameters = append(parameters, &ASTParameter{Type: type_, Name: name.Value, Position: tokens.Span(type_.Position)})
     }
 
     err = consumeToken(tokens, TokenRightParens)
@@ -1612,6 +1864,7 @@ func parseParameterList(tokens *TokenStream) ([]*ASTParameter, error) {
 }
 
 func parseMethod(tokens *TokenStream) (*ASTMethod, error) {
+    start := tokens.Start()
     err := consumeToken(tokens, TokenMethod)
     if err != nil {
         return nil, err
@@ -1628,7 +1881,7 @@ func parseMethod(tokens *TokenStream) (*ASTMethod, error) {
     }
 
     if name.Kind != TokenIdentifier {
-        return nil, fmt.Errorf("expected an identifier for the method name but got %v", name.String())
+        return nil, tokens.Errorf(name, "expected an identifier for the method name but got %v", name.String())
     }
 
     parameters, err := parseParameterList(tokens)
@@ -1646,6 +1899,7 @@ func parseMethod(tokens *TokenStream) (*ASTMethod, error) {
         Name: name.Value,
         Parameters: parameters,
         Body: body,
+        Position: tokens.Span(start),
     }, nil
 }
 
@@ -1656,7 +1910,7 @@ func parseFunction(tokens *TokenStream) (*ASTFunction, error) {
     }
 
     if function.Kind != TokenFunction {
-        return nil, fmt.Errorf("expected 'function' but got %v", function.String())
+        return nil, tokens.Errorf(function, "expected 'function' but got %v", function.String())
     }
 
     typeNode, err := parseTypeNode(tokens)
@@ -1670,7 +1924,7 @@ func parseFunction(tokens *TokenStream) (*ASTFunction, error) {
     }
 
     if name.Kind != TokenIdentifier {
-        return nil, fmt.Errorf("expected an identifier for the function name but got %v", name.String())
+        return nil, tokens.Errorf(name, "expected an identifier for the function name but got %v", name.String())
     }
 
     parameters, err := parseParameterList(tokens)
@@ -1688,10 +1942,12 @@ func parseFunction(tokens *TokenStream) (*ASTFunction, error) {
         Name: name.Value,
         Parameters: parameters,
         Body: body,
+        Position: tokens.Span(tokens.Position(function)),
     }, nil
 }
 
 func parseConstructor(tokens *TokenStream) (*ASTConstructor, error) {
+    start := tokens.Start()
     err := consumeToken(tokens, TokenConstructor)
     if err != nil {
         return nil, err
@@ -1704,7 +1960,7 @@ func parseConstructor(tokens *TokenStream) (*ASTConstructor, error) {
     }
 
     if class.Kind != TokenIdentifier {
-        return nil, fmt.Errorf("expected an identifier but found %v", class)
+        return nil, tokens.Errorf(class, "expected an identifier but found %v", class.String())
     }
 
     /* I think name always has to be 'new', so we could check it here */
@@ -1714,7 +1970,7 @@ func parseConstructor(tokens *TokenStream) (*ASTConstructor, error) {
     }
 
     if name.Kind != TokenIdentifier {
-        return nil, fmt.Errorf("expected an identifier but found %v", name)
+        return nil, tokens.Errorf(name, "expected an identifier but found %v", name.String())
     }
 
     parameters, err := parseParameterList(tokens)
@@ -1732,6 +1988,7 @@ func parseConstructor(tokens *TokenStream) (*ASTConstructor, error) {
         Name: name.Value,
         Parameters: parameters,
         Body: body,
+        Position: tokens.Span(start),
     }, nil
 }
 
@@ -1741,7 +1998,7 @@ func parseClassBody(tokens *TokenStream) ([]ASTNode, error) {
     for {
         first, err := tokens.Next()
         if err != nil {
-            return nil, fmt.Errorf("out of tokens")
+            return nil, err
         }
 
         switch first.Kind {
@@ -1784,40 +2041,41 @@ func parseClassBody(tokens *TokenStream) ([]ASTNode, error) {
 func parseClass(tokens *TokenStream) (*ASTClass, error) {
     class, err := tokens.Consume()
     if err != nil {
-        return nil, fmt.Errorf("expected a 'class' keyword: %v", err)
+        return nil, wrapError(err, "expected a 'class' keyword")
     }
 
     if class.Kind != TokenClass {
-        return nil, fmt.Errorf("expected a 'class' keyword but got %v", class.String())
+        return nil, tokens.Errorf(class, "expected a 'class' keyword but got %v", class.String())
     }
 
     name, err := tokens.Consume()
 
     if err != nil {
-        return nil, fmt.Errorf("expected an identifier to follow the 'class' keyword: %v", err)
+        return nil, wrapError(err, "expected an identifier to follow the 'class' keyword")
     }
 
     if name.Kind != TokenIdentifier {
-        return nil, fmt.Errorf("expected an identifier to follow the 'class' keyword: %v", name.String())
+        return nil, tokens.Errorf(name, "expected an identifier to follow the 'class' keyword but got %v", name.String())
     }
 
     err = consumeToken(tokens, TokenLeftCurly)
     if err != nil {
-        return nil, fmt.Errorf("expected a '{' after the class name: %v", err)
+        return nil, wrapError(err, "expected a '{' after the class name")
     }
 
     classElements, err := parseClassBody(tokens)
     if err != nil {
-        return nil, fmt.Errorf("unable to parse class body: %v", err)
+        return nil, wrapError(err, "unable to parse class body")
     }
 
     err = consumeToken(tokens, TokenRightCurly)
     if err != nil {
-        return nil, fmt.Errorf("expected a '}' to close the class body: %v", err)
+        return nil, wrapError(err, "expected a '}' to close the class body")
     }
 
     return &ASTClass{
         Name: name.Value,
         Body: classElements,
+        Position: tokens.Span(tokens.Position(class)),
     }, nil
 }
@@ -192,3 +192,71 @@ class Main {
     _ = ast
     /* TODO: verify the ast */
 }
+
+func TestPositions(test *testing.T){
+    text := `class Foo {
+    function void main() {
+        let x = a + b;
+        return;
+    }
+}`
+
+    ast, err := parseSource(strings.NewReader(text), "Foo.jack")
+    if err != nil {
+        test.Fatalf("could not parse: %v", err)
+    }
+
+    class := ast.(*ASTClass)
+    function := class.Body[0].(*ASTFunction)
+    let := function.Body.Statements[0].(*ASTLet)
+    operator := let.Expression.(*ASTOperator)
+    right := operator.Right.(*ASTReference)
+
+    check := func(position Position, line uint64, column uint64, endLine uint64, endColumn uint64){
+        if position.File != "Foo.jack" || position.Line != line || position.Column != column || position.EndLine != endLine || position.EndColumn != endColumn {
+            test.Errorf("wrong position %+v, expected %v:%v to %v:%v", position, line, column, endLine, endColumn)
+        }
+    }
+
+    check(class.Position, 1, 1, 6, 2)
+    check(function.Position, 2, 5, 5, 6)
+    check(let.Position, 3, 9, 3, 23)
+    check(operator.Position, 3, 17, 3, 22)
+    check(right.Position, 3, 21, 3, 22)
+}
+
+func TestParseErrorPosition(test *testing.T){
+    text := `class Foo {
+    function void main() {
+        let x = ;
+    }
+}`
+
+    _, err := parseSource(strings.NewReader(text), "Foo.jack")
+    if err == nil {
+        test.Fatalf("expected a parse error")
+    }
+
+    if !strings.HasPrefix(err.Error(), "Foo.jack:3:17: ") {
+        test.Fatalf("wrong position for the error: %v", err)
+    }
+}
+
+/* an unterminated string is reported where it starts, not where the let does */
+func TestUnterminatedStringPosition(test *testing.T){
+    text := `class Foo {
+    function void main() {
+        let s = "abc;
+        return;
+    }
+}`
+
+    _, err := parseSource(strings.NewReader(text), "Foo.jack")
+    if err == nil {
+        test.Fatalf("expected an error")
+    }
+
+    if err.Error() != "Foo.jack:3:17: unterminated string constant" {
+        test.Fatalf("wrong error: %v", err)
+    }
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "fmt"
+)
+
+/* A range of a source file. Lines and columns start at 1, and the end is the
+ * line and column just past the last character.
+ */
+type Position struct {
+    File string
+    Line uint64
+    Column uint64
+    EndLine uint64
+    EndColumn uint64
+}
+
+/* file:line:col, or just line:col when the file is not known */
+func (position Position) String() string {
+    if position.File == "" {
+        return fmt.Sprintf("%v:%v", position.Line, position.Column)
+    }
+    return fmt.Sprintf("%v:%v:%v", position.File, position.Line, position.Column)
+}
+
+/* from the start of one position to the end of another */
+func spanPositions(start Position, end Position) Position {
+    return Position{
+        File: start.File,
+        Line: start.Line,
+        Column: start.Column,
+        EndLine: end.EndLine,
+        EndColumn: end.EndColumn,
+    }
+}
+
+/* An error at a place in the source, which prints as file:line:col: message */
+type SourceError struct {
+    Position Position
+    Message string
+}
+
+func (err *SourceError) Error() string {
+    return fmt.Sprintf("%v: %v", err.Position, err.Message)
+}
+
+func errorAt(position Position, format string, args ...interface{}) error {
+    return &SourceError{
+        Position: position,
+        Message: fmt.Sprintf(format, args...),
+    }
+}
+
+/* puts a message in front of an error but keeps the position it has */
+func wrapError(err error, format string, args ...interface{}) error {
+    message := fmt.Sprintf(format, args...)
+    source, ok := err.(*SourceError)
+    if ok {
+        return &SourceError{
+            Position: source.Position,
+            Message: fmt.Sprintf("%v: %v", message, source.Message),
+        }
+    }
+
+    return fmt.Errorf("%v: %v", message, err)
+}
+
+/* gives an error a position if it does not have one already */
+func positionError(position Position, err error) error {
+    if _, ok := err.(*SourceError); ok {
+        return err
+    }
+
+    return &SourceError{
+        Position: position,
+        Message: err.Error(),
+    }
+}
+
+/* fills in the file of an error whose position has none */
+func errorInFile(err error, file string) error {
+    source, ok := err.(*SourceError)
+    if !ok {
+        return err
+    }
+
+    if source.Position.File == "" {
+        source.Position.File = file
+    }
+    return source
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+    "io"
+    "fmt"
+    "bytes"
+    "strings"
+)
+
+/* Writes tokens and parse trees in the xml format of the nand2tetris project
+ * 10 tools, so they can be checked against the XxxT.xml and Xxx.xml files of
+ * the course with the TextComparer.
+ */
+
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;")
+
+/* the text of a symbol, Name() spells out + for the s-expressions */
+func symbolText(kind TokenKind) string {
+    if kind == TokenPlus {
+        return "+"
+    }
+    return kind.Name()
+}
+
+/* the element name and text the course uses for a token */
+func tokenElement(token *Token) (string, string) {
+    switch token.Kind {
+        case TokenIdentifier: return "identifier", token.Value
+        case TokenNumber: return "integerConstant", token.Value
+        case TokenString: return "stringConstant", token.Value
+    }
+
+    if token.Kind.IsKeyword() {
+        return "keyword", token.Kind.Name()
+    }
+
+    return "symbol", symbolText(token.Kind)
+}
+
+/* <tokens> with one element per token, leaving out whitespace and comments */
+func writeTokensXML(reader io.Reader, output io.Writer) error {
+    tokens, err := standardLexerTokenSequence(reader)
+    if err != nil {
+        return err
+    }
+
+    var out bytes.Buffer
+    out.WriteString("<tokens>\n")
+    for _, token := range removeWhitespaceTokens(tokens) {
+        element, text := tokenElement(&token)
+        fmt.Fprintf(&out, "<%v> %v </%v>\n", element, xmlEscaper.Replace(text), element)
+    }
+    out.WriteString("</tokens>\n")
+
+    _, err = output.Write(out.Bytes())
+    return err
+}
+
+/* An ASTVisitor that writes the parse tree. Expression nodes write the inside
+ * of their <term>, the callers put the <term> and <expression> elements
+ * around them.
+ */
+type XMLWriter struct {
+    out bytes.Buffer
+    indent int
+}
+
+func (writer *XMLWriter) line(text string) {
+    for i := 0; i < writer.indent; i++ {
+        writer.out.WriteString("  ")
+    }
+    writer.out.WriteString(text)
+    writer.out.WriteByte('\n')
+}
+
+func (writer *XMLWriter) open(element string) {
+    writer.line(fmt.Sprintf("<%v>", element))
+    writer.indent += 1
+}
+
+func (writer *XMLWriter) close(element string) {
+    writer.indent -= 1
+    writer.line(fmt.Sprintf("</%v>", element))
+}
+
+func (writer *XMLWriter) terminal(element string, text string) {
+    writer.line(fmt.Sprintf("<%v> %v </%v>", element, xmlEscaper.Replace(text), element))
+}
+
+func (writer *XMLWriter) keyword(word string) {
+    writer.terminal("keyword", word)
+}
+
+func (writer *XMLWriter) symbol(symbol string) {
+    writer.terminal("symbol", symbol)
+}
+
+func (writer *XMLWriter) identifier(name string) {
+    writer.terminal("identifier", name)
+}
+
+/* int, char, boolean and void are keywords, class names are identifiers */
+func (writer *XMLWriter) typeName(name string) {
+    switch name {
+        case "int", "char", "boolean", "void":
+            writer.keyword(name)
+        default:
+            writer.identifier(name)
+    }
+}
+
+func (writer *XMLWriter) names(names []string) {
+    for i, name := range names {
+        if i > 0 {
+            writer.symbol(",")
+        }
+        writer.identifier(name)
+    }
+}
+
+/* the operands and operators of an expression. The parser nests operators to
+ * the left and the right side is always a single term, so the expression
+ * comes out flat the way the course writes it
+ */
+func (writer *XMLWriter) operands(ast ASTExpression) error {
+    operator, ok := ast.(*ASTOperator)
+    if !ok {
+        return writer.term(ast)
+    }
+
+    err := writer.operands(operator.Left)
+    if err != nil {
+        return err
+    }
+    writer.symbol(symbolText(operator.Operator))
+    return writer.term(operator.Right)
+}
+
+func (writer *XMLWriter) expression(ast ASTExpression) error {
+    writer.open("expression")
+    err := writer.operands(ast)
+    writer.close("expression")
+    return err
+}
+
+func (writer *XMLWriter) term(ast ASTExpression) error {
+    writer.open("term")
+    _, err := ast.Visit(writer)
+    writer.close("term")
+    return err
+}
+
+func (writer *XMLWriter) expressionList(expressions []ASTExpression) error {
+    writer.open("expressionList")
+    for i, expression := range expressions {
+        if i > 0 {
+            writer.symbol(",")
+        }
+        err := writer.expression(expression)
+        if err != nil {
+            return err
+        }
+    }
+    writer.close("expressionList")
+    return nil
+}
+
+func (writer *XMLWriter) statements(statements []ASTNode) error {
+    writer.open("statements")
+    for _, statement := range statements {
+        _, err := statement.Visit(writer)
+        if err != nil {
+            return err
+        }
+    }
+    writer.close("statements")
+    return nil
+}
+
+/* { statements } of an if or while */
+func (writer *XMLWriter) block(block *ASTBlock) error {
+    writer.symbol("{")
+    err := writer.statements(block.Statements)
+    writer.symbol("}")
+    return err
+}
+
+func (writer *XMLWriter) subroutine(kind string, returnType string, name string, parameters []*ASTParameter, body *ASTBlock) error {
+    writer.open("subroutineDec")
+    writer.keyword(kind)
+    writer.typeName(returnType)
+    writer.identifier(name)
+
+    writer.symbol("(")
+    writer.open("parameterList")
+    for i, parameter := range parameters {
+        if i > 0 {
+            writer.symbol(",")
+        }
+        writer.typeName(parameter.Type.ToSExpression())
+        writer.identifier(parameter.Name)
+    }
+    writer.close("parameterList")
+    writer.symbol(")")
+
+    /* the var declarations at the start of the body come before the
+     * statements
+     */
+    writer.open("subroutineBody")
+    writer.symbol("{")
+    statements := body.Statements
+    for len(statements) > 0 {
+        declaration, ok := statements[0].(*ASTVar)
+        if !ok {
+            break
+        }
+        writer.VisitVar(declaration)
+        statements = statements[1:]
+    }
+    err := writer.statements(statements)
+    if err != nil {
+        return err
+    }
+    writer.symbol("}")
+    writer.close("subroutineBody")
+
+    writer.close("subroutineDec")
+    return nil
+}
+
+func (writer *XMLWriter) VisitClass(ast *ASTClass) (interface{}, error) {
+    writer.open("class")
+    writer.keyword("class")
+    writer.identifier(ast.Name)
+    writer.symbol("{")
+    for _, body := range ast.Body {
+        _, err := body.Visit(writer)
+        if err != nil {
+            return nil, err
+        }
+    }
+    writer.symbol("}")
+    writer.close("class")
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitStatic(ast *ASTStatic) (interface{}, error) {
+    var names []string
+    for _, name := range ast.Names {
+        names = append(names, name.Name)
+    }
+
+    writer.open("classVarDec")
+    writer.keyword("static")
+    writer.typeName(ast.Type.ToSExpression())
+    writer.names(names)
+    writer.symbol(";")
+    writer.close("classVarDec")
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitField(ast *ASTField) (interface{}, error) {
+    writer.open("classVarDec")
+    writer.keyword("field")
+    writer.typeName(ast.Type.ToSExpression())
+    writer.names(ast.Names)
+    writer.symbol(";")
+    writer.close("classVarDec")
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitConstructor(ast *ASTConstructor) (interface{}, error) {
+    return nil, writer.subroutine("constructor", ast.Class, ast.Name, ast.Parameters, ast.Body)
+}
+
+func (writer *XMLWriter) VisitFunction(ast *ASTFunction) (interface{}, error) {
+    return nil, writer.subroutine("function", ast.ReturnType.ToSExpression(), ast.Name, ast.Parameters, ast.Body)
+}
+
+func (writer *XMLWriter) VisitMethod(ast *ASTMethod) (interface{}, error) {
+    return nil, writer.subroutine("method", ast.ReturnType.ToSExpression(), ast.Name, ast.Parameters, ast.Body)
+}
+
+func (writer *XMLWriter) VisitVar(ast *ASTVar) (interface{}, error) {
+    writer.open("varDec")
+    writer.keyword("var")
+    writer.typeName(ast.Type.ToSExpression())
+    writer.names(ast.Names)
+    writer.symbol(";")
+    writer.close("varDec")
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitBlock(ast *ASTBlock) (interface{}, error) {
+    return nil, writer.block(ast)
+}
+
+func (writer *XMLWriter) VisitLet(ast *ASTLet) (interface{}, error) {
+    writer.open("letStatement")
+    writer.keyword("let")
+    writer.identifier(ast.Name)
+    if ast.ArrayIndex != nil {
+        writer.symbol("[")
+        err := writer.expression(ast.ArrayIndex)
+        if err != nil {
+            return nil, err
+        }
+        writer.symbol("]")
+    }
+    writer.symbol("=")
+    err := writer.expression(ast.Expression)
+    if err != nil {
+        return nil, err
+    }
+    writer.symbol(";")
+    writer.close("letStatement")
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitIf(ast *ASTIf) (interface{}, error) {
+    writer.open("ifStatement")
+    writer.keyword("if")
+    writer.symbol("(")
+    err := writer.expression(ast.Condition)
+    if err != nil {
+        return nil, err
+    }
+    writer.symbol(")")
+    err = writer.block(ast.Then)
+    if err != nil {
+        return nil, err
+    }
+    if ast.Else != nil {
+        writer.keyword("else")
+        err = writer.block(ast.Else)
+        if err != nil {
+            return nil, err
+        }
+    }
+    writer.close("ifStatement")
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitWhile(ast *ASTWhile) (interface{}, error) {
+    writer.open("whileStatement")
+    writer.keyword("while")
+    writer.symbol("(")
+    err := writer.expression(ast.Condition)
+    if err != nil {
+        return nil, err
+    }
+    writer.symbol(")")
+    err = writer.block(ast.Body)
+    if err != nil {
+        return nil, err
+    }
+    writer.close("whileStatement")
+    return nil, nil
+}
+
+/* the subroutine call of a do statement is written without a term around it */
+func (writer *XMLWriter) VisitDo(ast *ASTDo) (interface{}, error) {
+    writer.open("doStatement")
+    writer.keyword("do")
+    var err error
+    switch ast.Expression.(type) {
+        case *ASTCall, *ASTMethodCall:
+            _, err = ast.Expression.Visit(writer)
+        default:
+            err = writer.expression(ast.Expression)
+    }
+    if err != nil {
+        return nil, err
+    }
+    writer.symbol(";")
+    writer.close("doStatement")
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitReturn(ast *ASTReturn) (interface{}, error) {
+    writer.open("returnStatement")
+    writer.keyword("return")
+    if ast.Expression != nil {
+        err := writer.expression(ast.Expression)
+        if err != nil {
+            return nil, err
+        }
+    }
+    writer.symbol(";")
+    writer.close("returnStatement")
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitIdentifier(ast *ASTIdentifier) (interface{}, error) {
+    writer.identifier(ast.Name)
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitReference(ast *ASTReference) (interface{}, error) {
+    writer.identifier(ast.Name)
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitConstant(ast *ASTConstant) (interface{}, error) {
+    writer.terminal("integerConstant", ast.Number)
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitString(ast *ASTString) (interface{}, error) {
+    writer.terminal("stringConstant", ast.Value)
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitBoolean(ast *ASTBoolean) (interface{}, error) {
+    writer.keyword(fmt.Sprintf("%v", ast.Value))
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitNull(ast *ASTNull) (interface{}, error) {
+    writer.keyword("null")
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitThis(ast *ASTThis) (interface{}, error) {
+    writer.keyword("this")
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitIndexExpression(ast *ASTIndexExpression) (interface{}, error) {
+    _, err := ast.Left.Visit(writer)
+    if err != nil {
+        return nil, err
+    }
+    writer.symbol("[")
+    err = writer.expression(ast.Index)
+    if err != nil {
+        return nil, err
+    }
+    writer.symbol("]")
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitCall(ast *ASTCall) (interface{}, error) {
+    writer.identifier(ast.Name)
+    writer.symbol("(")
+    err := writer.expressionList(ast.Arguments)
+    if err != nil {
+        return nil, err
+    }
+    writer.symbol(")")
+    return nil, nil
+}
+
+func (writer *XMLWriter) VisitMethodCall(ast *ASTMethodCall) (interface{}, error) {
+    _, err := ast.Left.Visit(writer)
+    if err != nil {
+        return nil, err
+    }
+    writer.symbol(".")
+    return writer.VisitCall(ast.Call)
+}
+
+func (writer *XMLWriter) VisitNot(ast *ASTNot) (interface{}, error) {
+    writer.symbol("~")
+    return nil, writer.term(ast.Expression)
+}
+
+func (writer *XMLWriter) VisitNegation(ast *ASTNegation) (interface{}, error) {
+    writer.symbol("-")
+    return nil, writer.term(ast.Expression)
+}
+
+func (writer *XMLWriter) VisitParenthesized(ast *ASTParenthesized) (interface{}, error) {
+    writer.symbol("(")
+    err := writer.expression(ast.Expression)
+    if err != nil {
+        return nil, err
+    }
+    writer.symbol(")")
+    return nil, nil
+}
+
+/* operators are written by the expression they are part of */
+func (writer *XMLWriter) VisitOperator(ast *ASTOperator) (interface{}, error) {
+    return nil, errorAt(ast.Position, "xml writer: operator %v outside of an expression", ast.Operator.Name())
+}
+
+func writeParseTreeXML(ast ASTNode, output io.Writer) error {
+    var writer XMLWriter
+    _, err := ast.Visit(&writer)
+    if err != nil {
+        return err
+    }
+
+    _, err = output.Write(writer.out.Bytes())
+    return err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+    "testing"
+    "strings"
+)
+
+func TestTokensXML(test *testing.T){
+    text := `if (x < 3) { let s = "a b"; } // comment`
+
+    var out strings.Builder
+    err := writeTokensXML(strings.NewReader(text), &out)
+    if err != nil {
+        test.Fatalf("could not write tokens of %v: %v", text, err)
+    }
+
+    expected := `<tokens>
+<keyword> if </keyword>
+<symbol> ( </symbol>
+<identifier> x </identifier>
+<symbol> &lt; </symbol>
+<integerConstant> 3 </integerConstant>
+<symbol> ) </symbol>
+<symbol> { </symbol>
+<keyword> let </keyword>
+<identifier> s </identifier>
+<symbol> = </symbol>
+<stringConstant> a b </stringConstant>
+<symbol> ; </symbol>
+<symbol> } </symbol>
+</tokens>
+`
+
+    if out.String() != expected {
+        test.Fatalf("wrong token xml:\n%v", out.String())
+    }
+}
+
+func TestParseTreeXML(test *testing.T){
+    text := `class Foo {
+    function void main(int a) {
+        var int b;
+        let b = a + (-a) < 1;
+        do Output.printInt(b);
+        return;
+    }
+}`
+
+    class, err := parse(strings.NewReader(text))
+    if err != nil {
+        test.Fatalf("could not parse %v: %v", text, err)
+    }
+
+    var out strings.Builder
+    err = writeParseTreeXML(class, &out)
+    if err != nil {
+        test.Fatalf("could not write parse tree: %v", err)
+    }
+
+    expected := `<class>
+  <keyword> class </keyword>
+  <identifier> Foo </identifier>
+  <symbol> { </symbol>
+  <subroutineDec>
+    <keyword> function </keyword>
+    <keyword> void </keyword>
+    <identifier> main </identifier>
+    <symbol> ( </symbol>
+    <parameterList>
+      <keyword> int </keyword>
+      <identifier> a </identifier>
+    </parameterList>
+    <symbol> ) </symbol>
+    <subroutineBody>
+      <symbol> { </symbol>
+      <varDec>
+        <keyword> var </keyword>
+        <keyword> int </keyword>
+        <identifier> b </identifier>
+        <symbol> ; </symbol>
+      </varDec>
+      <statements>
+        <letStatement>
+          <keyword> let </keyword>
+          <identifier> b </identifier>
+          <symbol> = </symbol>
+          <expression>
+            <term>
+              <identifier> a </identifier>
+            </term>
+            <symbol> + </symbol>
+            <term>
+              <symbol> ( </symbol>
+              <expression>
+                <term>
+                  <symbol> - </symbol>
+                  <term>
+                    <identifier> a </identifier>
+                  </term>
+                </term>
+              </expression>
+              <symbol> ) </symbol>
+            </term>
+            <symbol> &lt; </symbol>
+            <term>
+              <integerConstant> 1 </integerConstant>
+            </term>
+          </expression>
+          <symbol> ; </symbol>
+        </letStatement>
+        <doStatement>
+          <keyword> do </keyword>
+          <identifier> Output </identifier>
+          <symbol> . </symbol>
+          <identifier> printInt </identifier>
+          <symbol> ( </symbol>
+          <expressionList>
+            <expression>
+              <term>
+                <identifier> b </identifier>
+              </term>
+            </expression>
+          </expressionList>
+          <symbol> ) </symbol>
+          <symbol> ; </symbol>
+        </doStatement>
+        <returnStatement>
+          <keyword> return </keyword>
+          <symbol> ; </symbol>
+        </returnStatement>
+      </statements>
+      <symbol> } </symbol>
+    </subroutineBody>
+  </subroutineDec>
+  <symbol> } </symbol>
+</class>
+`
+
+    if out.String() != expected {
+        test.Fatalf("wrong parse tree xml:\n%v", out.String())
+    }
+}